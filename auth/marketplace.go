@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// app id of the Microsoft Marketplace SaaS fulfillment service, which signs in
+// to call our webhook
+const MarketplaceAppId = "20e940b3-4c77-4b0b-9a53-9e16a1b010a7"
+
+// how long signing keys are cached, and how often an unknown key id may
+// trigger a refresh (so forged tokens can't make us hammer the keys endpoint)
+const signingKeysMaxAge = 24 * time.Hour
+const signingKeysMinRefreshInterval = 5 * time.Minute
+
+var ErrInvalidMarketplaceToken = errors.New("invalid marketplace token")
+
+type MarketplaceClaims struct {
+	jwt.RegisteredClaims
+	TenantId string `json:"tid"`
+	AppId    string `json:"appid"` // v1 tokens
+	Azp      string `json:"azp"`   // v2 tokens
+}
+
+// Validates the Azure AD bearer tokens Microsoft sends on SaaS webhook calls:
+// signed by a current Azure AD signing key, issued by our publisher tenant for
+// our app id, to the Marketplace fulfillment service.
+type MarketplaceTokenValidator struct {
+	TenantId        string // tenant the publisher app is registered in
+	Audience        string // publisher app id
+	OpenIDConfigUrl string // where to discover the signing keys
+	HTTPClient      *http.Client
+	Now             func() time.Time
+	mu              sync.Mutex
+	keys            map[string]*rsa.PublicKey
+	keysFetchedAt   time.Time
+	keysLastAttempt time.Time
+}
+
+func NewMarketplaceTokenValidator(tenantId string, audience string) *MarketplaceTokenValidator {
+	return &MarketplaceTokenValidator{
+		TenantId:        tenantId,
+		Audience:        audience,
+		OpenIDConfigUrl: fmt.Sprintf("https://login.microsoftonline.com/%s/v2.0/.well-known/openid-configuration", tenantId),
+		HTTPClient:      &http.Client{Timeout: 10 * time.Second},
+		Now:             time.Now,
+	}
+}
+
+// validate the value of an Authorization header
+func (v *MarketplaceTokenValidator) ValidateAuthorizationHeader(ctx context.Context, header string) (*MarketplaceClaims, error) {
+	scheme, tokenString, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || tokenString == "" {
+		return nil, fmt.Errorf("%w: missing bearer token", ErrInvalidMarketplaceToken)
+	}
+	return v.Validate(ctx, tokenString)
+}
+
+func (v *MarketplaceTokenValidator) Validate(ctx context.Context, tokenString string) (*MarketplaceClaims, error) {
+	claims := &MarketplaceClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"RS256"}), jwt.WithoutClaimsValidation())
+	_, err := parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("missing kid")
+		}
+		return v.signingKey(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMarketplaceToken, err)
+	}
+
+	err = v.validateClaims(claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMarketplaceToken, err)
+	}
+
+	return claims, nil
+}
+
+func (v *MarketplaceTokenValidator) validateClaims(claims *MarketplaceClaims) error {
+	now := v.Now()
+
+	// lifetime (exp is required; allow a little clock skew)
+	skew := 5 * time.Minute
+	if claims.ExpiresAt == nil || now.Add(-skew).After(claims.ExpiresAt.Time) {
+		return errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(skew).Before(claims.NotBefore.Time) {
+		return errors.New("token not valid yet")
+	}
+
+	// tenant and issuer (v1 and v2 endpoints use different issuers)
+	if claims.TenantId != v.TenantId {
+		return fmt.Errorf("unexpected tenant: %s", claims.TenantId)
+	}
+	issuers := []string{
+		fmt.Sprintf("https://sts.windows.net/%s/", v.TenantId),
+		fmt.Sprintf("https://login.microsoftonline.com/%s/v2.0", v.TenantId),
+	}
+	validIssuer := false
+	for _, issuer := range issuers {
+		if claims.Issuer == issuer {
+			validIssuer = true
+			break
+		}
+	}
+	if !validIssuer {
+		return fmt.Errorf("unexpected issuer: %s", claims.Issuer)
+	}
+
+	// audience is our app id (v1 tokens may use the api:// form)
+	if !claims.VerifyAudience(v.Audience, true) && !claims.VerifyAudience("api://"+v.Audience, true) {
+		return fmt.Errorf("unexpected audience: %v", claims.Audience)
+	}
+
+	// caller is the Marketplace fulfillment service
+	if claims.AppId != MarketplaceAppId && claims.Azp != MarketplaceAppId {
+		return errors.New("token not issued to the marketplace")
+	}
+
+	return nil
+}
+
+// get a signing key by id, refreshing the cached keys if needed
+func (v *MarketplaceTokenValidator) signingKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := v.Now()
+	key, ok := v.keys[kid]
+	stale := now.Sub(v.keysFetchedAt) > signingKeysMaxAge
+	if ok && !stale {
+		return key, nil
+	}
+
+	// refresh on expiry, or on an unknown kid (keys rotate), at most every few minutes
+	if stale || now.Sub(v.keysLastAttempt) > signingKeysMinRefreshInterval {
+		v.keysLastAttempt = now
+		keys, err := v.fetchSigningKeys(ctx)
+		if err != nil {
+			fmt.Println("error fetching openid signing keys:", err)
+			if ok {
+				return key, nil // keep using the cached key while the endpoint is down
+			}
+			return nil, err
+		}
+		v.keys = keys
+		v.keysFetchedAt = now
+		key, ok = v.keys[kid]
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %s", kid)
+	}
+	return key, nil
+}
+
+type openIDConfiguration struct {
+	JwksUri string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+func (v *MarketplaceTokenValidator) getJSON(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status fetching %s: %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (v *MarketplaceTokenValidator) fetchSigningKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	config := &openIDConfiguration{}
+	err := v.getJSON(ctx, v.OpenIDConfigUrl, config)
+	if err != nil {
+		return nil, err
+	}
+	if config.JwksUri == "" {
+		return nil, errors.New("openid configuration has no jwks_uri")
+	}
+
+	keySet := &jsonWebKeySet{}
+	err = v.getJSON(ctx, config.JwksUri, keySet)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range keySet.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := parseRSAPublicKey(jwk)
+		if err != nil {
+			fmt.Println("skipping invalid signing key:", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing keys")
+	}
+
+	return keys, nil
+}
+
+func parseRSAPublicKey(jwk jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid exponent")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(exponent.Int64()),
+	}, nil
+}
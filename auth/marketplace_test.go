@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const testTenantId = "11111111-1111-1111-1111-111111111111"
+const testAppId = "22222222-2222-2222-2222-222222222222"
+
+type testKeyServer struct {
+	server  *httptest.Server
+	keys    map[string]*rsa.PrivateKey
+	fetches int32
+}
+
+func newTestKeyServer(t *testing.T, kids ...string) *testKeyServer {
+	t.Helper()
+	ks := &testKeyServer{keys: make(map[string]*rsa.PrivateKey)}
+	for _, kid := range kids {
+		ks.addKey(t, kid)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"jwks_uri": ks.server.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&ks.fetches, 1)
+		keySet := jsonWebKeySet{}
+		for kid, key := range ks.keys {
+			keySet.Keys = append(keySet.Keys, jsonWebKey{
+				Kty: "RSA",
+				Use: "sig",
+				Kid: kid,
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(keySet)
+	})
+	ks.server = httptest.NewServer(mux)
+	t.Cleanup(ks.server.Close)
+	return ks
+}
+
+func (ks *testKeyServer) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	ks.keys[kid] = key
+	return key
+}
+
+func (ks *testKeyServer) validator() *MarketplaceTokenValidator {
+	v := NewMarketplaceTokenValidator(testTenantId, testAppId)
+	v.OpenIDConfigUrl = ks.server.URL + "/openid-configuration"
+	return v
+}
+
+func validClaims() *MarketplaceClaims {
+	now := time.Now()
+	return &MarketplaceClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "https://sts.windows.net/" + testTenantId + "/",
+			Audience:  jwt.ClaimStrings{testAppId},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+		TenantId: testTenantId,
+		AppId:    MarketplaceAppId,
+	}
+}
+
+func sign(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.Claims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+	return signed
+}
+
+func TestMarketplaceTokenValid(t *testing.T) {
+	ks := newTestKeyServer(t, "key1")
+	v := ks.validator()
+
+	// v1 token
+	token := sign(t, ks.keys["key1"], "key1", validClaims())
+	claims, err := v.ValidateAuthorizationHeader(context.Background(), "Bearer "+token)
+	if err != nil {
+		t.Fatalf("expected valid v1 token, got %v", err)
+	}
+	if claims.TenantId != testTenantId {
+		t.Fatalf("unexpected tenant: %s", claims.TenantId)
+	}
+
+	// v2 token
+	v2 := validClaims()
+	v2.Issuer = "https://login.microsoftonline.com/" + testTenantId + "/v2.0"
+	v2.AppId = ""
+	v2.Azp = MarketplaceAppId
+	if _, err := v.Validate(context.Background(), sign(t, ks.keys["key1"], "key1", v2)); err != nil {
+		t.Fatalf("expected valid v2 token, got %v", err)
+	}
+}
+
+func TestMarketplaceTokenRejected(t *testing.T) {
+	ks := newTestKeyServer(t, "key1")
+	v := ks.validator()
+	key := ks.keys["key1"]
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	cases := map[string]func() string{
+		"wrong audience": func() string {
+			claims := validClaims()
+			claims.Audience = jwt.ClaimStrings{"someone-else"}
+			return sign(t, key, "key1", claims)
+		},
+		"wrong tenant": func() string {
+			claims := validClaims()
+			claims.TenantId = "33333333-3333-3333-3333-333333333333"
+			return sign(t, key, "key1", claims)
+		},
+		"wrong issuer": func() string {
+			claims := validClaims()
+			claims.Issuer = "https://sts.windows.net/33333333-3333-3333-3333-333333333333/"
+			return sign(t, key, "key1", claims)
+		},
+		"not the marketplace": func() string {
+			claims := validClaims()
+			claims.AppId = "44444444-4444-4444-4444-444444444444"
+			return sign(t, key, "key1", claims)
+		},
+		"expired": func() string {
+			claims := validClaims()
+			claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+			return sign(t, key, "key1", claims)
+		},
+		"no expiry": func() string {
+			claims := validClaims()
+			claims.ExpiresAt = nil
+			return sign(t, key, "key1", claims)
+		},
+		"not valid yet": func() string {
+			claims := validClaims()
+			claims.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Hour))
+			return sign(t, key, "key1", claims)
+		},
+		"signed with another key": func() string {
+			return sign(t, otherKey, "key1", validClaims())
+		},
+		"unknown kid": func() string {
+			return sign(t, otherKey, "key2", validClaims())
+		},
+		"missing kid": func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, validClaims())
+			signed, _ := token.SignedString(key)
+			return signed
+		},
+		"hmac with public key": func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims())
+			token.Header["kid"] = "key1"
+			signed, _ := token.SignedString(key.PublicKey.N.Bytes())
+			return signed
+		},
+		"alg none": func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims())
+			token.Header["kid"] = "key1"
+			signed, _ := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return signed
+		},
+		"garbage": func() string {
+			return "not.a.token"
+		},
+	}
+	for name, makeToken := range cases {
+		_, err := v.Validate(context.Background(), makeToken())
+		if !errors.Is(err, ErrInvalidMarketplaceToken) {
+			t.Errorf("%s: expected ErrInvalidMarketplaceToken, got %v", name, err)
+		}
+	}
+
+	for _, header := range []string{"", "Bearer", "Bearer ", "Basic abc", sign(t, key, "key1", validClaims())} {
+		if _, err := v.ValidateAuthorizationHeader(context.Background(), header); err == nil {
+			t.Errorf("expected header %q to be rejected", header)
+		}
+	}
+}
+
+func TestMarketplaceSigningKeysCached(t *testing.T) {
+	ks := newTestKeyServer(t, "key1")
+	v := ks.validator()
+	now := time.Now()
+	v.Now = func() time.Time { return now }
+
+	token := sign(t, ks.keys["key1"], "key1", validClaims())
+	for i := 0; i < 3; i++ {
+		if _, err := v.Validate(context.Background(), token); err != nil {
+			t.Fatalf("Validate: %v", err)
+		}
+	}
+	if fetches := atomic.LoadInt32(&ks.fetches); fetches != 1 {
+		t.Fatalf("expected keys to be fetched once, got %d", fetches)
+	}
+
+	// unknown kids can't force a refetch more than every few minutes
+	for i := 0; i < 3; i++ {
+		v.Validate(context.Background(), sign(t, ks.keys["key1"], "forged", validClaims()))
+	}
+	if fetches := atomic.LoadInt32(&ks.fetches); fetches != 1 {
+		t.Fatalf("expected no refetch for unknown kids, got %d fetches", fetches)
+	}
+
+	// a rotated key is picked up once the refresh interval has passed
+	ks.addKey(t, "key2")
+	now = now.Add(signingKeysMinRefreshInterval + time.Second)
+	rotated := sign(t, ks.keys["key2"], "key2", validClaims())
+	if _, err := v.Validate(context.Background(), rotated); err != nil {
+		t.Fatalf("expected rotated key to be accepted, got %v", err)
+	}
+	if fetches := atomic.LoadInt32(&ks.fetches); fetches != 2 {
+		t.Fatalf("expected keys to be refetched once, got %d fetches", fetches)
+	}
+}
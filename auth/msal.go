@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
 
 	kiota "github.com/microsoft/kiota-authentication-azure-go"
@@ -31,20 +33,30 @@ type MSALConfig struct {
 var Config = &MSALConfig{
 	ClientID:     "9ef60b2f-3246-4390-8e17-a57478e7ec45",
 	Authority:    "https://login.microsoftonline.com/common",
-	Scopes:       []string{"User.Read", "Team.ReadBasic.All", "openid", "profile", "email"},
+	Scopes:       TeamsScopes,
 	RedirectURI:  "http://localhost:8080",
 	ClientSecret: os.Getenv("MSAL_CLIENT_SECRET"),
 }
 
+// scopes requested at each consent level; each level includes the ones below it
+// so consent can be upgraded incrementally
+var BasicScopes = []string{"User.Read", "openid", "profile", "email"}
+var TeamsScopes = append([]string{"Team.ReadBasic.All"}, BasicScopes...)
+
 type TokenCredentialHelper struct {
 	app             *confidential.Client
 	userAccessToken string
+	scopes          []string
 	UserAuth        *confidential.AuthResult
 }
 
 // implements azcore.TokenCredential interface
 func (helper *TokenCredentialHelper) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
-	authResult, err := helper.app.AcquireTokenOnBehalfOf(ctx, helper.userAccessToken, Config.Scopes)
+	scopes := helper.scopes
+	if len(scopes) == 0 {
+		scopes = Config.Scopes
+	}
+	authResult, err := helper.app.AcquireTokenOnBehalfOf(ctx, helper.userAccessToken, scopes)
 	if err != nil {
 		fmt.Println("Error acquiring token on-behalf-of user:", err)
 		return azcore.AccessToken{}, err
@@ -60,6 +72,23 @@ func (helper *TokenCredentialHelper) GetToken(ctx context.Context, options polic
 
 }
 
+// acquire the on-behalf-of token up front, so consent errors surface before any
+// graph requests are made and UserAuth is populated
+func (helper *TokenCredentialHelper) Authenticate(ctx context.Context) error {
+	_, err := helper.GetToken(ctx, policy.TokenRequestOptions{})
+	return err
+}
+
+// reports whether an on-behalf-of error means the user (or their admin) has not
+// consented to the requested scopes yet
+func IsConsentRequired(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "AADSTS65001") || strings.Contains(msg, "consent_required")
+}
+
 func NewTokenCredentialHelper(userAccessToken string) (*TokenCredentialHelper, error) {
 	cred, err := confidential.NewCredFromSecret(Config.ClientSecret)
 	if err != nil {
@@ -105,6 +134,7 @@ func NewOBOProviderWithScopes(userAccessToken string, scopes []string) (*TokenCr
 		fmt.Println("Error creating credential:", err)
 		return nil, nil, err
 	}
+	cred.scopes = scopes
 
 	provider, err := kiota.NewAzureIdentityAuthenticationProviderWithScopes(cred, scopes)
 	if err != nil {
@@ -150,3 +180,28 @@ func NewMSGraphClientWithScopes(userAccessToken string, scopes []string) (*Token
 
 	return cred, client, nil
 }
+
+// app-only client for the given tenant (requires admin consent for application permissions)
+func NewAppMSGraphClient(tenantId string) (*msgraphsdk.GraphServiceClient, error) {
+	cred, err := azidentity.NewClientSecretCredential(tenantId, Config.ClientID, Config.ClientSecret, nil)
+	if err != nil {
+		fmt.Println("Error creating credential:", err)
+		return nil, err
+	}
+
+	provider, err := kiota.NewAzureIdentityAuthenticationProviderWithScopes(cred, []string{"https://graph.microsoft.com/.default"})
+	if err != nil {
+		fmt.Println("Error creating auth provider:", err)
+		return nil, err
+	}
+
+	adapter, err := msgraphsdk.NewGraphRequestAdapter(provider)
+	if err != nil {
+		fmt.Println("Error creating adapter:", err)
+		return nil, err
+	}
+
+	client := msgraphsdk.NewGraphServiceClient(adapter)
+
+	return client, nil
+}
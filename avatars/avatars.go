@@ -0,0 +1,102 @@
+package avatars
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Profile photos are stored as blobs named by the sha256 of their content,
+// so unchanged photos are never rewritten and identical photos are shared.
+// Dir must be a persistent volume shared by every instance of the service,
+// otherwise avatar URLs 404 on instances that did not handle the user's login.
+var Dir string
+
+func InitAvatarStore() {
+	AVATAR_DIR := os.Getenv("AVATAR_DIR")
+	if AVATAR_DIR == "" {
+		AVATAR_DIR = "data/avatars"
+		log.Printf("defaulting avatar dir to %s", AVATAR_DIR)
+	}
+
+	err := os.MkdirAll(AVATAR_DIR, 0755)
+	if err != nil {
+		log.Fatalf("error creating avatar dir: %v\n", err)
+	}
+
+	Dir = AVATAR_DIR
+}
+
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func Save(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", errors.New("empty avatar")
+	}
+
+	hash := Hash(data)
+	path := filepath.Join(Dir, hash)
+
+	// content addressed: nothing to do if we already have it
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+
+	// write to a temp file first so readers never see a partial blob
+	tmp, err := os.CreateTemp(Dir, hash+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return hash, nil
+}
+
+func validHash(hash string) bool {
+	// hashes are hex encoded sha256 sums; reject anything else so the
+	// value can never be used to escape Dir
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func Read(hash string) ([]byte, error) {
+	if !validHash(hash) {
+		return nil, errors.New("invalid avatar hash")
+	}
+
+	return os.ReadFile(filepath.Join(Dir, hash))
+}
+
+func Delete(hash string) error {
+	if !validHash(hash) {
+		return errors.New("invalid avatar hash")
+	}
+
+	err := os.Remove(filepath.Join(Dir, hash))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
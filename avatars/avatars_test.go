@@ -0,0 +1,134 @@
+package avatars
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveDedupesByContent(t *testing.T) {
+	Dir = t.TempDir()
+
+	photo := []byte("\x89PNG\r\n\x1a\nnot really a png")
+	first, err := Save(photo)
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	second, err := Save(photo)
+	if err != nil {
+		t.Fatalf("Save again: %v", err)
+	}
+	if first != second {
+		t.Fatalf("expected identical hashes, got %s and %s", first, second)
+	}
+	if first != Hash(photo) {
+		t.Fatalf("expected hash %s, got %s", Hash(photo), first)
+	}
+
+	other, err := Save([]byte("another photo"))
+	if err != nil {
+		t.Fatalf("Save other: %v", err)
+	}
+	if other == first {
+		t.Fatal("different content produced the same hash")
+	}
+
+	entries, err := os.ReadDir(Dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 blobs, found %d", len(entries))
+	}
+
+	data, err := Read(first)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(data, photo) {
+		t.Fatal("Read returned different content")
+	}
+}
+
+func TestSaveLeavesNoTempFiles(t *testing.T) {
+	Dir = t.TempDir()
+
+	for i := 0; i < 5; i++ {
+		if _, err := Save([]byte(strings.Repeat("x", i+1))); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+
+	entries, err := os.ReadDir(Dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			t.Fatalf("temp file left behind: %s", entry.Name())
+		}
+		if !validHash(entry.Name()) {
+			t.Fatalf("unexpected file in avatar dir: %s", entry.Name())
+		}
+	}
+}
+
+func TestSaveRejectsEmpty(t *testing.T) {
+	Dir = t.TempDir()
+
+	if _, err := Save(nil); err == nil {
+		t.Fatal("expected error saving empty avatar")
+	}
+}
+
+func TestReadRejectsInvalidHashes(t *testing.T) {
+	Dir = t.TempDir()
+
+	// a file outside Dir that traversal would reach
+	secret := filepath.Join(filepath.Dir(Dir), "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	defer os.Remove(secret)
+
+	invalid := []string{
+		"",
+		"abc123",
+		"../secret",
+		strings.Repeat("a", 63),
+		strings.Repeat("a", 65),
+		strings.Repeat("g", 64),
+		"../" + strings.Repeat("a", 61),
+		strings.Repeat("a", 30) + "/../" + strings.Repeat("a", 30),
+	}
+	for _, hash := range invalid {
+		if _, err := Read(hash); err == nil || !strings.Contains(err.Error(), "invalid avatar hash") {
+			t.Errorf("Read(%q): expected invalid hash error, got %v", hash, err)
+		}
+		if err := Delete(hash); err == nil {
+			t.Errorf("Delete(%q): expected error", hash)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	Dir = t.TempDir()
+
+	hash, err := Save([]byte("photo"))
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := Delete(hash); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := Read(hash); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist after delete, got %v", err)
+	}
+
+	// deleting a missing blob is not an error
+	if err := Delete(hash); err != nil {
+		t.Fatalf("Delete missing: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+// Runs the Marketplace SaaS fulfillment API emulator for local development.
+//
+//	go run ./cmd/marketplace-emulator -addr :8081 -seed
+//
+// then start the server with
+//
+//	MARKETPLACE_API_URL=http://localhost:8081
+//	MARKETPLACE_EMULATOR=true
+//	MARKETPLACE_OPENID_CONFIG_URL=http://localhost:8081/.well-known/openid-configuration
+//
+// and script the emulator through its /emulator/... endpoints.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"peachone/saasapi"
+	"peachone/saasapi/emulator"
+)
+
+func main() {
+	addr := flag.String("addr", ":8081", "address to listen on")
+	seed := flag.Bool("seed", false, "add a subscription and print its purchase token")
+	purchaser := flag.String("purchaser", "", "purchaser and beneficiary oid of the seeded subscription")
+	tenant := flag.String("tenant", "", "purchaser and beneficiary tenant of the seeded subscription")
+	flag.Parse()
+
+	e := emulator.New()
+	if *seed {
+		identity := &saasapi.AADIdentifier{}
+		if *purchaser != "" {
+			identity.ObjectID = purchaser
+		}
+		if *tenant != "" {
+			identity.TenantID = tenant
+		}
+		beneficiary := *identity
+		id, token := e.AddSubscription(saasapi.Subscription{
+			Purchaser:   identity,
+			Beneficiary: &beneficiary,
+		})
+		log.Printf("Seeded subscription %s with purchase token %s", id, token)
+	}
+
+	log.Printf("Marketplace emulator listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, e))
+}
@@ -25,6 +25,9 @@ func InitDBTables(db *gorm.DB) {
 		"ALTER TABLE team_users DROP CONSTRAINT fk_team_users_id;",
 		"ALTER TABLE team_users DROP CONSTRAINT fk_team_users_oid;",
 		"ALTER TABLE team_rooms DROP CONSTRAINT fk_team_rooms_team_id;",
+		"ALTER TABLE user_statuses DROP CONSTRAINT fk_user_statuses_oid;",
+		"ALTER TABLE presence_subscriptions DROP CONSTRAINT fk_presence_subscriptions_oid;",
+		"ALTER TABLE tenant_domains DROP CONSTRAINT fk_tenant_domains_tid;",
 	}
 	// run sql statements
 	for _, sql := range sql_drop_constraints {
@@ -34,17 +37,37 @@ func InitDBTables(db *gorm.DB) {
 		}
 	}
 
+	db.AutoMigrate(&models.Tenant{})
+	db.AutoMigrate(&models.TenantDomain{})
 	db.AutoMigrate(&models.TenantUser{})
 	db.AutoMigrate(&models.TenantTeam{})
 	db.AutoMigrate(&models.TeamUser{})
 	db.AutoMigrate(&models.TeamRoom{})
 	db.AutoMigrate(&models.Subscription{})
+	db.AutoMigrate(&models.UserStatus{})
+	db.AutoMigrate(&models.PresenceSubscription{})
+	db.AutoMigrate(&models.MarketplaceOperation{})
+	db.AutoMigrate(&models.SubscriptionSettings{})
+	db.AutoMigrate(&models.SubscriptionAutoAssignTeam{})
+	db.AutoMigrate(&models.SubscriptionAdmin{})
+	db.AutoMigrate(&models.SubscriptionActivation{})
+	db.AutoMigrate(&models.PublisherOperation{})
+	db.AutoMigrate(&models.SubscriptionCancellation{})
+	db.AutoMigrate(&models.ParticipantSession{})
+	db.AutoMigrate(&models.UsageReport{})
+	db.AutoMigrate(&models.SubscriptionLedgerEntry{})
+	db.AutoMigrate(&models.SeatRequest{})
+	db.AutoMigrate(&models.TrialExtension{})
+	db.AutoMigrate(&models.TenantTrial{})
 
 	// define foreign key relationships
 	sql_add_constraints := []string{
 		"ALTER TABLE team_users ADD CONSTRAINT fk_team_users_id FOREIGN KEY (id) REFERENCES tenant_teams(id) ON DELETE CASCADE;",
 		"ALTER TABLE team_users ADD CONSTRAINT fk_team_users_oid FOREIGN KEY (oid) REFERENCES tenant_users(oid) ON DELETE CASCADE;",
 		"ALTER TABLE team_rooms ADD CONSTRAINT fk_team_rooms_team_id FOREIGN KEY (team_id) REFERENCES tenant_teams(id) ON DELETE CASCADE;",
+		"ALTER TABLE user_statuses ADD CONSTRAINT fk_user_statuses_oid FOREIGN KEY (oid) REFERENCES tenant_users(oid) ON DELETE CASCADE;",
+		"ALTER TABLE presence_subscriptions ADD CONSTRAINT fk_presence_subscriptions_oid FOREIGN KEY (oid) REFERENCES tenant_users(oid) ON DELETE CASCADE;",
+		"ALTER TABLE tenant_domains ADD CONSTRAINT fk_tenant_domains_tid FOREIGN KEY (tid) REFERENCES tenants(tid) ON DELETE CASCADE;",
 	}
 	// run sql statements
 	for _, sql := range sql_add_constraints {
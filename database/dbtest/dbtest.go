@@ -0,0 +1,66 @@
+// Package dbtest sets up a database for tests that need Postgres.
+//
+// Tests run against a local Postgres, e.g.
+//
+//	docker run --rm -d -p 5433:5432 -e POSTGRES_PASSWORD=postgres postgres:14
+//	TEST_DATABASE_URL="host=localhost port=5433 user=postgres password=postgres dbname=postgres sslmode=disable" go test ./...
+//
+// Each run migrates a fresh schema and drops it afterwards. Without
+// TEST_DATABASE_URL, Open returns no database and the tests skip.
+package dbtest
+
+import (
+	"fmt"
+	"os"
+	"peachone/database"
+	"strings"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Open a fresh, migrated schema in the database at TEST_DATABASE_URL. Returns
+// a nil db if TEST_DATABASE_URL isn't set; call drop when done.
+func Open() (db *gorm.DB, drop func(), err error) {
+	TEST_DATABASE_URL := os.Getenv("TEST_DATABASE_URL")
+	if TEST_DATABASE_URL == "" {
+		return nil, func() {}, nil
+	}
+
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	admin, err := gorm.Open(postgres.Open(TEST_DATABASE_URL), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not connect to test database: %w", err)
+	}
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		return nil, nil, fmt.Errorf("could not create test schema: %w", err)
+	}
+	drop = func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+	}
+
+	db, err = gorm.Open(postgres.Open(withSearchPath(TEST_DATABASE_URL, schema)), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		drop()
+		return nil, nil, fmt.Errorf("could not connect to test schema: %w", err)
+	}
+	database.InitDBTables(db)
+
+	return db, drop, nil
+}
+
+func withSearchPath(dsn string, schema string) string {
+	if strings.Contains(dsn, "://") {
+		if strings.Contains(dsn, "?") {
+			return dsn + "&search_path=" + schema
+		}
+		return dsn + "?search_path=" + schema
+	}
+	return dsn + " search_path=" + schema
+}
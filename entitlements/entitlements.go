@@ -0,0 +1,117 @@
+package entitlements
+
+// The features each Marketplace plan gives its users. Handlers ask what a
+// user is entitled to instead of checking plan ids, so plans can be added or
+// changed in Partner Center by configuring the catalog.
+
+import (
+	"encoding/json"
+	"fmt"
+	"peachone/models"
+)
+
+type Entitlements struct {
+	LicensePlan     models.LicensePlan `json:"licensePlan"`
+	MaxRoomCapacity int                `json:"maxRoomCapacity"` // participants per room
+	CustomRooms     int                `json:"customRooms"`     // rooms a team may add to its default ones
+	Recording       bool               `json:"recording"`
+	GuestLinks      bool               `json:"guestLinks"`
+	Regions         []string           `json:"regions"` // where rooms may be hosted
+}
+
+// no subscription or trial
+var NoEntitlements = Entitlements{LicensePlan: models.None, Regions: []string{}}
+
+var StandardEntitlements = Entitlements{
+	LicensePlan:     models.Standard,
+	MaxRoomCapacity: 25,
+	CustomRooms:     0,
+	Recording:       false,
+	GuestLinks:      false,
+	Regions:         []string{"us-west1"},
+}
+
+var ProfessionalEntitlements = Entitlements{
+	LicensePlan:     models.Professional,
+	MaxRoomCapacity: 100,
+	CustomRooms:     20,
+	Recording:       true,
+	GuestLinks:      true,
+	Regions:         []string{"us-west1"},
+}
+
+func (e Entitlements) HasRegion(region string) bool {
+	for _, r := range e.Regions {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
+
+// Catalog maps plan ids to entitlements. Plans that aren't in it get the
+// Standard entitlements, so a new plan never locks its users out; trials get
+// the Standard entitlements too.
+type Catalog struct {
+	plans map[string]Entitlements
+}
+
+func NewCatalog(plans map[string]Entitlements) *Catalog {
+	if plans == nil {
+		plans = map[string]Entitlements{}
+	}
+	return &Catalog{plans: plans}
+}
+
+// ParseCatalog reads a catalog from JSON: an object of plan id to
+// entitlements, e.g. {"teraphone-pro": {"licensePlan": "professional", ...}}.
+// A plan that only sets licensePlan gets the defaults for that plan.
+func ParseCatalog(config string) (*Catalog, error) {
+	raw := map[string]json.RawMessage{}
+	err := json.Unmarshal([]byte(config), &raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid plan catalog: %w", err)
+	}
+
+	plans := make(map[string]Entitlements)
+	for planId, planConfig := range raw {
+		base := struct {
+			LicensePlan models.LicensePlan `json:"licensePlan"`
+		}{}
+		err := json.Unmarshal(planConfig, &base)
+		if err != nil {
+			return nil, fmt.Errorf("invalid plan %s: %w", planId, err)
+		}
+
+		var entitlements Entitlements
+		switch base.LicensePlan {
+		case models.Standard:
+			entitlements = StandardEntitlements
+		case models.Professional:
+			entitlements = ProfessionalEntitlements
+		default:
+			return nil, fmt.Errorf("plan %s: licensePlan must be standard or professional", planId)
+		}
+		entitlements.Regions = append([]string{}, entitlements.Regions...)
+		err = json.Unmarshal(planConfig, &entitlements)
+		if err != nil {
+			return nil, fmt.Errorf("invalid plan %s: %w", planId, err)
+		}
+		if entitlements.MaxRoomCapacity < 1 || entitlements.CustomRooms < 0 || len(entitlements.Regions) == 0 {
+			return nil, fmt.Errorf("plan %s: needs maxRoomCapacity >= 1, customRooms >= 0 and at least one region", planId)
+		}
+		plans[planId] = entitlements
+	}
+	return NewCatalog(plans), nil
+}
+
+func (c *Catalog) ForPlan(planId string) Entitlements {
+	if entitlements, ok := c.plans[planId]; ok {
+		return entitlements
+	}
+	return StandardEntitlements
+}
+
+func (c *Catalog) ForTrial() Entitlements {
+	return StandardEntitlements
+}
@@ -0,0 +1,56 @@
+package entitlements
+
+import (
+	"peachone/models"
+	"testing"
+)
+
+func TestParseCatalog(t *testing.T) {
+	catalog, err := ParseCatalog(`{
+		"teraphone-pro": {"licensePlan": "professional"},
+		"teraphone-pro-eu": {"licensePlan": "professional", "maxRoomCapacity": 50, "regions": ["europe-west1"]},
+		"teraphone-standard": {"licensePlan": "standard", "guestLinks": true}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pro := catalog.ForPlan("teraphone-pro")
+	if pro.LicensePlan != models.Professional || !pro.Recording || pro.MaxRoomCapacity != ProfessionalEntitlements.MaxRoomCapacity {
+		t.Errorf("teraphone-pro = %+v, want the Professional defaults", pro)
+	}
+	eu := catalog.ForPlan("teraphone-pro-eu")
+	if eu.MaxRoomCapacity != 50 || !eu.HasRegion("europe-west1") || eu.HasRegion("us-west1") || !eu.Recording {
+		t.Errorf("teraphone-pro-eu = %+v", eu)
+	}
+	if ProfessionalEntitlements.HasRegion("europe-west1") {
+		t.Error("configuring a plan changed the Professional defaults")
+	}
+	standard := catalog.ForPlan("teraphone-standard")
+	if standard.LicensePlan != models.Standard || !standard.GuestLinks || standard.Recording {
+		t.Errorf("teraphone-standard = %+v", standard)
+	}
+
+	// plans that aren't configured, and trials, get Standard
+	if unknown := catalog.ForPlan("new-plan"); unknown.LicensePlan != models.Standard {
+		t.Errorf("unconfigured plan = %+v, want Standard", unknown)
+	}
+	if trial := catalog.ForTrial(); trial.LicensePlan != models.Standard {
+		t.Errorf("trial = %+v, want Standard", trial)
+	}
+}
+
+func TestParseCatalogErrors(t *testing.T) {
+	configs := []string{
+		`not json`,
+		`{"plan": {}}`,
+		`{"plan": {"licensePlan": "enterprise"}}`,
+		`{"plan": {"licensePlan": "standard", "maxRoomCapacity": 0}}`,
+		`{"plan": {"licensePlan": "standard", "regions": []}}`,
+	}
+	for _, config := range configs {
+		if _, err := ParseCatalog(config); err == nil {
+			t.Errorf("%s: no error", config)
+		}
+	}
+}
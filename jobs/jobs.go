@@ -0,0 +1,52 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Every runs fn every interval until ctx is done. Errors are logged and a
+// panic only ends the current run, so one bad run never stops the job.
+func Every(ctx context.Context, name string, interval time.Duration, fn func(ctx context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		run(ctx, name, fn)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func run(ctx context.Context, name string, fn func(ctx context.Context) error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("panic in job", name+":", r)
+		}
+	}()
+
+	err := fn(ctx)
+	if err != nil {
+		fmt.Println("error in job", name+":", err)
+	}
+}
+
+// Backoff returns the delay before retry number attempt (starting at 1):
+// base doubled for each previous attempt, capped at max.
+func Backoff(attempt int, base time.Duration, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= max {
+			return max
+		}
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
@@ -0,0 +1,56 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	cases := map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		6:  32 * time.Second,
+		7:  time.Minute,
+		50: time.Minute,
+	}
+	for attempt, expected := range cases {
+		if actual := Backoff(attempt, time.Second, time.Minute); actual != expected {
+			t.Errorf("Backoff(%d) = %s, expected %s", attempt, actual, expected)
+		}
+	}
+}
+
+func TestEveryKeepsRunningAfterErrorsAndPanics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var runs int32
+	done := make(chan struct{})
+
+	go func() {
+		Every(ctx, "test", time.Millisecond, func(ctx context.Context) error {
+			n := atomic.AddInt32(&runs, 1)
+			switch n {
+			case 1:
+				return errors.New("failed")
+			case 2:
+				panic("boom")
+			case 3:
+				cancel()
+			}
+			return nil
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job did not stop after cancel")
+	}
+	if runs < 3 {
+		t.Fatalf("expected at least 3 runs, got %d", runs)
+	}
+}
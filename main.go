@@ -7,10 +7,14 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"peachone/avatars"
 	"peachone/database"
 	"peachone/fbadmin"
+	"peachone/jobs"
 	"peachone/routes"
+	"peachone/saasapi"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -24,6 +28,7 @@ func setupRoutes(app *fiber.App) {
 	setupRoomService(app)
 	setupWebhooks(app)
 	setupSubscriptions(app)
+	setupStaff(app)
 
 }
 
@@ -34,6 +39,7 @@ func setupPublic(app *fiber.App) {
 	public.Get("/", routes.PublicWelcome)
 
 	// Public endpoints
+	public.Post("/signin", routes.SignIn)
 	public.Post("/login", routes.Login)
 	public.Post("/email-signup", routes.EmailSignup)
 	public.Post("/auth", routes.Auth)
@@ -53,6 +59,11 @@ func setupPrivate(app *fiber.App) {
 	private.Patch("/trial", routes.UpdateTrial)
 	private.Get("/world", routes.GetWorld)
 	private.Post("/auth", routes.GetRefreshedAccessToken)
+	private.Get("/avatars/:oid", routes.GetAvatar)
+	private.Put("/status", routes.SetStatus)
+	private.Delete("/status", routes.ClearStatus)
+	private.Post("/seat-request", routes.RequestSeat)
+	private.Get("/seat-request", routes.GetSeatRequest)
 
 }
 
@@ -75,8 +86,11 @@ func setupWebhooks(app *fiber.App) {
 	// Livekit webhook handler
 	webhooks.Post("/livekit", routes.LivekitHandler)
 
-	// Subscriptions webhook handler
-	webhooks.Post("/subscriptions", routes.SubscriptionsWebhook)
+	// Microsoft Graph presence notifications
+	webhooks.Post("/presence", routes.PresenceWebhook)
+
+	// Subscriptions webhook handler (authenticated with the Marketplace's Azure AD token)
+	webhooks.Post("/subscriptions", routes.AuthenticateMarketplaceWebhook, routes.SubscriptionsWebhook)
 }
 
 func setupSubscriptions(app *fiber.App) {
@@ -89,17 +103,64 @@ func setupSubscriptions(app *fiber.App) {
 	// Resolve purchase token
 	subscriptions.Post("/resolve", routes.Resolve)
 
-	// Activate subscription
+	// Activate subscription (queued; poll the activation for its status)
 	subscriptions.Post("/activate", routes.Activate)
+	subscriptions.Get("/:subscriptionId/activation", routes.GetActivation)
 
 	// Get subscriptions
 	subscriptions.Get("/", routes.GetSubscriptions)
 
 	// Get users by tenant
 	subscriptions.Get("/:tid/users", routes.GetUsersByTenant)
+	subscriptions.Get("/:tid/users/export", routes.ExportUsersByTenant)
 
-	// Assign subscription to user
+	// Assign subscription to user, or to many users at once
 	subscriptions.Patch("/:tid/users/:oid", routes.AssignUserSubscription)
+	subscriptions.Post("/:subscriptionId/seats", routes.AssignSubscriptionSeats)
+
+	// Delegated admins, granted by the purchaser or beneficiary
+	subscriptions.Get("/:subscriptionId/admins", routes.GetSubscriptionAdmins)
+	subscriptions.Post("/:subscriptionId/admins", routes.GrantSubscriptionAdmin)
+	subscriptions.Delete("/:subscriptionId/admins/:oid", routes.RevokeSubscriptionAdmin)
+
+	// Seat requests from unassigned users, decided by an admin
+	subscriptions.Get("/:subscriptionId/seat-requests", routes.GetSubscriptionSeatRequests)
+	subscriptions.Post("/:subscriptionId/seat-requests/:requestId/approve", routes.ApproveSeatRequest)
+	subscriptions.Post("/:subscriptionId/seat-requests/:requestId/deny", routes.DenySeatRequest)
+
+	// Seat overage and over-allocation policy
+	subscriptions.Get("/:subscriptionId/overage", routes.GetSubscriptionOverage)
+	subscriptions.Patch("/:subscriptionId/settings", routes.UpdateSubscriptionSettings)
+
+	// Plan and quantity changes
+	subscriptions.Get("/:subscriptionId/plans", routes.GetSubscriptionPlans)
+	subscriptions.Patch("/:subscriptionId/plan", routes.ChangeSubscriptionPlan)
+	subscriptions.Patch("/:subscriptionId/quantity", routes.ChangeSubscriptionQuantity)
+	subscriptions.Get("/:subscriptionId/operations", routes.GetSubscriptionOperations)
+
+	// Cancellation, requested then confirmed by an admin
+	subscriptions.Post("/:subscriptionId/cancellation", routes.RequestSubscriptionCancellation)
+	subscriptions.Post("/:subscriptionId/cancellation/confirm", routes.ConfirmSubscriptionCancellation)
+	subscriptions.Get("/:subscriptionId/cancellation", routes.GetSubscriptionCancellation)
+
+	// Metered usage reported to the Marketplace
+	subscriptions.Get("/:subscriptionId/usage", routes.GetSubscriptionUsage)
+
+	// Ledger of subscription and seat changes
+	subscriptions.Get("/:subscriptionId/ledger", routes.GetSubscriptionLedger)
+}
+
+func setupStaff(app *fiber.App) {
+	staff := app.Group("/v1/staff")
+	SIGNING_KEY := os.Getenv("SIGNING_KEY")
+	staff.Use(jwtware.New(jwtware.Config{
+		SigningKey: []byte(SIGNING_KEY),
+	}))
+	staff.Use(routes.RequireStaff)
+
+	// Trials
+	staff.Post("/trials/:oid/extend", routes.ExtendTrial)
+	staff.Get("/trials/conversions", routes.GetTrialConversions)
 }
 
 func main() {
@@ -111,10 +172,34 @@ func main() {
 	// Connect to DB
 	database.CreateDBConnection(ctx)
 
+	// Init avatar store
+	avatars.InitAvatarStore()
+
+	// Marketplace API (the emulator sends no Azure AD token; never in production)
+	if saasapi.EmulatorMode() {
+		log.Printf("MARKETPLACE_EMULATOR is set: Marketplace API calls go to %s without an Azure AD token or retries", saasapi.Host())
+	} else if saasapi.Host() != saasapi.DefaultHost {
+		log.Printf("Marketplace API calls go to %s", saasapi.Host())
+	}
+
 	// Create app
 	app := fiber.New()
 	setupRoutes(app)
 
+	// Start background jobs
+	jobsCtx, stopJobs := context.WithCancel(ctx)
+	go jobs.Every(jobsCtx, "marketplace-operations", 10*time.Second, routes.ProcessMarketplaceOperations)
+	go jobs.Every(jobsCtx, "publisher-operations", 10*time.Second, routes.ProcessPublisherOperations)
+	go jobs.Every(jobsCtx, "subscription-activations", 5*time.Second, routes.ProcessSubscriptionActivations)
+	go jobs.Every(jobsCtx, "suspend-grace-periods", 5*time.Minute, routes.EnforceSuspendGracePeriods)
+	go jobs.Every(jobsCtx, "subscription-terms", time.Hour, routes.EnforceSubscriptionTerms)
+	go jobs.Every(jobsCtx, "seat-overages", 15*time.Minute, routes.EnforceSeatOverages)
+	go jobs.Every(jobsCtx, "auto-assign-backfill", 15*time.Minute, routes.BackfillAutoAssignments)
+	go jobs.Every(jobsCtx, "subscription-reconciliation", time.Hour, routes.ReconcileSubscriptions)
+	go jobs.Every(jobsCtx, "usage-reports", 15*time.Minute, routes.ReportUsage)
+	go jobs.Every(jobsCtx, "trial-reminders", time.Hour, routes.SendTrialReminders)
+	go jobs.Every(jobsCtx, "presence-subscriptions", time.Minute, routes.RenewPresenceSubscriptions)
+
 	// Determine port for HTTP service.
 	PORT := os.Getenv("PORT")
 	if PORT == "" {
@@ -139,6 +224,7 @@ func main() {
 	<-c
 	fmt.Println("Gracefully shutting down...")
 	_ = app.Shutdown()
+	stopJobs()
 
 	// Cleanup
 	fmt.Println("Running cleanup tasks...")
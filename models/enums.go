@@ -1,5 +1,7 @@
 package models
 
+import "fmt"
+
 type LicenseStatus int
 
 const (
@@ -34,6 +36,8 @@ const (
 
 func (s LicensePlan) String() string {
 	switch s {
+	case None:
+		return "none"
 	case Standard:
 		return "standard"
 	case Professional:
@@ -43,6 +47,21 @@ func (s LicensePlan) String() string {
 	}
 }
 
+// LicensePlan is written as its name in JSON (e.g. the plan catalog)
+func (s LicensePlan) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *LicensePlan) UnmarshalText(text []byte) error {
+	for _, plan := range []LicensePlan{None, Standard, Professional} {
+		if plan.String() == string(text) {
+			*s = plan
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown license plan %q", text)
+}
+
 type DeploymentZone int
 
 const (
@@ -102,3 +121,159 @@ const (
 	SessionModeEnumNone   SessionModeEnum = "None"
 	SessionModeEnumDryRun SessionModeEnum = "DryRun"
 )
+
+type AvailabilityEnum string
+
+const (
+	AvailabilityEnumAvailable    AvailabilityEnum = "Available"
+	AvailabilityEnumBusy         AvailabilityEnum = "Busy"
+	AvailabilityEnumAway         AvailabilityEnum = "Away"
+	AvailabilityEnumDoNotDisturb AvailabilityEnum = "DoNotDisturb"
+	AvailabilityEnumOffline      AvailabilityEnum = "Offline"
+)
+
+func PossibleAvailabilityEnumValues() []AvailabilityEnum {
+	return []AvailabilityEnum{
+		AvailabilityEnumAvailable,
+		AvailabilityEnumBusy,
+		AvailabilityEnumAway,
+		AvailabilityEnumDoNotDisturb,
+		AvailabilityEnumOffline,
+	}
+}
+
+type StatusSourceEnum string
+
+const (
+	StatusSourceEnumManual StatusSourceEnum = "Manual"
+	StatusSourceEnumTeams  StatusSourceEnum = "Teams"
+)
+
+// scopes a user has consented to, in increasing order
+type ConsentLevelEnum string
+
+const (
+	ConsentLevelEnumBasic ConsentLevelEnum = "basic" // User.Read: profile and tenant only
+	ConsentLevelEnumTeams ConsentLevelEnum = "teams" // adds Team.ReadBasic.All: joined teams and rooms
+)
+
+func (s ConsentLevelEnum) Includes(other ConsentLevelEnum) bool {
+	return s == other || s == ConsentLevelEnumTeams
+}
+
+type MarketplaceOperationStatusEnum string
+
+const (
+	MarketplaceOperationStatusEnumPending   MarketplaceOperationStatusEnum = "Pending" // waiting for its first or next attempt
+	MarketplaceOperationStatusEnumSucceeded MarketplaceOperationStatusEnum = "Succeeded"
+	MarketplaceOperationStatusEnumFailed    MarketplaceOperationStatusEnum = "Failed" // gave up after the last attempt
+)
+
+type SubscriptionActivationEnum string
+
+const (
+	SubscriptionActivationEnumPending SubscriptionActivationEnum = "Pending" // activating, or waiting for term dates
+	SubscriptionActivationEnumActive  SubscriptionActivationEnum = "Active"  // activated and synced with its term dates
+	SubscriptionActivationEnumFailed  SubscriptionActivationEnum = "Failed"  // gave up; the client may activate again
+)
+
+type PublisherOperationStatusEnum string
+
+const (
+	PublisherOperationStatusEnumInProgress PublisherOperationStatusEnum = "InProgress" // waiting for the Marketplace to complete it
+	PublisherOperationStatusEnumSucceeded  PublisherOperationStatusEnum = "Succeeded"  // completed and the subscription synced
+	PublisherOperationStatusEnumFailed     PublisherOperationStatusEnum = "Failed"     // failed or conflicted at the Marketplace, or gave up polling
+)
+
+type SubscriptionCancellationStatusEnum string
+
+const (
+	SubscriptionCancellationStatusEnumPendingConfirmation SubscriptionCancellationStatusEnum = "PendingConfirmation" // requested, waiting for the admin to confirm
+	SubscriptionCancellationStatusEnumCancelling          SubscriptionCancellationStatusEnum = "Cancelling"          // confirmed, waiting for the Marketplace
+	SubscriptionCancellationStatusEnumCancelled           SubscriptionCancellationStatusEnum = "Cancelled"           // the subscription is unsubscribed
+	SubscriptionCancellationStatusEnumFailed              SubscriptionCancellationStatusEnum = "Failed"              // the Marketplace didn't cancel it; the admin may try again
+)
+
+// why an admin cancelled, for churn analysis
+type CancellationReasonEnum string
+
+const (
+	CancellationReasonEnumTooExpensive     CancellationReasonEnum = "too_expensive"
+	CancellationReasonEnumMissingFeatures  CancellationReasonEnum = "missing_features"
+	CancellationReasonEnumTechnicalIssues  CancellationReasonEnum = "technical_issues"
+	CancellationReasonEnumNotUsing         CancellationReasonEnum = "not_using"
+	CancellationReasonEnumSwitchingProduct CancellationReasonEnum = "switching_product"
+	CancellationReasonEnumOther            CancellationReasonEnum = "other"
+)
+
+func PossibleCancellationReasonEnumValues() []CancellationReasonEnum {
+	return []CancellationReasonEnum{
+		CancellationReasonEnumTooExpensive,
+		CancellationReasonEnumMissingFeatures,
+		CancellationReasonEnumTechnicalIssues,
+		CancellationReasonEnumNotUsing,
+		CancellationReasonEnumSwitchingProduct,
+		CancellationReasonEnumOther,
+	}
+}
+
+// what to do when a ChangeQuantity lowers the quantity below the assigned seats
+type OverAllocationPolicyEnum string
+
+const (
+	OverAllocationPolicyEnumReject   OverAllocationPolicyEnum = "reject"   // fail the operation; the quantity is unchanged
+	OverAllocationPolicyEnumUnassign OverAllocationPolicyEnum = "unassign" // accept, then unassign the least recently active users after a notice period
+)
+
+func PossibleOverAllocationPolicyEnumValues() []OverAllocationPolicyEnum {
+	return []OverAllocationPolicyEnum{
+		OverAllocationPolicyEnumReject,
+		OverAllocationPolicyEnumUnassign,
+	}
+}
+
+type UsageReportStatusEnum string
+
+const (
+	UsageReportStatusEnumPending  UsageReportStatusEnum = "Pending"  // not reported yet, or the last attempt failed
+	UsageReportStatusEnumAccepted UsageReportStatusEnum = "Accepted" // accepted by the Marketplace (or already was)
+	UsageReportStatusEnumRejected UsageReportStatusEnum = "Rejected" // rejected by the Marketplace; see MarketplaceStatus
+)
+
+type LedgerEventEnum string
+
+const (
+	LedgerEventEnumSubscriptionChanged LedgerEventEnum = "SubscriptionChanged" // Marketplace or lifecycle state changed
+	LedgerEventEnumSeatAssigned        LedgerEventEnum = "SeatAssigned"
+	LedgerEventEnumSeatUnassigned      LedgerEventEnum = "SeatUnassigned"
+	LedgerEventEnumAdminGranted        LedgerEventEnum = "AdminGranted" // a delegated admin; see SubscriptionAdmin
+	LedgerEventEnumAdminRevoked        LedgerEventEnum = "AdminRevoked"
+	LedgerEventEnumRenewed             LedgerEventEnum = "Renewed" // the Marketplace renewed the subscription for a new term
+)
+
+// what a bulk seat assignment did for one of the requested users
+type SeatAssignmentStatusEnum string
+
+const (
+	SeatAssignmentStatusEnumAssigned        SeatAssignmentStatusEnum = "Assigned"        // assigned, possibly moved from another subscription
+	SeatAssignmentStatusEnumAlreadyAssigned SeatAssignmentStatusEnum = "AlreadyAssigned" // no seat used
+	SeatAssignmentStatusEnumNotFound        SeatAssignmentStatusEnum = "NotFound"        // not a user of the subscription's tenant (they may not have signed in yet)
+)
+
+type SeatRequestStatusEnum string
+
+const (
+	SeatRequestStatusEnumPending  SeatRequestStatusEnum = "Pending"
+	SeatRequestStatusEnumApproved SeatRequestStatusEnum = "Approved"
+	SeatRequestStatusEnumDenied   SeatRequestStatusEnum = "Denied"
+)
+
+// trial reminders, in the order they are emailed
+type TrialReminderEnum string
+
+const (
+	TrialReminderEnumNone      TrialReminderEnum = ""
+	TrialReminderEnumSevenDays TrialReminderEnum = "SevenDays"
+	TrialReminderEnumOneDay    TrialReminderEnum = "OneDay"
+	TrialReminderEnumExpired   TrialReminderEnum = "Expired"
+)
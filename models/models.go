@@ -7,15 +7,41 @@ import (
 )
 
 type TenantUser struct {
-	Oid            string    `gorm:"primary_key" json:"oid"`
-	Name           string    `json:"name"`
-	Email          string    `json:"email"`
-	Tid            string    `json:"tid"`
-	CreatedAt      time.Time `json:"createdAt"`
-	UpdatedAt      time.Time `json:"updatedAt"`
-	SubscriptionId string    `json:"subscriptionId"` // fk: Subscription.Id
-	TrialActivated bool      `json:"trialActivated"`
-	TrialExpiresAt time.Time `json:"trialExpiresAt"`
+	Oid            string            `gorm:"primary_key" json:"oid"`
+	Name           string            `json:"name"`
+	Email          string            `json:"email"`
+	Tid            string            `json:"tid"`
+	CreatedAt      time.Time         `json:"createdAt"`
+	UpdatedAt      time.Time         `json:"updatedAt"`
+	SubscriptionId string            `json:"subscriptionId"` // fk: Subscription.Id
+	TrialActivated bool              `json:"trialActivated"`
+	TrialExpiresAt time.Time         `json:"trialExpiresAt"`
+	TrialStartedAt time.Time         `json:"trialStartedAt"` // zero for trials started before it was recorded
+	TrialReminder  TrialReminderEnum `json:"trialReminder"`  // the last trial reminder emailed
+	JobTitle       string            `json:"jobTitle"`
+	Department     string            `json:"department"`
+	PhotoHash      string            `json:"photoHash"`                         // sha256 of profile photo in avatar store
+	ConsentLevel   ConsentLevelEnum  `gorm:"default:teams" json:"consentLevel"` // highest consent level granted at sign in
+	LastActiveAt   time.Time         `json:"lastActiveAt"`                      // last sign in or room join
+	AvatarUrl      string            `gorm:"-" json:"avatarUrl"`                // derived from PhotoHash, not stored
+	Status         *UserStatus       `gorm:"-" json:"status,omitempty"`         // populated by GetWorld
+}
+
+type Tenant struct {
+	Tid               string         `gorm:"primary_key" json:"tid"`
+	DisplayName       string         `json:"displayName"`
+	CountryLetterCode string         `json:"countryLetterCode"`
+	DefaultDomain     string         `json:"defaultDomain"`
+	CreatedAt         time.Time      `json:"createdAt"`
+	UpdatedAt         time.Time      `json:"updatedAt"`
+	VerifiedDomains   []TenantDomain `gorm:"-" json:"verifiedDomains"` // loaded by queries.GetTenant and Repository.GetTenant
+}
+
+type TenantDomain struct {
+	Tid       string `gorm:"primary_key" json:"tid"` // fk: Tenant.Tid
+	Name      string `gorm:"primary_key" json:"name"`
+	IsDefault bool   `json:"isDefault"`
+	IsInitial bool   `json:"isInitial"`
 }
 
 type UserLicense struct { // todo: Delete this table
@@ -95,4 +121,263 @@ type Subscription struct {
 	StoreFront                string                 `json:"storeFront"`
 	SubscriptionTermStartDate time.Time              `json:"subscriptionTermStartDate"`
 	SubscriptionTermEndDate   time.Time              `json:"subscriptionTermEndDate"`
+
+	// lifecycle state kept by us; not part of the Marketplace subscription, so
+	// not overwritten when the subscription is synced
+	SuspendedAt     time.Time `json:"suspendedAt"`     // when the Marketplace suspended it (e.g. failed payment)
+	GraceEndsAt     time.Time `json:"graceEndsAt"`     // users keep access until then while suspended
+	AccessRevokedAt time.Time `json:"accessRevokedAt"` // when users lost access after the grace period
+	UnsubscribedAt  time.Time `json:"unsubscribedAt"`  // when seats were cleared after Unsubscribe
+
+	// set while more users are assigned than the quantity allows
+	OverAllocatedAt          time.Time `json:"overAllocatedAt"`
+	OverAllocationUnassignAt time.Time `json:"overAllocationUnassignAt"` // when the extra users will be unassigned
+
+	// set when automatic assignment found no free seat and the admins were told;
+	// cleared once there are free seats again
+	SeatsExhaustedAt time.Time `json:"seatsExhaustedAt"`
+
+	// for a subscription that doesn't auto-renew: when its admins were warned
+	// that the term is ending, and when it ended without a Renew; both cleared
+	// on Renew
+	TermEndingNotifiedAt time.Time `json:"termEndingNotifiedAt"`
+	TermExpiredAt        time.Time `json:"termExpiredAt"`
+	RenewedUntil         time.Time `json:"renewedUntil"` // the term end date of the last renewal recorded
+}
+
+// An activation requested by the client, done by a background worker: activate
+// the subscription with the Marketplace, then wait until it has its term dates.
+type SubscriptionActivation struct {
+	SubscriptionId string                     `gorm:"primary_key" json:"subscriptionId"` // fk: Subscription.Id (once synced)
+	RequestedBy    string                     `json:"requestedBy"`                       // oid of the user who activated it
+	Status         SubscriptionActivationEnum `gorm:"index" json:"status"`
+	Attempts       int                        `json:"attempts"` // failed attempts; waiting for term dates doesn't count
+	LastError      string                     `json:"lastError"`
+	NextAttemptAt  time.Time                  `gorm:"index" json:"nextAttemptAt"`
+	ActivatedAt    time.Time                  `json:"activatedAt"` // activate call accepted by the Marketplace
+	RetriedAt      time.Time                  `json:"retriedAt"`   // activated again by the client after failing
+	CompletedAt    time.Time                  `json:"completedAt"`
+	CreatedAt      time.Time                  `json:"createdAt"`
+	UpdatedAt      time.Time                  `json:"updatedAt"`
+}
+
+// An operation we started on a subscription through the Marketplace API (a
+// plan or quantity change, or a cancellation), tracked by a background worker
+// until the Marketplace completes it.
+type PublisherOperation struct {
+	Id                string                       `gorm:"primary_key" json:"id"` // Marketplace operation id, from its Operation-Location
+	SubscriptionId    string                       `gorm:"index" json:"subscriptionId"`
+	Action            string                       `json:"action"`      // ChangePlan or ChangeQuantity
+	PlanId            string                       `json:"planId"`      // ChangePlan: the new plan
+	Quantity          int                          `json:"quantity"`    // ChangeQuantity: the new quantity
+	RequestedBy       string                       `json:"requestedBy"` // oid of the admin who started it
+	OperationLocation string                       `json:"-"`
+	Status            PublisherOperationStatusEnum `gorm:"index" json:"status"`
+	MarketplaceStatus string                       `json:"marketplaceStatus"` // as last polled: NotStarted, InProgress, Succeeded, Failed or Conflict
+	Attempts          int                          `json:"attempts"`          // failed polls
+	LastError         string                       `json:"lastError"`
+	NextAttemptAt     time.Time                    `gorm:"index" json:"nextAttemptAt"`
+	CompletedAt       time.Time                    `json:"completedAt"`
+	CreatedAt         time.Time                    `json:"createdAt"`
+	UpdatedAt         time.Time                    `json:"updatedAt"`
+}
+
+// A cancellation requested by an admin. It is confirmed in a second step, then
+// cancelled with the Marketplace; the row is kept afterwards, with the reason,
+// for churn analysis.
+type SubscriptionCancellation struct {
+	SubscriptionId    string                             `gorm:"primary_key" json:"subscriptionId"` // fk: Subscription.Id
+	RequestedBy       string                             `json:"requestedBy"`                       // oid of the admin who asked to cancel
+	ReasonCode        CancellationReasonEnum             `gorm:"index" json:"reasonCode"`
+	Comment           string                             `json:"comment"`
+	ConfirmationToken string                             `json:"-"`
+	ConfirmBy         time.Time                          `json:"confirmBy"` // the request expires after this
+	Status            SubscriptionCancellationStatusEnum `gorm:"index" json:"status"`
+	ConfirmedBy       string                             `json:"confirmedBy"`
+	ConfirmedAt       time.Time                          `json:"confirmedAt"`
+	OperationId       string                             `json:"operationId"` // fk: PublisherOperation.Id, once confirmed
+	LastError         string                             `json:"lastError"`
+	CancelledAt       time.Time                          `json:"cancelledAt"` // when the subscription was unsubscribed
+	CreatedAt         time.Time                          `json:"createdAt"`
+	UpdatedAt         time.Time                          `json:"updatedAt"`
+}
+
+// Per-subscription settings chosen by its admins. Subscriptions without a row
+// use DefaultSubscriptionSettings.
+type SubscriptionSettings struct {
+	SubscriptionId           string                   `gorm:"primary_key" json:"subscriptionId"` // fk: Subscription.Id
+	OverAllocationPolicy     OverAllocationPolicyEnum `json:"overAllocationPolicy"`
+	OverAllocationNoticeDays int                      `json:"overAllocationNoticeDays"` // for the unassign policy
+
+	// seats are assigned automatically, while there are free ones, to users of
+	// the beneficiary tenant who sign in for the first time after
+	// AutoAssignNewUsersAt, and to members of the AutoAssignTeamIds teams
+	AutoAssignNewUsers   bool      `json:"autoAssignNewUsers"`
+	AutoAssignNewUsersAt time.Time `json:"autoAssignNewUsersAt"`       // when AutoAssignNewUsers was turned on
+	AutoAssignTeamIds    []string  `gorm:"-" json:"autoAssignTeamIds"` // stored in subscription_auto_assign_teams
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// a team whose members get seats of the subscription automatically
+type SubscriptionAutoAssignTeam struct {
+	SubscriptionId string    `gorm:"primary_key" json:"subscriptionId"` // fk: Subscription.Id
+	TeamId         string    `gorm:"primary_key" json:"teamId"`         // fk: TenantTeam.Id
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// A user of the beneficiary tenant granted admin rights on a subscription, on
+// top of its purchaser and beneficiary, so seats can still be managed when they
+// leave. Granted and revoked by the purchaser or beneficiary; revoking deletes it.
+type SubscriptionAdmin struct {
+	SubscriptionId string    `gorm:"primary_key" json:"subscriptionId"` // fk: Subscription.Id
+	Oid            string    `gorm:"primary_key;index" json:"oid"`      // fk: TenantUser.Oid
+	Tid            string    `json:"tid"`
+	Name           string    `json:"name"`
+	Email          string    `json:"email"`
+	GrantedBy      string    `json:"grantedBy"` // oid of the purchaser or beneficiary
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+func DefaultSubscriptionSettings(subscriptionId string) *SubscriptionSettings {
+	return &SubscriptionSettings{
+		SubscriptionId:           subscriptionId,
+		OverAllocationPolicy:     OverAllocationPolicyEnumUnassign,
+		OverAllocationNoticeDays: 7,
+		AutoAssignTeamIds:        []string{},
+	}
+}
+
+type UserStatus struct {
+	Oid          string           `gorm:"primary_key" json:"oid"` // fk: TenantUser.Oid
+	Availability AvailabilityEnum `json:"availability"`
+	Activity     string           `json:"activity"` // Teams activity, e.g. "InAMeeting"
+	Message      string           `json:"message"`
+	Source       StatusSourceEnum `json:"source"`
+	ExpiresAt    time.Time        `json:"expiresAt"` // manual status only; zero means it never expires
+	UpdatedAt    time.Time        `json:"updatedAt"`
+}
+
+// A user's Teams presence feed: a Microsoft Graph subscription, created and
+// renewed by a background job while the user's client keeps requesting it.
+type PresenceSubscription struct {
+	Oid         string    `gorm:"primary_key" json:"oid"` // fk: TenantUser.Oid
+	Tid         string    `json:"tid"`
+	Id          string    `gorm:"index" json:"id"` // Microsoft Graph subscription id; empty until created
+	ExpiresAt   time.Time `gorm:"index" json:"expiresAt"`
+	RequestedAt time.Time `json:"requestedAt"` // last sign in or world load
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// a Marketplace webhook call, recorded so retries are deduped and the work is
+// done (and retried) by a background worker instead of inside the request
+type MarketplaceOperation struct {
+	Id             string                         `gorm:"primary_key" json:"id"` // Marketplace operation id
+	ActivityId     string                         `json:"activityId"`
+	SubscriptionId string                         `gorm:"index" json:"subscriptionId"`
+	Action         string                         `json:"action"`
+	Payload        string                         `json:"-"` // webhook body as received
+	Status         MarketplaceOperationStatusEnum `gorm:"index" json:"status"`
+	Attempts       int                            `json:"attempts"`
+	LastError      string                         `json:"lastError"`
+	NextAttemptAt  time.Time                      `gorm:"index" json:"nextAttemptAt"`
+	AckedAt        time.Time                      `json:"ackedAt"` // operation status reported back to the Marketplace
+	CompletedAt    time.Time                      `json:"completedAt"`
+	CreatedAt      time.Time                      `json:"createdAt"`
+	UpdatedAt      time.Time                      `json:"updatedAt"`
+}
+
+// A user's time in a room, from the LiveKit participant webhooks. Counted
+// towards the subscription's metered usage.
+type ParticipantSession struct {
+	Sid            string    `gorm:"primary_key" json:"sid"`      // LiveKit participant sid
+	Oid            string    `gorm:"index" json:"oid"`            // fk: TenantUser.Oid
+	SubscriptionId string    `gorm:"index" json:"subscriptionId"` // the user's subscription when they joined; empty on a trial
+	RoomName       string    `gorm:"index" json:"roomName"`
+	JoinedAt       time.Time `gorm:"index" json:"joinedAt"`
+	LeftAt         time.Time `gorm:"index" json:"leftAt"` // zero while in the room
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// Usage of one metering dimension by one subscription in one hour, and what
+// the Marketplace did with it. One row per subscription, dimension and hour, so
+// the same hour is never reported twice.
+type UsageReport struct {
+	Id                 uint                  `gorm:"primary_key" json:"id"`
+	SubscriptionId     string                `gorm:"uniqueIndex:idx_usage_report_hour" json:"subscriptionId"`
+	Dimension          string                `gorm:"uniqueIndex:idx_usage_report_hour" json:"dimension"`
+	EffectiveStartTime time.Time             `gorm:"uniqueIndex:idx_usage_report_hour" json:"effectiveStartTime"` // start of the hour
+	PlanId             string                `json:"planId"`
+	Quantity           float64               `json:"quantity"`
+	Status             UsageReportStatusEnum `gorm:"index" json:"status"`
+	UsageEventId       string                `json:"usageEventId"`      // Marketplace id, once accepted
+	MarketplaceStatus  string                `json:"marketplaceStatus"` // e.g. Accepted, Duplicate, Expired, InvalidDimension
+	Attempts           int                   `json:"attempts"`
+	LastError          string                `json:"lastError"`
+	ReportedAt         time.Time             `json:"reportedAt"`
+	CreatedAt          time.Time             `json:"createdAt"`
+	UpdatedAt          time.Time             `json:"updatedAt"`
+}
+
+// An entry in the append-only ledger of a subscription: a change of its state
+// or of its seat assignments, who made it and through which operation. Entries
+// are never updated or deleted, so they can settle billing disputes.
+type SubscriptionLedgerEntry struct {
+	Id             uint            `gorm:"primary_key" json:"id"`
+	SubscriptionId string          `gorm:"index" json:"subscriptionId"`
+	Event          LedgerEventEnum `json:"event"`
+	Operation      string          `json:"operation"`            // what made the change, e.g. ChangePlan, Suspend, AssignSeat, Reconcile
+	OperationId    string          `json:"operationId"`          // Marketplace operation id, if there was one
+	Actor          string          `json:"actor"`                // oid of the user who made the change, or "marketplace" or "system"
+	UserOid        string          `gorm:"index" json:"userOid"` // seat and admin events: the user assigned, unassigned, granted or revoked
+	UserEmail      string          `json:"userEmail"`
+	Changes        string          `json:"changes"`  // subscription events: "field: before -> after", one per line
+	Snapshot       string          `json:"snapshot"` // subscription events: the subscription after the change, as JSON
+	CreatedAt      time.Time       `gorm:"index" json:"createdAt"`
+}
+
+// An unassigned user's request for a seat, for the admins of their tenant's
+// subscriptions to approve or deny. A user has at most one pending request.
+type SeatRequest struct {
+	Id             uint                  `gorm:"primary_key" json:"id"`
+	Oid            string                `gorm:"index" json:"oid"`
+	Tid            string                `gorm:"index" json:"tid"`
+	Name           string                `json:"name"`
+	Email          string                `json:"email"`
+	Message        string                `json:"message"` // why the user needs a seat
+	Status         SeatRequestStatusEnum `gorm:"index" json:"status"`
+	SubscriptionId string                `json:"subscriptionId"` // approved: the subscription the user was assigned to
+	DecidedBy      string                `json:"decidedBy"`      // oid of the admin who approved or denied it
+	DecidedAt      time.Time             `json:"decidedAt"`
+	Reason         string                `json:"reason"` // denied: why, as told to the user
+	CreatedAt      time.Time             `json:"createdAt"`
+	UpdatedAt      time.Time             `json:"updatedAt"`
+}
+
+// Days added to a user's trial by Teraphone staff; kept for the conversion report
+type TrialExtension struct {
+	Id                uint      `gorm:"primary_key" json:"id"`
+	Oid               string    `gorm:"index" json:"oid"` // fk: TenantUser.Oid
+	Days              int       `json:"days"`
+	Reason            string    `json:"reason"`
+	GrantedBy         string    `json:"grantedBy"` // oid of the staff member
+	PreviousExpiresAt time.Time `json:"previousExpiresAt"`
+	ExpiresAt         time.Time `json:"expiresAt"`
+	CreatedAt         time.Time `json:"createdAt"`
+}
+
+// A trial for a whole tenant, started by its first user who asks for one. It
+// covers all the tenant's users, alongside their own trials.
+type TenantTrial struct {
+	Tid            string            `gorm:"primary_key" json:"tid"` // fk: Tenant.Tid
+	StartedBy      string            `json:"startedBy"`              // oid of the user who started it
+	StartedByEmail string            `json:"startedByEmail"`
+	StartedAt      time.Time         `json:"startedAt"`
+	ExpiresAt      time.Time         `json:"expiresAt"`
+	Reminder       TrialReminderEnum `json:"reminder"` // the last trial reminder emailed to StartedByEmail
+	CreatedAt      time.Time         `json:"createdAt"`
+	UpdatedAt      time.Time         `json:"updatedAt"`
 }
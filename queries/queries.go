@@ -2,7 +2,6 @@ package queries
 
 import (
 	"errors"
-	"fmt"
 	"peachone/models"
 
 	"github.com/gofiber/fiber/v2"
@@ -52,6 +51,49 @@ func SetUpNewUser(db *gorm.DB, user *models.TenantUser) error {
 	return nil
 }
 
+func SetUpNewTenant(db *gorm.DB, tenant *models.Tenant) error {
+	// make sure tenant isn't empty
+	if tenant.Tid == "" {
+		return errors.New("missing fields in tenant")
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		// create tenant
+		if err := tx.Create(tenant).Error; err != nil {
+			return err
+		}
+
+		// create verified domains
+		for i := range tenant.VerifiedDomains {
+			tenant.VerifiedDomains[i].Tid = tenant.Tid
+			if err := tx.Create(&tenant.VerifiedDomains[i]).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func GetTenant(db *gorm.DB, tid string) (*models.Tenant, error) {
+	tenant := &models.Tenant{}
+	query := db.Where("tid = ?", tid).Find(tenant)
+	if query.Error != nil {
+		return nil, query.Error
+	}
+	if query.RowsAffected == 0 {
+		return nil, errors.New("tenant not found")
+	}
+
+	tenant.VerifiedDomains = []models.TenantDomain{}
+	query = db.Where("tid = ?", tid).Order("name").Find(&tenant.VerifiedDomains)
+	if query.Error != nil {
+		return nil, query.Error
+	}
+
+	return tenant, nil
+}
+
 type DefaultRoomConfig struct {
 	DisplayName    string                `json:"name"`
 	Description    string                `json:"description"`
@@ -131,18 +173,3 @@ func SetUpNewTeamAndRooms(db *gorm.DB, team *models.TenantTeam) error {
 
 	return nil
 }
-
-func GetUsersForTeam(db *gorm.DB, teamId string) ([]models.TenantUser, error) {
-	sql_fmt := "SELECT tenant_users.* " +
-		"FROM tenant_users " +
-		"JOIN team_users ON tenant_users.oid = team_users.oid " +
-		"WHERE team_users.id = '%s' "
-	sql := fmt.Sprintf(sql_fmt, teamId)
-	users := []models.TenantUser{}
-	query := db.Raw(sql).Scan(&users)
-	if query.RowsAffected == 0 {
-		return nil, errors.New("could not find users for team")
-	}
-
-	return users, nil
-}
@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"context"
+	"peachone/models"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+func (r *Repository) GetSubscriptionActivation(ctx context.Context, subscriptionId string) (*models.SubscriptionActivation, error) {
+	activation := &models.SubscriptionActivation{}
+	err := found(r.conn(ctx).Where("subscription_id = ?", subscriptionId).Limit(1).Find(activation))
+	if err != nil {
+		return nil, err
+	}
+	return activation, nil
+}
+
+// record a new activation; returns false if the subscription already has one
+func (r *Repository) CreateSubscriptionActivation(ctx context.Context, activation *models.SubscriptionActivation) (bool, error) {
+	query := r.conn(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(activation)
+	if query.Error != nil {
+		return false, query.Error
+	}
+	return query.RowsAffected > 0, nil
+}
+
+// queue a failed activation again, keeping its history (who requested it and
+// when it was activated); returns false if it hasn't failed
+func (r *Repository) RetrySubscriptionActivation(ctx context.Context, subscriptionId string, now time.Time) (bool, error) {
+	query := r.conn(ctx).Model(&models.SubscriptionActivation{}).
+		Where("subscription_id = ? AND status = ?", subscriptionId, models.SubscriptionActivationEnumFailed).
+		Updates(map[string]interface{}{
+			"status":          models.SubscriptionActivationEnumPending,
+			"attempts":        0,
+			"last_error":      "",
+			"next_attempt_at": now,
+			"retried_at":      now,
+			"completed_at":    time.Time{},
+		})
+	if query.Error != nil {
+		return false, query.Error
+	}
+	return query.RowsAffected > 0, nil
+}
+
+// lock the activation that has been due the longest; call inside a transaction.
+// Rows locked by other workers are skipped.
+func (r *Repository) LockNextDueSubscriptionActivation(ctx context.Context, now time.Time) (*models.SubscriptionActivation, error) {
+	activation := &models.SubscriptionActivation{}
+	err := found(r.conn(ctx).
+		Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+		Where("status = ? AND next_attempt_at <= ?", models.SubscriptionActivationEnumPending, now).
+		Order("next_attempt_at, created_at").
+		Limit(1).
+		Find(activation))
+	if err != nil {
+		return nil, err
+	}
+	return activation, nil
+}
+
+// insert or overwrite an activation
+func (r *Repository) SaveSubscriptionActivation(ctx context.Context, activation *models.SubscriptionActivation) error {
+	return r.conn(ctx).Save(activation).Error
+}
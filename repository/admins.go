@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"context"
+	"peachone/models"
+
+	"gorm.io/gorm/clause"
+)
+
+// grant admin rights; returns false if the user already had them
+func (r *Repository) CreateSubscriptionAdmin(ctx context.Context, admin *models.SubscriptionAdmin) (bool, error) {
+	query := r.conn(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(admin)
+	if query.Error != nil {
+		return false, query.Error
+	}
+	return query.RowsAffected > 0, nil
+}
+
+// revoke admin rights; ErrNotFound if the user didn't have them
+func (r *Repository) DeleteSubscriptionAdmin(ctx context.Context, subscriptionId string, oid string) error {
+	return found(r.conn(ctx).
+		Where("subscription_id = ? AND oid = ?", subscriptionId, oid).
+		Delete(&models.SubscriptionAdmin{}))
+}
+
+// whether the user is a delegated admin of the subscription
+func (r *Repository) IsSubscriptionAdmin(ctx context.Context, subscriptionId string, oid string) (bool, error) {
+	var count int64 = 0
+	err := r.conn(ctx).Model(&models.SubscriptionAdmin{}).
+		Where("subscription_id = ? AND oid = ?", subscriptionId, oid).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// the delegated admins of the subscriptions, oldest first
+func (r *Repository) ListSubscriptionAdmins(ctx context.Context, subscriptionIds []string) ([]models.SubscriptionAdmin, error) {
+	admins := []models.SubscriptionAdmin{}
+	if len(subscriptionIds) == 0 {
+		return admins, nil
+	}
+	err := r.conn(ctx).
+		Where("subscription_id IN ?", subscriptionIds).
+		Order("created_at").
+		Find(&admins).Error
+	if err != nil {
+		return nil, err
+	}
+	return admins, nil
+}
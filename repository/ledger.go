@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"context"
+	"peachone/models"
+
+	"gorm.io/gorm"
+)
+
+// The ledger is append-only: there is no way to update or delete an entry.
+
+func (r *Repository) CreateLedgerEntries(ctx context.Context, entries []models.SubscriptionLedgerEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return r.conn(ctx).Create(&entries).Error
+}
+
+// a subscription's ledger, newest first; beforeId pages back from an entry
+// (0 starts at the newest)
+func (r *Repository) ListLedgerEntries(ctx context.Context, subscriptionId string, beforeId uint, limit int) ([]models.SubscriptionLedgerEntry, error) {
+	entries := []models.SubscriptionLedgerEntry{}
+	query := r.conn(ctx).Where("subscription_id = ?", subscriptionId)
+	if beforeId > 0 {
+		query = query.Where("id < ?", beforeId)
+	}
+	err := query.Order("id DESC").Limit(limit).Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// oids of users unassigned from a subscription at some point, as a subquery
+func (r *Repository) unassignedUsers(subscriptionId string) *gorm.DB {
+	return r.db.Model(&models.SubscriptionLedgerEntry{}).
+		Select("user_oid").
+		Where("subscription_id = ? AND event = ?", subscriptionId, models.LedgerEventEnumSeatUnassigned)
+}
+
+// whether the user was ever unassigned from the subscription
+func (r *Repository) WasUnassigned(ctx context.Context, subscriptionId string, oid string) (bool, error) {
+	var count int64 = 0
+	err := r.conn(ctx).Table("(?) AS unassigned", r.unassignedUsers(subscriptionId)).
+		Where("user_oid = ?", oid).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// the seats assigned to any of the users, oldest first
+func (r *Repository) ListSeatAssignments(ctx context.Context, oids []string) ([]models.SubscriptionLedgerEntry, error) {
+	entries := []models.SubscriptionLedgerEntry{}
+	if len(oids) == 0 {
+		return entries, nil
+	}
+	err := r.conn(ctx).
+		Where("event = ? AND user_oid IN ?", models.LedgerEventEnumSeatAssigned, oids).
+		Order("id").
+		Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
+
+// Take the advisory lock named name if no one holds it, on a connection of
+// its own; false if it is held elsewhere. Call release to let it go. Jobs that
+// must not run on several instances at once take one for the run.
+func (r *Repository) TryAdvisoryLock(ctx context.Context, name string) (release func(), locked bool, err error) {
+	db, err := r.db.DB()
+	if err != nil {
+		return nil, false, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", name).Scan(&locked)
+	if err != nil || !locked {
+		conn.Close()
+		return nil, false, err
+	}
+	release = func() {
+		// the lock goes with the session, should unlocking fail
+		conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", name)
+		conn.Close()
+	}
+	return release, true, nil
+}
+
+// Run fn holding the advisory lock named name, waiting for it if it is held
+// elsewhere. The lock is held by a transaction of its own until fn returns,
+// so fn may use any connection.
+func (r *Repository) WithAdvisoryLock(ctx context.Context, name string, fn func() error) error {
+	return r.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", name).Error
+		if err != nil {
+			return err
+		}
+		return fn()
+	})
+}
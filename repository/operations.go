@@ -0,0 +1,101 @@
+package repository
+
+import (
+	"context"
+	"peachone/models"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// record a webhook operation; returns false if it was already recorded (a retry)
+func (r *Repository) CreateMarketplaceOperation(ctx context.Context, operation *models.MarketplaceOperation) (bool, error) {
+	query := r.conn(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(operation)
+	if query.Error != nil {
+		return false, query.Error
+	}
+	return query.RowsAffected > 0, nil
+}
+
+func (r *Repository) GetMarketplaceOperation(ctx context.Context, id string) (*models.MarketplaceOperation, error) {
+	operation := &models.MarketplaceOperation{}
+	err := found(r.conn(ctx).Where("id = ?", id).Limit(1).Find(operation))
+	if err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+// lock the oldest pending operation that is due; call inside a transaction.
+// Rows locked by other workers are skipped, so workers never process the same
+// operation at the same time.
+func (r *Repository) LockNextDueMarketplaceOperation(ctx context.Context, now time.Time) (*models.MarketplaceOperation, error) {
+	operation := &models.MarketplaceOperation{}
+	err := found(r.conn(ctx).
+		Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+		Where("status = ? AND next_attempt_at <= ?", models.MarketplaceOperationStatusEnumPending, now).
+		Order("next_attempt_at, created_at").
+		Limit(1).
+		Find(operation))
+	if err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+func (r *Repository) SaveMarketplaceOperation(ctx context.Context, operation *models.MarketplaceOperation) error {
+	return r.conn(ctx).Save(operation).Error
+}
+
+// recent operations for a subscription, newest first
+func (r *Repository) ListMarketplaceOperations(ctx context.Context, subscriptionId string) ([]models.MarketplaceOperation, error) {
+	operations := []models.MarketplaceOperation{}
+	err := r.conn(ctx).Where("subscription_id = ?", subscriptionId).Order("created_at DESC").Find(&operations).Error
+	if err != nil {
+		return nil, err
+	}
+	return operations, nil
+}
+
+func (r *Repository) CreatePublisherOperation(ctx context.Context, operation *models.PublisherOperation) error {
+	return r.conn(ctx).Create(operation).Error
+}
+
+func (r *Repository) GetPublisherOperation(ctx context.Context, id string) (*models.PublisherOperation, error) {
+	operation := &models.PublisherOperation{}
+	err := found(r.conn(ctx).Where("id = ?", id).Limit(1).Find(operation))
+	if err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+// lock the in-progress operation that has been due the longest; call inside a
+// transaction. Rows locked by other workers are skipped.
+func (r *Repository) LockNextDuePublisherOperation(ctx context.Context, now time.Time) (*models.PublisherOperation, error) {
+	operation := &models.PublisherOperation{}
+	err := found(r.conn(ctx).
+		Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+		Where("status = ? AND next_attempt_at <= ?", models.PublisherOperationStatusEnumInProgress, now).
+		Order("next_attempt_at, created_at").
+		Limit(1).
+		Find(operation))
+	if err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+func (r *Repository) SavePublisherOperation(ctx context.Context, operation *models.PublisherOperation) error {
+	return r.conn(ctx).Save(operation).Error
+}
+
+// operations we started on a subscription, newest first
+func (r *Repository) ListPublisherOperations(ctx context.Context, subscriptionId string) ([]models.PublisherOperation, error) {
+	operations := []models.PublisherOperation{}
+	err := r.conn(ctx).Where("subscription_id = ?", subscriptionId).Order("created_at DESC").Find(&operations).Error
+	if err != nil {
+		return nil, err
+	}
+	return operations, nil
+}
@@ -0,0 +1,101 @@
+package repository
+
+import (
+	"context"
+	"peachone/models"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// --------------------------------------------------------------------------------
+// User statuses
+// --------------------------------------------------------------------------------
+
+func (r *Repository) GetUserStatus(ctx context.Context, oid string) (*models.UserStatus, error) {
+	status := &models.UserStatus{}
+	err := found(r.conn(ctx).Where("oid = ?", oid).Limit(1).Find(status))
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// the statuses of the given users; users without one are left out
+func (r *Repository) ListUserStatuses(ctx context.Context, oids []string) ([]models.UserStatus, error) {
+	statuses := []models.UserStatus{}
+	if len(oids) == 0 {
+		return statuses, nil
+	}
+	err := r.conn(ctx).Where("oid IN ?", oids).Find(&statuses).Error
+	if err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// insert or replace a user's status
+func (r *Repository) SaveUserStatus(ctx context.Context, status *models.UserStatus) error {
+	return r.conn(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(status).Error
+}
+
+func (r *Repository) DeleteUserStatus(ctx context.Context, oid string) error {
+	return r.conn(ctx).Where("oid = ?", oid).Delete(&models.UserStatus{}).Error
+}
+
+// --------------------------------------------------------------------------------
+// Presence subscriptions
+// --------------------------------------------------------------------------------
+
+// the graph presence subscription of a user
+func (r *Repository) GetPresenceSubscription(ctx context.Context, oid string) (*models.PresenceSubscription, error) {
+	subscription := &models.PresenceSubscription{}
+	err := found(r.conn(ctx).Where("oid = ?", oid).Limit(1).Find(subscription))
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// the presence subscription a change notification is for, by its graph id
+func (r *Repository) GetPresenceSubscriptionById(ctx context.Context, id string) (*models.PresenceSubscription, error) {
+	subscription := &models.PresenceSubscription{}
+	err := found(r.conn(ctx).Where("id = ?", id).Limit(1).Find(subscription))
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// insert or replace a user's presence subscription
+func (r *Repository) SavePresenceSubscription(ctx context.Context, subscription *models.PresenceSubscription) error {
+	return r.conn(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(subscription).Error
+}
+
+// record that the user's client wants their presence feed; the job creating
+// and renewing feeds picks it up
+func (r *Repository) RequestPresenceSubscription(ctx context.Context, oid string, tid string, now time.Time) error {
+	subscription := &models.PresenceSubscription{Oid: oid, Tid: tid, RequestedAt: now}
+	return r.conn(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "oid"}},
+		DoUpdates: clause.AssignmentColumns([]string{"tid", "requested_at", "updated_at"}),
+	}).Create(subscription).Error
+}
+
+// feeds requested since requestedSince that expire by expiresBy (or were
+// never created), soonest first
+func (r *Repository) ListPresenceSubscriptionsToRenew(ctx context.Context, requestedSince time.Time, expiresBy time.Time) ([]models.PresenceSubscription, error) {
+	subscriptions := []models.PresenceSubscription{}
+	err := r.conn(ctx).
+		Where("requested_at >= ? AND expires_at <= ?", requestedSince, expiresBy).
+		Order("expires_at").
+		Find(&subscriptions).Error
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+func (r *Repository) RenewPresenceSubscription(ctx context.Context, oid string, expiresAt time.Time) error {
+	return found(r.conn(ctx).Model(&models.PresenceSubscription{}).Where("oid = ?", oid).Update("expires_at", expiresAt))
+}
@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// ErrNotFound is returned when a lookup matches no rows.
+var ErrNotFound = errors.New("record not found")
+
+// Repository wraps the database with parameterized, context aware queries, so
+// route handlers never build SQL themselves.
+type Repository struct {
+	db *gorm.DB
+}
+
+func New(db *gorm.DB) *Repository {
+	return &Repository{db: db}
+}
+
+// run fn in a transaction, with a repository bound to that transaction
+func (r *Repository) Transaction(ctx context.Context, fn func(tx *Repository) error) error {
+	return r.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&Repository{db: tx})
+	})
+}
+
+func (r *Repository) conn(ctx context.Context) *gorm.DB {
+	return r.db.WithContext(ctx)
+}
+
+// check the result of a query that should match exactly one row
+func found(query *gorm.DB) error {
+	if query.Error != nil {
+		return query.Error
+	}
+	if query.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,1302 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"peachone/database/dbtest"
+	"peachone/models"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+)
+
+// Tests run against the Postgres at TEST_DATABASE_URL (see dbtest), and are
+// skipped without it.
+var testDB *gorm.DB
+
+func TestMain(m *testing.M) {
+	db, drop, err := dbtest.Open()
+	if err != nil {
+		fmt.Println("error opening test database:", err)
+		os.Exit(1)
+	}
+	testDB = db
+
+	code := m.Run()
+
+	drop()
+	os.Exit(code)
+}
+
+func testRepository(t *testing.T) *Repository {
+	t.Helper()
+	if testDB == nil {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	return New(testDB)
+}
+
+func newId() string {
+	return uuid.Must(uuid.NewV4()).String()
+}
+
+func createTestUser(t *testing.T, repo *Repository, tid string) *models.TenantUser {
+	t.Helper()
+	user := &models.TenantUser{
+		Oid:   newId(),
+		Tid:   tid,
+		Name:  "user " + newId()[:8],
+		Email: "user@example.com",
+	}
+	if err := repo.CreateUser(context.Background(), user); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	return user
+}
+
+func createTestTeam(t *testing.T, repo *Repository, tid string) *models.TenantTeam {
+	t.Helper()
+	team := &models.TenantTeam{
+		Id:          newId(),
+		Tid:         tid,
+		DisplayName: "team",
+	}
+	if err := repo.CreateTeam(context.Background(), team); err != nil {
+		t.Fatalf("CreateTeam: %v", err)
+	}
+	return team
+}
+
+func TestUsers(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	tid := newId()
+
+	if _, err := repo.GetUser(ctx, newId()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetUser missing: expected ErrNotFound, got %v", err)
+	}
+
+	user := createTestUser(t, repo, tid)
+	other := createTestUser(t, repo, tid)
+	createTestUser(t, repo, newId())
+
+	got, err := repo.GetUser(ctx, user.Oid)
+	if err != nil || got.Name != user.Name {
+		t.Fatalf("GetUser: got %v, %v", got, err)
+	}
+	if _, err := repo.GetTenantUser(ctx, newId(), user.Oid); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetTenantUser wrong tenant: expected ErrNotFound, got %v", err)
+	}
+	if _, err := repo.GetTenantUser(ctx, tid, user.Oid); err != nil {
+		t.Fatalf("GetTenantUser: %v", err)
+	}
+
+	err = repo.UpdateUser(ctx, user.Oid, map[string]interface{}{"job_title": "Engineer", "photo_hash": "abc"})
+	if err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	if err := repo.UpdateUser(ctx, newId(), map[string]interface{}{"job_title": "x"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("UpdateUser missing: expected ErrNotFound, got %v", err)
+	}
+	got, _ = repo.GetUser(ctx, user.Oid)
+	if got.JobTitle != "Engineer" {
+		t.Fatalf("UpdateUser did not update job title: %q", got.JobTitle)
+	}
+
+	users, err := repo.ListUsersByTenant(ctx, tid)
+	if err != nil || len(users) != 2 {
+		t.Fatalf("ListUsersByTenant: got %d users, %v", len(users), err)
+	}
+	users, err = repo.ListUsersByTenant(ctx, newId())
+	if err != nil || users == nil || len(users) != 0 {
+		t.Fatalf("ListUsersByTenant empty: got %v, %v", users, err)
+	}
+
+	subscriptionId := newId()
+	for _, u := range []*models.TenantUser{user, other} {
+		if err := repo.SetUserSubscription(ctx, u.Oid, subscriptionId); err != nil {
+			t.Fatalf("SetUserSubscription: %v", err)
+		}
+	}
+	if err := repo.SetUserSubscription(ctx, other.Oid, ""); err != nil {
+		t.Fatalf("SetUserSubscription unassign: %v", err)
+	}
+	count, err := repo.CountSubscriptionUsers(ctx, subscriptionId)
+	if err != nil || count != 1 {
+		t.Fatalf("CountSubscriptionUsers: got %d, %v", count, err)
+	}
+
+	count, err = repo.CountUsersWithPhoto(ctx, "abc")
+	if err != nil || count != 1 {
+		t.Fatalf("CountUsersWithPhoto: got %d, %v", count, err)
+	}
+}
+
+func TestTeamMembers(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	tid := newId()
+
+	team := createTestTeam(t, repo, tid)
+	otherTeam := createTestTeam(t, repo, tid)
+	user := createTestUser(t, repo, tid)
+	other := createTestUser(t, repo, tid)
+	outsider := createTestUser(t, repo, newId())
+
+	// an empty team is not an error
+	members, err := repo.ListTeamMembers(ctx, team.Id)
+	if err != nil || members == nil || len(members) != 0 {
+		t.Fatalf("ListTeamMembers empty: got %v, %v", members, err)
+	}
+
+	// adding twice is not an error
+	for i := 0; i < 2; i++ {
+		if err := repo.AddTeamMember(ctx, team.Id, user.Oid); err != nil {
+			t.Fatalf("AddTeamMember: %v", err)
+		}
+	}
+	if err := repo.AddTeamMember(ctx, team.Id, other.Oid); err != nil {
+		t.Fatalf("AddTeamMember: %v", err)
+	}
+	if err := repo.AddTeamMember(ctx, otherTeam.Id, outsider.Oid); err != nil {
+		t.Fatalf("AddTeamMember: %v", err)
+	}
+
+	members, err = repo.ListTeamMembers(ctx, team.Id)
+	if err != nil || len(members) != 2 {
+		t.Fatalf("ListTeamMembers: got %d members, %v", len(members), err)
+	}
+
+	isMember, err := repo.IsTeamMember(ctx, team.Id, user.Oid)
+	if err != nil || !isMember {
+		t.Fatalf("IsTeamMember: got %v, %v", isMember, err)
+	}
+	isMember, err = repo.IsTeamMember(ctx, team.Id, outsider.Oid)
+	if err != nil || isMember {
+		t.Fatalf("IsTeamMember outsider: got %v, %v", isMember, err)
+	}
+
+	teams, err := repo.ListTeamsForUser(ctx, user.Oid)
+	if err != nil || len(teams) != 1 || teams[0].Id != team.Id {
+		t.Fatalf("ListTeamsForUser: got %v, %v", teams, err)
+	}
+
+	shared, err := repo.ShareTeam(ctx, user.Oid, other.Oid)
+	if err != nil || !shared {
+		t.Fatalf("ShareTeam: got %v, %v", shared, err)
+	}
+	shared, err = repo.ShareTeam(ctx, user.Oid, outsider.Oid)
+	if err != nil || shared {
+		t.Fatalf("ShareTeam outsider: got %v, %v", shared, err)
+	}
+}
+
+func TestTeamMembersParameterized(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+
+	team := createTestTeam(t, repo, newId())
+	user := createTestUser(t, repo, team.Tid)
+	if err := repo.AddTeamMember(ctx, team.Id, user.Oid); err != nil {
+		t.Fatalf("AddTeamMember: %v", err)
+	}
+
+	// a quote in the team id must not change the query
+	members, err := repo.ListTeamMembers(ctx, "x' OR '1'='1")
+	if err != nil || len(members) != 0 {
+		t.Fatalf("ListTeamMembers injection: got %d members, %v", len(members), err)
+	}
+}
+
+func TestRooms(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+
+	team := createTestTeam(t, repo, newId())
+	rooms, err := repo.ListRoomsForTeam(ctx, team.Id)
+	if err != nil || rooms == nil || len(rooms) != 0 {
+		t.Fatalf("ListRoomsForTeam empty: got %v, %v", rooms, err)
+	}
+
+	for _, name := range []string{"Lounge", "Focus"} {
+		room := &models.TeamRoom{
+			Id:          uuid.Must(uuid.NewV4()),
+			TeamId:      team.Id,
+			DisplayName: name,
+			Capacity:    10,
+		}
+		if err := repo.CreateRoom(ctx, room); err != nil {
+			t.Fatalf("CreateRoom: %v", err)
+		}
+	}
+	rooms, err = repo.ListRoomsForTeam(ctx, team.Id)
+	if err != nil || len(rooms) != 2 {
+		t.Fatalf("ListRoomsForTeam: got %d rooms, %v", len(rooms), err)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	admin := newId()
+	tid := newId()
+
+	if _, err := repo.GetSubscription(ctx, newId()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetSubscription missing: expected ErrNotFound, got %v", err)
+	}
+
+	subscription := &models.Subscription{
+		Id:             newId(),
+		AutoRenew:      true,
+		PurchaserOid:   admin,
+		BeneficiaryTid: tid,
+		Quantity:       5,
+	}
+	if err := repo.SaveSubscription(ctx, subscription); err != nil {
+		t.Fatalf("SaveSubscription insert: %v", err)
+	}
+
+	// saving again overwrites every field, including zero values
+	subscription.AutoRenew = false
+	subscription.Quantity = 3
+	if err := repo.SaveSubscription(ctx, subscription); err != nil {
+		t.Fatalf("SaveSubscription update: %v", err)
+	}
+	got, err := repo.GetSubscription(ctx, subscription.Id)
+	if err != nil || got.AutoRenew || got.Quantity != 3 {
+		t.Fatalf("GetSubscription: got %+v, %v", got, err)
+	}
+
+	beneficiary := &models.Subscription{Id: newId(), BeneficiaryOid: admin, BeneficiaryTid: newId()}
+	if err := repo.SaveSubscription(ctx, beneficiary); err != nil {
+		t.Fatalf("SaveSubscription: %v", err)
+	}
+	if err := repo.SaveSubscription(ctx, &models.Subscription{Id: newId(), PurchaserOid: newId()}); err != nil {
+		t.Fatalf("SaveSubscription: %v", err)
+	}
+
+	all, err := repo.ListSubscriptions(ctx)
+	if err != nil || !containsSubscription(all, subscription.Id) || !containsSubscription(all, beneficiary.Id) {
+		t.Fatalf("ListSubscriptions: got %v, %v", all, err)
+	}
+
+	subscriptions, err := repo.ListAdminSubscriptions(ctx, admin)
+	if err != nil || len(subscriptions) != 2 {
+		t.Fatalf("ListAdminSubscriptions: got %d, %v", len(subscriptions), err)
+	}
+	subscriptions, err = repo.ListAdminSubscriptionsForTenant(ctx, admin, tid)
+	if err != nil || len(subscriptions) != 1 || subscriptions[0].Id != subscription.Id {
+		t.Fatalf("ListAdminSubscriptionsForTenant: got %v, %v", subscriptions, err)
+	}
+}
+
+func TestSubscriptionLifecycle(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	tid := newId()
+	now := time.Now()
+
+	subscription := &models.Subscription{Id: newId(), BeneficiaryTid: tid, Quantity: 2}
+	if err := repo.SaveSubscription(ctx, subscription); err != nil {
+		t.Fatalf("SaveSubscription: %v", err)
+	}
+	user := createTestUser(t, repo, tid)
+	if err := repo.SetUserSubscription(ctx, user.Oid, subscription.Id); err != nil {
+		t.Fatalf("SetUserSubscription: %v", err)
+	}
+
+	// local lifecycle fields survive a sync from the Marketplace
+	err := repo.UpdateSubscription(ctx, subscription.Id, map[string]interface{}{
+		"suspended_at":  now.Add(-2 * time.Hour),
+		"grace_ends_at": now.Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("UpdateSubscription: %v", err)
+	}
+	subscription.Quantity = 3
+	if err := repo.SaveSubscription(ctx, subscription); err != nil {
+		t.Fatalf("SaveSubscription: %v", err)
+	}
+	got, err := repo.GetSubscription(ctx, subscription.Id)
+	if err != nil || got.Quantity != 3 || got.SuspendedAt.IsZero() || got.GraceEndsAt.IsZero() {
+		t.Fatalf("GetSubscription after sync: got %+v, %v", got, err)
+	}
+
+	pastGrace, err := repo.ListSubscriptionsPastGrace(ctx, now)
+	if err != nil || !containsSubscription(pastGrace, subscription.Id) {
+		t.Fatalf("ListSubscriptionsPastGrace: got %v, %v", pastGrace, err)
+	}
+	// rows from before access_revoked_at was added have it NULL
+	if err := repo.db.Exec("UPDATE subscriptions SET access_revoked_at = NULL WHERE id = ?", subscription.Id).Error; err != nil {
+		t.Fatal(err)
+	}
+	pastGrace, err = repo.ListSubscriptionsPastGrace(ctx, now)
+	if err != nil || !containsSubscription(pastGrace, subscription.Id) {
+		t.Fatalf("ListSubscriptionsPastGrace with NULL access_revoked_at: got %v, %v", pastGrace, err)
+	}
+	repo.UpdateSubscription(ctx, subscription.Id, map[string]interface{}{"access_revoked_at": now})
+	pastGrace, err = repo.ListSubscriptionsPastGrace(ctx, now)
+	if err != nil || containsSubscription(pastGrace, subscription.Id) {
+		t.Fatalf("ListSubscriptionsPastGrace after revoking: got %v, %v", pastGrace, err)
+	}
+
+	users, err := repo.ListSubscriptionUsers(ctx, subscription.Id)
+	if err != nil || len(users) != 1 || users[0].Oid != user.Oid {
+		t.Fatalf("ListSubscriptionUsers: got %v, %v", users, err)
+	}
+	cleared, err := repo.UnassignSubscriptionUsers(ctx, subscription.Id)
+	if err != nil || cleared != 1 {
+		t.Fatalf("UnassignSubscriptionUsers: got %d, %v", cleared, err)
+	}
+	if count, _ := repo.CountSubscriptionUsers(ctx, subscription.Id); count != 0 {
+		t.Fatalf("expected no users after unassigning, got %d", count)
+	}
+
+	if err := repo.UpdateSubscription(ctx, newId(), map[string]interface{}{"unsubscribed_at": now}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("UpdateSubscription missing: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSeatOverage(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	tid := newId()
+	now := time.Now()
+
+	subscription := &models.Subscription{Id: newId(), BeneficiaryTid: tid, Quantity: 1}
+	if err := repo.SaveSubscription(ctx, subscription); err != nil {
+		t.Fatalf("SaveSubscription: %v", err)
+	}
+
+	// settings default until saved
+	settings, err := repo.GetSubscriptionSettings(ctx, subscription.Id)
+	if err != nil || settings.OverAllocationPolicy != models.OverAllocationPolicyEnumUnassign {
+		t.Fatalf("GetSubscriptionSettings default: got %+v, %v", settings, err)
+	}
+	settings.OverAllocationPolicy = models.OverAllocationPolicyEnumReject
+	settings.OverAllocationNoticeDays = 0
+	if err := repo.SaveSubscriptionSettings(ctx, settings); err != nil {
+		t.Fatalf("SaveSubscriptionSettings insert: %v", err)
+	}
+	settings.OverAllocationNoticeDays = 3
+	if err := repo.SaveSubscriptionSettings(ctx, settings); err != nil {
+		t.Fatalf("SaveSubscriptionSettings update: %v", err)
+	}
+	settings, err = repo.GetSubscriptionSettings(ctx, subscription.Id)
+	if err != nil || settings.OverAllocationPolicy != models.OverAllocationPolicyEnumReject || settings.OverAllocationNoticeDays != 3 {
+		t.Fatalf("GetSubscriptionSettings: got %+v, %v", settings, err)
+	}
+
+	// least recently active users come first
+	active := createTestUser(t, repo, tid)
+	idle := createTestUser(t, repo, tid)
+	for _, user := range []*models.TenantUser{active, idle} {
+		if err := repo.SetUserSubscription(ctx, user.Oid, subscription.Id); err != nil {
+			t.Fatalf("SetUserSubscription: %v", err)
+		}
+	}
+	repo.UpdateUser(ctx, active.Oid, map[string]interface{}{"last_active_at": now})
+	repo.UpdateUser(ctx, idle.Oid, map[string]interface{}{"last_active_at": now.Add(-time.Hour)})
+	users, err := repo.ListLeastRecentlyActiveSubscriptionUsers(ctx, subscription.Id, 1)
+	if err != nil || len(users) != 1 || users[0].Oid != idle.Oid {
+		t.Fatalf("ListLeastRecentlyActiveSubscriptionUsers: got %v, %v", users, err)
+	}
+
+	repo.UpdateSubscription(ctx, subscription.Id, map[string]interface{}{
+		"over_allocated_at":           now.Add(-time.Hour),
+		"over_allocation_unassign_at": now.Add(-time.Minute),
+	})
+	due, err := repo.ListSubscriptionsDueForUnassign(ctx, now)
+	if err != nil || !containsSubscription(due, subscription.Id) {
+		t.Fatalf("ListSubscriptionsDueForUnassign: got %v, %v", due, err)
+	}
+
+	// only users still assigned to the subscription are unassigned
+	cleared, err := repo.UnassignUsers(ctx, subscription.Id, []string{idle.Oid, newId()})
+	if err != nil || cleared != 1 {
+		t.Fatalf("UnassignUsers: got %d, %v", cleared, err)
+	}
+	if count, _ := repo.CountSubscriptionUsers(ctx, subscription.Id); count != 1 {
+		t.Fatalf("expected 1 user left, got %d", count)
+	}
+}
+
+func containsSubscription(subscriptions []models.Subscription, id string) bool {
+	for _, subscription := range subscriptions {
+		if subscription.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTransactionRollback(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+
+	oid := newId()
+	rollback := errors.New("rollback")
+	err := repo.Transaction(ctx, func(tx *Repository) error {
+		if err := tx.CreateUser(ctx, &models.TenantUser{Oid: oid, Tid: newId()}); err != nil {
+			return err
+		}
+		return rollback
+	})
+	if !errors.Is(err, rollback) {
+		t.Fatalf("Transaction: expected rollback error, got %v", err)
+	}
+	if _, err := repo.GetUser(ctx, oid); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("user created in rolled back transaction: %v", err)
+	}
+}
+
+func TestMarketplaceOperations(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	operation := &models.MarketplaceOperation{
+		Id:             newId(),
+		SubscriptionId: newId(),
+		Action:         "Suspend",
+		Status:         models.MarketplaceOperationStatusEnumPending,
+		NextAttemptAt:  now.Add(-time.Minute),
+	}
+	created, err := repo.CreateMarketplaceOperation(ctx, operation)
+	if err != nil || !created {
+		t.Fatalf("CreateMarketplaceOperation: got %v, %v", created, err)
+	}
+
+	// a webhook retry is deduped
+	retry := *operation
+	created, err = repo.CreateMarketplaceOperation(ctx, &retry)
+	if err != nil || created {
+		t.Fatalf("CreateMarketplaceOperation retry: got %v, %v", created, err)
+	}
+
+	// not due yet
+	later := &models.MarketplaceOperation{
+		Id:             newId(),
+		SubscriptionId: operation.SubscriptionId,
+		Status:         models.MarketplaceOperationStatusEnumPending,
+		NextAttemptAt:  now.Add(time.Hour),
+	}
+	if _, err := repo.CreateMarketplaceOperation(ctx, later); err != nil {
+		t.Fatalf("CreateMarketplaceOperation: %v", err)
+	}
+
+	// while one transaction holds the due operation, another can't get it
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- repo.Transaction(ctx, func(tx *Repository) error {
+			got, err := tx.LockNextDueMarketplaceOperation(ctx, now)
+			if err != nil {
+				close(locked)
+				return err
+			}
+			if got.Id != operation.Id {
+				t.Errorf("locked %s, expected %s", got.Id, operation.Id)
+			}
+			close(locked)
+			<-release
+			got.Status = models.MarketplaceOperationStatusEnumSucceeded
+			return tx.SaveMarketplaceOperation(ctx, got)
+		})
+	}()
+	<-locked
+	err = repo.Transaction(ctx, func(tx *Repository) error {
+		_, err := tx.LockNextDueMarketplaceOperation(ctx, now)
+		return err
+	})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected locked operation to be skipped, got %v", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Transaction: %v", err)
+	}
+
+	got, err := repo.GetMarketplaceOperation(ctx, operation.Id)
+	if err != nil || got.Status != models.MarketplaceOperationStatusEnumSucceeded {
+		t.Fatalf("GetMarketplaceOperation: got %+v, %v", got, err)
+	}
+	operations, err := repo.ListMarketplaceOperations(ctx, operation.SubscriptionId)
+	if err != nil || len(operations) != 2 {
+		t.Fatalf("ListMarketplaceOperations: got %d, %v", len(operations), err)
+	}
+}
+
+func TestSubscriptionActivations(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	if _, err := repo.GetSubscriptionActivation(ctx, newId()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetSubscriptionActivation missing: expected ErrNotFound, got %v", err)
+	}
+
+	activation := &models.SubscriptionActivation{
+		SubscriptionId: newId(),
+		RequestedBy:    newId(),
+		Status:         models.SubscriptionActivationEnumPending,
+		NextAttemptAt:  now.Add(-time.Second),
+	}
+	if err := repo.SaveSubscriptionActivation(ctx, activation); err != nil {
+		t.Fatalf("SaveSubscriptionActivation insert: %v", err)
+	}
+
+	err := repo.Transaction(ctx, func(tx *Repository) error {
+		got, err := tx.LockNextDueSubscriptionActivation(ctx, now)
+		if err != nil {
+			return err
+		}
+		if got.SubscriptionId != activation.SubscriptionId {
+			t.Errorf("locked %s, expected %s", got.SubscriptionId, activation.SubscriptionId)
+		}
+		got.Status = models.SubscriptionActivationEnumActive
+		return tx.SaveSubscriptionActivation(ctx, got)
+	})
+	if err != nil {
+		t.Fatalf("Transaction: %v", err)
+	}
+
+	got, err := repo.GetSubscriptionActivation(ctx, activation.SubscriptionId)
+	if err != nil || got.Status != models.SubscriptionActivationEnumActive || got.RequestedBy != activation.RequestedBy {
+		t.Fatalf("GetSubscriptionActivation: got %+v, %v", got, err)
+	}
+	if _, err := repo.LockNextDueSubscriptionActivation(ctx, now); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected no due activation, got %v", err)
+	}
+
+	// a second activation of the same subscription isn't recorded
+	created, err := repo.CreateSubscriptionActivation(ctx, &models.SubscriptionActivation{SubscriptionId: activation.SubscriptionId, RequestedBy: newId()})
+	if err != nil || created {
+		t.Fatalf("CreateSubscriptionActivation existing: created %v, %v", created, err)
+	}
+
+	// only a failed activation is retried, and keeps its history
+	if retried, err := repo.RetrySubscriptionActivation(ctx, activation.SubscriptionId, now); err != nil || retried {
+		t.Fatalf("RetrySubscriptionActivation active: retried %v, %v", retried, err)
+	}
+	failed := &models.SubscriptionActivation{
+		SubscriptionId: newId(),
+		RequestedBy:    newId(),
+		Status:         models.SubscriptionActivationEnumFailed,
+		Attempts:       3,
+		LastError:      "marketplace down",
+		ActivatedAt:    now.Add(-time.Hour),
+		CompletedAt:    now.Add(-time.Minute),
+	}
+	if created, err := repo.CreateSubscriptionActivation(ctx, failed); err != nil || !created {
+		t.Fatalf("CreateSubscriptionActivation: created %v, %v", created, err)
+	}
+	if retried, err := repo.RetrySubscriptionActivation(ctx, failed.SubscriptionId, now); err != nil || !retried {
+		t.Fatalf("RetrySubscriptionActivation failed: retried %v, %v", retried, err)
+	}
+	got, err = repo.GetSubscriptionActivation(ctx, failed.SubscriptionId)
+	if err != nil {
+		t.Fatalf("GetSubscriptionActivation: %v", err)
+	}
+	if got.Status != models.SubscriptionActivationEnumPending || got.Attempts != 0 || got.LastError != "" || !got.CompletedAt.IsZero() {
+		t.Fatalf("retried activation: %+v", got)
+	}
+	if got.RequestedBy != failed.RequestedBy || !got.ActivatedAt.Equal(failed.ActivatedAt) || !got.CreatedAt.Equal(failed.CreatedAt) {
+		t.Fatalf("retried activation lost its history: %+v", got)
+	}
+}
+
+func TestLedger(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	subscriptionId := newId()
+
+	if err := repo.CreateLedgerEntries(ctx, nil); err != nil {
+		t.Fatalf("CreateLedgerEntries with no entries: %v", err)
+	}
+	entries := []models.SubscriptionLedgerEntry{}
+	for i := 0; i < 3; i++ {
+		entries = append(entries, models.SubscriptionLedgerEntry{
+			SubscriptionId: subscriptionId,
+			Event:          models.LedgerEventEnumSeatAssigned,
+			Operation:      "AssignSeat",
+			Actor:          newId(),
+			UserOid:        newId(),
+		})
+	}
+	if err := repo.CreateLedgerEntries(ctx, entries); err != nil {
+		t.Fatalf("CreateLedgerEntries: %v", err)
+	}
+	other := []models.SubscriptionLedgerEntry{{SubscriptionId: newId(), Event: models.LedgerEventEnumSubscriptionChanged}}
+	if err := repo.CreateLedgerEntries(ctx, other); err != nil {
+		t.Fatalf("CreateLedgerEntries: %v", err)
+	}
+
+	got, err := repo.ListLedgerEntries(ctx, subscriptionId, 0, 10)
+	if err != nil || len(got) != 3 {
+		t.Fatalf("ListLedgerEntries: got %d, %v", len(got), err)
+	}
+	if got[0].UserOid != entries[2].UserOid || got[2].UserOid != entries[0].UserOid {
+		t.Fatalf("ListLedgerEntries: not newest first: %+v", got)
+	}
+	page, err := repo.ListLedgerEntries(ctx, subscriptionId, got[0].Id, 1)
+	if err != nil || len(page) != 1 || page[0].Id != got[1].Id {
+		t.Fatalf("ListLedgerEntries before %d: got %+v, %v", got[0].Id, page, err)
+	}
+}
+
+func TestAssignUsers(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	tid := newId()
+	subscriptionId := newId()
+	alice := createTestUser(t, repo, tid)
+	bob := createTestUser(t, repo, tid)
+	stranger := createTestUser(t, repo, newId())
+	if err := repo.UpdateUser(ctx, bob.Oid, map[string]interface{}{"email": "Bob@Example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := repo.ListTenantUsersByOids(ctx, tid, []string{alice.Oid, stranger.Oid, newId()})
+	if err != nil || len(users) != 1 || users[0].Oid != alice.Oid {
+		t.Fatalf("ListTenantUsersByOids: got %+v, %v", users, err)
+	}
+	users, err = repo.ListTenantUsersByEmails(ctx, tid, []string{"bob@example.COM"})
+	if err != nil || len(users) != 1 || users[0].Oid != bob.Oid {
+		t.Fatalf("ListTenantUsersByEmails: got %+v, %v", users, err)
+	}
+	if users, err := repo.ListTenantUsersByEmails(ctx, tid, nil); err != nil || len(users) != 0 {
+		t.Fatalf("ListTenantUsersByEmails with no emails: got %+v, %v", users, err)
+	}
+
+	if err := repo.SaveSubscription(ctx, &models.Subscription{Id: subscriptionId, Quantity: 2}); err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Transaction(ctx, func(tx *Repository) error {
+		subscription, err := tx.LockSubscription(ctx, subscriptionId)
+		if err != nil || subscription.Quantity != 2 {
+			t.Errorf("LockSubscription: got %+v, %v", subscription, err)
+		}
+		assigned, err := tx.AssignUsers(ctx, subscriptionId, []string{alice.Oid, bob.Oid})
+		if assigned != 2 {
+			t.Errorf("AssignUsers: %d assigned", assigned)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Transaction: %v", err)
+	}
+	if count, err := repo.CountSubscriptionUsers(ctx, subscriptionId); err != nil || count != 2 {
+		t.Fatalf("CountSubscriptionUsers: got %d, %v", count, err)
+	}
+	if _, err := repo.LockSubscription(ctx, newId()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("LockSubscription missing: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestAutoAssign(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	tid := newId()
+	subscription := &models.Subscription{Id: newId(), BeneficiaryTid: tid, Quantity: 10}
+	if err := repo.SaveSubscription(ctx, subscription); err != nil {
+		t.Fatalf("SaveSubscription: %v", err)
+	}
+	if subscriptions, err := repo.ListTenantSubscriptions(ctx, tid); err != nil || len(subscriptions) != 1 {
+		t.Fatalf("ListTenantSubscriptions: got %+v, %v", subscriptions, err)
+	}
+
+	oldUser := createTestUser(t, repo, tid)
+	team := createTestTeam(t, repo, tid)
+	member := createTestUser(t, repo, tid)
+	if err := repo.AddTeamMember(ctx, team.Id, member.Oid); err != nil {
+		t.Fatal(err)
+	}
+	since := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	newUser := createTestUser(t, repo, tid)
+	unassigned := createTestUser(t, repo, tid)
+	createTestUser(t, repo, newId()) // another tenant
+
+	// settings with teams round trip
+	settings := models.DefaultSubscriptionSettings(subscription.Id)
+	settings.AutoAssignNewUsers = true
+	settings.AutoAssignNewUsersAt = since
+	settings.AutoAssignTeamIds = []string{team.Id}
+	if err := repo.SaveSubscriptionSettings(ctx, settings); err != nil {
+		t.Fatalf("SaveSubscriptionSettings: %v", err)
+	}
+	got, err := repo.GetSubscriptionSettings(ctx, subscription.Id)
+	if err != nil || !got.AutoAssignNewUsers || len(got.AutoAssignTeamIds) != 1 || got.AutoAssignTeamIds[0] != team.Id {
+		t.Fatalf("GetSubscriptionSettings: got %+v, %v", got, err)
+	}
+	all, err := repo.ListAutoAssignSettings(ctx)
+	if err != nil {
+		t.Fatalf("ListAutoAssignSettings: %v", err)
+	}
+	listed := false
+	for _, s := range all {
+		listed = listed || (s.SubscriptionId == subscription.Id && len(s.AutoAssignTeamIds) == 1)
+	}
+	if !listed {
+		t.Fatalf("ListAutoAssignSettings: %s not listed", subscription.Id)
+	}
+
+	// a user unassigned before is left out
+	err = repo.CreateLedgerEntries(ctx, []models.SubscriptionLedgerEntry{{
+		SubscriptionId: subscription.Id,
+		Event:          models.LedgerEventEnumSeatUnassigned,
+		UserOid:        unassigned.Oid,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if was, err := repo.WasUnassigned(ctx, subscription.Id, unassigned.Oid); err != nil || !was {
+		t.Fatalf("WasUnassigned: got %v, %v", was, err)
+	}
+	if was, err := repo.WasUnassigned(ctx, subscription.Id, newUser.Oid); err != nil || was {
+		t.Fatalf("WasUnassigned for a user never unassigned: got %v, %v", was, err)
+	}
+
+	candidates, err := repo.ListAutoAssignCandidates(ctx, subscription.Id, tid, since, []string{team.Id}, 10)
+	if err != nil {
+		t.Fatalf("ListAutoAssignCandidates: %v", err)
+	}
+	oids := []string{}
+	for _, user := range candidates {
+		oids = append(oids, user.Oid)
+	}
+	if fmt.Sprint(oids) != fmt.Sprint([]string{member.Oid, newUser.Oid}) {
+		t.Fatalf("ListAutoAssignCandidates: got %v, want the member then the new user (not %s)", oids, oldUser.Oid)
+	}
+
+	// only unassigned users; no policy covers nobody
+	if err := repo.SetUserSubscription(ctx, member.Oid, subscription.Id); err != nil {
+		t.Fatal(err)
+	}
+	candidates, err = repo.ListAutoAssignCandidates(ctx, subscription.Id, tid, time.Time{}, []string{team.Id}, 10)
+	if err != nil || len(candidates) != 0 {
+		t.Fatalf("ListAutoAssignCandidates after assigning the member: got %+v, %v", candidates, err)
+	}
+	candidates, err = repo.ListAutoAssignCandidates(ctx, subscription.Id, tid, time.Time{}, nil, 10)
+	if err != nil || len(candidates) != 0 {
+		t.Fatalf("ListAutoAssignCandidates without a policy: got %+v, %v", candidates, err)
+	}
+
+	// replacing the teams
+	settings.AutoAssignTeamIds = nil
+	if err := repo.SaveSubscriptionSettings(ctx, settings); err != nil {
+		t.Fatalf("SaveSubscriptionSettings: %v", err)
+	}
+	if got, err := repo.GetSubscriptionSettings(ctx, subscription.Id); err != nil || len(got.AutoAssignTeamIds) != 0 {
+		t.Fatalf("GetSubscriptionSettings after clearing teams: got %+v, %v", got, err)
+	}
+}
+
+func TestSeatRequests(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	tid := newId()
+	oid := newId()
+
+	if _, err := repo.GetLatestSeatRequest(ctx, oid); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetLatestSeatRequest with none: %v", err)
+	}
+	denied := &models.SeatRequest{Oid: oid, Tid: tid, Status: models.SeatRequestStatusEnumDenied}
+	if err := repo.CreateSeatRequest(ctx, denied); err != nil {
+		t.Fatalf("CreateSeatRequest: %v", err)
+	}
+	pending := &models.SeatRequest{Oid: oid, Tid: tid, Status: models.SeatRequestStatusEnumPending}
+	if err := repo.CreateSeatRequest(ctx, pending); err != nil {
+		t.Fatalf("CreateSeatRequest: %v", err)
+	}
+	if err := repo.CreateSeatRequest(ctx, &models.SeatRequest{Oid: newId(), Tid: newId(), Status: models.SeatRequestStatusEnumPending}); err != nil {
+		t.Fatalf("CreateSeatRequest: %v", err)
+	}
+
+	latest, err := repo.GetLatestSeatRequest(ctx, oid)
+	if err != nil || latest.Id != pending.Id {
+		t.Fatalf("GetLatestSeatRequest: got %+v, %v", latest, err)
+	}
+	list, err := repo.ListSeatRequests(ctx, tid, models.SeatRequestStatusEnumPending)
+	if err != nil || len(list) != 1 || list[0].Id != pending.Id {
+		t.Fatalf("ListSeatRequests: got %+v, %v", list, err)
+	}
+
+	err = repo.Transaction(ctx, func(tx *Repository) error {
+		locked, err := tx.LockSeatRequest(ctx, pending.Id)
+		if err != nil {
+			return err
+		}
+		locked.Status = models.SeatRequestStatusEnumApproved
+		return tx.SaveSeatRequest(ctx, locked)
+	})
+	if err != nil {
+		t.Fatalf("LockSeatRequest and SaveSeatRequest: %v", err)
+	}
+	if list, _ := repo.ListSeatRequests(ctx, tid, models.SeatRequestStatusEnumPending); len(list) != 0 {
+		t.Fatalf("approved request still pending: %+v", list)
+	}
+	if _, err := repo.LockSeatRequest(ctx, 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("LockSeatRequest missing: %v", err)
+	}
+}
+
+func TestLockTenantUsers(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	tid := newId()
+	alice := createTestUser(t, repo, tid)
+	bob := createTestUser(t, repo, tid)
+	createTestUser(t, repo, newId()) // another tenant
+
+	if users, err := repo.LockTenantUsers(ctx, tid, nil); err != nil || len(users) != 0 {
+		t.Fatalf("LockTenantUsers with no oids: got %+v, %v", users, err)
+	}
+
+	// a second transaction waits for the lock, then reads the committed row
+	locked := make(chan struct{})
+	done := make(chan string)
+	go func() {
+		<-locked
+		repo.Transaction(ctx, func(tx *Repository) error {
+			users, err := tx.LockTenantUsers(ctx, tid, []string{alice.Oid})
+			if err != nil || len(users) != 1 {
+				t.Errorf("LockTenantUsers: got %+v, %v", users, err)
+				done <- ""
+				return err
+			}
+			done <- users[0].SubscriptionId
+			return nil
+		})
+	}()
+	err := repo.Transaction(ctx, func(tx *Repository) error {
+		users, err := tx.LockTenantUsers(ctx, tid, []string{bob.Oid, alice.Oid})
+		if err != nil || len(users) != 2 || users[0].Oid > users[1].Oid {
+			t.Errorf("LockTenantUsers: got %+v, %v", users, err)
+		}
+		close(locked)
+		time.Sleep(100 * time.Millisecond)
+		return tx.SetUserSubscription(ctx, alice.Oid, "sub")
+	})
+	if err != nil {
+		t.Fatalf("Transaction: %v", err)
+	}
+	if subscriptionId := <-done; subscriptionId != "sub" {
+		t.Fatalf("second transaction read %q, want the committed sub", subscriptionId)
+	}
+}
+
+func TestSubscriptionAdmins(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	tid := newId()
+	owner := createTestUser(t, repo, tid)
+	delegate := createTestUser(t, repo, tid)
+	subscription := &models.Subscription{Id: newId(), PurchaserOid: owner.Oid, BeneficiaryOid: owner.Oid, BeneficiaryTid: tid}
+	if err := repo.SaveSubscription(ctx, subscription); err != nil {
+		t.Fatalf("SaveSubscription: %v", err)
+	}
+
+	if subscriptions, err := repo.ListAdminSubscriptions(ctx, delegate.Oid); err != nil || len(subscriptions) != 0 {
+		t.Fatalf("ListAdminSubscriptions before grant: got %+v, %v", subscriptions, err)
+	}
+	admin := &models.SubscriptionAdmin{SubscriptionId: subscription.Id, Oid: delegate.Oid, Tid: tid, GrantedBy: owner.Oid}
+	if granted, err := repo.CreateSubscriptionAdmin(ctx, admin); err != nil || !granted {
+		t.Fatalf("CreateSubscriptionAdmin: %v, %v", granted, err)
+	}
+	if granted, err := repo.CreateSubscriptionAdmin(ctx, admin); err != nil || granted {
+		t.Fatalf("CreateSubscriptionAdmin again: %v, %v", granted, err)
+	}
+
+	if isAdmin, err := repo.IsSubscriptionAdmin(ctx, subscription.Id, delegate.Oid); err != nil || !isAdmin {
+		t.Fatalf("IsSubscriptionAdmin: %v, %v", isAdmin, err)
+	}
+	if subscriptions, err := repo.ListAdminSubscriptions(ctx, delegate.Oid); err != nil || len(subscriptions) != 1 {
+		t.Fatalf("ListAdminSubscriptions: got %+v, %v", subscriptions, err)
+	}
+	if subscriptions, err := repo.ListAdminSubscriptionsForTenant(ctx, delegate.Oid, tid); err != nil || len(subscriptions) != 1 {
+		t.Fatalf("ListAdminSubscriptionsForTenant: got %+v, %v", subscriptions, err)
+	}
+	if subscriptions, err := repo.ListAdminSubscriptionsForTenant(ctx, delegate.Oid, newId()); err != nil || len(subscriptions) != 0 {
+		t.Fatalf("ListAdminSubscriptionsForTenant of another tenant: got %+v, %v", subscriptions, err)
+	}
+	if admins, err := repo.ListSubscriptionAdmins(ctx, []string{subscription.Id}); err != nil || len(admins) != 1 {
+		t.Fatalf("ListSubscriptionAdmins: got %+v, %v", admins, err)
+	}
+
+	if err := repo.DeleteSubscriptionAdmin(ctx, subscription.Id, delegate.Oid); err != nil {
+		t.Fatalf("DeleteSubscriptionAdmin: %v", err)
+	}
+	if err := repo.DeleteSubscriptionAdmin(ctx, subscription.Id, delegate.Oid); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("DeleteSubscriptionAdmin again: expected ErrNotFound, got %v", err)
+	}
+	if subscriptions, err := repo.ListAdminSubscriptions(ctx, delegate.Oid); err != nil || len(subscriptions) != 0 {
+		t.Fatalf("ListAdminSubscriptions after revoke: got %+v, %v", subscriptions, err)
+	}
+}
+
+func TestTrials(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	now := time.Now()
+	tid := newId()
+	trial := func(expiresAt time.Time, updates map[string]interface{}) *models.TenantUser {
+		user := createTestUser(t, repo, tid)
+		updates["trial_activated"] = true
+		updates["trial_started_at"] = expiresAt.Add(-30 * 24 * time.Hour)
+		updates["trial_expires_at"] = expiresAt
+		if err := repo.UpdateUser(ctx, user.Oid, updates); err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	ending := trial(now.Add(3*24*time.Hour), map[string]interface{}{})
+	reminded := trial(now.Add(-time.Hour), map[string]interface{}{"trial_reminder": models.TrialReminderEnumExpired})
+	seated := trial(now.Add(time.Hour), map[string]interface{}{"subscription_id": "sub"})
+	later := trial(now.Add(20*24*time.Hour), map[string]interface{}{})
+	legacy := trial(now.Add(2*24*time.Hour), map[string]interface{}{})
+	if err := repo.db.Exec("UPDATE tenant_users SET trial_reminder = NULL WHERE oid = ?", legacy.Oid).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := repo.ListTrialsEndingBetween(ctx, now.Add(-7*24*time.Hour), now.Add(7*24*time.Hour))
+	if err != nil {
+		t.Fatalf("ListTrialsEndingBetween: %v", err)
+	}
+	got := map[string]bool{}
+	for _, user := range users {
+		got[user.Oid] = true
+	}
+	if !got[ending.Oid] || !got[legacy.Oid] || got[reminded.Oid] || got[seated.Oid] || got[later.Oid] {
+		t.Fatalf("ListTrialsEndingBetween: got %+v", users)
+	}
+
+	// each reminder is claimed once, also from NULL
+	if claimed, err := repo.AdvanceTrialReminder(ctx, legacy.Oid, models.TrialReminderEnumNone, models.TrialReminderEnumSevenDays); err != nil || !claimed {
+		t.Fatalf("AdvanceTrialReminder: %v, %v", claimed, err)
+	}
+	if claimed, err := repo.AdvanceTrialReminder(ctx, legacy.Oid, models.TrialReminderEnumNone, models.TrialReminderEnumSevenDays); err != nil || claimed {
+		t.Fatalf("AdvanceTrialReminder again: %v, %v", claimed, err)
+	}
+
+	users, err = repo.ListTrialUsersSince(ctx, now.Add(-20*24*time.Hour))
+	if err != nil {
+		t.Fatalf("ListTrialUsersSince: %v", err)
+	}
+	got = map[string]bool{}
+	for _, user := range users {
+		got[user.Oid] = true
+	}
+	if !got[ending.Oid] || !got[later.Oid] {
+		t.Fatalf("ListTrialUsersSince: got %+v", users)
+	}
+
+	extension := &models.TrialExtension{Oid: ending.Oid, Days: 7, GrantedBy: newId()}
+	if err := repo.CreateTrialExtension(ctx, extension); err != nil {
+		t.Fatalf("CreateTrialExtension: %v", err)
+	}
+	if extensions, err := repo.ListTrialExtensions(ctx, []string{ending.Oid, later.Oid}); err != nil || len(extensions) != 1 || extensions[0].Days != 7 {
+		t.Fatalf("ListTrialExtensions: got %+v, %v", extensions, err)
+	}
+
+	entries := []models.SubscriptionLedgerEntry{
+		{SubscriptionId: newId(), Event: models.LedgerEventEnumSeatAssigned, UserOid: ending.Oid},
+		{SubscriptionId: newId(), Event: models.LedgerEventEnumSeatUnassigned, UserOid: ending.Oid},
+	}
+	if err := repo.CreateLedgerEntries(ctx, entries); err != nil {
+		t.Fatal(err)
+	}
+	if seats, err := repo.ListSeatAssignments(ctx, []string{ending.Oid}); err != nil || len(seats) != 1 || seats[0].SubscriptionId != entries[0].SubscriptionId {
+		t.Fatalf("ListSeatAssignments: got %+v, %v", seats, err)
+	}
+
+	subscription := &models.Subscription{Id: newId(), BeneficiaryTid: tid}
+	if err := repo.SaveSubscription(ctx, subscription); err != nil {
+		t.Fatal(err)
+	}
+	if subscriptions, err := repo.ListSubscriptionsForTenants(ctx, []string{tid, newId()}); err != nil || len(subscriptions) != 1 {
+		t.Fatalf("ListSubscriptionsForTenants: got %+v, %v", subscriptions, err)
+	}
+}
+
+func TestTenantTrials(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	now := time.Now()
+	tid := newId()
+
+	if _, err := repo.GetTenantTrial(ctx, tid); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetTenantTrial before start: %v", err)
+	}
+	first := &models.TenantTrial{Tid: tid, StartedBy: newId(), StartedAt: now, ExpiresAt: now.Add(3 * 24 * time.Hour)}
+	if created, err := repo.CreateTenantTrial(ctx, first); err != nil || !created {
+		t.Fatalf("CreateTenantTrial: %v, %v", created, err)
+	}
+	second := &models.TenantTrial{Tid: tid, StartedBy: newId(), StartedAt: now, ExpiresAt: now.Add(30 * 24 * time.Hour)}
+	if created, err := repo.CreateTenantTrial(ctx, second); err != nil || created {
+		t.Fatalf("CreateTenantTrial again: %v, %v", created, err)
+	}
+	if trial, err := repo.GetTenantTrial(ctx, tid); err != nil || trial.StartedBy != first.StartedBy {
+		t.Fatalf("GetTenantTrial: got %+v, %v", trial, err)
+	}
+
+	ending := func() bool {
+		trials, err := repo.ListTenantTrialsEndingBetween(ctx, now.Add(-7*24*time.Hour), now.Add(7*24*time.Hour))
+		if err != nil {
+			t.Fatalf("ListTenantTrialsEndingBetween: %v", err)
+		}
+		for _, trial := range trials {
+			if trial.Tid == tid {
+				return true
+			}
+		}
+		return false
+	}
+	if !ending() {
+		t.Fatal("ListTenantTrialsEndingBetween: trial missing")
+	}
+	if claimed, err := repo.AdvanceTenantTrialReminder(ctx, tid, models.TrialReminderEnumNone, models.TrialReminderEnumExpired); err != nil || !claimed {
+		t.Fatalf("AdvanceTenantTrialReminder: %v, %v", claimed, err)
+	}
+	if claimed, err := repo.AdvanceTenantTrialReminder(ctx, tid, models.TrialReminderEnumNone, models.TrialReminderEnumExpired); err != nil || claimed {
+		t.Fatalf("AdvanceTenantTrialReminder again: %v, %v", claimed, err)
+	}
+	if ending() {
+		t.Fatal("ListTenantTrialsEndingBetween: reminded trial listed")
+	}
+}
+
+func TestListNonRenewingSubscriptions(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	now := time.Now()
+	subscription := func(autoRenew bool, status models.SubscriptionStatusEnum, termEnd time.Time, updates map[string]interface{}) string {
+		id := newId()
+		err := repo.SaveSubscription(ctx, &models.Subscription{Id: id, AutoRenew: autoRenew, SaaSSubscriptionStatus: status, SubscriptionTermEndDate: termEnd})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(updates) > 0 {
+			if err := repo.UpdateSubscription(ctx, id, updates); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return id
+	}
+	subscribed := models.SubscriptionStatusEnumSubscribed
+	ending := subscription(false, subscribed, now.Add(24*time.Hour), nil)
+	suspended := subscription(false, models.SubscriptionStatusEnumSuspended, now.Add(-24*time.Hour), nil)
+	renewing := subscription(true, subscribed, now.Add(24*time.Hour), nil)
+	later := subscription(false, subscribed, now.Add(60*24*time.Hour), nil)
+	unsubscribed := subscription(false, models.SubscriptionStatusEnumUnsubscribed, now.Add(24*time.Hour), nil)
+	expired := subscription(false, subscribed, now.Add(-24*time.Hour), map[string]interface{}{"term_expired_at": now})
+	pending := subscription(false, models.SubscriptionStatusEnumPendingFulfillmentStart, time.Time{}, nil)
+	legacy := subscription(false, subscribed, now.Add(-24*time.Hour), nil)
+	if err := repo.db.Exec("UPDATE subscriptions SET term_expired_at = NULL WHERE id = ?", legacy).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptions, err := repo.ListNonRenewingSubscriptions(ctx, now.Add(14*24*time.Hour))
+	if err != nil {
+		t.Fatalf("ListNonRenewingSubscriptions: %v", err)
+	}
+	if !containsSubscription(subscriptions, ending) || !containsSubscription(subscriptions, suspended) ||
+		!containsSubscription(subscriptions, legacy) || containsSubscription(subscriptions, renewing) || containsSubscription(subscriptions, later) ||
+		containsSubscription(subscriptions, unsubscribed) || containsSubscription(subscriptions, expired) ||
+		containsSubscription(subscriptions, pending) {
+		t.Fatalf("ListNonRenewingSubscriptions: got %+v", subscriptions)
+	}
+
+	// the lifecycle fields survive a sync from the Marketplace
+	if err := repo.SaveSubscription(ctx, &models.Subscription{Id: expired, SaaSSubscriptionStatus: subscribed}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := repo.GetSubscription(ctx, expired); err != nil || got.TermExpiredAt.IsZero() {
+		t.Fatalf("GetSubscription after sync: got %+v, %v", got, err)
+	}
+}
+
+func TestTryAdvisoryLock(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	name := "test-" + newId()
+
+	release, locked, err := repo.TryAdvisoryLock(ctx, name)
+	if err != nil || !locked {
+		t.Fatalf("TryAdvisoryLock: %v, %v", locked, err)
+	}
+	if _, locked, err := repo.TryAdvisoryLock(ctx, name); err != nil || locked {
+		t.Fatalf("TryAdvisoryLock while held: %v, %v", locked, err)
+	}
+	release()
+	release, locked, err = repo.TryAdvisoryLock(ctx, name)
+	if err != nil || !locked {
+		t.Fatalf("TryAdvisoryLock after release: %v, %v", locked, err)
+	}
+	release()
+}
+
+func TestGetTenant(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	tid := newId()
+
+	if _, err := repo.GetTenant(ctx, tid); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetTenant missing: expected ErrNotFound, got %v", err)
+	}
+	if err := repo.db.Create(&models.Tenant{Tid: tid, DisplayName: "Contoso", DefaultDomain: "contoso.com"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	domains := []models.TenantDomain{{Tid: tid, Name: "contoso.onmicrosoft.com", IsInitial: true}, {Tid: tid, Name: "contoso.com", IsDefault: true}}
+	if err := repo.db.Create(&domains).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tenant, err := repo.GetTenant(ctx, tid)
+	if err != nil || tenant.DisplayName != "Contoso" {
+		t.Fatalf("GetTenant: got %+v, %v", tenant, err)
+	}
+	if len(tenant.VerifiedDomains) != 2 || tenant.VerifiedDomains[0].Name != "contoso.com" {
+		t.Fatalf("verified domains = %+v, want both, by name", tenant.VerifiedDomains)
+	}
+}
+
+func TestUserStatuses(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	oid := newId()
+
+	if _, err := repo.GetUserStatus(ctx, oid); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetUserStatus missing: expected ErrNotFound, got %v", err)
+	}
+	status := &models.UserStatus{Oid: oid, Availability: models.AvailabilityEnumBusy, Source: models.StatusSourceEnumTeams}
+	if err := repo.SaveUserStatus(ctx, status); err != nil {
+		t.Fatalf("SaveUserStatus insert: %v", err)
+	}
+	status = &models.UserStatus{Oid: oid, Availability: models.AvailabilityEnumAway, Message: "lunch", Source: models.StatusSourceEnumManual}
+	if err := repo.SaveUserStatus(ctx, status); err != nil {
+		t.Fatalf("SaveUserStatus replace: %v", err)
+	}
+	got, err := repo.GetUserStatus(ctx, oid)
+	if err != nil || got.Availability != models.AvailabilityEnumAway || got.Message != "lunch" {
+		t.Fatalf("GetUserStatus: got %+v, %v", got, err)
+	}
+
+	statuses, err := repo.ListUserStatuses(ctx, []string{oid, newId()})
+	if err != nil || len(statuses) != 1 {
+		t.Fatalf("ListUserStatuses: got %+v, %v", statuses, err)
+	}
+	if statuses, err := repo.ListUserStatuses(ctx, nil); err != nil || len(statuses) != 0 {
+		t.Fatalf("ListUserStatuses with no oids: got %+v, %v", statuses, err)
+	}
+
+	if err := repo.DeleteUserStatus(ctx, oid); err != nil {
+		t.Fatalf("DeleteUserStatus: %v", err)
+	}
+	if _, err := repo.GetUserStatus(ctx, oid); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetUserStatus after delete: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestPresenceSubscriptions(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	oid := newId()
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	if _, err := repo.GetPresenceSubscription(ctx, oid); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetPresenceSubscription missing: expected ErrNotFound, got %v", err)
+	}
+	if err := repo.RenewPresenceSubscription(ctx, oid, expiresAt); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("RenewPresenceSubscription missing: expected ErrNotFound, got %v", err)
+	}
+
+	subscription := &models.PresenceSubscription{Oid: oid, Tid: newId(), Id: newId(), ExpiresAt: expiresAt}
+	if err := repo.SavePresenceSubscription(ctx, subscription); err != nil {
+		t.Fatalf("SavePresenceSubscription insert: %v", err)
+	}
+	replacement := &models.PresenceSubscription{Oid: oid, Tid: subscription.Tid, Id: newId(), ExpiresAt: expiresAt}
+	if err := repo.SavePresenceSubscription(ctx, replacement); err != nil {
+		t.Fatalf("SavePresenceSubscription replace: %v", err)
+	}
+	if _, err := repo.GetPresenceSubscriptionById(ctx, subscription.Id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetPresenceSubscriptionById replaced: expected ErrNotFound, got %v", err)
+	}
+	got, err := repo.GetPresenceSubscriptionById(ctx, replacement.Id)
+	if err != nil || got.Oid != oid {
+		t.Fatalf("GetPresenceSubscriptionById: got %+v, %v", got, err)
+	}
+
+	renewed := expiresAt.Add(time.Hour)
+	if err := repo.RenewPresenceSubscription(ctx, oid, renewed); err != nil {
+		t.Fatalf("RenewPresenceSubscription: %v", err)
+	}
+	got, err = repo.GetPresenceSubscription(ctx, oid)
+	if err != nil || !got.ExpiresAt.Equal(renewed) {
+		t.Fatalf("GetPresenceSubscription after renewal: got %+v, %v", got, err)
+	}
+
+	// requesting a feed records the request and keeps the subscription
+	now := time.Now().UTC().Truncate(time.Second)
+	if err := repo.RequestPresenceSubscription(ctx, oid, subscription.Tid, now); err != nil {
+		t.Fatalf("RequestPresenceSubscription existing: %v", err)
+	}
+	got, err = repo.GetPresenceSubscription(ctx, oid)
+	if err != nil || got.Id != replacement.Id || !got.ExpiresAt.Equal(renewed) || !got.RequestedAt.Equal(now) {
+		t.Fatalf("GetPresenceSubscription after request: got %+v, %v", got, err)
+	}
+	requested := newId()
+	if err := repo.RequestPresenceSubscription(ctx, requested, newId(), now); err != nil {
+		t.Fatalf("RequestPresenceSubscription new: %v", err)
+	}
+	idle := &models.PresenceSubscription{Oid: newId(), Tid: newId(), Id: newId(), ExpiresAt: now, RequestedAt: now.Add(-2 * time.Hour)}
+	if err := repo.SavePresenceSubscription(ctx, idle); err != nil {
+		t.Fatal(err)
+	}
+
+	// due: requested recently and expiring soon, or never created
+	due, err := repo.ListPresenceSubscriptionsToRenew(ctx, now.Add(-time.Hour), now.Add(15*time.Minute))
+	if err != nil {
+		t.Fatalf("ListPresenceSubscriptionsToRenew: %v", err)
+	}
+	dueOids := map[string]bool{}
+	for _, subscription := range due {
+		dueOids[subscription.Oid] = true
+	}
+	if !dueOids[requested] || dueOids[oid] || dueOids[idle.Oid] {
+		t.Fatalf("due presence subscriptions = %v, want only %s", dueOids, requested)
+	}
+}
+
+func TestWithAdvisoryLock(t *testing.T) {
+	repo := testRepository(t)
+	ctx := context.Background()
+	name := "test-" + newId()
+
+	err := repo.WithAdvisoryLock(ctx, name, func() error {
+		if _, locked, err := repo.TryAdvisoryLock(ctx, name); err != nil || locked {
+			t.Errorf("TryAdvisoryLock while held: %v, %v", locked, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WithAdvisoryLock: %v", err)
+	}
+
+	// released when fn returns, even with an error
+	failed := errors.New("failed")
+	if err := repo.WithAdvisoryLock(ctx, name, func() error { return failed }); !errors.Is(err, failed) {
+		t.Fatalf("WithAdvisoryLock: expected fn's error, got %v", err)
+	}
+	release, locked, err := repo.TryAdvisoryLock(ctx, name)
+	if err != nil || !locked {
+		t.Fatalf("TryAdvisoryLock after WithAdvisoryLock: %v, %v", locked, err)
+	}
+	release()
+}
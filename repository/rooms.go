@@ -0,0 +1,19 @@
+package repository
+
+import (
+	"context"
+	"peachone/models"
+)
+
+func (r *Repository) CreateRoom(ctx context.Context, room *models.TeamRoom) error {
+	return r.conn(ctx).Create(room).Error
+}
+
+func (r *Repository) ListRoomsForTeam(ctx context.Context, teamId string) ([]models.TeamRoom, error) {
+	rooms := []models.TeamRoom{}
+	err := r.conn(ctx).Where("team_id = ?", teamId).Order("created_at, display_name").Find(&rooms).Error
+	if err != nil {
+		return nil, err
+	}
+	return rooms, nil
+}
@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"context"
+	"peachone/models"
+
+	"gorm.io/gorm/clause"
+)
+
+func (r *Repository) CreateSeatRequest(ctx context.Context, request *models.SeatRequest) error {
+	return r.conn(ctx).Create(request).Error
+}
+
+func (r *Repository) SaveSeatRequest(ctx context.Context, request *models.SeatRequest) error {
+	return r.conn(ctx).Save(request).Error
+}
+
+// the user's latest request, whatever its status
+func (r *Repository) GetLatestSeatRequest(ctx context.Context, oid string) (*models.SeatRequest, error) {
+	request := &models.SeatRequest{}
+	err := found(r.conn(ctx).
+		Where("oid = ?", oid).
+		Order("id DESC").
+		Limit(1).
+		Find(request))
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// lock a request until the transaction ends, so it is decided only once
+func (r *Repository) LockSeatRequest(ctx context.Context, id uint) (*models.SeatRequest, error) {
+	request := &models.SeatRequest{}
+	err := found(r.conn(ctx).
+		Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ?", id).
+		Limit(1).
+		Find(request))
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// a tenant's requests with the status, oldest first
+func (r *Repository) ListSeatRequests(ctx context.Context, tid string, status models.SeatRequestStatusEnum) ([]models.SeatRequest, error) {
+	requests := []models.SeatRequest{}
+	err := r.conn(ctx).
+		Where("tid = ? AND status = ?", tid, status).
+		Order("id").
+		Find(&requests).Error
+	if err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
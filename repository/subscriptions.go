@@ -0,0 +1,287 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"peachone/models"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+func (r *Repository) GetSubscription(ctx context.Context, id string) (*models.Subscription, error) {
+	subscription := &models.Subscription{}
+	err := found(r.conn(ctx).Where("id = ?", id).Limit(1).Find(subscription))
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// get a subscription and lock its row until the transaction ends, so seat
+// changes to it are made one at a time
+func (r *Repository) LockSubscription(ctx context.Context, id string) (*models.Subscription, error) {
+	subscription := &models.Subscription{}
+	err := found(r.conn(ctx).
+		Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ?", id).
+		Limit(1).
+		Find(subscription))
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// Subscription fields we keep ourselves, which a sync from the Marketplace must not reset
+var localSubscriptionFields = map[string]bool{
+	"SuspendedAt":     true,
+	"GraceEndsAt":     true,
+	"AccessRevokedAt": true,
+	"UnsubscribedAt":  true,
+
+	"OverAllocatedAt":          true,
+	"OverAllocationUnassignAt": true,
+	"SeatsExhaustedAt":         true,
+
+	"TermEndingNotifiedAt": true,
+	"TermExpiredAt":        true,
+	"RenewedUntil":         true,
+}
+
+var marketplaceSubscriptionColumns []string
+var marketplaceSubscriptionColumnsOnce sync.Once
+
+// columns of Subscription that come from the Marketplace
+func (r *Repository) marketplaceSubscriptionColumns() []string {
+	marketplaceSubscriptionColumnsOnce.Do(func() {
+		parsed, err := schema.Parse(&models.Subscription{}, &sync.Map{}, r.db.NamingStrategy)
+		if err != nil {
+			panic(err)
+		}
+		for _, field := range parsed.Fields {
+			if field.DBName == "" || field.PrimaryKey || localSubscriptionFields[field.Name] {
+				continue
+			}
+			marketplaceSubscriptionColumns = append(marketplaceSubscriptionColumns, field.DBName)
+		}
+	})
+	return marketplaceSubscriptionColumns
+}
+
+// Insert the subscription as synced from the Marketplace, or overwrite the
+// Marketplace fields of the stored copy with it. Lifecycle fields we keep
+// ourselves are left alone; use UpdateSubscription for those.
+func (r *Repository) SaveSubscription(ctx context.Context, subscription *models.Subscription) error {
+	return r.conn(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns(r.marketplaceSubscriptionColumns()),
+	}).Create(subscription).Error
+}
+
+// update columns of a subscription; keys are column names
+func (r *Repository) UpdateSubscription(ctx context.Context, id string, updates map[string]interface{}) error {
+	return found(r.conn(ctx).Model(&models.Subscription{}).Where("id = ?", id).Updates(updates))
+}
+
+func (r *Repository) ListSubscriptions(ctx context.Context) ([]models.Subscription, error) {
+	subscriptions := []models.Subscription{}
+	err := r.conn(ctx).Order("id").Find(&subscriptions).Error
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// suspended subscriptions whose grace period is over but whose users still
+// have access; access_revoked_at is NULL on rows from before it was added
+func (r *Repository) ListSubscriptionsPastGrace(ctx context.Context, now time.Time) ([]models.Subscription, error) {
+	subscriptions := []models.Subscription{}
+	err := r.conn(ctx).
+		Where("suspended_at > ? AND grace_ends_at <= ?", time.Time{}, now).
+		Where("access_revoked_at IS NULL OR access_revoked_at <= ?", time.Time{}).
+		Find(&subscriptions).Error
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// over-allocated subscriptions whose notice period is over
+func (r *Repository) ListSubscriptionsDueForUnassign(ctx context.Context, now time.Time) ([]models.Subscription, error) {
+	subscriptions := []models.Subscription{}
+	err := r.conn(ctx).
+		Where("over_allocation_unassign_at > ? AND over_allocation_unassign_at <= ?", time.Time{}, now).
+		Find(&subscriptions).Error
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// active subscriptions that won't auto-renew, whose term ends on or before
+// endDate and hasn't been found expired yet; term_expired_at is NULL on rows
+// from before it was added
+func (r *Repository) ListNonRenewingSubscriptions(ctx context.Context, endDate time.Time) ([]models.Subscription, error) {
+	subscriptions := []models.Subscription{}
+	err := r.conn(ctx).
+		Where("auto_renew = ?", false).
+		Where("saas_subscription_status IN ?", []models.SubscriptionStatusEnum{models.SubscriptionStatusEnumSubscribed, models.SubscriptionStatusEnumSuspended}).
+		Where("subscription_term_end_date > ? AND subscription_term_end_date <= ?", time.Time{}, endDate).
+		Where("term_expired_at IS NULL OR term_expired_at <= ?", time.Time{}).
+		Find(&subscriptions).Error
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// settings for a subscription, or the defaults if its admins never changed them
+func (r *Repository) GetSubscriptionSettings(ctx context.Context, subscriptionId string) (*models.SubscriptionSettings, error) {
+	settings := &models.SubscriptionSettings{}
+	err := found(r.conn(ctx).Where("subscription_id = ?", subscriptionId).Limit(1).Find(settings))
+	if errors.Is(err, ErrNotFound) {
+		return models.DefaultSubscriptionSettings(subscriptionId), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	settings.AutoAssignTeamIds, err = r.listAutoAssignTeamIds(ctx, subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (r *Repository) listAutoAssignTeamIds(ctx context.Context, subscriptionId string) ([]string, error) {
+	teamIds := []string{}
+	err := r.conn(ctx).Model(&models.SubscriptionAutoAssignTeam{}).
+		Where("subscription_id = ?", subscriptionId).
+		Order("team_id").
+		Pluck("team_id", &teamIds).Error
+	if err != nil {
+		return nil, err
+	}
+	return teamIds, nil
+}
+
+// insert or overwrite the settings, and replace the auto-assign teams
+func (r *Repository) SaveSubscriptionSettings(ctx context.Context, settings *models.SubscriptionSettings) error {
+	return r.Transaction(ctx, func(tx *Repository) error {
+		err := tx.conn(ctx).Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "subscription_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{
+				"over_allocation_policy",
+				"over_allocation_notice_days",
+				"auto_assign_new_users",
+				"auto_assign_new_users_at",
+				"updated_at",
+			}),
+		}).Create(settings).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.conn(ctx).Where("subscription_id = ?", settings.SubscriptionId).Delete(&models.SubscriptionAutoAssignTeam{}).Error
+		if err != nil {
+			return err
+		}
+		if len(settings.AutoAssignTeamIds) == 0 {
+			return nil
+		}
+		teams := make([]models.SubscriptionAutoAssignTeam, len(settings.AutoAssignTeamIds))
+		for i, teamId := range settings.AutoAssignTeamIds {
+			teams[i] = models.SubscriptionAutoAssignTeam{SubscriptionId: settings.SubscriptionId, TeamId: teamId}
+		}
+		return tx.conn(ctx).Create(&teams).Error
+	})
+}
+
+// settings of subscriptions that assign seats automatically
+func (r *Repository) ListAutoAssignSettings(ctx context.Context) ([]models.SubscriptionSettings, error) {
+	settings := []models.SubscriptionSettings{}
+	err := r.conn(ctx).
+		Where("auto_assign_new_users OR subscription_id IN (?)", r.conn(ctx).Model(&models.SubscriptionAutoAssignTeam{}).Select("subscription_id")).
+		Order("subscription_id").
+		Find(&settings).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range settings {
+		settings[i].AutoAssignTeamIds, err = r.listAutoAssignTeamIds(ctx, settings[i].SubscriptionId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+func (r *Repository) GetSubscriptionCancellation(ctx context.Context, subscriptionId string) (*models.SubscriptionCancellation, error) {
+	cancellation := &models.SubscriptionCancellation{}
+	err := found(r.conn(ctx).Where("subscription_id = ?", subscriptionId).Limit(1).Find(cancellation))
+	if err != nil {
+		return nil, err
+	}
+	return cancellation, nil
+}
+
+// insert or overwrite a cancellation
+func (r *Repository) SaveSubscriptionCancellation(ctx context.Context, cancellation *models.SubscriptionCancellation) error {
+	return r.conn(ctx).Save(cancellation).Error
+}
+
+// subscriptions whose beneficiary is the tenant, oldest first
+func (r *Repository) ListTenantSubscriptions(ctx context.Context, tid string) ([]models.Subscription, error) {
+	subscriptions := []models.Subscription{}
+	err := r.conn(ctx).Where("beneficiary_tid = ?", tid).Order("created, id").Find(&subscriptions).Error
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// subscriptions whose beneficiary is any of the tenants, oldest first
+func (r *Repository) ListSubscriptionsForTenants(ctx context.Context, tids []string) ([]models.Subscription, error) {
+	subscriptions := []models.Subscription{}
+	if len(tids) == 0 {
+		return subscriptions, nil
+	}
+	err := r.conn(ctx).Where("beneficiary_tid IN ?", tids).Order("created, id").Find(&subscriptions).Error
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// subscriptions the user administers: as purchaser or beneficiary, or as a
+// delegated admin
+func (r *Repository) administeredBy(oid string) *gorm.DB {
+	return r.db.Where("beneficiary_oid = ? OR purchaser_oid = ?", oid, oid).
+		Or("id IN (?)", r.db.Model(&models.SubscriptionAdmin{}).Select("subscription_id").Where("oid = ?", oid))
+}
+
+// subscriptions the user administers
+func (r *Repository) ListAdminSubscriptions(ctx context.Context, oid string) ([]models.Subscription, error) {
+	subscriptions := []models.Subscription{}
+	err := r.conn(ctx).Where(r.administeredBy(oid)).Find(&subscriptions).Error
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// subscriptions the user administers for a beneficiary tenant
+func (r *Repository) ListAdminSubscriptionsForTenant(ctx context.Context, oid string, tid string) ([]models.Subscription, error) {
+	subscriptions := []models.Subscription{}
+	err := r.conn(ctx).
+		Where(r.administeredBy(oid)).
+		Where("beneficiary_tid = ?", tid).
+		Find(&subscriptions).Error
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"context"
+	"peachone/models"
+
+	"gorm.io/gorm/clause"
+)
+
+func (r *Repository) GetTeam(ctx context.Context, id string) (*models.TenantTeam, error) {
+	team := &models.TenantTeam{}
+	err := found(r.conn(ctx).Where("id = ?", id).Limit(1).Find(team))
+	if err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+func (r *Repository) CreateTeam(ctx context.Context, team *models.TenantTeam) error {
+	return r.conn(ctx).Create(team).Error
+}
+
+// teams the user is a member of
+func (r *Repository) ListTeamsForUser(ctx context.Context, oid string) ([]models.TenantTeam, error) {
+	teams := []models.TenantTeam{}
+	err := r.conn(ctx).
+		Joins("JOIN team_users ON team_users.id = tenant_teams.id").
+		Where("team_users.oid = ?", oid).
+		Order("tenant_teams.display_name").
+		Find(&teams).Error
+	if err != nil {
+		return nil, err
+	}
+	return teams, nil
+}
+
+// --------------------------------------------------------------------------------
+// Team members
+// --------------------------------------------------------------------------------
+
+// add a user to a team; adding an existing member is not an error
+func (r *Repository) AddTeamMember(ctx context.Context, teamId string, oid string) error {
+	teamUser := &models.TeamUser{
+		Id:  teamId,
+		Oid: oid,
+	}
+	return r.conn(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(teamUser).Error
+}
+
+func (r *Repository) IsTeamMember(ctx context.Context, teamId string, oid string) (bool, error) {
+	var count int64 = 0
+	err := r.conn(ctx).Model(&models.TeamUser{}).Where("id = ? AND oid = ?", teamId, oid).Count(&count).Error
+	return count > 0, err
+}
+
+// users in a team; a team without members returns an empty slice
+func (r *Repository) ListTeamMembers(ctx context.Context, teamId string) ([]models.TenantUser, error) {
+	users := []models.TenantUser{}
+	err := r.conn(ctx).
+		Joins("JOIN team_users ON team_users.oid = tenant_users.oid").
+		Where("team_users.id = ?", teamId).
+		Order("tenant_users.name").
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// whether two users are members of at least one common team
+func (r *Repository) ShareTeam(ctx context.Context, oid string, otherOid string) (bool, error) {
+	var count int64 = 0
+	err := r.conn(ctx).Table("team_users AS a").
+		Joins("JOIN team_users AS b ON a.id = b.id").
+		Where("a.oid = ? AND b.oid = ?", oid, otherOid).
+		Count(&count).Error
+	return count > 0, err
+}
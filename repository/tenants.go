@@ -0,0 +1,22 @@
+package repository
+
+import (
+	"context"
+	"peachone/models"
+)
+
+// get a tenant with its verified domains
+func (r *Repository) GetTenant(ctx context.Context, tid string) (*models.Tenant, error) {
+	tenant := &models.Tenant{}
+	err := found(r.conn(ctx).Where("tid = ?", tid).Limit(1).Find(tenant))
+	if err != nil {
+		return nil, err
+	}
+
+	tenant.VerifiedDomains = []models.TenantDomain{}
+	err = r.conn(ctx).Where("tid = ?", tid).Order("name").Find(&tenant.VerifiedDomains).Error
+	if err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"context"
+	"peachone/models"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// Users without a seat whose trial ends between from and to, and who haven't
+// been sent the expiry reminder yet. trial_reminder is NULL on users from
+// before it was added.
+func (r *Repository) ListTrialsEndingBetween(ctx context.Context, from time.Time, to time.Time) ([]models.TenantUser, error) {
+	users := []models.TenantUser{}
+	err := r.conn(ctx).
+		Where("trial_activated AND subscription_id = ''").
+		Where("trial_expires_at BETWEEN ? AND ?", from, to).
+		Where("trial_reminder IS NULL OR trial_reminder <> ?", models.TrialReminderEnumExpired).
+		Order("trial_expires_at").
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// move the user's trial reminder from one to the next; false if it moved
+// already, e.g. on another instance, so each reminder is sent once
+func (r *Repository) AdvanceTrialReminder(ctx context.Context, oid string, from models.TrialReminderEnum, to models.TrialReminderEnum) (bool, error) {
+	query := r.conn(ctx).Model(&models.TenantUser{}).
+		Where("oid = ? AND COALESCE(trial_reminder, '') = ?", oid, from).
+		Update("trial_reminder", to)
+	if query.Error != nil {
+		return false, query.Error
+	}
+	return query.RowsAffected > 0, nil
+}
+
+// Users whose trial may have started since the given time: started since, or
+// (for trials from before the start was recorded) still running since.
+func (r *Repository) ListTrialUsersSince(ctx context.Context, since time.Time) ([]models.TenantUser, error) {
+	users := []models.TenantUser{}
+	err := r.conn(ctx).
+		Where("trial_activated").
+		Where("trial_started_at >= ? OR trial_expires_at >= ?", since, since).
+		Order("trial_started_at, oid").
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (r *Repository) CreateTrialExtension(ctx context.Context, extension *models.TrialExtension) error {
+	return r.conn(ctx).Create(extension).Error
+}
+
+func (r *Repository) ListTrialExtensions(ctx context.Context, oids []string) ([]models.TrialExtension, error) {
+	extensions := []models.TrialExtension{}
+	if len(oids) == 0 {
+		return extensions, nil
+	}
+	err := r.conn(ctx).Where("oid IN ?", oids).Order("id").Find(&extensions).Error
+	if err != nil {
+		return nil, err
+	}
+	return extensions, nil
+}
+
+func (r *Repository) GetTenantTrial(ctx context.Context, tid string) (*models.TenantTrial, error) {
+	trial := &models.TenantTrial{}
+	err := found(r.conn(ctx).Where("tid = ?", tid).Limit(1).Find(trial))
+	if err != nil {
+		return nil, err
+	}
+	return trial, nil
+}
+
+// start a tenant's trial; returns false if it had one already
+func (r *Repository) CreateTenantTrial(ctx context.Context, trial *models.TenantTrial) (bool, error) {
+	query := r.conn(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(trial)
+	if query.Error != nil {
+		return false, query.Error
+	}
+	return query.RowsAffected > 0, nil
+}
+
+// update columns of a tenant trial; keys are column names
+func (r *Repository) UpdateTenantTrial(ctx context.Context, tid string, updates map[string]interface{}) error {
+	return found(r.conn(ctx).Model(&models.TenantTrial{}).Where("tid = ?", tid).Updates(updates))
+}
+
+// move the tenant trial's reminder from one to the next; false if it moved already
+func (r *Repository) AdvanceTenantTrialReminder(ctx context.Context, tid string, from models.TrialReminderEnum, to models.TrialReminderEnum) (bool, error) {
+	query := r.conn(ctx).Model(&models.TenantTrial{}).
+		Where("tid = ? AND reminder = ?", tid, from).
+		Update("reminder", to)
+	if query.Error != nil {
+		return false, query.Error
+	}
+	return query.RowsAffected > 0, nil
+}
+
+// tenant trials ending between from and to whose expiry reminder wasn't sent yet
+func (r *Repository) ListTenantTrialsEndingBetween(ctx context.Context, from time.Time, to time.Time) ([]models.TenantTrial, error) {
+	trials := []models.TenantTrial{}
+	err := r.conn(ctx).
+		Where("expires_at BETWEEN ? AND ?", from, to).
+		Where("reminder <> ?", models.TrialReminderEnumExpired).
+		Order("expires_at").
+		Find(&trials).Error
+	if err != nil {
+		return nil, err
+	}
+	return trials, nil
+}
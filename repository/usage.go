@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"context"
+	"peachone/models"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// record a participant joining a room; LiveKit retries of the same join are ignored
+func (r *Repository) CreateParticipantSession(ctx context.Context, session *models.ParticipantSession) error {
+	return r.conn(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(session).Error
+}
+
+// record a participant leaving; sessions that already ended are left alone
+func (r *Repository) EndParticipantSession(ctx context.Context, sid string, leftAt time.Time) error {
+	return r.conn(ctx).Model(&models.ParticipantSession{}).
+		Where("sid = ? AND left_at = ?", sid, time.Time{}).
+		Update("left_at", leftAt).Error
+}
+
+// end the sessions still open in a room, e.g. when the room closes
+func (r *Repository) EndRoomParticipantSessions(ctx context.Context, roomName string, leftAt time.Time) (int64, error) {
+	query := r.conn(ctx).Model(&models.ParticipantSession{}).
+		Where("room_name = ? AND left_at = ?", roomName, time.Time{}).
+		Update("left_at", leftAt)
+	return query.RowsAffected, query.Error
+}
+
+// sessions of subscribed users that overlap [start, end), including ones still open
+func (r *Repository) ListSubscriptionParticipantSessions(ctx context.Context, start time.Time, end time.Time) ([]models.ParticipantSession, error) {
+	sessions := []models.ParticipantSession{}
+	err := r.conn(ctx).
+		Where("subscription_id <> '' AND joined_at < ? AND (left_at = ? OR left_at > ?)", end, time.Time{}, start).
+		Order("subscription_id, joined_at").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// record usage to report; hours already recorded are skipped. Returns how many were new.
+func (r *Repository) CreateUsageReports(ctx context.Context, reports []models.UsageReport) (int64, error) {
+	if len(reports) == 0 {
+		return 0, nil
+	}
+	query := r.conn(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&reports)
+	return query.RowsAffected, query.Error
+}
+
+// lock up to limit pending reports, oldest hour first; call inside a
+// transaction. Rows locked by other workers are skipped.
+func (r *Repository) LockPendingUsageReports(ctx context.Context, limit int) ([]models.UsageReport, error) {
+	reports := []models.UsageReport{}
+	err := r.conn(ctx).
+		Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+		Where("status = ?", models.UsageReportStatusEnumPending).
+		Order("effective_start_time, id").
+		Limit(limit).
+		Find(&reports).Error
+	return reports, err
+}
+
+func (r *Repository) SaveUsageReport(ctx context.Context, report *models.UsageReport) error {
+	return r.conn(ctx).Save(report).Error
+}
+
+// a subscription's usage reports, newest hour first
+func (r *Repository) ListUsageReports(ctx context.Context, subscriptionId string, since time.Time) ([]models.UsageReport, error) {
+	reports := []models.UsageReport{}
+	err := r.conn(ctx).
+		Where("subscription_id = ? AND effective_start_time >= ?", subscriptionId, since).
+		Order("effective_start_time DESC, dimension").
+		Find(&reports).Error
+	return reports, err
+}
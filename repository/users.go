@@ -0,0 +1,194 @@
+package repository
+
+import (
+	"context"
+	"peachone/models"
+	"strings"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+func (r *Repository) GetUser(ctx context.Context, oid string) (*models.TenantUser, error) {
+	user := &models.TenantUser{}
+	err := found(r.conn(ctx).Where("oid = ?", oid).Limit(1).Find(user))
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// get a user, but only if they belong to the given tenant
+func (r *Repository) GetTenantUser(ctx context.Context, tid string, oid string) (*models.TenantUser, error) {
+	user := &models.TenantUser{}
+	err := found(r.conn(ctx).Where("oid = ? AND tid = ?", oid, tid).Limit(1).Find(user))
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *Repository) CreateUser(ctx context.Context, user *models.TenantUser) error {
+	return r.conn(ctx).Create(user).Error
+}
+
+// update columns of a user; keys are column names
+func (r *Repository) UpdateUser(ctx context.Context, oid string, updates map[string]interface{}) error {
+	return found(r.conn(ctx).Model(&models.TenantUser{}).Where("oid = ?", oid).Updates(updates))
+}
+
+func (r *Repository) ListUsersByTenant(ctx context.Context, tid string) ([]models.TenantUser, error) {
+	users := []models.TenantUser{}
+	err := r.conn(ctx).Where("tid = ?", tid).Order("name").Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// assign a subscription to a user; an empty subscriptionId unassigns it
+func (r *Repository) SetUserSubscription(ctx context.Context, oid string, subscriptionId string) error {
+	return r.UpdateUser(ctx, oid, map[string]interface{}{"subscription_id": subscriptionId})
+}
+
+// number of users (seats) assigned to a subscription
+func (r *Repository) CountSubscriptionUsers(ctx context.Context, subscriptionId string) (int64, error) {
+	var count int64 = 0
+	err := r.conn(ctx).Model(&models.TenantUser{}).Where("subscription_id = ?", subscriptionId).Count(&count).Error
+	return count, err
+}
+
+// number of users whose profile photo is the given avatar blob
+func (r *Repository) CountUsersWithPhoto(ctx context.Context, photoHash string) (int64, error) {
+	var count int64 = 0
+	err := r.conn(ctx).Model(&models.TenantUser{}).Where("photo_hash = ?", photoHash).Count(&count).Error
+	return count, err
+}
+
+// users (seats) assigned to a subscription
+func (r *Repository) ListSubscriptionUsers(ctx context.Context, subscriptionId string) ([]models.TenantUser, error) {
+	users := []models.TenantUser{}
+	err := r.conn(ctx).Where("subscription_id = ?", subscriptionId).Order("name").Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// unassign every user from a subscription; returns the number of seats cleared
+func (r *Repository) UnassignSubscriptionUsers(ctx context.Context, subscriptionId string) (int64, error) {
+	query := r.conn(ctx).Model(&models.TenantUser{}).
+		Where("subscription_id = ?", subscriptionId).
+		Update("subscription_id", "")
+	return query.RowsAffected, query.Error
+}
+
+// the least recently active users assigned to a subscription, first to lose a
+// seat when it is over-allocated
+func (r *Repository) ListLeastRecentlyActiveSubscriptionUsers(ctx context.Context, subscriptionId string, limit int) ([]models.TenantUser, error) {
+	users := []models.TenantUser{}
+	err := r.conn(ctx).
+		Where("subscription_id = ?", subscriptionId).
+		Order("last_active_at, created_at, oid").
+		Limit(limit).
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// unassign the given users, if they are still assigned to the subscription;
+// returns the number of seats cleared
+func (r *Repository) UnassignUsers(ctx context.Context, subscriptionId string, oids []string) (int64, error) {
+	query := r.conn(ctx).Model(&models.TenantUser{}).
+		Where("subscription_id = ? AND oid IN ?", subscriptionId, oids).
+		Update("subscription_id", "")
+	return query.RowsAffected, query.Error
+}
+
+// users of a tenant with the given oids
+func (r *Repository) ListTenantUsersByOids(ctx context.Context, tid string, oids []string) ([]models.TenantUser, error) {
+	users := []models.TenantUser{}
+	if len(oids) == 0 {
+		return users, nil
+	}
+	err := r.conn(ctx).Where("tid = ? AND oid IN ?", tid, oids).Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Lock users of a tenant until the transaction ends, and read them fresh.
+// Rows are locked in oid order so that transactions locking overlapping users
+// can't deadlock.
+func (r *Repository) LockTenantUsers(ctx context.Context, tid string, oids []string) ([]models.TenantUser, error) {
+	users := []models.TenantUser{}
+	if len(oids) == 0 {
+		return users, nil
+	}
+	err := r.conn(ctx).
+		Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("tid = ? AND oid IN ?", tid, oids).
+		Order("oid").
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// users of a tenant with the given emails, ignoring case
+func (r *Repository) ListTenantUsersByEmails(ctx context.Context, tid string, emails []string) ([]models.TenantUser, error) {
+	users := []models.TenantUser{}
+	if len(emails) == 0 {
+		return users, nil
+	}
+	lower := make([]string, len(emails))
+	for i, email := range emails {
+		lower[i] = strings.ToLower(email)
+	}
+	err := r.conn(ctx).Where("tid = ? AND LOWER(email) IN ?", tid, lower).Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// assign a subscription to the given users; returns the number of users updated
+func (r *Repository) AssignUsers(ctx context.Context, subscriptionId string, oids []string) (int64, error) {
+	if len(oids) == 0 {
+		return 0, nil
+	}
+	query := r.conn(ctx).Model(&models.TenantUser{}).
+		Where("oid IN ?", oids).
+		Update("subscription_id", subscriptionId)
+	return query.RowsAffected, query.Error
+}
+
+// Unassigned users of a tenant that a subscription's auto-assign policy covers:
+// those created since newUsersSince (unless it is zero) and members of the
+// given teams, except users who were unassigned from the subscription before.
+// Oldest first, so seats go to users in the order they signed up.
+func (r *Repository) ListAutoAssignCandidates(ctx context.Context, subscriptionId string, tid string, newUsersSince time.Time, teamIds []string, limit int) ([]models.TenantUser, error) {
+	users := []models.TenantUser{}
+	covered := r.db.Where("false")
+	if !newUsersSince.IsZero() {
+		covered = covered.Or("created_at >= ?", newUsersSince)
+	}
+	if len(teamIds) > 0 {
+		covered = covered.Or("oid IN (?)", r.db.Model(&models.TeamUser{}).Select("oid").Where("id IN ?", teamIds))
+	}
+	err := r.conn(ctx).
+		Where("tid = ? AND subscription_id = ?", tid, "").
+		Where(covered).
+		Where("oid NOT IN (?)", r.unassignedUsers(subscriptionId)).
+		Order("created_at, oid").
+		Limit(limit).
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
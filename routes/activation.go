@@ -0,0 +1,308 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"peachone/database"
+	"peachone/jobs"
+	"peachone/models"
+	"peachone/repository"
+	"peachone/saasapi"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// how often to check whether an activated subscription has its term dates yet,
+// and how long to wait for them before giving up
+const activationPollInterval = 5 * time.Second
+const activationMaxWait = 30 * time.Minute
+
+// retry failed activation attempts with exponential backoff, then give up
+const activationMaxAttempts = 8
+const activationRetryBase = 10 * time.Second
+const activationRetryMax = 5 * time.Minute
+
+// activations processed per worker run
+const activationBatchSize = 20
+
+// how long a claimed activation is left to its worker before another may retry it
+const activationLease = 5 * time.Minute
+
+// --------------------------------------------------------------------------------
+// Activate handler
+// --------------------------------------------------------------------------------
+type ActivateRequest struct {
+	SubscriptionId string `json:"subscriptionId"`
+}
+
+type ActivateResponse struct {
+	Success    bool                           `json:"success"`
+	Activation *models.SubscriptionActivation `json:"activation"`
+}
+
+// Queue the activation and return right away; the client polls
+// /:subscriptionId/activation until it is Active.
+func Activate(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get request body
+	req := new(ActivateRequest)
+	if err := c.BodyParser(req); err != nil {
+		return err
+	}
+
+	// validate request body
+	if req.SubscriptionId == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid subscriptionId")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// an activation already queued or done is returned as is; a failed one is retried
+	_, err = repo.CreateSubscriptionActivation(c.Context(), &models.SubscriptionActivation{
+		SubscriptionId: req.SubscriptionId,
+		RequestedBy:    claims.Oid,
+		Status:         models.SubscriptionActivationEnumPending,
+		NextAttemptAt:  time.Now(),
+	})
+	if err != nil {
+		fmt.Println("db error creating activation:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not activate subscription")
+	}
+	_, err = repo.RetrySubscriptionActivation(c.Context(), req.SubscriptionId, time.Now())
+	if err != nil {
+		fmt.Println("db error retrying activation:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not activate subscription")
+	}
+	activation, err := repo.GetSubscriptionActivation(c.Context(), req.SubscriptionId)
+	if err != nil {
+		fmt.Println("db error getting activation:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not activate subscription")
+	}
+
+	// return response
+	response := &ActivateResponse{
+		Success:    true,
+		Activation: activation,
+	}
+	return c.Status(fiber.StatusAccepted).JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Get activation status
+// --------------------------------------------------------------------------------
+type GetActivationResponse struct {
+	Success      bool                           `json:"success"`
+	Activation   *models.SubscriptionActivation `json:"activation"`
+	Subscription *models.Subscription           `json:"subscription"` // once Active
+}
+
+func GetActivation(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+	subscriptionId := c.Params("subscriptionId")
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get activation
+	activation, err := repo.GetSubscriptionActivation(c.Context(), subscriptionId)
+	if errors.Is(err, repository.ErrNotFound) {
+		return fiber.NewError(fiber.StatusNotFound, "activation not found")
+	}
+	if err != nil {
+		fmt.Println("db error getting activation:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get activation")
+	}
+
+	// get subscription, once synced
+	var subscription *models.Subscription
+	if activation.Status == models.SubscriptionActivationEnumActive {
+		subscription, err = repo.GetSubscription(c.Context(), subscriptionId)
+		if err != nil {
+			fmt.Println("db error getting subscription:", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "could not get subscription")
+		}
+	}
+
+	// only the user who activated it and the subscription's admins may see it
+	isAdmin := false
+	if subscription != nil {
+		isAdmin = isSubscriptionOwner(subscription, claims.Oid)
+		if !isAdmin {
+			isAdmin, err = repo.IsSubscriptionAdmin(c.Context(), subscription.Id, claims.Oid)
+			if err != nil {
+				fmt.Println("db error getting subscription admin:", err)
+				return fiber.NewError(fiber.StatusInternalServerError, "could not get subscription")
+			}
+		}
+	}
+	if activation.RequestedBy != claims.Oid && !isAdmin {
+		return fiber.NewError(fiber.StatusForbidden, "user may not view this activation")
+	}
+
+	// return response
+	response := &GetActivationResponse{
+		Success:      true,
+		Activation:   activation,
+		Subscription: subscription,
+	}
+	return c.JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Activation worker
+// --------------------------------------------------------------------------------
+
+// Worker for activations queued by Activate. Each activation is claimed by
+// leasing it (pushing its next attempt past the work) under its row lock, so no
+// two workers process it at once and no lock is held during the Marketplace calls.
+func ProcessSubscriptionActivations(ctx context.Context) error {
+	repo := repository.New(database.DB.DB)
+
+	for i := 0; i < activationBatchSize; i++ {
+		activation, err := claimNextDueSubscriptionActivation(ctx, repo, time.Now())
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		done, err := processSubscriptionActivation(ctx, repo, activation)
+		recordSubscriptionActivationResult(activation, done, err, time.Now())
+		err = repo.SaveSubscriptionActivation(ctx, activation)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lease the next due activation to this worker
+func claimNextDueSubscriptionActivation(ctx context.Context, repo *repository.Repository, now time.Time) (*models.SubscriptionActivation, error) {
+	var activation *models.SubscriptionActivation
+	err := repo.Transaction(ctx, func(tx *repository.Repository) error {
+		var err error
+		activation, err = tx.LockNextDueSubscriptionActivation(ctx, now)
+		if err != nil {
+			return err
+		}
+		activation.NextAttemptAt = now.Add(activationLease)
+		return tx.SaveSubscriptionActivation(ctx, activation)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return activation, nil
+}
+
+// update status after an attempt: active, poll again, retry later, or give up
+func recordSubscriptionActivationResult(activation *models.SubscriptionActivation, done bool, err error, now time.Time) {
+	if err != nil {
+		activation.Attempts++
+		fmt.Println("error activating subscription:", activation.SubscriptionId, "attempt", activation.Attempts, err)
+		activation.LastError = err.Error()
+		if activation.Attempts >= activationMaxAttempts {
+			activation.Status = models.SubscriptionActivationEnumFailed
+			activation.CompletedAt = now
+			return
+		}
+		activation.NextAttemptAt = now.Add(jobs.Backoff(activation.Attempts, activationRetryBase, activationRetryMax))
+		return
+	}
+
+	if done {
+		activation.Status = models.SubscriptionActivationEnumActive
+		activation.LastError = ""
+		activation.CompletedAt = now
+		return
+	}
+
+	// activated, but the term dates haven't shown up yet (since activating, or
+	// since the client retried a failed activation)
+	waitingSince := activation.ActivatedAt
+	if activation.RetriedAt.After(waitingSince) {
+		waitingSince = activation.RetriedAt
+	}
+	if now.Sub(waitingSince) > activationMaxWait {
+		activation.Status = models.SubscriptionActivationEnumFailed
+		activation.LastError = "subscription has no term dates"
+		activation.CompletedAt = now
+		return
+	}
+	activation.NextAttemptAt = now.Add(activationPollInterval)
+}
+
+// Activate the subscription (once), then sync it if it has its term dates.
+// Returns false while still waiting for them.
+func processSubscriptionActivation(ctx context.Context, repo *repository.Repository, activation *models.SubscriptionActivation) (bool, error) {
+	// create fulfillment api client
+	client, err := saasapi.NewDefaultFulfillmentOperationsClient()
+	if err != nil {
+		return false, fmt.Errorf("could not create fulfillment api client: %w", err)
+	}
+
+	// get subscription
+	subscriptionResponse, err := client.GetSubscription(
+		ctx,
+		activation.SubscriptionId,
+		&saasapi.FulfillmentOperationsClientGetSubscriptionOptions{},
+	)
+	if err != nil {
+		return false, fmt.Errorf("could not retrieve subscription: %w", err)
+	}
+
+	// activate subscription
+	if activation.ActivatedAt.IsZero() {
+		quantity := int64(*subscriptionResponse.Subscription.Quantity)
+		_, err = client.ActivateSubscription(ctx, activation.SubscriptionId, saasapi.SubscriberPlan{
+			PlanID:   subscriptionResponse.Subscription.PlanID,
+			Quantity: &quantity,
+		}, &saasapi.FulfillmentOperationsClientActivateSubscriptionOptions{})
+		if err != nil {
+			return false, fmt.Errorf("could not activate subscription: %w", err)
+		}
+		activation.ActivatedAt = time.Now()
+		return false, nil // the term dates are set after activation
+	}
+
+	// make sure subscription has valid start dates
+	newSubscription := makeSubscription(&subscriptionResponse.Subscription)
+	if newSubscription.SubscriptionTermEndDate.IsZero() ||
+		newSubscription.SubscriptionTermStartDate.IsZero() {
+		return false, nil
+	}
+
+	// check if subscription in db... if no, create it; if so, update it
+	_, err = repo.GetSubscription(ctx, activation.SubscriptionId)
+	isNewSubscription := errors.Is(err, repository.ErrNotFound)
+	if err != nil && !isNewSubscription {
+		return false, fmt.Errorf("db could not get subscription: %w", err)
+	}
+	err = saveSubscriptionToLedger(ctx, repo, newSubscription, ledgerSource{Actor: activation.RequestedBy, Operation: "Activate"})
+	if err != nil {
+		return false, fmt.Errorf("db could not save subscription: %w", err)
+	}
+
+	// if new subscription, send email
+	if isNewSubscription {
+		_, _, err := SendNewSubscriptionAlert(ctx, newSubscription)
+		if err != nil {
+			fmt.Println("error sending new subscription alert for subscriptionId:", newSubscription.Id, err)
+		}
+	}
+
+	return true, nil
+}
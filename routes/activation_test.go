@@ -0,0 +1,50 @@
+package routes
+
+import (
+	"errors"
+	"peachone/models"
+	"testing"
+	"time"
+)
+
+func TestRecordSubscriptionActivationResult(t *testing.T) {
+	now := time.Now()
+
+	active := &models.SubscriptionActivation{Status: models.SubscriptionActivationEnumPending, ActivatedAt: now, LastError: "earlier failure"}
+	recordSubscriptionActivationResult(active, true, nil, now)
+	if active.Status != models.SubscriptionActivationEnumActive || active.LastError != "" || !active.CompletedAt.Equal(now) {
+		t.Fatalf("unexpected result when done: %+v", active)
+	}
+
+	// waiting for term dates polls again and doesn't count as an attempt
+	waiting := &models.SubscriptionActivation{Status: models.SubscriptionActivationEnumPending, ActivatedAt: now.Add(-time.Minute)}
+	recordSubscriptionActivationResult(waiting, false, nil, now)
+	if waiting.Status != models.SubscriptionActivationEnumPending || waiting.Attempts != 0 || !waiting.NextAttemptAt.Equal(now.Add(activationPollInterval)) {
+		t.Fatalf("unexpected result while waiting: %+v", waiting)
+	}
+
+	timedOut := &models.SubscriptionActivation{Status: models.SubscriptionActivationEnumPending, ActivatedAt: now.Add(-activationMaxWait - time.Second)}
+	recordSubscriptionActivationResult(timedOut, false, nil, now)
+	if timedOut.Status != models.SubscriptionActivationEnumFailed || timedOut.LastError == "" {
+		t.Fatalf("unexpected result after waiting too long: %+v", timedOut)
+	}
+
+	// a retried activation waits again from the retry
+	retried := &models.SubscriptionActivation{Status: models.SubscriptionActivationEnumPending, ActivatedAt: now.Add(-activationMaxWait - time.Hour), RetriedAt: now.Add(-time.Minute)}
+	recordSubscriptionActivationResult(retried, false, nil, now)
+	if retried.Status != models.SubscriptionActivationEnumPending {
+		t.Fatalf("unexpected result while waiting after a retry: %+v", retried)
+	}
+
+	retry := &models.SubscriptionActivation{Status: models.SubscriptionActivationEnumPending}
+	recordSubscriptionActivationResult(retry, false, errors.New("marketplace down"), now)
+	if retry.Status != models.SubscriptionActivationEnumPending || retry.Attempts != 1 || !retry.NextAttemptAt.Equal(now.Add(activationRetryBase)) {
+		t.Fatalf("unexpected result after first failure: %+v", retry)
+	}
+
+	failed := &models.SubscriptionActivation{Status: models.SubscriptionActivationEnumPending, Attempts: activationMaxAttempts - 1}
+	recordSubscriptionActivationResult(failed, false, errors.New("still down"), now)
+	if failed.Status != models.SubscriptionActivationEnumFailed || failed.LastError != "still down" || failed.CompletedAt.IsZero() {
+		t.Fatalf("unexpected result after last attempt: %+v", failed)
+	}
+}
@@ -0,0 +1,232 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"peachone/database"
+	"peachone/models"
+	"peachone/repository"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// get a subscription its purchaser or beneficiary is asking for; delegated
+// admins manage seats, but may not grant or revoke admin rights, change the
+// plan or quantity, or cancel the subscription
+func getOwnedSubscription(c *fiber.Ctx, repo *repository.Repository, oid string) (*models.Subscription, error) {
+	subscription, err := getAdminSubscription(c.Context(), repo, oid, c.Params("subscriptionId"))
+	if err != nil {
+		return nil, err
+	}
+	if !isSubscriptionOwner(subscription, oid) {
+		return nil, fiber.NewError(fiber.StatusForbidden, "only the purchaser or beneficiary can do this")
+	}
+	return subscription, nil
+}
+
+// --------------------------------------------------------------------------------
+// Get Subscription Admins Request
+// --------------------------------------------------------------------------------
+type GetSubscriptionAdminsResponse struct {
+	Success     bool                       `json:"success"`
+	Purchaser   SubscriptionOwner          `json:"purchaser"`
+	Beneficiary SubscriptionOwner          `json:"beneficiary"`
+	Admins      []models.SubscriptionAdmin `json:"admins"` // delegated admins
+}
+
+type SubscriptionOwner struct {
+	Oid   string `json:"oid"`
+	Tid   string `json:"tid"`
+	Email string `json:"email"`
+}
+
+func GetSubscriptionAdmins(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getAdminSubscription(c.Context(), repo, claims.Oid, c.Params("subscriptionId"))
+	if err != nil {
+		return err
+	}
+
+	// get admins
+	admins, err := repo.ListSubscriptionAdmins(c.Context(), []string{subscription.Id})
+	if err != nil {
+		fmt.Println("db error getting subscription admins:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get admins")
+	}
+
+	// return response
+	response := &GetSubscriptionAdminsResponse{
+		Success:     true,
+		Purchaser:   SubscriptionOwner{Oid: subscription.PurchaserOid, Tid: subscription.PurchaserTid, Email: subscription.PurchaserEmail},
+		Beneficiary: SubscriptionOwner{Oid: subscription.BeneficiaryOid, Tid: subscription.BeneficiaryTid, Email: subscription.BeneficiaryEmail},
+		Admins:      admins,
+	}
+	return c.JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Grant Subscription Admin Request
+// --------------------------------------------------------------------------------
+type GrantSubscriptionAdminRequest struct {
+	Oid   string `json:"oid"`
+	Email string `json:"email"`
+}
+
+type GrantSubscriptionAdminResponse struct {
+	Success bool                     `json:"success"`
+	Admin   models.SubscriptionAdmin `json:"admin"`
+}
+
+func GrantSubscriptionAdmin(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// parse request
+	req := &GrantSubscriptionAdminRequest{}
+	if err := c.BodyParser(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if (req.Oid == "") == (req.Email == "") {
+		return fiber.NewError(fiber.StatusBadRequest, "either oid or email is required")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getOwnedSubscription(c, repo, claims.Oid)
+	if err != nil {
+		return err
+	}
+
+	// the user must be of the beneficiary tenant
+	var users []models.TenantUser
+	if req.Oid != "" {
+		users, err = repo.ListTenantUsersByOids(c.Context(), subscription.BeneficiaryTid, []string{req.Oid})
+	} else {
+		users, err = repo.ListTenantUsersByEmails(c.Context(), subscription.BeneficiaryTid, []string{req.Email})
+	}
+	if err != nil {
+		fmt.Println("db error getting user:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get user")
+	}
+	if len(users) == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "user not found in the subscription's tenant")
+	}
+	user := users[0]
+	if isSubscriptionOwner(subscription, user.Oid) {
+		return fiber.NewError(fiber.StatusConflict, "user is already admin of this subscription")
+	}
+
+	// grant admin rights
+	admin := &models.SubscriptionAdmin{
+		SubscriptionId: subscription.Id,
+		Oid:            user.Oid,
+		Tid:            user.Tid,
+		Name:           user.Name,
+		Email:          user.Email,
+		GrantedBy:      claims.Oid,
+	}
+	granted := false
+	err = repo.Transaction(c.Context(), func(tx *repository.Repository) error {
+		granted, err = tx.CreateSubscriptionAdmin(c.Context(), admin)
+		if err != nil || !granted {
+			return err
+		}
+		return recordSeatChanges(c.Context(), tx, ledgerSource{Actor: claims.Oid, Operation: "GrantAdmin"}, subscription.Id, models.LedgerEventEnumAdminGranted, []models.TenantUser{user})
+	})
+	if err != nil {
+		fmt.Println("db error granting subscription admin:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not grant admin rights")
+	}
+	if !granted {
+		return fiber.NewError(fiber.StatusConflict, "user is already admin of this subscription")
+	}
+
+	_, _, err = SendNotificationEmail(c.Context(), &NotificationVars{
+		RecipientEmails: []string{user.Email},
+		Subject:         fmt.Sprintf("You are now an admin of the subscription %s", subscription.Name),
+		Paragraphs: []string{
+			fmt.Sprintf("You have been made an admin of the Teraphone subscription %s. You can now assign seats and manage the subscription.", subscription.Name),
+		},
+	})
+	if err != nil {
+		fmt.Println("error notifying subscription admin:", user.Oid, err)
+	}
+
+	// return response
+	response := &GrantSubscriptionAdminResponse{
+		Success: true,
+		Admin:   *admin,
+	}
+	return c.JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Revoke Subscription Admin Request
+// --------------------------------------------------------------------------------
+type RevokeSubscriptionAdminResponse struct {
+	Success bool `json:"success"`
+}
+
+func RevokeSubscriptionAdmin(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getOwnedSubscription(c, repo, claims.Oid)
+	if err != nil {
+		return err
+	}
+
+	// revoke admin rights
+	oid := c.Params("oid")
+	err = repo.Transaction(c.Context(), func(tx *repository.Repository) error {
+		admins, err := tx.ListSubscriptionAdmins(c.Context(), []string{subscription.Id})
+		if err != nil {
+			return err
+		}
+		err = tx.DeleteSubscriptionAdmin(c.Context(), subscription.Id, oid)
+		if err != nil {
+			return err
+		}
+		revoked := models.TenantUser{Oid: oid}
+		for _, admin := range admins {
+			if admin.Oid == oid {
+				revoked.Email = admin.Email
+			}
+		}
+		return recordSeatChanges(c.Context(), tx, ledgerSource{Actor: claims.Oid, Operation: "RevokeAdmin"}, subscription.Id, models.LedgerEventEnumAdminRevoked, []models.TenantUser{revoked})
+	})
+	if errors.Is(err, repository.ErrNotFound) {
+		return fiber.NewError(fiber.StatusNotFound, "user is not a delegated admin of this subscription")
+	}
+	if err != nil {
+		fmt.Println("db error revoking subscription admin:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not revoke admin rights")
+	}
+
+	// return response
+	response := &RevokeSubscriptionAdminResponse{
+		Success: true,
+	}
+	return c.JSON(response)
+}
@@ -0,0 +1,205 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"peachone/database"
+	"peachone/models"
+	"peachone/repository"
+	"time"
+)
+
+// users assigned per subscription per backfill run
+const autoAssignBatchSize = 500
+
+// whether the subscription's auto-assign policy covers the user
+func autoAssignCovers(settings *models.SubscriptionSettings, user *models.TenantUser, teamIds []string) bool {
+	if settings.AutoAssignNewUsers && !settings.AutoAssignNewUsersAt.IsZero() && !user.CreatedAt.Before(settings.AutoAssignNewUsersAt) {
+		return true
+	}
+	for _, policyTeamId := range settings.AutoAssignTeamIds {
+		for _, teamId := range teamIds {
+			if teamId == policyTeamId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// At sign in: give an unassigned user a seat on the first subscription of
+// their tenant whose policy covers them, unless they were unassigned from it
+// before. Returns the subscription assigned, if any.
+func autoAssignUser(ctx context.Context, repo *repository.Repository, user *models.TenantUser) (string, error) {
+	if user.SubscriptionId != "" {
+		return "", nil
+	}
+
+	subscriptions, err := repo.ListTenantSubscriptions(ctx, user.Tid)
+	if err != nil {
+		return "", err
+	}
+	var teamIds []string
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		if subscription.SaaSSubscriptionStatus != models.SubscriptionStatusEnumSubscribed {
+			continue
+		}
+		settings, err := repo.GetSubscriptionSettings(ctx, subscription.Id)
+		if err != nil {
+			return "", err
+		}
+		if len(settings.AutoAssignTeamIds) > 0 && teamIds == nil {
+			teams, err := repo.ListTeamsForUser(ctx, user.Oid)
+			if err != nil {
+				return "", err
+			}
+			teamIds = []string{}
+			for _, team := range teams {
+				teamIds = append(teamIds, team.Id)
+			}
+		}
+		if !autoAssignCovers(settings, user, teamIds) {
+			continue
+		}
+		unassigned, err := repo.WasUnassigned(ctx, subscription.Id, user.Oid)
+		if err != nil {
+			return "", err
+		}
+		if unassigned {
+			continue // an admin took the seat away; don't give it back
+		}
+
+		assigned, err := autoAssignSeats(ctx, repo, subscription, []models.TenantUser{*user})
+		if err != nil {
+			return "", err
+		}
+		if len(assigned) > 0 {
+			user.SubscriptionId = subscription.Id
+			return subscription.Id, nil
+		}
+	}
+	return "", nil
+}
+
+// Job: assign seats to users the auto-assign policies cover but who weren't
+// assigned at sign in, e.g. members of a team added to the policy later, or
+// users who signed in while there were no free seats.
+func BackfillAutoAssignments(ctx context.Context) error {
+	repo := repository.New(database.DB.DB)
+
+	settings, err := repo.ListAutoAssignSettings(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := range settings {
+		subscription, err := repo.GetSubscription(ctx, settings[i].SubscriptionId)
+		if err != nil {
+			fmt.Println("error getting subscription:", settings[i].SubscriptionId, err)
+			continue
+		}
+		if subscription.SaaSSubscriptionStatus != models.SubscriptionStatusEnumSubscribed {
+			continue
+		}
+
+		newUsersSince := time.Time{}
+		if settings[i].AutoAssignNewUsers {
+			newUsersSince = settings[i].AutoAssignNewUsersAt
+		}
+		users, err := repo.ListAutoAssignCandidates(ctx, subscription.Id, subscription.BeneficiaryTid, newUsersSince, settings[i].AutoAssignTeamIds, autoAssignBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			continue
+		}
+		_, err = autoAssignSeats(ctx, repo, subscription, users)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Assign as many of the users as there are free seats, in order, with the
+// subscription locked. The admins are told once when users are left without a seat.
+func autoAssignSeats(ctx context.Context, repo *repository.Repository, subscription *models.Subscription, users []models.TenantUser) ([]models.TenantUser, error) {
+	assigned := []models.TenantUser{}
+	exhausted := false
+	notify := false
+	err := repo.Transaction(ctx, func(tx *repository.Repository) error {
+		locked, err := tx.LockSubscription(ctx, subscription.Id)
+		if err != nil {
+			return err
+		}
+		seats, err := tx.CountSubscriptionUsers(ctx, locked.Id)
+		if err != nil {
+			return err
+		}
+		free := int(int64(locked.Quantity) - seats)
+		if free < 0 {
+			free = 0
+		}
+
+		// skip users an admin assigned in the meantime
+		oids := make([]string, len(users))
+		for i, user := range users {
+			oids[i] = user.Oid
+		}
+		current, err := tx.LockTenantUsers(ctx, locked.BeneficiaryTid, oids)
+		if err != nil {
+			return err
+		}
+		stillUnassigned := make(map[string]bool)
+		for _, user := range current {
+			stillUnassigned[user.Oid] = user.SubscriptionId == ""
+		}
+		assigned = []models.TenantUser{}
+		for _, user := range users {
+			if !stillUnassigned[user.Oid] {
+				continue
+			}
+			if len(assigned) == free {
+				exhausted = true
+				break
+			}
+			assigned = append(assigned, user)
+		}
+
+		oids = make([]string, len(assigned))
+		for i, user := range assigned {
+			oids[i] = user.Oid
+		}
+		_, err = tx.AssignUsers(ctx, locked.Id, oids)
+		if err != nil {
+			return err
+		}
+		err = recordSeatChanges(ctx, tx, ledgerSource{Actor: ledgerActorSystem, Operation: "AutoAssign"}, locked.Id, models.LedgerEventEnumSeatAssigned, assigned)
+		if err != nil {
+			return err
+		}
+
+		// remember that the admins were told, until seats free up again
+		if exhausted && locked.SeatsExhaustedAt.IsZero() {
+			notify = true
+			return tx.UpdateSubscription(ctx, locked.Id, map[string]interface{}{"seats_exhausted_at": time.Now()})
+		}
+		if !exhausted && !locked.SeatsExhaustedAt.IsZero() {
+			return tx.UpdateSubscription(ctx, locked.Id, map[string]interface{}{"seats_exhausted_at": time.Time{}})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if notify {
+		notifySubscriptionAdmins(ctx, repo, subscription, fmt.Sprintf("Your subscription %s has no seats left", subscription.Name), []string{
+			fmt.Sprintf("All %d seats of your Teraphone subscription %s are assigned, so new users can't be assigned a seat automatically.", subscription.Quantity, subscription.Name),
+			"Please add seats or unassign users who no longer need one. Users left without a seat will be assigned as soon as seats are free.",
+		})
+	}
+	return assigned, nil
+}
@@ -0,0 +1,37 @@
+package routes
+
+import (
+	"peachone/models"
+	"testing"
+	"time"
+)
+
+func TestAutoAssignCovers(t *testing.T) {
+	enabledAt := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	newUser := &models.TenantUser{Oid: "new", CreatedAt: enabledAt.Add(time.Minute)}
+	oldUser := &models.TenantUser{Oid: "old", CreatedAt: enabledAt.Add(-time.Minute)}
+
+	off := models.DefaultSubscriptionSettings("sub")
+	if autoAssignCovers(off, newUser, []string{"team"}) {
+		t.Error("no policy covers the user")
+	}
+
+	newUsers := models.DefaultSubscriptionSettings("sub")
+	newUsers.AutoAssignNewUsers = true
+	newUsers.AutoAssignNewUsersAt = enabledAt
+	if !autoAssignCovers(newUsers, newUser, nil) {
+		t.Error("new user not covered")
+	}
+	if autoAssignCovers(newUsers, oldUser, nil) {
+		t.Error("user from before the policy covered")
+	}
+
+	teams := models.DefaultSubscriptionSettings("sub")
+	teams.AutoAssignTeamIds = []string{"sales", "support"}
+	if !autoAssignCovers(teams, oldUser, []string{"engineering", "support"}) {
+		t.Error("team member not covered")
+	}
+	if autoAssignCovers(teams, newUser, []string{"engineering"}) {
+		t.Error("user of another team covered")
+	}
+}
@@ -0,0 +1,397 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"peachone/database"
+	"peachone/models"
+	"peachone/repository"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// users that can be assigned in one request
+const maxBulkSeatAssignments = 1000
+
+type SeatAssignmentResult struct {
+	Oid                    string                          `json:"oid"`
+	Email                  string                          `json:"email"`
+	Status                 models.SeatAssignmentStatusEnum `json:"status"`
+	PreviousSubscriptionId string                          `json:"previousSubscriptionId,omitempty"` // moved from another subscription
+}
+
+// Decide what happens to each requested oid and email, given the users found
+// for them in the subscription's tenant. Returns one result per distinct oid
+// or email, in request order, and the users that need a seat.
+func planSeatAssignments(subscriptionId string, oids []string, emails []string, users []models.TenantUser) ([]SeatAssignmentResult, []models.TenantUser) {
+	results := []SeatAssignmentResult{}
+	toAssign := []models.TenantUser{}
+	requested := make(map[string]bool)
+	assigning := make(map[string]bool)
+
+	add := func(find func(user *models.TenantUser) bool, result SeatAssignmentResult) {
+		var user *models.TenantUser
+		for i := range users {
+			if find(&users[i]) {
+				user = &users[i]
+				break
+			}
+		}
+		switch {
+		case user == nil:
+			result.Status = models.SeatAssignmentStatusEnumNotFound
+		case user.SubscriptionId == subscriptionId:
+			result.Oid, result.Email = user.Oid, user.Email
+			result.Status = models.SeatAssignmentStatusEnumAlreadyAssigned
+		default:
+			result.Oid, result.Email = user.Oid, user.Email
+			result.Status = models.SeatAssignmentStatusEnumAssigned
+			result.PreviousSubscriptionId = user.SubscriptionId
+			if !assigning[user.Oid] {
+				assigning[user.Oid] = true
+				toAssign = append(toAssign, *user)
+			}
+		}
+		results = append(results, result)
+	}
+
+	for _, oid := range oids {
+		if oid == "" || requested["oid:"+oid] {
+			continue
+		}
+		requested["oid:"+oid] = true
+		add(func(user *models.TenantUser) bool { return user.Oid == oid }, SeatAssignmentResult{Oid: oid})
+	}
+	for _, email := range emails {
+		key := "email:" + strings.ToLower(email)
+		if email == "" || requested[key] {
+			continue
+		}
+		requested[key] = true
+		add(func(user *models.TenantUser) bool { return strings.EqualFold(user.Email, email) }, SeatAssignmentResult{Email: email})
+	}
+
+	return results, toAssign
+}
+
+var errNotEnoughSeats = errors.New("not enough seats available")
+var errSubscriptionCancelled = errors.New("subscription is cancelled")
+
+type seatAssignment struct {
+	Assigned int   // seats used
+	Seats    int64 // seats now assigned
+	Quantity int
+	Results  []SeatAssignmentResult
+}
+
+// Assign the users of the subscription's tenant with the given oids and emails
+// to it, all or none: with the subscription locked, so the seat count can't
+// change until we're done, the seats needed are checked once against its
+// quantity (errNotEnoughSeats). Users on another subscription are moved.
+// Cancelled subscriptions take no seats (errSubscriptionCancelled).
+func assignSeats(ctx context.Context, repo *repository.Repository, subscriptionId string, oids []string, emails []string, source ledgerSource) (*seatAssignment, error) {
+	assignment := &seatAssignment{}
+	err := repo.Transaction(ctx, func(tx *repository.Repository) error {
+		subscription, err := tx.LockSubscription(ctx, subscriptionId)
+		if err != nil {
+			return err
+		}
+		if subscription.SaaSSubscriptionStatus == models.SubscriptionStatusEnumUnsubscribed {
+			return errSubscriptionCancelled
+		}
+		users, err := tx.ListTenantUsersByOids(ctx, subscription.BeneficiaryTid, oids)
+		if err != nil {
+			return err
+		}
+		usersByEmail, err := tx.ListTenantUsersByEmails(ctx, subscription.BeneficiaryTid, emails)
+		if err != nil {
+			return err
+		}
+
+		// lock the users too, so one moved concurrently to another
+		// subscription isn't counted or recorded twice
+		foundOids := []string{}
+		for _, user := range append(users, usersByEmail...) {
+			foundOids = append(foundOids, user.Oid)
+		}
+		users, err = tx.LockTenantUsers(ctx, subscription.BeneficiaryTid, foundOids)
+		if err != nil {
+			return err
+		}
+		results, toAssign := planSeatAssignments(subscription.Id, oids, emails, users)
+
+		seats, err := tx.CountSubscriptionUsers(ctx, subscription.Id)
+		if err != nil {
+			return err
+		}
+		if seats+int64(len(toAssign)) > int64(subscription.Quantity) {
+			available := int64(subscription.Quantity) - seats
+			if available < 0 {
+				available = 0
+			}
+			return fmt.Errorf("%w: %d needed, %d available", errNotEnoughSeats, len(toAssign), available)
+		}
+
+		assignOids := make([]string, len(toAssign))
+		for i, user := range toAssign {
+			assignOids[i] = user.Oid
+		}
+		_, err = tx.AssignUsers(ctx, subscription.Id, assignOids)
+		if err != nil {
+			return err
+		}
+
+		// record the seats, and the ones freed on other subscriptions
+		for _, user := range toAssign {
+			if user.SubscriptionId == "" {
+				continue
+			}
+			err = recordSeatChanges(ctx, tx, source, user.SubscriptionId, models.LedgerEventEnumSeatUnassigned, []models.TenantUser{user})
+			if err != nil {
+				return err
+			}
+		}
+		err = recordSeatChanges(ctx, tx, source, subscription.Id, models.LedgerEventEnumSeatAssigned, toAssign)
+		if err != nil {
+			return err
+		}
+
+		assignment.Assigned = len(toAssign)
+		assignment.Seats = seats + int64(len(toAssign))
+		assignment.Quantity = subscription.Quantity
+		assignment.Results = results
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return assignment, nil
+}
+
+var errSeatChanged = errors.New("the user's seat changed in the meantime")
+
+// Unassign the user from their subscription, with it locked like assignSeats
+// does. errSeatChanged if the user was moved or unassigned since they were read.
+func unassignSeat(ctx context.Context, repo *repository.Repository, user *models.TenantUser, source ledgerSource) error {
+	return repo.Transaction(ctx, func(tx *repository.Repository) error {
+		_, err := tx.LockSubscription(ctx, user.SubscriptionId)
+		if err != nil {
+			return err
+		}
+		locked, err := tx.LockTenantUsers(ctx, user.Tid, []string{user.Oid})
+		if err != nil {
+			return err
+		}
+		if len(locked) == 0 || locked[0].SubscriptionId != user.SubscriptionId {
+			return errSeatChanged
+		}
+		err = tx.SetUserSubscription(ctx, user.Oid, "")
+		if err != nil {
+			return err
+		}
+		return recordSeatChanges(ctx, tx, source, user.SubscriptionId, models.LedgerEventEnumSeatUnassigned, locked)
+	})
+}
+
+// Read the users to assign from a CSV file with a header row and an "oid" or
+// "email" column (e.g. a filtered export); rows with an oid are matched by oid.
+func parseSeatAssignmentCSV(r io.Reader) (oids []string, emails []string, err error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read header: %w", err)
+	}
+	oidColumn, emailColumn := -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "oid":
+			oidColumn = i
+		case "email":
+			emailColumn = i
+		}
+	}
+	if oidColumn < 0 && emailColumn < 0 {
+		return nil, nil, errors.New("needs an oid or email column")
+	}
+
+	column := func(record []string, i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return oids, emails, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if oid := column(record, oidColumn); oid != "" {
+			oids = append(oids, oid)
+		} else if email := column(record, emailColumn); email != "" {
+			emails = append(emails, email)
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------
+// Assign Subscription Seats Request
+// --------------------------------------------------------------------------------
+type AssignSubscriptionSeatsRequest struct {
+	Oids   []string `json:"oids"`
+	Emails []string `json:"emails"`
+}
+
+type AssignSubscriptionSeatsResponse struct {
+	Success  bool                   `json:"success"`
+	Assigned int                    `json:"assigned"` // seats used by this request
+	Seats    int64                  `json:"seats"`    // seats now assigned
+	Quantity int                    `json:"quantity"`
+	Results  []SeatAssignmentResult `json:"results"`
+}
+
+func AssignSubscriptionSeats(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get request body: JSON, or a CSV file
+	req := &AssignSubscriptionSeatsRequest{}
+	if c.Is("csv") {
+		req.Oids, req.Emails, err = parseSeatAssignmentCSV(bytes.NewReader(c.Body()))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid csv: "+err.Error())
+		}
+	} else if err := c.BodyParser(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if len(req.Oids)+len(req.Emails) == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "no users to assign")
+	}
+	if len(req.Oids)+len(req.Emails) > maxBulkSeatAssignments {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("at most %d users can be assigned at once", maxBulkSeatAssignments))
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getAdminSubscription(c.Context(), repo, claims.Oid, c.Params("subscriptionId"))
+	if err != nil {
+		return err
+	}
+
+	// assign all of them or none
+	assignment, err := assignSeats(c.Context(), repo, subscription.Id, req.Oids, req.Emails, ledgerSource{Actor: claims.Oid, Operation: "AssignSeats"})
+	if errors.Is(err, errNotEnoughSeats) || errors.Is(err, errSubscriptionCancelled) {
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	}
+	if err != nil {
+		fmt.Println("db error assigning seats:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not assign seats")
+	}
+
+	// return response
+	response := &AssignSubscriptionSeatsResponse{
+		Success:  true,
+		Assigned: assignment.Assigned,
+		Seats:    assignment.Seats,
+		Quantity: assignment.Quantity,
+		Results:  assignment.Results,
+	}
+	return c.JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Export Users By Tenant Request
+// --------------------------------------------------------------------------------
+func ExportUsersByTenant(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get tenantId from request
+	tid := c.Params("tid")
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// only admins of the tenant's subscriptions may export it
+	subscriptions, err := repo.ListAdminSubscriptionsForTenant(c.Context(), claims.Oid, tid)
+	if err != nil {
+		fmt.Println("db error getting admin subscriptions:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get subscriptions")
+	}
+	if len(subscriptions) == 0 {
+		return fiber.NewError(fiber.StatusForbidden, "user is not admin of any subscriptions for this tenant")
+	}
+	subscriptionNames := make(map[string]string)
+	for _, subscription := range subscriptions {
+		subscriptionNames[subscription.Id] = subscription.Name
+	}
+
+	// get users
+	users, err := repo.ListUsersByTenant(c.Context(), tid)
+	if err != nil {
+		fmt.Println("db error getting users:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get users")
+	}
+
+	// write csv
+	data, err := usersCSV(users, subscriptionNames)
+	if err != nil {
+		fmt.Println("error writing users csv:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not export users")
+	}
+
+	// name the file after the tenant's domain, if we know it
+	filename := "users-" + tid + ".csv"
+	tenant, err := repo.GetTenant(c.Context(), tid)
+	if err == nil && tenant.DefaultDomain != "" {
+		filename = "users-" + tenant.DefaultDomain + ".csv"
+	}
+
+	c.Attachment(filename)
+	c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	return c.Send(data)
+}
+
+// one row per user, with their assignment status
+func usersCSV(users []models.TenantUser, subscriptionNames map[string]string) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	writer := csv.NewWriter(buffer)
+	writer.Write([]string{"oid", "name", "email", "jobTitle", "department", "assigned", "subscriptionId", "subscriptionName", "lastActiveAt"})
+	for _, user := range users {
+		lastActiveAt := ""
+		if !user.LastActiveAt.IsZero() {
+			lastActiveAt = user.LastActiveAt.UTC().Format(time.RFC3339)
+		}
+		writer.Write([]string{
+			user.Oid,
+			user.Name,
+			user.Email,
+			user.JobTitle,
+			user.Department,
+			fmt.Sprint(user.SubscriptionId != ""),
+			user.SubscriptionId,
+			subscriptionNames[user.SubscriptionId],
+			lastActiveAt,
+		})
+	}
+	writer.Flush()
+	return buffer.Bytes(), writer.Error()
+}
@@ -0,0 +1,84 @@
+package routes
+
+import (
+	"fmt"
+	"peachone/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanSeatAssignments(t *testing.T) {
+	users := []models.TenantUser{
+		{Oid: "a", Email: "a@example.com"},
+		{Oid: "b", Email: "B@example.com", SubscriptionId: "sub"},
+		{Oid: "c", Email: "c@example.com", SubscriptionId: "other"},
+	}
+
+	results, toAssign := planSeatAssignments("sub",
+		[]string{"a", "b", "x", "a", ""},
+		[]string{"b@EXAMPLE.com", "c@example.com", "A@example.com", "y@example.com"},
+		users)
+
+	got := []string{}
+	for _, result := range results {
+		got = append(got, fmt.Sprintf("%s/%s:%s:%s", result.Oid, result.Email, result.Status, result.PreviousSubscriptionId))
+	}
+	want := []string{
+		"a/a@example.com:Assigned:",
+		"b/B@example.com:AlreadyAssigned:",
+		"x/:NotFound:",
+		"b/B@example.com:AlreadyAssigned:",
+		"c/c@example.com:Assigned:other",
+		"a/a@example.com:Assigned:",
+		"/y@example.com:NotFound:",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("results =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// a user asked for twice only takes one seat
+	if len(toAssign) != 2 || toAssign[0].Oid != "a" || toAssign[1].Oid != "c" {
+		t.Errorf("toAssign = %+v", toAssign)
+	}
+}
+
+func TestParseSeatAssignmentCSV(t *testing.T) {
+	oids, emails, err := parseSeatAssignmentCSV(strings.NewReader("name, Email,OID\nAlice,a@example.com,a\nBob, b@example.com\n,,\nCarol\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(oids) != "[a]" || fmt.Sprint(emails) != "[b@example.com]" {
+		t.Errorf("oids = %v, emails = %v", oids, emails)
+	}
+
+	for _, data := range []string{"", "name,department\nAlice,Sales\n", "oid\n\"a\n"} {
+		if _, _, err := parseSeatAssignmentCSV(strings.NewReader(data)); err == nil {
+			t.Errorf("%q: no error", data)
+		}
+	}
+}
+
+func TestUsersCSV(t *testing.T) {
+	lastActive := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	users := []models.TenantUser{
+		{Oid: "a", Name: "Alice, Jr.", Email: "a@example.com", SubscriptionId: "sub", LastActiveAt: lastActive},
+		{Oid: "b", Name: "Bob", Email: "b@example.com"},
+	}
+	data, err := usersCSV(users, map[string]string{"sub": "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "oid,name,email,jobTitle,department,assigned,subscriptionId,subscriptionName,lastActiveAt\n" +
+		"a,\"Alice, Jr.\",a@example.com,,,true,sub,Acme,2026-03-10T12:00:00Z\n" +
+		"b,Bob,b@example.com,,,false,,,\n"
+	if string(data) != want {
+		t.Errorf("csv =\n%s\nwant\n%s", data, want)
+	}
+
+	// an export can be imported again
+	oids, _, err := parseSeatAssignmentCSV(strings.NewReader(string(data)))
+	if err != nil || fmt.Sprint(oids) != "[a b]" {
+		t.Errorf("reimport: %v, %v", oids, err)
+	}
+}
@@ -0,0 +1,331 @@
+package routes
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"peachone/database"
+	"peachone/models"
+	"peachone/repository"
+	"peachone/saasapi"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+)
+
+// how long an admin has to confirm a cancellation request
+const cancellationConfirmWindow = 15 * time.Minute
+
+const cancellationCommentMaxLength = 1000
+
+// --------------------------------------------------------------------------------
+// Request Subscription Cancellation
+// --------------------------------------------------------------------------------
+type RequestSubscriptionCancellationRequest struct {
+	ReasonCode models.CancellationReasonEnum `json:"reasonCode"`
+	Comment    string                        `json:"comment"`
+}
+
+type RequestSubscriptionCancellationResponse struct {
+	Success           bool                             `json:"success"`
+	Cancellation      *models.SubscriptionCancellation `json:"cancellation"`
+	ConfirmationToken string                           `json:"confirmationToken"` // send to /cancellation/confirm before confirmBy
+	Assigned          int64                            `json:"assigned"`          // users who will lose their seat
+	Subscription      *models.Subscription             `json:"subscription"`
+}
+
+// First step of a cancellation: record the reason and return a confirmation
+// token, with what the admin is about to lose. Nothing is cancelled until the
+// token is confirmed.
+func RequestSubscriptionCancellation(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get request body
+	req := &RequestSubscriptionCancellationRequest{}
+	if err := c.BodyParser(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	validReason := false
+	for _, reason := range models.PossibleCancellationReasonEnumValues() {
+		if req.ReasonCode == reason {
+			validReason = true
+			break
+		}
+	}
+	if !validReason {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid reasonCode")
+	}
+	if len(req.Comment) > cancellationCommentMaxLength {
+		return fiber.NewError(fiber.StatusBadRequest, "comment is too long")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getOwnedSubscription(c, repo, claims.Oid)
+	if err != nil {
+		return err
+	}
+	if err := checkSubscriptionCancellable(c.Context(), repo, subscription); err != nil {
+		return err
+	}
+
+	// count the seats that will be lost
+	assigned, err := repo.CountSubscriptionUsers(c.Context(), subscription.Id)
+	if err != nil {
+		fmt.Println("db error counting users:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not count users")
+	}
+
+	// record the request; an earlier unconfirmed or failed one is replaced
+	token := uuid.Must(uuid.NewV4()).String()
+	cancellation := &models.SubscriptionCancellation{
+		SubscriptionId:    subscription.Id,
+		RequestedBy:       claims.Oid,
+		ReasonCode:        req.ReasonCode,
+		Comment:           req.Comment,
+		ConfirmationToken: token,
+		ConfirmBy:         time.Now().Add(cancellationConfirmWindow),
+		Status:            models.SubscriptionCancellationStatusEnumPendingConfirmation,
+	}
+	err = repo.SaveSubscriptionCancellation(c.Context(), cancellation)
+	if err != nil {
+		fmt.Println("db error saving cancellation:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not request cancellation")
+	}
+
+	// return response
+	response := &RequestSubscriptionCancellationResponse{
+		Success:           true,
+		Cancellation:      cancellation,
+		ConfirmationToken: token,
+		Assigned:          assigned,
+		Subscription:      subscription,
+	}
+	return c.JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Confirm Subscription Cancellation
+// --------------------------------------------------------------------------------
+type ConfirmSubscriptionCancellationRequest struct {
+	ConfirmationToken string `json:"confirmationToken"`
+}
+
+type ConfirmSubscriptionCancellationResponse struct {
+	Success      bool                             `json:"success"`
+	Cancellation *models.SubscriptionCancellation `json:"cancellation"`
+	Operation    *models.PublisherOperation       `json:"operation"`
+}
+
+// Second step: cancel the subscription with the Marketplace and return right
+// away; the client polls /:subscriptionId/cancellation until it is Cancelled.
+func ConfirmSubscriptionCancellation(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get request body
+	req := &ConfirmSubscriptionCancellationRequest{}
+	if err := c.BodyParser(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getOwnedSubscription(c, repo, claims.Oid)
+	if err != nil {
+		return err
+	}
+
+	// check the request
+	cancellation, err := repo.GetSubscriptionCancellation(c.Context(), subscription.Id)
+	if errors.Is(err, repository.ErrNotFound) {
+		return fiber.NewError(fiber.StatusNotFound, "cancellation not requested")
+	}
+	if err != nil {
+		fmt.Println("db error getting cancellation:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get cancellation")
+	}
+	if cancellation.Status != models.SubscriptionCancellationStatusEnumPendingConfirmation {
+		return fiber.NewError(fiber.StatusConflict, fmt.Sprintf("cancellation is %s", cancellation.Status))
+	}
+	if req.ConfirmationToken == "" ||
+		subtle.ConstantTimeCompare([]byte(req.ConfirmationToken), []byte(cancellation.ConfirmationToken)) != 1 {
+		return fiber.NewError(fiber.StatusForbidden, "invalid confirmationToken")
+	}
+	if time.Now().After(cancellation.ConfirmBy) {
+		return fiber.NewError(fiber.StatusGone, "cancellation request expired; please request it again")
+	}
+	if err := checkSubscriptionCancellable(c.Context(), repo, subscription); err != nil {
+		return err
+	}
+
+	// cancel with the Marketplace
+	operation, err := startPublisherOperation(c.Context(), repo, subscription, claims.Oid, &models.PublisherOperation{
+		Action: string(saasapi.OperationActionEnumUnsubscribe),
+	})
+	if err != nil {
+		return err
+	}
+
+	// record the confirmation
+	cancellation.Status = models.SubscriptionCancellationStatusEnumCancelling
+	cancellation.ConfirmationToken = ""
+	cancellation.ConfirmedBy = claims.Oid
+	cancellation.ConfirmedAt = time.Now()
+	cancellation.OperationId = operation.Id
+	cancellation.LastError = ""
+	err = repo.SaveSubscriptionCancellation(c.Context(), cancellation)
+	if err != nil {
+		// the operation is tracked, and the Unsubscribe still completes the cancellation
+		fmt.Println("db error saving cancellation:", err)
+	}
+
+	// return response
+	response := &ConfirmSubscriptionCancellationResponse{
+		Success:      true,
+		Cancellation: cancellation,
+		Operation:    operation,
+	}
+	return c.Status(fiber.StatusAccepted).JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Get Subscription Cancellation
+// --------------------------------------------------------------------------------
+type GetSubscriptionCancellationResponse struct {
+	Success      bool                             `json:"success"`
+	Cancellation *models.SubscriptionCancellation `json:"cancellation"`
+	Operation    *models.PublisherOperation       `json:"operation"` // once confirmed
+}
+
+func GetSubscriptionCancellation(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getAdminSubscription(c.Context(), repo, claims.Oid, c.Params("subscriptionId"))
+	if err != nil {
+		return err
+	}
+
+	// get cancellation
+	cancellation, err := repo.GetSubscriptionCancellation(c.Context(), subscription.Id)
+	if errors.Is(err, repository.ErrNotFound) {
+		return fiber.NewError(fiber.StatusNotFound, "cancellation not requested")
+	}
+	if err != nil {
+		fmt.Println("db error getting cancellation:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get cancellation")
+	}
+
+	// get operation, once confirmed
+	var operation *models.PublisherOperation
+	if cancellation.OperationId != "" {
+		operation, err = repo.GetPublisherOperation(c.Context(), cancellation.OperationId)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			fmt.Println("db error getting publisher operation:", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "could not get cancellation")
+		}
+	}
+
+	// return response
+	response := &GetSubscriptionCancellationResponse{
+		Success:      true,
+		Cancellation: cancellation,
+		Operation:    operation,
+	}
+	return c.JSON(response)
+}
+
+// Active and suspended subscriptions can be cancelled, unless a cancellation
+// is already under way. Returns a fiber error for the handler to return.
+func checkSubscriptionCancellable(ctx context.Context, repo *repository.Repository, subscription *models.Subscription) error {
+	if subscription.SaaSSubscriptionStatus != models.SubscriptionStatusEnumSubscribed &&
+		subscription.SaaSSubscriptionStatus != models.SubscriptionStatusEnumSuspended {
+		return fiber.NewError(fiber.StatusConflict, fmt.Sprintf("subscription is %s", subscription.SaaSSubscriptionStatus))
+	}
+	cancellation, err := repo.GetSubscriptionCancellation(ctx, subscription.Id)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		fmt.Println("db error getting cancellation:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get cancellation")
+	}
+	if cancellation.Status == models.SubscriptionCancellationStatusEnumCancelling {
+		return fiber.NewError(fiber.StatusConflict, "subscription is already being cancelled")
+	}
+	return nil
+}
+
+// After the subscription was unsubscribed, by our cancellation or otherwise
+// (e.g. by the customer in the Azure portal): record the cancellation as done.
+// Safe to repeat.
+func recordSubscriptionCancelled(ctx context.Context, repo *repository.Repository, subscriptionId string) error {
+	cancellation, err := repo.GetSubscriptionCancellation(ctx, subscriptionId)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil // not cancelled from our app
+	}
+	if err != nil {
+		return err
+	}
+	if cancellation.Status == models.SubscriptionCancellationStatusEnumCancelled {
+		return nil
+	}
+
+	cancellation.Status = models.SubscriptionCancellationStatusEnumCancelled
+	cancellation.ConfirmationToken = ""
+	cancellation.LastError = ""
+	cancellation.CancelledAt = time.Now()
+	return repo.SaveSubscriptionCancellation(ctx, cancellation)
+}
+
+// The Marketplace didn't cancel the subscription: let the admins try again.
+func failSubscriptionCancellation(ctx context.Context, repo *repository.Repository, operation *models.PublisherOperation) error {
+	cancellation, err := repo.GetSubscriptionCancellation(ctx, operation.SubscriptionId)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if cancellation.OperationId != operation.Id || cancellation.Status != models.SubscriptionCancellationStatusEnumCancelling {
+		return nil // superseded, or the subscription was unsubscribed anyway
+	}
+
+	cancellation.Status = models.SubscriptionCancellationStatusEnumFailed
+	cancellation.LastError = operation.LastError
+	err = repo.SaveSubscriptionCancellation(ctx, cancellation)
+	if err != nil {
+		return err
+	}
+
+	subscription, err := repo.GetSubscription(ctx, operation.SubscriptionId)
+	if err != nil {
+		return err
+	}
+	notifySubscriptionAdmins(ctx, repo, subscription, fmt.Sprintf("The cancellation of your subscription %s failed", subscription.Name), []string{
+		fmt.Sprintf("Your Teraphone subscription %s could not be cancelled: %s.", subscription.Name, operation.LastError),
+		"The subscription is still active. Please try again, or contact us if the problem persists.",
+	})
+	return nil
+}
@@ -6,10 +6,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	htmltemplate "html/template"
 	"log"
 	"os"
+	"peachone/avatars"
 	"peachone/fbadmin"
 	"peachone/models"
+	"peachone/queries"
+	"peachone/repository"
 	"strings"
 	"text/template"
 	"time"
@@ -21,6 +25,11 @@ import (
 	"github.com/livekit/protocol/auth"
 
 	"github.com/mailgun/mailgun-go/v4"
+	"gorm.io/gorm"
+
+	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/me"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
 )
 
 type TokenClaims struct {
@@ -118,7 +127,8 @@ func createFirebaseAuthToken(ctx context.Context, userId string) (string, error)
 	return token, nil
 }
 
-func createLiveKitJoinToken(teamId, roomId, userId string) (string, error) {
+// canRecord comes from the user's entitlements
+func createLiveKitJoinToken(teamId, roomId, userId string, canRecord bool) (string, error) {
 	LIVEKIT_KEY := os.Getenv("LIVEKIT_KEY")
 	LIVEKIT_SECRET := os.Getenv("LIVEKIT_SECRET")
 	at := auth.NewAccessToken(LIVEKIT_KEY, LIVEKIT_SECRET)
@@ -127,7 +137,7 @@ func createLiveKitJoinToken(teamId, roomId, userId string) (string, error) {
 	grant := &auth.VideoGrant{
 		RoomCreate: false,
 		RoomList:   false,
-		RoomRecord: false,
+		RoomRecord: canRecord,
 
 		RoomAdmin: false,
 		RoomJoin:  true,
@@ -171,11 +181,197 @@ func DecodeRoomName(name string) (string, string, error) {
 	return teamId, roomId, nil
 }
 
+type UserProfile struct {
+	CompanyName string
+	JobTitle    string
+	Department  string
+	PhotoHash   string
+	Photo       []byte // the photo stored as PhotoHash, to store again when it is referenced
+	PhotoKnown  bool   // false if the photo lookup failed for a reason other than "no photo"
+}
+
+// graph error codes returned when the user has no profile photo
+var noPhotoErrorCodes = map[string]bool{
+	"ImageNotFound":     true,
+	"ErrorItemNotFound": true,
+	"ResourceNotFound":  true,
+}
+
+func isNoPhotoError(err error) bool {
+	var odataErr *odataerrors.ODataError
+	if !errors.As(err, &odataErr) || odataErr.GetError() == nil {
+		return false
+	}
+	return noPhotoErrorCodes[ReadString(odataErr.GetError().GetCode())]
+}
+
+// fetch company name, job title, department and profile photo for the signed in user
+func fetchUserProfile(client *msgraphsdk.GraphServiceClient) (*UserProfile, error) {
+	userable, err := client.Me().GetWithRequestConfigurationAndResponseHandler(
+		&me.MeRequestBuilderGetRequestConfiguration{
+			QueryParameters: &me.MeRequestBuilderGetQueryParameters{
+				Select: []string{"companyName", "jobTitle", "department"},
+			},
+		}, nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	profile := &UserProfile{
+		CompanyName: ReadString(userable.GetCompanyName()),
+		JobTitle:    ReadString(userable.GetJobTitle()),
+		Department:  ReadString(userable.GetDepartment()),
+	}
+
+	// only a 404 means "no photo"; on any other error keep the stored photo
+	photo, err := client.Me().Photo().Content().Get()
+	if err != nil {
+		if isNoPhotoError(err) {
+			profile.PhotoKnown = true
+		} else {
+			fmt.Println("error fetching profile photo:", err)
+		}
+		return profile, nil
+	}
+	hash, err := avatars.Save(photo)
+	if err != nil {
+		fmt.Println("error saving profile photo:", err)
+		return profile, nil
+	}
+	profile.PhotoHash = hash
+	profile.Photo = photo
+	profile.PhotoKnown = true
+
+	return profile, nil
+}
+
+func applyUserProfile(user *models.TenantUser, profile *UserProfile) {
+	user.JobTitle = profile.JobTitle
+	user.Department = profile.Department
+	if profile.PhotoKnown {
+		user.PhotoHash = profile.PhotoHash
+	}
+}
+
+// avatars are stored and deleted holding the lock named after their hash
+func avatarLockName(hash string) string {
+	return "avatar:" + hash
+}
+
+// Save the user with setReference, holding the lock on their photo (if the
+// profile has one) and storing it again first, so removeUnusedAvatar can't
+// delete it between fetchUserProfile and the user pointing at it.
+func referenceAvatar(ctx context.Context, repo *repository.Repository, profile *UserProfile, setReference func() error) error {
+	if profile == nil || len(profile.Photo) == 0 {
+		return setReference()
+	}
+	return repo.WithAdvisoryLock(ctx, avatarLockName(profile.PhotoHash), func() error {
+		_, err := avatars.Save(profile.Photo)
+		if err != nil {
+			return fmt.Errorf("could not store avatar: %w", err)
+		}
+		return setReference()
+	})
+}
+
+// delete a replaced photo from the avatar store unless another user still has
+// it, checked under the photo's lock so no one can start using it meanwhile
+func removeUnusedAvatar(ctx context.Context, repo *repository.Repository, hash string) {
+	err := repo.WithAdvisoryLock(ctx, avatarLockName(hash), func() error {
+		count, err := repo.CountUsersWithPhoto(ctx, hash)
+		if err != nil {
+			return fmt.Errorf("could not count avatar references: %w", err)
+		}
+		if count > 0 {
+			return nil
+		}
+		return avatars.Delete(hash)
+	})
+	if err != nil {
+		fmt.Println("error removing unused avatar:", hash, err)
+	}
+}
+
+// fetch the signed in user's organization (covered by the User.Read scope)
+func fetchTenant(client *msgraphsdk.GraphServiceClient, tid string) (*models.Tenant, error) {
+	result, err := client.Organization().Get()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, organization := range result.GetValue() {
+		if ReadString(organization.GetId()) != tid {
+			continue
+		}
+		tenant := &models.Tenant{
+			Tid:               tid,
+			DisplayName:       ReadString(organization.GetDisplayName()),
+			CountryLetterCode: ReadString(organization.GetCountryLetterCode()),
+			VerifiedDomains:   []models.TenantDomain{},
+		}
+		for _, domain := range organization.GetVerifiedDomains() {
+			tenantDomain := models.TenantDomain{
+				Tid:       tid,
+				Name:      ReadString(domain.GetName()),
+				IsDefault: ReadBool(domain.GetIsDefault()),
+				IsInitial: ReadBool(domain.GetIsInitial()),
+			}
+			if tenantDomain.IsDefault {
+				tenant.DefaultDomain = tenantDomain.Name
+			}
+			tenant.VerifiedDomains = append(tenant.VerifiedDomains, tenantDomain)
+		}
+		return tenant, nil
+	}
+
+	return nil, fmt.Errorf("organization not found for tenant: %s", tid)
+}
+
+// get the tenant, creating it from Graph organization data on first login
+func getOrCreateTenant(db *gorm.DB, client *msgraphsdk.GraphServiceClient, tid string) (*models.Tenant, error) {
+	tenant, err := queries.GetTenant(db, tid)
+	if err == nil {
+		return tenant, nil
+	}
+
+	tenant, err = fetchTenant(client, tid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = queries.SetUpNewTenant(db, tenant)
+	if err != nil {
+		// a concurrent login may have created it first
+		existing, getErr := queries.GetTenant(db, tid)
+		if getErr == nil {
+			return existing, nil
+		}
+		return nil, err
+	}
+
+	return tenant, nil
+}
+
+func setAvatarUrl(user *models.TenantUser) {
+	if user.PhotoHash == "" {
+		user.AvatarUrl = ""
+		return
+	}
+	// the hash busts client caches whenever the photo changes
+	user.AvatarUrl = fmt.Sprintf("/v1/private/avatars/%s?v=%s", user.Oid, user.PhotoHash[:12])
+}
+
 func CreateMailgunClient() *mailgun.MailgunImpl {
 	MG_DOMAIN := os.Getenv("MG_DOMAIN")
 	MG_API_KEY := os.Getenv("MG_API_KEY")
 
 	mg := mailgun.NewMailgun(MG_DOMAIN, MG_API_KEY)
+
+	// e.g. a stub server in tests
+	MG_API_BASE := os.Getenv("MG_API_BASE")
+	if MG_API_BASE != "" {
+		mg.SetAPIBase(MG_API_BASE)
+	}
 	return mg
 }
 
@@ -291,6 +487,13 @@ func ReadString(s *string) string {
 	return *s
 }
 
+func ReadBool(b *bool) bool {
+	if b == nil {
+		return false
+	}
+	return *b
+}
+
 func ReadDate(d *time.Time) time.Time {
 	if d == nil {
 		return time.Time{}
@@ -298,6 +501,65 @@ func ReadDate(d *time.Time) time.Time {
 	return *d
 }
 
+type NotificationVars struct {
+	RecipientEmails []string
+	Subject         string
+	Paragraphs      []string
+}
+
+// send a plain notification to customers (purchasers, tenant admins, users).
+// Paragraphs may contain user supplied text, so the template escapes them.
+func SendNotificationEmail(ctx context.Context, vars *NotificationVars) (mes string, id string, err error) {
+	// email template
+	htmlNotificationTemplate := `
+<html>
+	<body>
+		{{range .Paragraphs}}<p>{{.}}</p>
+		{{end}}
+		<p>The Teraphone team</p>
+	</body>
+</html>
+`
+	// filter out empty recipients (e.g. a purchaser without an email)
+	recipients := []string{}
+	for _, email := range vars.RecipientEmails {
+		if email != "" {
+			recipients = append(recipients, email)
+		}
+	}
+	if len(recipients) == 0 {
+		return "", "", errors.New("no recipients")
+	}
+
+	// create email message
+	mg := CreateMailgunClient()
+	message := mg.NewMessage("help@teraphone.app", vars.Subject, strings.Join(vars.Paragraphs, "\n\n"), recipients...)
+	parsedHtmlTemplate, err := htmltemplate.New("body").Parse(htmlNotificationTemplate)
+	if err != nil {
+		fmt.Println(err.Error())
+		return "", "", err
+	}
+	var htmlBuffer bytes.Buffer
+	if err := parsedHtmlTemplate.Execute(&htmlBuffer, vars); err != nil {
+		fmt.Println(err.Error())
+		return "", "", err
+	}
+	message.SetHtml(htmlBuffer.String())
+
+	// send message with 10 second timeout
+	log.Printf("Sending notification to %s", strings.Join(recipients, ", "))
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	resp, id, err := mg.Send(ctxWithTimeout, message)
+	if err != nil {
+		fmt.Println(err.Error())
+		return resp, id, err
+	}
+	log.Printf("ID: %s Resp: %s", id, resp)
+
+	return resp, id, nil
+}
+
 func SendSubscriptionActionAlert(ctx context.Context, action string, newSub *models.Subscription, oldSub *models.Subscription) (mes string, id string, err error) {
 	// email template
 	htmlSubscriptionActionAlertTemplate := `
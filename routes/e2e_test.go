@@ -0,0 +1,1677 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"peachone/auth"
+	"peachone/database"
+	"peachone/database/dbtest"
+	"peachone/models"
+	"peachone/repository"
+	"peachone/saasapi"
+	"peachone/saasapi/emulator"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	jwtware "github.com/gofiber/jwt/v3"
+	"github.com/gofrs/uuid"
+)
+
+// End-to-end tests: the handlers and workers, against the Postgres at
+// TEST_DATABASE_URL (see dbtest) and the Marketplace emulator, with emails
+// sent to a stub. Skipped without TEST_DATABASE_URL.
+func TestMain(m *testing.M) {
+	db, drop, err := dbtest.Open()
+	if err != nil {
+		fmt.Println("error opening test database:", err)
+		os.Exit(1)
+	}
+	if db != nil {
+		database.DB = database.DBInstance{DB: db}
+	}
+
+	code := m.Run()
+
+	drop()
+	os.Exit(code)
+}
+
+type e2e struct {
+	t        *testing.T
+	ctx      context.Context
+	emulator *emulator.Emulator
+	repo     *repository.Repository
+	appURL   string
+	mail     *mailStub
+}
+
+func newE2E(t *testing.T) *e2e {
+	t.Helper()
+	if database.DB.DB == nil {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	// marketplace
+	marketplace := emulator.New()
+	marketplaceServer := httptest.NewServer(marketplace)
+	t.Cleanup(marketplaceServer.Close)
+	t.Setenv("MARKETPLACE_API_URL", marketplaceServer.URL)
+	t.Setenv("MARKETPLACE_EMULATOR", "true")
+
+	validator := marketplaceTokenValidator
+	marketplaceTokenValidator = auth.NewMarketplaceTokenValidator(saasapi.TenantId, saasapi.AppId)
+	marketplaceTokenValidator.OpenIDConfigUrl = marketplaceServer.URL + "/.well-known/openid-configuration"
+	t.Cleanup(func() { marketplaceTokenValidator = validator })
+
+	// email
+	mail := newMailStub(t)
+	t.Setenv("MG_API_BASE", mail.server.URL)
+	t.Setenv("MG_DOMAIN", "mg.example.com")
+	t.Setenv("MG_API_KEY", "key")
+
+	// app
+	t.Setenv("SIGNING_KEY", "e2e-signing-key")
+	app := fiber.New()
+	app.Post("/v1/webhooks/subscriptions", AuthenticateMarketplaceWebhook, SubscriptionsWebhook)
+	subscriptions := app.Group("/v1/subscriptions")
+	subscriptions.Use(jwtware.New(jwtware.Config{
+		SigningKey: []byte("e2e-signing-key"),
+	}))
+	subscriptions.Post("/resolve", Resolve)
+	subscriptions.Post("/activate", Activate)
+	subscriptions.Get("/:subscriptionId/activation", GetActivation)
+	subscriptions.Get("/:subscriptionId/plans", GetSubscriptionPlans)
+	subscriptions.Patch("/:subscriptionId/plan", ChangeSubscriptionPlan)
+	subscriptions.Patch("/:subscriptionId/quantity", ChangeSubscriptionQuantity)
+	subscriptions.Get("/:subscriptionId/operations", GetSubscriptionOperations)
+	subscriptions.Post("/:subscriptionId/cancellation", RequestSubscriptionCancellation)
+	subscriptions.Post("/:subscriptionId/cancellation/confirm", ConfirmSubscriptionCancellation)
+	subscriptions.Get("/:subscriptionId/cancellation", GetSubscriptionCancellation)
+	subscriptions.Patch("/:tid/users/:oid", AssignUserSubscription)
+	subscriptions.Get("/:tid/users/export", ExportUsersByTenant)
+	subscriptions.Post("/:subscriptionId/seats", AssignSubscriptionSeats)
+	subscriptions.Get("/:subscriptionId/ledger", GetSubscriptionLedger)
+	subscriptions.Patch("/:subscriptionId/settings", UpdateSubscriptionSettings)
+	subscriptions.Get("/", GetSubscriptions)
+	subscriptions.Get("/:tid/users", GetUsersByTenant)
+	subscriptions.Get("/:subscriptionId/admins", GetSubscriptionAdmins)
+	subscriptions.Post("/:subscriptionId/admins", GrantSubscriptionAdmin)
+	subscriptions.Delete("/:subscriptionId/admins/:oid", RevokeSubscriptionAdmin)
+	subscriptions.Get("/:subscriptionId/seat-requests", GetSubscriptionSeatRequests)
+	subscriptions.Post("/:subscriptionId/seat-requests/:requestId/approve", ApproveSeatRequest)
+	subscriptions.Post("/:subscriptionId/seat-requests/:requestId/deny", DenySeatRequest)
+	private := app.Group("/v1/private")
+	private.Use(jwtware.New(jwtware.Config{
+		SigningKey: []byte("e2e-signing-key"),
+	}))
+	private.Post("/seat-request", RequestSeat)
+	private.Get("/seat-request", GetSeatRequest)
+	private.Patch("/trial", UpdateTrial)
+	private.Get("/world", GetWorld)
+	staff := app.Group("/v1/staff")
+	staff.Use(jwtware.New(jwtware.Config{
+		SigningKey: []byte("e2e-signing-key"),
+	}))
+	staff.Use(RequireStaff)
+	staff.Post("/trials/:oid/extend", ExtendTrial)
+	staff.Get("/trials/conversions", GetTrialConversions)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(listener)
+	t.Cleanup(func() { app.Shutdown() })
+
+	return &e2e{
+		t:        t,
+		ctx:      context.Background(),
+		emulator: marketplace,
+		repo:     repository.New(database.DB.DB),
+		appURL:   "http://" + listener.Addr().String(),
+		mail:     mail,
+	}
+}
+
+func newTestId() string {
+	return uuid.Must(uuid.NewV4()).String()
+}
+
+func (e *e2e) createUser(tid string) *models.TenantUser {
+	e.t.Helper()
+	user := &models.TenantUser{
+		Oid:   newTestId(),
+		Tid:   tid,
+		Name:  "user",
+		Email: "user-" + newTestId()[:8] + "@example.com",
+	}
+	if err := e.repo.CreateUser(e.ctx, user); err != nil {
+		e.t.Fatal(err)
+	}
+	return user
+}
+
+// call the api as user, and decode the response into out (if not nil)
+func (e *e2e) call(user *models.TenantUser, method string, path string, body interface{}, out interface{}) int {
+	e.t.Helper()
+	var reader io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		reader = bytes.NewReader(b)
+	}
+	req, _ := http.NewRequest(method, e.appURL+path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if user != nil {
+		token, _, err := createAccessToken(user)
+		if err != nil {
+			e.t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			e.t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// call the api as user with a CSV body (if not empty), and return the response body
+func (e *e2e) callCSV(user *models.TenantUser, method string, path string, body string) (int, string) {
+	e.t.Helper()
+	req, _ := http.NewRequest(method, e.appURL+path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/csv")
+	token, _, err := createAccessToken(user)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+// buy a subscription as admin in the emulator, and go through the landing
+// page flow: resolve, activate, and the activation worker
+func (e *e2e) purchase(admin *models.TenantUser, quantity int32) string {
+	e.t.Helper()
+	identity := &saasapi.AADIdentifier{ObjectID: &admin.Oid, TenantID: &admin.Tid, EmailID: &admin.Email}
+	beneficiary := *identity
+	_, token := e.emulator.AddSubscription(saasapi.Subscription{
+		Purchaser:   identity,
+		Beneficiary: &beneficiary,
+		Quantity:    &quantity,
+	})
+
+	resolved := &ResolveResponse{}
+	if status := e.call(admin, http.MethodPost, "/v1/subscriptions/resolve", ResolveRequest{Token: token}, resolved); status != http.StatusOK {
+		e.t.Fatalf("resolve: %d", status)
+	}
+	id := resolved.SubscriptionId
+
+	if status := e.call(admin, http.MethodPost, "/v1/subscriptions/activate", ActivateRequest{SubscriptionId: id}, nil); status != http.StatusAccepted {
+		e.t.Fatalf("activate: %d", status)
+	}
+
+	// activates, then syncs once the term dates are set (the poll is made
+	// due right away instead of waiting for it)
+	e.runActivations()
+	e.makeActivationDue(id)
+	e.runActivations()
+
+	return id
+}
+
+func (e *e2e) runActivations() {
+	e.t.Helper()
+	if err := ProcessSubscriptionActivations(e.ctx); err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+func (e *e2e) makeActivationDue(id string) {
+	e.t.Helper()
+	activation, err := e.repo.GetSubscriptionActivation(e.ctx, id)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	activation.NextAttemptAt = time.Now()
+	if err := e.repo.SaveSubscriptionActivation(e.ctx, activation); err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+// start an operation as the customer would, send its webhook, and run the worker
+func (e *e2e) customerOperation(id string, action saasapi.OperationActionEnum, quantity int32) saasapi.Operation {
+	e.t.Helper()
+	op, err := e.emulator.StartOperation(id, action, "", quantity)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	status, err := e.emulator.SendWebhook(e.ctx, e.appURL+"/v1/webhooks/subscriptions", *op.ID)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		e.t.Fatalf("webhook %s: %d", action, status)
+	}
+	if err := ProcessMarketplaceOperations(e.ctx); err != nil {
+		e.t.Fatal(err)
+	}
+	op, _ = e.emulator.Operation(*op.ID)
+	return op
+}
+
+func (e *e2e) subscription(id string) *models.Subscription {
+	e.t.Helper()
+	subscription, err := e.repo.GetSubscription(e.ctx, id)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return subscription
+}
+
+// --------------------------------------------------------------------------------
+// mailgun stub
+// --------------------------------------------------------------------------------
+type sentEmail struct {
+	To      string
+	Subject string
+}
+
+type mailStub struct {
+	server *httptest.Server
+	mu     sync.Mutex
+	sent   []sentEmail
+}
+
+func newMailStub(t *testing.T) *mailStub {
+	stub := &mailStub{}
+	stub.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(1 << 20)
+		stub.mu.Lock()
+		stub.sent = append(stub.sent, sentEmail{
+			To:      strings.Join(r.Form["to"], ","),
+			Subject: r.FormValue("subject"),
+		})
+		stub.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "<stub@mg.example.com>", "message": "Queued. Thank you."}`))
+	}))
+	t.Cleanup(stub.server.Close)
+	return stub
+}
+
+// whether an email to address has a subject containing text
+func (stub *mailStub) sentTo(address string, text string) bool {
+	return stub.countSentTo(address, text) > 0
+}
+
+// emails to address with a subject containing text
+func (stub *mailStub) countSentTo(address string, text string) int {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	count := 0
+	for _, email := range stub.sent {
+		if strings.Contains(email.To, address) && strings.Contains(email.Subject, text) {
+			count++
+		}
+	}
+	return count
+}
+
+// --------------------------------------------------------------------------------
+// tests
+// --------------------------------------------------------------------------------
+
+func TestE2EPurchaseAndActivate(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	e.emulator.SetTermDelay(time.Hour) // the term dates take a while
+
+	id := e.purchase(admin, 5)
+
+	// activated, but still waiting for the term dates
+	response := &GetActivationResponse{}
+	if status := e.call(admin, http.MethodGet, "/v1/subscriptions/"+id+"/activation", nil, response); status != http.StatusOK {
+		t.Fatalf("get activation: %d", status)
+	}
+	if response.Activation.Status != models.SubscriptionActivationEnumPending || response.Activation.ActivatedAt.IsZero() {
+		t.Fatalf("activation %s, activated at %s; want Pending, activated", response.Activation.Status, response.Activation.ActivatedAt)
+	}
+	marketplaceSubscription, _ := e.emulator.Subscription(id)
+	if *marketplaceSubscription.SaasSubscriptionStatus != saasapi.SubscriptionStatusEnumSubscribed {
+		t.Fatalf("marketplace status = %s", *marketplaceSubscription.SaasSubscriptionStatus)
+	}
+
+	// the term dates show up, and the next poll syncs the subscription
+	e.emulator.SetTermDelay(0)
+	e.makeActivationDue(id)
+	e.runActivations()
+	if status := e.call(admin, http.MethodGet, "/v1/subscriptions/"+id+"/activation", nil, response); status != http.StatusOK {
+		t.Fatalf("get activation: %d", status)
+	}
+	if response.Activation.Status != models.SubscriptionActivationEnumActive || response.Subscription == nil {
+		t.Fatalf("activation %s; want Active with the subscription", response.Activation.Status)
+	}
+	if response.Subscription.Quantity != 5 || response.Subscription.SubscriptionTermEndDate.IsZero() {
+		t.Fatalf("subscription quantity %d, term end %s", response.Subscription.Quantity, response.Subscription.SubscriptionTermEndDate)
+	}
+	if !e.mail.sentTo("help@teraphone.app", "New Subscription") {
+		t.Fatal("no new subscription alert")
+	}
+
+	// someone else may not see it
+	stranger := e.createUser(newTestId())
+	if status := e.call(stranger, http.MethodGet, "/v1/subscriptions/"+id+"/activation", nil, nil); status != http.StatusForbidden {
+		t.Fatalf("stranger got activation: %d", status)
+	}
+}
+
+func TestE2EActivationRetriesMarketplaceErrors(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	_, token := e.emulator.AddSubscription(saasapi.Subscription{})
+	resolved := &ResolveResponse{}
+	e.call(admin, http.MethodPost, "/v1/subscriptions/resolve", ResolveRequest{Token: token}, resolved)
+	e.call(admin, http.MethodPost, "/v1/subscriptions/activate", ActivateRequest{SubscriptionId: resolved.SubscriptionId}, nil)
+
+	e.emulator.FailNext("/activate", 1, http.StatusServiceUnavailable)
+	e.runActivations()
+	activation, _ := e.repo.GetSubscriptionActivation(e.ctx, resolved.SubscriptionId)
+	if activation.Attempts != 1 || activation.LastError == "" || !activation.ActivatedAt.IsZero() {
+		t.Fatalf("after failure: %d attempts, error %q", activation.Attempts, activation.LastError)
+	}
+
+	e.makeActivationDue(resolved.SubscriptionId)
+	e.runActivations()
+	e.makeActivationDue(resolved.SubscriptionId)
+	e.runActivations()
+	activation, _ = e.repo.GetSubscriptionActivation(e.ctx, resolved.SubscriptionId)
+	if activation.Status != models.SubscriptionActivationEnumActive {
+		t.Fatalf("after retry: %s (%s)", activation.Status, activation.LastError)
+	}
+
+	// a failed activation the client activates again keeps its history
+	failed := *activation
+	failed.Status = models.SubscriptionActivationEnumFailed
+	if err := e.repo.SaveSubscriptionActivation(e.ctx, &failed); err != nil {
+		t.Fatal(err)
+	}
+	other := e.createUser(newTestId())
+	response := &ActivateResponse{}
+	if status := e.call(other, http.MethodPost, "/v1/subscriptions/activate", ActivateRequest{SubscriptionId: resolved.SubscriptionId}, response); status != http.StatusAccepted {
+		t.Fatalf("activate again: %d", status)
+	}
+	retried := response.Activation
+	if retried.Status != models.SubscriptionActivationEnumPending || retried.RetriedAt.IsZero() {
+		t.Fatalf("activate again: %s, retried at %s", retried.Status, retried.RetriedAt)
+	}
+	if retried.RequestedBy != admin.Oid || !retried.ActivatedAt.Equal(activation.ActivatedAt) || !retried.CreatedAt.Equal(activation.CreatedAt) {
+		t.Fatalf("activate again lost the activation's history: %+v", retried)
+	}
+}
+
+func TestE2EResolveUnknownToken(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	status := e.call(admin, http.MethodPost, "/v1/subscriptions/resolve", ResolveRequest{Token: "not-a-token"}, nil)
+	if status != http.StatusInternalServerError {
+		t.Fatalf("resolve unknown token: %d", status)
+	}
+}
+
+func TestE2EWebhookRequiresMarketplaceToken(t *testing.T) {
+	e := newE2E(t)
+	body := `{"id": "op", "subscriptionId": "sub", "action": "Suspend"}`
+	resp, err := http.Post(e.appURL+"/v1/webhooks/subscriptions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("webhook without token: %d", resp.StatusCode)
+	}
+}
+
+func TestE2ESuspendAndReinstate(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	id := e.purchase(admin, 5)
+
+	e.customerOperation(id, saasapi.OperationActionEnumSuspend, 0)
+	subscription := e.subscription(id)
+	if subscription.SaaSSubscriptionStatus != models.SubscriptionStatusEnumSuspended || subscription.SuspendedAt.IsZero() {
+		t.Fatalf("after Suspend: %s, suspended at %s", subscription.SaaSSubscriptionStatus, subscription.SuspendedAt)
+	}
+	if !e.mail.sentTo(admin.Email, "suspended") {
+		t.Fatal("purchaser not told about the suspension")
+	}
+
+	// a retry of the webhook doesn't do it again
+	operations, _ := e.repo.ListMarketplaceOperations(e.ctx, id)
+	if len(operations) != 1 || operations[0].Status != models.MarketplaceOperationStatusEnumSucceeded {
+		t.Fatalf("recorded operations = %v", operations)
+	}
+
+	// workers on several instances process the operation once
+	op, err := e.emulator.StartOperation(id, saasapi.OperationActionEnumReinstate, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := e.emulator.SendWebhook(e.ctx, e.appURL+"/v1/webhooks/subscriptions", *op.ID)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("webhook Reinstate: %d %v", status, err)
+	}
+	e.runJobConcurrently(ProcessMarketplaceOperations)
+	op, _ = e.emulator.Operation(*op.ID)
+	if *op.Status != saasapi.OperationStatusEnumSucceeded {
+		t.Fatalf("Reinstate not acknowledged: %s", *op.Status)
+	}
+	operation, err := e.repo.GetMarketplaceOperation(e.ctx, *op.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if operation.Status != models.MarketplaceOperationStatusEnumSucceeded || operation.Attempts != 1 {
+		t.Fatalf("Reinstate operation: %s after %d attempts, want Succeeded after 1", operation.Status, operation.Attempts)
+	}
+	subscription = e.subscription(id)
+	if subscription.SaaSSubscriptionStatus != models.SubscriptionStatusEnumSubscribed || !subscription.SuspendedAt.IsZero() {
+		t.Fatalf("after Reinstate: %s, suspended at %s", subscription.SaaSSubscriptionStatus, subscription.SuspendedAt)
+	}
+}
+
+func TestE2ESuspendGracePeriodEnds(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	id := e.purchase(admin, 5)
+	e.customerOperation(id, saasapi.OperationActionEnumSuspend, 0)
+	if err := e.repo.UpdateSubscription(e.ctx, id, map[string]interface{}{"grace_ends_at": time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// every instance runs the job; the purchaser hears about it once
+	e.runJobConcurrently(EnforceSuspendGracePeriods)
+	if e.subscription(id).AccessRevokedAt.IsZero() {
+		t.Fatal("access not revoked after the grace period")
+	}
+	if count := e.mail.countSentTo(admin.Email, "no longer active"); count != 1 {
+		t.Fatalf("%d grace period emails, want 1", count)
+	}
+}
+
+func TestE2EChangeQuantity(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	id := e.purchase(admin, 5)
+	for i := 0; i < 3; i++ {
+		user := e.createUser(admin.Tid)
+		if err := e.repo.SetUserSubscription(e.ctx, user.Oid, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	settings := models.DefaultSubscriptionSettings(id)
+	settings.OverAllocationPolicy = models.OverAllocationPolicyEnumReject
+	if err := e.repo.SaveSubscriptionSettings(e.ctx, settings); err != nil {
+		t.Fatal(err)
+	}
+
+	// fewer seats than assigned users: rejected
+	op := e.customerOperation(id, saasapi.OperationActionEnumChangeQuantity, 2)
+	if *op.Status != saasapi.OperationStatusEnumFailed {
+		t.Fatalf("quantity below assigned seats: operation %s, want Failed", *op.Status)
+	}
+	marketplaceSubscription, _ := e.emulator.Subscription(id)
+	if *marketplaceSubscription.Quantity != 5 || e.subscription(id).Quantity != 5 {
+		t.Fatalf("quantity changed after rejection")
+	}
+	if !e.mail.sentTo(admin.Email, "rejected") {
+		t.Fatal("admin not told about the rejection")
+	}
+
+	// enough seats: accepted
+	op = e.customerOperation(id, saasapi.OperationActionEnumChangeQuantity, 4)
+	if *op.Status != saasapi.OperationStatusEnumSucceeded {
+		t.Fatalf("quantity above assigned seats: operation %s, want Succeeded", *op.Status)
+	}
+	if quantity := e.subscription(id).Quantity; quantity != 4 {
+		t.Fatalf("quantity = %d, want 4", quantity)
+	}
+}
+
+func TestE2ESeatOverageUnassigned(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	id := e.purchase(admin, 5)
+	for i := 0; i < 3; i++ {
+		user := e.createUser(admin.Tid)
+		if err := e.repo.SetUserSubscription(e.ctx, user.Oid, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// fewer seats than assigned users: accepted, with a notice period
+	op := e.customerOperation(id, saasapi.OperationActionEnumChangeQuantity, 1)
+	if *op.Status != saasapi.OperationStatusEnumSucceeded {
+		t.Fatalf("quantity below assigned seats: operation %s, want Succeeded", *op.Status)
+	}
+	if e.subscription(id).OverAllocationUnassignAt.IsZero() {
+		t.Fatal("no unassignment scheduled")
+	}
+	if err := e.repo.UpdateSubscription(e.ctx, id, map[string]interface{}{"over_allocation_unassign_at": time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// every instance runs the job; the extra users are unassigned and the admins told once
+	e.runJobConcurrently(EnforceSeatOverages)
+	if count, _ := e.repo.CountSubscriptionUsers(e.ctx, id); count != 1 {
+		t.Fatalf("%d users assigned, want 1", count)
+	}
+	if count := e.countLedgerEvents(id, models.LedgerEventEnumSeatUnassigned); count != 2 {
+		t.Fatalf("%d unassignments recorded, want 2", count)
+	}
+	if count := e.mail.countSentTo(admin.Email, "were unassigned"); count != 1 {
+		t.Fatalf("%d unassignment emails, want 1", count)
+	}
+}
+
+func TestE2EReconcileMissedWebhook(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	id := e.purchase(admin, 5)
+
+	// suspended without telling us, and an operation we never heard about
+	e.emulator.UpdateSubscription(id, func(subscription *saasapi.Subscription) {
+		subscription.SaasSubscriptionStatus = to(saasapi.SubscriptionStatusEnumSuspended)
+	})
+
+	// skipped while another instance is running it
+	release, locked, err := e.repo.TryAdvisoryLock(e.ctx, "subscription-reconciliation")
+	if err != nil || !locked {
+		t.Fatalf("lock: %v, %v", locked, err)
+	}
+	if err := ReconcileSubscriptions(e.ctx); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if subscription := e.subscription(id); !subscription.SuspendedAt.IsZero() {
+		t.Fatal("reconciled while another instance held the lock")
+	}
+
+	if err := ReconcileSubscriptions(e.ctx); err != nil {
+		t.Fatal(err)
+	}
+	subscription := e.subscription(id)
+	if subscription.SaaSSubscriptionStatus != models.SubscriptionStatusEnumSuspended || subscription.SuspendedAt.IsZero() {
+		t.Fatalf("after reconciliation: %s, suspended at %s", subscription.SaaSSubscriptionStatus, subscription.SuspendedAt)
+	}
+	if !e.mail.sentTo("help@teraphone.app", "Reconciliation") {
+		t.Fatal("no reconciliation report")
+	}
+
+	// a purchase that was never activated is reported, not created
+	unactivated, _ := e.emulator.AddSubscription(saasapi.Subscription{})
+	if err := ReconcileSubscriptions(e.ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.repo.GetSubscription(e.ctx, unactivated); !errors.Is(err, repository.ErrNotFound) {
+		t.Fatalf("unactivated subscription saved by reconciliation: %v", err)
+	}
+
+	op, _ := e.emulator.StartOperation(id, saasapi.OperationActionEnumReinstate, "", 0)
+	if err := ReconcileSubscriptions(e.ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.repo.GetMarketplaceOperation(e.ctx, *op.ID); err != nil {
+		t.Fatalf("outstanding operation not queued: %v", err)
+	}
+	if err := ProcessMarketplaceOperations(e.ctx); err != nil {
+		t.Fatal(err)
+	}
+	if subscription := e.subscription(id); !subscription.SuspendedAt.IsZero() {
+		t.Fatal("still suspended after the queued Reinstate")
+	}
+}
+
+// poll an operation we started now instead of waiting for the worker's interval
+func (e *e2e) pollPublisherOperation(id string) *models.PublisherOperation {
+	e.t.Helper()
+	operation, err := e.repo.GetPublisherOperation(e.ctx, id)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	operation.NextAttemptAt = time.Now()
+	if err := e.repo.SavePublisherOperation(e.ctx, operation); err != nil {
+		e.t.Fatal(err)
+	}
+	if err := ProcessPublisherOperations(e.ctx); err != nil {
+		e.t.Fatal(err)
+	}
+	operation, err = e.repo.GetPublisherOperation(e.ctx, id)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return operation
+}
+
+func TestE2EChangePlanAndQuantity(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	id := e.purchase(admin, 5)
+	e.emulator.SetPlans(
+		&saasapi.Plan{PlanID: to("basic"), DisplayName: to("Basic"), IsPricePerSeat: to(true), PlanComponents: &saasapi.PlanComponents{
+			RecurrentBillingTerms: []*saasapi.RecurrentBillingTerm{{Currency: to("USD"), Price: to(float32(4)), TermUnit: to(saasapi.TermUnitEnumP1M)}},
+		}},
+		&saasapi.Plan{PlanID: to("pro"), DisplayName: to("Professional"), IsPricePerSeat: to(true), PlanComponents: &saasapi.PlanComponents{
+			RecurrentBillingTerms: []*saasapi.RecurrentBillingTerm{{Currency: to("USD"), Price: to(float32(8)), TermUnit: to(saasapi.TermUnitEnumP1M)}},
+		}},
+		&saasapi.Plan{PlanID: to("legacy"), IsStopSell: to(true)},
+	)
+
+	plans := GetSubscriptionPlansResponse{}
+	if status := e.call(admin, "GET", "/v1/subscriptions/"+id+"/plans", nil, &plans); status != 200 {
+		t.Fatalf("get plans: %d", status)
+	}
+	if len(plans.Plans) != 2 || !plans.Plans[0].IsCurrent || plans.Plans[1].Prices[0].Price != 8 {
+		t.Fatalf("plans = %+v", plans.Plans)
+	}
+	outsider := e.createUser(newTestId())
+	if status := e.call(outsider, "GET", "/v1/subscriptions/"+id+"/plans", nil, nil); status != 403 {
+		t.Fatalf("get plans as a non-admin: %d, want 403", status)
+	}
+
+	// the change stays in progress until the Marketplace completes it
+	e.emulator.HoldOperations(true)
+	changed := ChangeSubscriptionResponse{}
+	if status := e.call(admin, "PATCH", "/v1/subscriptions/"+id+"/plan", ChangeSubscriptionPlanRequest{PlanId: "legacy"}, nil); status != 400 {
+		t.Fatalf("change to a plan no longer sold: %d, want 400", status)
+	}
+	if status := e.call(admin, "PATCH", "/v1/subscriptions/"+id+"/plan", ChangeSubscriptionPlanRequest{PlanId: "pro"}, &changed); status != 202 {
+		t.Fatalf("change plan: %d", status)
+	}
+	if status := e.call(admin, "PATCH", "/v1/subscriptions/"+id+"/quantity", ChangeSubscriptionQuantityRequest{Quantity: 8}, nil); status != 409 {
+		t.Fatalf("change quantity during a plan change: %d, want 409", status)
+	}
+	if operation := e.pollPublisherOperation(changed.Operation.Id); operation.Status != models.PublisherOperationStatusEnumInProgress {
+		t.Fatalf("operation %s before the Marketplace completed it", operation.Status)
+	}
+	if err := e.emulator.CompleteOperation(changed.Operation.Id, saasapi.OperationStatusEnumSucceeded); err != nil {
+		t.Fatal(err)
+	}
+	if operation := e.pollPublisherOperation(changed.Operation.Id); operation.Status != models.PublisherOperationStatusEnumSucceeded {
+		t.Fatalf("operation %s after the Marketplace completed it: %s", operation.Status, operation.LastError)
+	}
+	if planId := e.subscription(id).PlanId; planId != "pro" {
+		t.Fatalf("plan = %s, want pro", planId)
+	}
+	if !e.mail.sentTo(admin.Email, "was changed") {
+		t.Fatal("admin not told about the plan change")
+	}
+
+	// a failed change leaves the subscription as it was
+	if status := e.call(admin, "PATCH", "/v1/subscriptions/"+id+"/quantity", ChangeSubscriptionQuantityRequest{Quantity: 8}, &changed); status != 202 {
+		t.Fatalf("change quantity: %d", status)
+	}
+	if err := e.emulator.CompleteOperation(changed.Operation.Id, saasapi.OperationStatusEnumFailed); err != nil {
+		t.Fatal(err)
+	}
+	if operation := e.pollPublisherOperation(changed.Operation.Id); operation.Status != models.PublisherOperationStatusEnumFailed {
+		t.Fatalf("operation %s after the Marketplace failed it", operation.Status)
+	}
+	if quantity := e.subscription(id).Quantity; quantity != 5 {
+		t.Fatalf("quantity = %d after a failed change, want 5", quantity)
+	}
+
+	// the reject policy refuses fewer seats than assigned users up front
+	for i := 0; i < 3; i++ {
+		user := e.createUser(admin.Tid)
+		if err := e.repo.SetUserSubscription(e.ctx, user.Oid, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	settings := models.DefaultSubscriptionSettings(id)
+	settings.OverAllocationPolicy = models.OverAllocationPolicyEnumReject
+	if err := e.repo.SaveSubscriptionSettings(e.ctx, settings); err != nil {
+		t.Fatal(err)
+	}
+	if status := e.call(admin, "PATCH", "/v1/subscriptions/"+id+"/quantity", ChangeSubscriptionQuantityRequest{Quantity: 2}, nil); status != 409 {
+		t.Fatalf("quantity below assigned seats: %d, want 409", status)
+	}
+
+	operations := GetSubscriptionOperationsResponse{}
+	if status := e.call(admin, "GET", "/v1/subscriptions/"+id+"/operations", nil, &operations); status != 200 || len(operations.Operations) != 2 {
+		t.Fatalf("get operations: %d, %+v", status, operations.Operations)
+	}
+}
+
+func TestE2ECancel(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	id := e.purchase(admin, 5)
+	user := e.createUser(admin.Tid)
+	if err := e.repo.SetUserSubscription(e.ctx, user.Oid, id); err != nil {
+		t.Fatal(err)
+	}
+	path := "/v1/subscriptions/" + id + "/cancellation"
+
+	if status := e.call(admin, "POST", path, RequestSubscriptionCancellationRequest{ReasonCode: "bored"}, nil); status != 400 {
+		t.Fatalf("request with an unknown reason: %d, want 400", status)
+	}
+	requested := RequestSubscriptionCancellationResponse{}
+	if status := e.call(admin, "POST", path, RequestSubscriptionCancellationRequest{ReasonCode: models.CancellationReasonEnumTooExpensive, Comment: "over budget"}, &requested); status != 200 {
+		t.Fatalf("request cancellation: %d", status)
+	}
+	if requested.Assigned != 1 || requested.ConfirmationToken == "" {
+		t.Fatalf("requested: %d assigned, token %q", requested.Assigned, requested.ConfirmationToken)
+	}
+	if e.subscription(id).SaaSSubscriptionStatus != models.SubscriptionStatusEnumSubscribed {
+		t.Fatal("cancelled before confirmation")
+	}
+
+	if status := e.call(admin, "POST", path+"/confirm", ConfirmSubscriptionCancellationRequest{ConfirmationToken: "wrong"}, nil); status != 403 {
+		t.Fatalf("confirm with the wrong token: %d, want 403", status)
+	}
+	confirmed := ConfirmSubscriptionCancellationResponse{}
+	if status := e.call(admin, "POST", path+"/confirm", ConfirmSubscriptionCancellationRequest{ConfirmationToken: requested.ConfirmationToken}, &confirmed); status != 202 {
+		t.Fatalf("confirm cancellation: %d", status)
+	}
+	if confirmed.Cancellation.Status != models.SubscriptionCancellationStatusEnumCancelling {
+		t.Fatalf("after confirmation: %s", confirmed.Cancellation.Status)
+	}
+	if status := e.call(admin, "POST", path+"/confirm", ConfirmSubscriptionCancellationRequest{ConfirmationToken: requested.ConfirmationToken}, nil); status != 409 {
+		t.Fatalf("confirm twice: %d, want 409", status)
+	}
+
+	if operation := e.pollPublisherOperation(confirmed.Operation.Id); operation.Status != models.PublisherOperationStatusEnumSucceeded {
+		t.Fatalf("operation %s: %s", operation.Status, operation.LastError)
+	}
+	subscription := e.subscription(id)
+	if subscription.SaaSSubscriptionStatus != models.SubscriptionStatusEnumUnsubscribed || subscription.UnsubscribedAt.IsZero() {
+		t.Fatalf("after cancellation: %s, unsubscribed at %s", subscription.SaaSSubscriptionStatus, subscription.UnsubscribedAt)
+	}
+	if count, _ := e.repo.CountSubscriptionUsers(e.ctx, id); count != 0 {
+		t.Fatalf("%d users still assigned", count)
+	}
+	cancellation := GetSubscriptionCancellationResponse{}
+	if status := e.call(admin, "GET", path, nil, &cancellation); status != 200 {
+		t.Fatalf("get cancellation: %d", status)
+	}
+	if cancellation.Cancellation.Status != models.SubscriptionCancellationStatusEnumCancelled ||
+		cancellation.Cancellation.ReasonCode != models.CancellationReasonEnumTooExpensive ||
+		cancellation.Cancellation.CancelledAt.IsZero() {
+		t.Fatalf("cancellation = %+v", cancellation.Cancellation)
+	}
+	if !e.mail.sentTo(admin.Email, "has been cancelled") {
+		t.Fatal("purchaser not told about the cancellation")
+	}
+
+	// a cancelled subscription takes no seats, one at a time or in bulk
+	newcomer := e.createUser(admin.Tid)
+	if status := e.call(admin, "PATCH", "/v1/subscriptions/"+admin.Tid+"/users/"+newcomer.Oid, AssignUserSubscriptionRequest{SubscriptionId: id}, nil); status != 409 {
+		t.Fatalf("seat assigned on a cancelled subscription: %d", status)
+	}
+	if status := e.call(admin, "POST", "/v1/subscriptions/"+id+"/seats", AssignSubscriptionSeatsRequest{Oids: []string{newcomer.Oid}}, nil); status != 409 {
+		t.Fatalf("seats assigned on a cancelled subscription: %d", status)
+	}
+}
+
+func TestE2ECancelReconciledByWebhook(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	id := e.purchase(admin, 5)
+	path := "/v1/subscriptions/" + id + "/cancellation"
+	e.emulator.HoldOperations(true)
+
+	// the Marketplace fails the first attempt
+	requested := RequestSubscriptionCancellationResponse{}
+	confirmed := ConfirmSubscriptionCancellationResponse{}
+	e.call(admin, "POST", path, RequestSubscriptionCancellationRequest{ReasonCode: models.CancellationReasonEnumNotUsing}, &requested)
+	if status := e.call(admin, "POST", path+"/confirm", ConfirmSubscriptionCancellationRequest{ConfirmationToken: requested.ConfirmationToken}, &confirmed); status != 202 {
+		t.Fatalf("confirm cancellation: %d", status)
+	}
+	if err := e.emulator.CompleteOperation(confirmed.Operation.Id, saasapi.OperationStatusEnumFailed); err != nil {
+		t.Fatal(err)
+	}
+	e.pollPublisherOperation(confirmed.Operation.Id)
+	cancellation, err := e.repo.GetSubscriptionCancellation(e.ctx, id)
+	if err != nil || cancellation.Status != models.SubscriptionCancellationStatusEnumFailed {
+		t.Fatalf("after the Marketplace failed it: %+v, %v", cancellation, err)
+	}
+	if !e.mail.sentTo(admin.Email, "cancellation of your subscription") {
+		t.Fatal("admins not told about the failed cancellation")
+	}
+
+	// the second attempt completes through the Unsubscribe webhook, before the worker polls it
+	e.call(admin, "POST", path, RequestSubscriptionCancellationRequest{ReasonCode: models.CancellationReasonEnumNotUsing}, &requested)
+	if status := e.call(admin, "POST", path+"/confirm", ConfirmSubscriptionCancellationRequest{ConfirmationToken: requested.ConfirmationToken}, &confirmed); status != 202 {
+		t.Fatalf("confirm cancellation again: %d", status)
+	}
+	if err := e.emulator.CompleteOperation(confirmed.Operation.Id, saasapi.OperationStatusEnumSucceeded); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := e.emulator.SendWebhook(e.ctx, e.appURL+"/v1/webhooks/subscriptions", confirmed.Operation.Id); err != nil || status != http.StatusOK {
+		t.Fatalf("webhook: %d, %v", status, err)
+	}
+	if err := ProcessMarketplaceOperations(e.ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancellation, err = e.repo.GetSubscriptionCancellation(e.ctx, id)
+	if err != nil || cancellation.Status != models.SubscriptionCancellationStatusEnumCancelled {
+		t.Fatalf("after the Unsubscribe webhook: %+v, %v", cancellation, err)
+	}
+	if operation := e.pollPublisherOperation(confirmed.Operation.Id); operation.Status != models.PublisherOperationStatusEnumSucceeded {
+		t.Fatalf("operation %s: %s", operation.Status, operation.LastError)
+	}
+}
+
+func TestE2EReportUsage(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	id := e.purchase(admin, 5)
+
+	// half an hour in a room during the last complete hour
+	hour := time.Now().Add(-usageReportDelay).UTC().Truncate(time.Hour).Add(-time.Hour)
+	err := e.repo.CreateParticipantSession(e.ctx, &models.ParticipantSession{
+		Sid:            newTestId(),
+		Oid:            admin.Oid,
+		SubscriptionId: id,
+		RoomName:       newTestId(),
+		JoinedAt:       hour.Add(5 * time.Minute),
+		LeftAt:         hour.Add(35 * time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reporting twice sends the hour once
+	for i := 0; i < 2; i++ {
+		if err := ReportUsage(e.ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events := []saasapi.UsageEventResult{}
+	for _, event := range e.emulator.UsageEvents() {
+		if event.ResourceID == id {
+			events = append(events, event)
+		}
+	}
+	if len(events) != 1 || events[0].Quantity != 30 || !events[0].EffectiveStartTime.Equal(hour) || events[0].Dimension != participantMinutesDimension {
+		t.Fatalf("usage events = %+v, want 30 minutes for %s", events, hour)
+	}
+
+	reports, err := e.repo.ListUsageReports(e.ctx, id, hour.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Status != models.UsageReportStatusEnumAccepted || reports[0].UsageEventId != events[0].UsageEventID {
+		t.Fatalf("usage reports = %+v", reports)
+	}
+}
+
+func to[T any](v T) *T {
+	return &v
+}
+
+func TestE2ELedger(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	id := e.purchase(admin, 5)
+	user := e.createUser(admin.Tid)
+	usersPath := "/v1/subscriptions/" + admin.Tid + "/users/" + user.Oid
+
+	if status := e.call(admin, "PATCH", usersPath, AssignUserSubscriptionRequest{SubscriptionId: id}, nil); status != 200 {
+		t.Fatalf("assign: %d", status)
+	}
+	changed := ChangeSubscriptionResponse{}
+	if status := e.call(admin, "PATCH", "/v1/subscriptions/"+id+"/quantity", ChangeSubscriptionQuantityRequest{Quantity: 8}, &changed); status != 202 {
+		t.Fatalf("change quantity: %d", status)
+	}
+	if operation := e.pollPublisherOperation(changed.Operation.Id); operation.Status != models.PublisherOperationStatusEnumSucceeded {
+		t.Fatalf("operation %s: %s", operation.Status, operation.LastError)
+	}
+	if status := e.call(admin, "PATCH", usersPath, AssignUserSubscriptionRequest{}, nil); status != 200 {
+		t.Fatalf("unassign: %d", status)
+	}
+
+	ledger := GetSubscriptionLedgerResponse{}
+	if status := e.call(admin, "GET", "/v1/subscriptions/"+id+"/ledger", nil, &ledger); status != 200 {
+		t.Fatalf("get ledger: %d", status)
+	}
+	entries := ledger.Entries
+	if len(entries) != 4 {
+		t.Fatalf("ledger = %+v, want 4 entries", entries)
+	}
+	// newest first
+	if entries[0].Event != models.LedgerEventEnumSeatUnassigned || entries[0].UserOid != user.Oid || entries[0].Actor != admin.Oid {
+		t.Errorf("unassign entry = %+v", entries[0])
+	}
+	if entries[1].Event != models.LedgerEventEnumSubscriptionChanged || entries[1].Operation != "ChangeQuantity" ||
+		entries[1].OperationId != changed.Operation.Id || entries[1].Actor != admin.Oid || !strings.Contains(entries[1].Changes, "quantity: 5 -> 8") {
+		t.Errorf("quantity entry = %+v", entries[1])
+	}
+	if entries[2].Event != models.LedgerEventEnumSeatAssigned || entries[2].UserOid != user.Oid || entries[2].Operation != "AssignSeat" {
+		t.Errorf("assign entry = %+v", entries[2])
+	}
+	if entries[3].Operation != "Activate" || entries[3].Changes != "created" || entries[3].Actor != admin.Oid {
+		t.Errorf("activation entry = %+v", entries[3])
+	}
+
+	page := GetSubscriptionLedgerResponse{}
+	if status := e.call(admin, "GET", fmt.Sprintf("/v1/subscriptions/%s/ledger?limit=2&before=%d", id, entries[1].Id), nil, &page); status != 200 {
+		t.Fatalf("get ledger page: %d", status)
+	}
+	if len(page.Entries) != 2 || page.Entries[0].Id != entries[2].Id {
+		t.Fatalf("page before %d = %+v", entries[1].Id, page.Entries)
+	}
+	outsider := e.createUser(newTestId())
+	if status := e.call(outsider, "GET", "/v1/subscriptions/"+id+"/ledger", nil, nil); status != 403 {
+		t.Fatalf("get ledger as a non-admin: %d, want 403", status)
+	}
+}
+
+func TestE2EAssignSeats(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	id := e.purchase(admin, 3)
+	path := "/v1/subscriptions/" + id + "/seats"
+	alice := e.createUser(admin.Tid)
+	bob := e.createUser(admin.Tid)
+	carol := e.createUser(admin.Tid)
+	dave := e.createUser(admin.Tid)
+	stranger := e.createUser(newTestId())
+
+	// by oid and email; unknown users and users of other tenants aren't found
+	assigned := AssignSubscriptionSeatsResponse{}
+	req := AssignSubscriptionSeatsRequest{Oids: []string{alice.Oid, stranger.Oid}, Emails: []string{strings.ToUpper(bob.Email), "nobody@example.com"}}
+	if status := e.call(admin, "POST", path, req, &assigned); status != 200 {
+		t.Fatalf("assign: %d", status)
+	}
+	if assigned.Assigned != 2 || assigned.Seats != 2 || len(assigned.Results) != 4 {
+		t.Fatalf("assigned = %+v", assigned)
+	}
+	statuses := []models.SeatAssignmentStatusEnum{}
+	for _, result := range assigned.Results {
+		statuses = append(statuses, result.Status)
+	}
+	if fmt.Sprint(statuses) != "[Assigned NotFound Assigned NotFound]" {
+		t.Fatalf("statuses = %v", statuses)
+	}
+
+	// two more don't fit in the last seat: nobody is assigned
+	req = AssignSubscriptionSeatsRequest{Oids: []string{alice.Oid, carol.Oid, dave.Oid}}
+	if status := e.call(admin, "POST", path, req, nil); status != 409 {
+		t.Fatalf("assign over the quantity: %d, want 409", status)
+	}
+	if count, _ := e.repo.CountSubscriptionUsers(e.ctx, id); count != 2 {
+		t.Fatalf("%d seats assigned after a failed bulk assignment, want 2", count)
+	}
+
+	// a CSV file, e.g. a filtered export
+	status, body := e.callCSV(admin, "POST", path, "oid,email\n,"+carol.Email+"\n"+alice.Oid+",\n")
+	if status != 200 {
+		t.Fatalf("assign from csv: %d %s", status, body)
+	}
+	if count, _ := e.repo.CountSubscriptionUsers(e.ctx, id); count != 3 {
+		t.Fatalf("%d seats assigned, want 3", count)
+	}
+	if status := e.call(stranger, "POST", path, AssignSubscriptionSeatsRequest{Oids: []string{dave.Oid}}, nil); status != 403 {
+		t.Fatalf("assign as a non-admin: %d, want 403", status)
+	}
+
+	// export
+	status, body = e.callCSV(admin, "GET", "/v1/subscriptions/"+admin.Tid+"/users/export", "")
+	if status != 200 {
+		t.Fatalf("export: %d", status)
+	}
+	rows, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 6 || rows[0][0] != "oid" || rows[0][5] != "assigned" {
+		t.Fatalf("export = %q", rows)
+	}
+	assignedRows := 0
+	for _, row := range rows[1:] {
+		if row[5] == "true" {
+			assignedRows++
+			if row[6] != id {
+				t.Errorf("row %q: want subscription %s", row, id)
+			}
+		}
+	}
+	if assignedRows != 3 {
+		t.Fatalf("export has %d assigned users, want 3: %q", assignedRows, rows)
+	}
+	if status, _ := e.callCSV(alice, "GET", "/v1/subscriptions/"+admin.Tid+"/users/export", ""); status != 403 {
+		t.Fatalf("export as a non-admin: %d, want 403", status)
+	}
+}
+
+func TestE2EAutoAssign(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	id := e.purchase(admin, 3)
+	settingsPath := "/v1/subscriptions/" + id + "/settings"
+	existing := e.createUser(admin.Tid)
+
+	// a team of the tenant, with one more member than there are seats
+	team := &models.TenantTeam{Id: newTestId(), Tid: admin.Tid, DisplayName: "Sales"}
+	if err := e.repo.CreateTeam(e.ctx, team); err != nil {
+		t.Fatal(err)
+	}
+	members := []*models.TenantUser{}
+	for i := 0; i < 4; i++ {
+		member := e.createUser(admin.Tid)
+		if err := e.repo.AddTeamMember(e.ctx, team.Id, member.Oid); err != nil {
+			t.Fatal(err)
+		}
+		members = append(members, member)
+	}
+	otherTeam := &models.TenantTeam{Id: newTestId(), Tid: newTestId()}
+	if err := e.repo.CreateTeam(e.ctx, otherTeam); err != nil {
+		t.Fatal(err)
+	}
+
+	// new users: only those who sign up after the policy is on
+	enable := true
+	if status := e.call(admin, "PATCH", settingsPath, UpdateSubscriptionSettingsRequest{AutoAssignNewUsers: &enable}, nil); status != 200 {
+		t.Fatalf("enable auto-assign: %d", status)
+	}
+	if assigned, err := autoAssignUser(e.ctx, e.repo, existing); err != nil || assigned != "" {
+		t.Fatalf("user from before the policy: assigned to %q, %v", assigned, err)
+	}
+	newcomer := e.createUser(admin.Tid)
+	if assigned, err := autoAssignUser(e.ctx, e.repo, newcomer); err != nil || assigned != id {
+		t.Fatalf("new user: assigned to %q, %v", assigned, err)
+	}
+
+	// an admin's unassignment sticks
+	if status := e.call(admin, "PATCH", "/v1/subscriptions/"+admin.Tid+"/users/"+newcomer.Oid, AssignUserSubscriptionRequest{}, nil); status != 200 {
+		t.Fatalf("unassign: %d", status)
+	}
+	newcomer.SubscriptionId = ""
+	if assigned, err := autoAssignUser(e.ctx, e.repo, newcomer); err != nil || assigned != "" {
+		t.Fatalf("unassigned user signing in again: assigned to %q, %v", assigned, err)
+	}
+
+	// team members, by the backfill, until the seats run out
+	if status := e.call(admin, "PATCH", settingsPath, UpdateSubscriptionSettingsRequest{AutoAssignTeamIds: &[]string{otherTeam.Id}}, nil); status != 400 {
+		t.Fatalf("auto-assign another tenant's team: %d, want 400", status)
+	}
+	settings := UpdateSubscriptionSettingsResponse{}
+	if status := e.call(admin, "PATCH", settingsPath, UpdateSubscriptionSettingsRequest{AutoAssignTeamIds: &[]string{team.Id}}, &settings); status != 200 {
+		t.Fatalf("auto-assign team: %d", status)
+	}
+	if !settings.Settings.AutoAssignNewUsers || fmt.Sprint(settings.Settings.AutoAssignTeamIds) != "["+team.Id+"]" {
+		t.Fatalf("settings = %+v", settings.Settings)
+	}
+	for i := 0; i < 2; i++ {
+		if err := BackfillAutoAssignments(e.ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, _ := e.repo.CountSubscriptionUsers(e.ctx, id); count != 3 {
+		t.Fatalf("%d seats assigned, want 3", count)
+	}
+	for i, member := range members {
+		user, _ := e.repo.GetUser(e.ctx, member.Oid)
+		if assigned := user.SubscriptionId == id; assigned != (i < 3) {
+			t.Errorf("member %d assigned: %v", i, assigned)
+		}
+	}
+	if count := e.mail.countSentTo(admin.Email, "no seats left"); count != 1 {
+		t.Fatalf("admins told %d times that the seats ran out, want once", count)
+	}
+	if e.subscription(id).SeatsExhaustedAt.IsZero() {
+		t.Fatal("seats not marked exhausted")
+	}
+}
+
+func TestE2ESeatRequests(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	requester := e.createUser(admin.Tid)
+	other := e.createUser(admin.Tid)
+
+	// nobody to ask yet
+	if status := e.call(requester, "POST", "/v1/private/seat-request", RequestSeatRequest{}, nil); status != 404 {
+		t.Fatalf("request without a subscription: %d, want 404", status)
+	}
+
+	id := e.purchase(admin, 1)
+	requestsPath := "/v1/subscriptions/" + id + "/seat-requests"
+
+	// asking twice makes one request and one email
+	created := SeatRequestResponse{}
+	for i := 0; i < 2; i++ {
+		if status := e.call(requester, "POST", "/v1/private/seat-request", RequestSeatRequest{Message: "for the sales calls"}, &created); status != 200 {
+			t.Fatalf("request seat: %d", status)
+		}
+	}
+	if count := e.mail.countSentTo(admin.Email, "requested a Teraphone seat"); count != 1 {
+		t.Fatalf("admins notified %d times, want once", count)
+	}
+	otherRequest := SeatRequestResponse{}
+	if status := e.call(other, "POST", "/v1/private/seat-request", RequestSeatRequest{}, &otherRequest); status != 200 {
+		t.Fatalf("request seat: %d", status)
+	}
+
+	// only admins see and decide requests
+	if status := e.call(requester, "GET", requestsPath, nil, nil); status != 403 {
+		t.Fatalf("list as non-admin: %d, want 403", status)
+	}
+	pending := GetSubscriptionSeatRequestsResponse{}
+	if status := e.call(admin, "GET", requestsPath, nil, &pending); status != 200 || len(pending.Requests) != 2 {
+		t.Fatalf("list: %d, %d requests", status, len(pending.Requests))
+	}
+
+	// approve assigns the seat, once
+	approvePath := fmt.Sprintf("%s/%d/approve", requestsPath, created.Request.Id)
+	if status := e.call(admin, "POST", approvePath, nil, nil); status != 200 {
+		t.Fatalf("approve: %d", status)
+	}
+	if user, _ := e.repo.GetUser(e.ctx, requester.Oid); user.SubscriptionId != id {
+		t.Fatalf("approved user on %q", user.SubscriptionId)
+	}
+	if status := e.call(admin, "POST", approvePath, nil, nil); status != 409 {
+		t.Fatalf("approve twice: %d, want 409", status)
+	}
+	if !e.mail.sentTo(requester.Email, "approved") {
+		t.Fatal("requester not told of the approval")
+	}
+	if status := e.call(requester, "POST", "/v1/private/seat-request", RequestSeatRequest{}, nil); status != 409 {
+		t.Fatalf("request with a seat: %d, want 409", status)
+	}
+
+	// no seats left for the other request; it stays pending until denied
+	otherPath := fmt.Sprintf("%s/%d", requestsPath, otherRequest.Request.Id)
+	if status := e.call(admin, "POST", otherPath+"/approve", nil, nil); status != 409 {
+		t.Fatalf("approve without seats: %d, want 409", status)
+	}
+	if status := e.call(admin, "POST", otherPath+"/deny", DenySeatRequestRequest{Reason: "no budget this quarter"}, nil); status != 200 {
+		t.Fatalf("deny: %d", status)
+	}
+	latest := SeatRequestResponse{}
+	if status := e.call(other, "GET", "/v1/private/seat-request", nil, &latest); status != 200 {
+		t.Fatalf("get request: %d", status)
+	}
+	if latest.Request.Status != models.SeatRequestStatusEnumDenied || latest.Request.Reason != "no budget this quarter" {
+		t.Fatalf("denied request = %+v", latest.Request)
+	}
+	if !e.mail.sentTo(other.Email, "no budget this quarter") {
+		t.Fatal("requester not told why they were denied")
+	}
+}
+
+// run a job as every instance would, all at once
+func (e *e2e) runJobConcurrently(job func(ctx context.Context) error) {
+	e.t.Helper()
+	errs := make([]error, 3)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = job(e.ctx)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			e.t.Fatal(err)
+		}
+	}
+}
+
+// count the subscription's seat events in its ledger
+func (e *e2e) countLedgerEvents(subscriptionId string, event models.LedgerEventEnum) int {
+	e.t.Helper()
+	entries, err := e.repo.ListLedgerEntries(e.ctx, subscriptionId, 0, 1000)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	count := 0
+	for _, entry := range entries {
+		if entry.Event == event {
+			count++
+		}
+	}
+	return count
+}
+
+func TestE2EConcurrentSeatAssignments(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	id := e.purchase(admin, 3)
+	users := []*models.TenantUser{}
+	for i := 0; i < 12; i++ {
+		users = append(users, e.createUser(admin.Tid))
+	}
+
+	// everyone at once, for 3 seats
+	statuses := make([]int, len(users))
+	var wg sync.WaitGroup
+	for i, user := range users {
+		wg.Add(1)
+		go func(i int, user *models.TenantUser) {
+			defer wg.Done()
+			statuses[i] = e.call(admin, "PATCH", "/v1/subscriptions/"+admin.Tid+"/users/"+user.Oid, AssignUserSubscriptionRequest{SubscriptionId: id}, nil)
+		}(i, user)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, status := range statuses {
+		switch status {
+		case 200:
+			succeeded++
+		case 403:
+		default:
+			t.Fatalf("assign: %d", status)
+		}
+	}
+	if count, _ := e.repo.CountSubscriptionUsers(e.ctx, id); count != 3 || succeeded != 3 {
+		t.Fatalf("%d seats assigned, %d assignments succeeded, want 3", count, succeeded)
+	}
+	if count := e.countLedgerEvents(id, models.LedgerEventEnumSeatAssigned); count != 3 {
+		t.Fatalf("%d seats recorded, want 3", count)
+	}
+}
+
+func TestE2EConcurrentSeatChanges(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	id := e.purchase(admin, 5)
+	users := []models.TenantUser{}
+	for i := 0; i < 15; i++ {
+		users = append(users, *e.createUser(admin.Tid))
+	}
+	subscription := e.subscription(id)
+
+	// the single, bulk and automatic paths race for the same seats
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(3)
+		single := users[i]
+		go func() {
+			defer wg.Done()
+			e.call(admin, "PATCH", "/v1/subscriptions/"+admin.Tid+"/users/"+single.Oid, AssignUserSubscriptionRequest{SubscriptionId: id}, nil)
+		}()
+		bulk := []string{users[5+i].Oid}
+		go func() {
+			defer wg.Done()
+			e.call(admin, "POST", "/v1/subscriptions/"+id+"/seats", AssignSubscriptionSeatsRequest{Oids: bulk}, nil)
+		}()
+		auto := users[10+i]
+		go func() {
+			defer wg.Done()
+			autoAssignSeats(e.ctx, e.repo, subscription, []models.TenantUser{auto})
+		}()
+	}
+	wg.Wait()
+
+	if count, _ := e.repo.CountSubscriptionUsers(e.ctx, id); count != 5 {
+		t.Fatalf("%d seats assigned, want 5", count)
+	}
+	if count := e.countLedgerEvents(id, models.LedgerEventEnumSeatAssigned); count != 5 {
+		t.Fatalf("%d seats recorded, want 5", count)
+	}
+
+	// unassigning the same user twice at once frees one seat, recorded once
+	assigned, _ := e.repo.ListSubscriptionUsers(e.ctx, id)
+	user := assigned[0]
+	statuses := make([]int, 2)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = e.call(admin, "PATCH", "/v1/subscriptions/"+admin.Tid+"/users/"+user.Oid, AssignUserSubscriptionRequest{}, nil)
+		}(i)
+	}
+	wg.Wait()
+	for _, status := range statuses {
+		if status != 200 && status != 409 {
+			t.Fatalf("unassign: %d", status)
+		}
+	}
+	if count, _ := e.repo.CountSubscriptionUsers(e.ctx, id); count != 4 {
+		t.Fatalf("%d seats assigned after unassign, want 4", count)
+	}
+	if count := e.countLedgerEvents(id, models.LedgerEventEnumSeatUnassigned); count != 1 {
+		t.Fatalf("%d unassignments recorded, want 1", count)
+	}
+}
+
+func TestE2EUnassignOtherAdminsSeat(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	otherAdmin := e.createUser(admin.Tid)
+	id := e.purchase(admin, 2)
+	e.purchase(otherAdmin, 2)
+	user := e.createUser(admin.Tid)
+	usersPath := "/v1/subscriptions/" + admin.Tid + "/users/" + user.Oid
+
+	if status := e.call(admin, "PATCH", usersPath, AssignUserSubscriptionRequest{SubscriptionId: id}, nil); status != 200 {
+		t.Fatalf("assign: %d", status)
+	}
+	if status := e.call(otherAdmin, "PATCH", usersPath, AssignUserSubscriptionRequest{}, nil); status != 403 {
+		t.Fatalf("unassign from another admin's subscription: %d, want 403", status)
+	}
+	if status := e.call(admin, "PATCH", usersPath, AssignUserSubscriptionRequest{}, nil); status != 200 {
+		t.Fatalf("unassign: %d", status)
+	}
+	// already unassigned: nothing to do
+	if status := e.call(otherAdmin, "PATCH", usersPath, AssignUserSubscriptionRequest{}, nil); status != 200 {
+		t.Fatalf("unassign an unassigned user: %d", status)
+	}
+}
+
+func TestE2EDelegatedAdmins(t *testing.T) {
+	e := newE2E(t)
+	purchaser := e.createUser(newTestId())
+	id := e.purchase(purchaser, 2)
+	adminsPath := "/v1/subscriptions/" + id + "/admins"
+	delegate := e.createUser(purchaser.Tid)
+	colleague := e.createUser(purchaser.Tid)
+	stranger := e.createUser(newTestId())
+
+	// not an admin yet
+	if status := e.call(delegate, "GET", "/v1/subscriptions/"+id+"/ledger", nil, nil); status != 403 {
+		t.Fatalf("ledger before grant: %d, want 403", status)
+	}
+
+	// only users of the beneficiary tenant, and only by the purchaser or beneficiary
+	if status := e.call(purchaser, "POST", adminsPath, GrantSubscriptionAdminRequest{Oid: stranger.Oid}, nil); status != 404 {
+		t.Fatalf("grant to another tenant's user: %d, want 404", status)
+	}
+	if status := e.call(purchaser, "POST", adminsPath, GrantSubscriptionAdminRequest{Email: strings.ToUpper(delegate.Email)}, nil); status != 200 {
+		t.Fatalf("grant: %d", status)
+	}
+	if status := e.call(purchaser, "POST", adminsPath, GrantSubscriptionAdminRequest{Oid: delegate.Oid}, nil); status != 409 {
+		t.Fatalf("grant twice: %d, want 409", status)
+	}
+	if status := e.call(delegate, "POST", adminsPath, GrantSubscriptionAdminRequest{Oid: colleague.Oid}, nil); status != 403 {
+		t.Fatalf("grant by a delegated admin: %d, want 403", status)
+	}
+	if !e.mail.sentTo(delegate.Email, "now an admin") {
+		t.Fatal("delegate not told of the grant")
+	}
+
+	// the delegate manages the subscription like its purchaser
+	subscriptions := GetSubscriptionsResponse{}
+	if status := e.call(delegate, "GET", "/v1/subscriptions/", nil, &subscriptions); status != 200 {
+		t.Fatalf("get subscriptions: %d", status)
+	}
+	if _, ok := subscriptions.Subscriptions[purchaser.Tid][id]; !ok {
+		t.Fatalf("subscriptions = %+v", subscriptions.Subscriptions)
+	}
+	if status := e.call(delegate, "PATCH", "/v1/subscriptions/"+purchaser.Tid+"/users/"+colleague.Oid, AssignUserSubscriptionRequest{SubscriptionId: id}, nil); status != 200 {
+		t.Fatalf("assign by delegate: %d", status)
+	}
+	if status := e.call(delegate, "GET", "/v1/subscriptions/"+id+"/ledger", nil, nil); status != 200 {
+		t.Fatalf("ledger by delegate: %d", status)
+	}
+
+	// but can't re-price or cancel it
+	if status := e.call(delegate, "PATCH", "/v1/subscriptions/"+id+"/quantity", ChangeSubscriptionQuantityRequest{Quantity: 10}, nil); status != 403 {
+		t.Fatalf("quantity change by delegate: %d, want 403", status)
+	}
+	if status := e.call(delegate, "PATCH", "/v1/subscriptions/"+id+"/plan", ChangeSubscriptionPlanRequest{PlanId: "pro"}, nil); status != 403 {
+		t.Fatalf("plan change by delegate: %d, want 403", status)
+	}
+	if status := e.call(delegate, "POST", "/v1/subscriptions/"+id+"/cancellation", RequestSubscriptionCancellationRequest{ReasonCode: models.CancellationReasonEnumOther}, nil); status != 403 {
+		t.Fatalf("cancellation by delegate: %d, want 403", status)
+	}
+	admins := GetSubscriptionAdminsResponse{}
+	if status := e.call(delegate, "GET", adminsPath, nil, &admins); status != 200 || len(admins.Admins) != 1 || admins.Admins[0].Oid != delegate.Oid {
+		t.Fatalf("admins: %d, %+v", status, admins)
+	}
+
+	// revoked
+	if status := e.call(purchaser, "DELETE", adminsPath+"/"+delegate.Oid, nil, nil); status != 200 {
+		t.Fatalf("revoke: %d", status)
+	}
+	if status := e.call(purchaser, "DELETE", adminsPath+"/"+delegate.Oid, nil, nil); status != 404 {
+		t.Fatalf("revoke twice: %d, want 404", status)
+	}
+	if status := e.call(delegate, "PATCH", "/v1/subscriptions/"+purchaser.Tid+"/users/"+colleague.Oid, AssignUserSubscriptionRequest{}, nil); status != 404 {
+		t.Fatalf("unassign after revoke: %d, want 404", status)
+	}
+	if count := e.countLedgerEvents(id, models.LedgerEventEnumAdminGranted); count != 1 {
+		t.Fatalf("%d grants recorded, want 1", count)
+	}
+	if count := e.countLedgerEvents(id, models.LedgerEventEnumAdminRevoked); count != 1 {
+		t.Fatalf("%d revocations recorded, want 1", count)
+	}
+}
+
+func TestE2ETrials(t *testing.T) {
+	e := newE2E(t)
+	staff := e.createUser(newTestId())
+	t.Setenv("STAFF_OIDS", staff.Oid)
+	t.Setenv("TRIAL_DAYS", "14")
+	user := e.createUser(newTestId())
+
+	// the configured length
+	started := UpdateTrialResponse{}
+	if status := e.call(user, "PATCH", "/v1/private/trial", nil, &started); status != 200 {
+		t.Fatalf("start trial: %d", status)
+	}
+	if length := started.User.TrialExpiresAt.Sub(started.User.TrialStartedAt); length != 14*24*time.Hour {
+		t.Fatalf("trial length = %v, want 14 days", length)
+	}
+
+	// reminders: a week out, then once the trial ended; each once
+	week := 7 * 24 * time.Hour
+	setExpiry := func(expiresAt time.Time) {
+		if err := e.repo.UpdateUser(e.ctx, user.Oid, map[string]interface{}{"trial_expires_at": expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setExpiry(time.Now().Add(week - time.Hour))
+	e.runJobConcurrently(SendTrialReminders)
+	if err := SendTrialReminders(e.ctx); err != nil {
+		t.Fatal(err)
+	}
+	if count := e.mail.countSentTo(user.Email, "trial ends in"); count != 1 {
+		t.Fatalf("%d week reminders, want 1", count)
+	}
+	setExpiry(time.Now().Add(-time.Hour))
+	if err := SendTrialReminders(e.ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !e.mail.sentTo(user.Email, "trial has ended") {
+		t.Fatal("no expiry reminder")
+	}
+
+	// only staff extend trials, from now when they ended
+	extendPath := "/v1/staff/trials/" + user.Oid + "/extend"
+	if status := e.call(user, "POST", extendPath, ExtendTrialRequest{Days: 7, Reason: "pilot"}, nil); status != 403 {
+		t.Fatalf("extend as user: %d, want 403", status)
+	}
+	if status := e.call(staff, "POST", extendPath, ExtendTrialRequest{Days: 7}, nil); status != 400 {
+		t.Fatalf("extend without a reason: %d, want 400", status)
+	}
+	extended := ExtendTrialResponse{}
+	if status := e.call(staff, "POST", extendPath, ExtendTrialRequest{Days: 7, Reason: "pilot with the sales team"}, &extended); status != 200 {
+		t.Fatalf("extend: %d", status)
+	}
+	if left := time.Until(extended.User.TrialExpiresAt); left < week-time.Minute || left > week {
+		t.Fatalf("extended trial ends in %v, want a week from now", left)
+	}
+	if access, _ := getUserRoomAccess(e.ctx, e.repo, user.Oid); !access {
+		t.Fatal("no room access after the extension")
+	}
+	if reloaded, _ := e.repo.GetUser(e.ctx, user.Oid); reloaded.TrialReminder != models.TrialReminderEnumNone {
+		t.Fatalf("reminders not reset: %q", reloaded.TrialReminder)
+	}
+
+	// the report links the trial to the seat that followed
+	admin := e.createUser(user.Tid)
+	id := e.purchase(admin, 1)
+	if status := e.call(admin, "PATCH", "/v1/subscriptions/"+user.Tid+"/users/"+user.Oid, AssignUserSubscriptionRequest{SubscriptionId: id}, nil); status != 200 {
+		t.Fatalf("assign: %d", status)
+	}
+	report := GetTrialConversionsResponse{}
+	if status := e.call(staff, "GET", "/v1/staff/trials/conversions", nil, &report); status != 200 {
+		t.Fatalf("conversions: %d", status)
+	}
+	var conversion *TrialConversion
+	for i := range report.Conversions {
+		if report.Conversions[i].Oid == user.Oid {
+			conversion = &report.Conversions[i]
+		}
+	}
+	if conversion == nil || !conversion.Converted || conversion.SeatSubscriptionId != id || conversion.TenantSubscriptionId != id || conversion.ExtendedDays != 7 {
+		t.Fatalf("conversion = %+v", conversion)
+	}
+}
+
+func TestE2ETenantTrial(t *testing.T) {
+	e := newE2E(t)
+	tid := newTestId()
+	first := e.createUser(tid)
+	second := e.createUser(tid)
+	other := e.createUser(newTestId())
+
+	// the first user to ask starts it; later ones join it
+	started := UpdateTrialResponse{}
+	if status := e.call(first, "PATCH", "/v1/private/trial", UpdateTrialRequest{Tenant: true}, &started); status != 200 {
+		t.Fatalf("start tenant trial: %d", status)
+	}
+	if started.Trial.TenantTrial == nil || !started.Trial.TenantActive || started.Trial.TenantTrial.StartedBy != first.Oid || started.Trial.UserActivated {
+		t.Fatalf("started = %+v", started.Trial)
+	}
+	joined := UpdateTrialResponse{}
+	if status := e.call(second, "PATCH", "/v1/private/trial", UpdateTrialRequest{Tenant: true}, &joined); status != 200 {
+		t.Fatalf("join tenant trial: %d", status)
+	}
+	if joined.Trial.TenantTrial == nil || joined.Trial.TenantTrial.StartedBy != first.Oid || !joined.Trial.TenantTrial.ExpiresAt.Equal(started.Trial.TenantTrial.ExpiresAt) {
+		t.Fatalf("joined = %+v", joined.Trial)
+	}
+
+	// it covers every user of the tenant, and only them
+	if access, _ := getUserRoomAccess(e.ctx, e.repo, second.Oid); !access {
+		t.Fatal("no room access through the tenant trial")
+	}
+	if access, _ := getUserRoomAccess(e.ctx, e.repo, other.Oid); access {
+		t.Fatal("room access through another tenant's trial")
+	}
+	world := GetWorldResponse{}
+	if status := e.call(second, "GET", "/v1/private/world", nil, &world); status != 200 {
+		t.Fatalf("world: %d", status)
+	}
+	if !world.Trial.Active || !world.Trial.TenantActive || world.Trial.UserActive {
+		t.Fatalf("world trial = %+v", world.Trial)
+	}
+
+	// a personal trial alongside it
+	personal := UpdateTrialResponse{}
+	if status := e.call(second, "PATCH", "/v1/private/trial", nil, &personal); status != 200 {
+		t.Fatalf("start personal trial: %d", status)
+	}
+	if !personal.Trial.UserActive || !personal.Trial.TenantActive {
+		t.Fatalf("personal = %+v", personal.Trial)
+	}
+
+	// the user who started it is reminded as it ends
+	if err := e.repo.UpdateTenantTrial(e.ctx, tid, map[string]interface{}{"expires_at": time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	e.runJobConcurrently(SendTrialReminders)
+	if count := e.mail.countSentTo(first.Email, "organization's Teraphone trial has ended"); count != 1 {
+		t.Fatalf("%d tenant trial expiry reminders, want 1", count)
+	}
+	if access, _ := getUserRoomAccess(e.ctx, e.repo, first.Oid); access {
+		t.Fatal("room access after the tenant trial ended")
+	}
+}
+
+func TestE2ESubscriptionTermEnd(t *testing.T) {
+	e := newE2E(t)
+	admin := e.createUser(newTestId())
+	id := e.purchase(admin, 2)
+	user := e.createUser(admin.Tid)
+	if err := e.repo.SetUserSubscription(e.ctx, user.Oid, id); err != nil {
+		t.Fatal(err)
+	}
+	setTerm := func(updates map[string]interface{}) {
+		if err := e.repo.UpdateSubscription(e.ctx, id, updates); err != nil {
+			t.Fatal(err)
+		}
+	}
+	enforce := func() {
+		if err := EnforceSubscriptionTerms(e.ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// auto-renew turned off: the admins are warned once before the term ends
+	setTerm(map[string]interface{}{"auto_renew": false, "subscription_term_end_date": time.Now().Add(3 * 24 * time.Hour)})
+	e.runJobConcurrently(EnforceSubscriptionTerms)
+	enforce()
+	if count := e.mail.countSentTo(admin.Email, "ends after"); count != 1 {
+		t.Fatalf("%d term end warnings, want 1", count)
+	}
+
+	// no Renew by the end of the term: no more access, seats kept
+	setTerm(map[string]interface{}{"subscription_term_end_date": time.Now().Add(-2 * 24 * time.Hour)})
+	if access, _ := getUserRoomAccess(e.ctx, e.repo, user.Oid); access {
+		t.Fatal("room access after the term ended")
+	}
+	e.runJobConcurrently(EnforceSubscriptionTerms)
+	subscription := e.subscription(id)
+	if subscription.TermExpiredAt.IsZero() || e.mail.countSentTo(admin.Email, "has ended") != 1 {
+		t.Fatalf("term end not recorded once: %+v", subscription)
+	}
+	if reloaded, _ := e.repo.GetUser(e.ctx, user.Oid); reloaded.SubscriptionId != id {
+		t.Fatal("seat not kept after the term ended")
+	}
+
+	// renewed after all: access is back, and the new term is in the ledger once
+	op := e.customerOperation(id, saasapi.OperationActionEnumRenew, 0)
+	if *op.Status != saasapi.OperationStatusEnumSucceeded {
+		t.Fatalf("Renew: %s", *op.Status)
+	}
+	subscription = e.subscription(id)
+	if !subscription.RenewedUntil.Equal(subscription.SubscriptionTermEndDate) || !subscription.TermExpiredAt.IsZero() || !subscription.TermEndingNotifiedAt.IsZero() {
+		t.Fatalf("after Renew: %+v", subscription)
+	}
+	if !subscription.SubscriptionTermEndDate.After(time.Now()) {
+		t.Fatalf("term end after Renew = %s", subscription.SubscriptionTermEndDate)
+	}
+	if access, _ := getUserRoomAccess(e.ctx, e.repo, user.Oid); !access {
+		t.Fatal("no room access after the renewal")
+	}
+	if !e.mail.sentTo(admin.Email, "renewed") {
+		t.Fatal("admins not told about the renewal")
+	}
+	err := applySubscriptionLifecycle(e.ctx, e.repo, ledgerSource{Actor: ledgerActorMarketplace, Operation: "Renew"}, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := e.countLedgerEvents(id, models.LedgerEventEnumRenewed); count != 1 {
+		t.Fatalf("%d renewals in the ledger, want 1", count)
+	}
+}
@@ -0,0 +1,59 @@
+package routes
+
+import (
+	"context"
+	"log"
+	"os"
+	"peachone/entitlements"
+	"peachone/models"
+	"peachone/repository"
+	"time"
+)
+
+var planCatalog = newPlanCatalog()
+
+// the catalog configured in PLAN_CATALOG (JSON), or one that gives every plan
+// the Standard entitlements
+func newPlanCatalog() *entitlements.Catalog {
+	PLAN_CATALOG := os.Getenv("PLAN_CATALOG")
+	if PLAN_CATALOG == "" {
+		return entitlements.NewCatalog(nil)
+	}
+	catalog, err := entitlements.ParseCatalog(PLAN_CATALOG)
+	if err != nil {
+		log.Fatalln("error reading PLAN_CATALOG:", err)
+	}
+	return catalog
+}
+
+// what the user may do, through their subscription or a trial; the
+// subscription's plan wins over a trial
+func userEntitlements(user *models.TenantUser, subscription *models.Subscription, tenantTrial *models.TenantTrial, now time.Time) entitlements.Entitlements {
+	if user.SubscriptionId != "" && subscriptionGrantsAccess(subscription, now) {
+		return planCatalog.ForPlan(subscription.PlanId)
+	}
+	if trialActive(user, tenantTrial, now) {
+		return planCatalog.ForTrial()
+	}
+	return entitlements.NoEntitlements
+}
+
+// load the user, their subscription and tenant trial, and get their entitlements
+func getUserEntitlements(ctx context.Context, repo *repository.Repository, oid string) (entitlements.Entitlements, error) {
+	user, err := repo.GetUser(ctx, oid)
+	if err != nil {
+		return entitlements.NoEntitlements, err
+	}
+	subscription := &models.Subscription{}
+	if user.SubscriptionId != "" {
+		subscription, err = repo.GetSubscription(ctx, user.SubscriptionId)
+		if err != nil {
+			return entitlements.NoEntitlements, err
+		}
+	}
+	tenantTrial, err := getTenantTrial(ctx, repo, user.Tid)
+	if err != nil {
+		return entitlements.NoEntitlements, err
+	}
+	return userEntitlements(user, subscription, tenantTrial, time.Now()), nil
+}
@@ -0,0 +1,44 @@
+package routes
+
+import (
+	"peachone/models"
+	"testing"
+	"time"
+)
+
+func TestUserEntitlements(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	subscription := &models.Subscription{Id: "sub", PlanId: "pro", SaaSSubscriptionStatus: models.SubscriptionStatusEnumSubscribed}
+	trial := &models.TenantUser{TrialActivated: true, TrialExpiresAt: now.Add(time.Hour)}
+
+	if got := userEntitlements(&models.TenantUser{}, &models.Subscription{}, nil, now); got.LicensePlan != models.None || got.MaxRoomCapacity != 0 {
+		t.Errorf("no subscription or trial: %+v", got)
+	}
+	if got := userEntitlements(trial, &models.Subscription{}, nil, now); got.LicensePlan != models.Standard {
+		t.Errorf("trial: %+v", got)
+	}
+	tenantTrial := &models.TenantTrial{Tid: "tid", ExpiresAt: now.Add(time.Hour)}
+	if got := userEntitlements(&models.TenantUser{}, &models.Subscription{}, tenantTrial, now); got.LicensePlan != models.Standard {
+		t.Errorf("tenant trial: %+v", got)
+	}
+
+	// the subscription's plan, from the catalog
+	catalog := planCatalog
+	t.Cleanup(func() { planCatalog = catalog })
+	t.Setenv("PLAN_CATALOG", `{"pro": {"licensePlan": "professional"}}`)
+	planCatalog = newPlanCatalog()
+	if got := userEntitlements(&models.TenantUser{SubscriptionId: "sub"}, subscription, nil, now); got.LicensePlan != models.Professional || !got.Recording {
+		t.Errorf("subscribed: %+v", got)
+	}
+
+	// a subscription that no longer grants access gives nothing, unless on a trial
+	unsubscribed := *subscription
+	unsubscribed.SaaSSubscriptionStatus = models.SubscriptionStatusEnumUnsubscribed
+	if got := userEntitlements(&models.TenantUser{SubscriptionId: "sub"}, &unsubscribed, nil, now); got.LicensePlan != models.None {
+		t.Errorf("unsubscribed: %+v", got)
+	}
+	trial.SubscriptionId = "sub"
+	if got := userEntitlements(trial, &unsubscribed, nil, now); got.LicensePlan != models.Standard {
+		t.Errorf("unsubscribed on a trial: %+v", got)
+	}
+}
@@ -0,0 +1,230 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"peachone/database"
+	"peachone/models"
+	"peachone/repository"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// actors for changes no user made directly
+const ledgerActorMarketplace = "marketplace" // a webhook, or an operation found by reconciliation
+const ledgerActorSystem = "system"           // a job, e.g. enforcing a grace or notice period
+
+// who made a change to a subscription or its seats, and how; recorded in its ledger
+type ledgerSource struct {
+	Actor       string // oid of the user, or ledgerActorMarketplace or ledgerActorSystem
+	Operation   string // e.g. a Marketplace action (ChangePlan, Suspend, ...), AssignSeat, Reconcile
+	OperationId string // Marketplace operation id, if there was one
+}
+
+// what changed between two copies of a subscription, including the lifecycle
+// state we keep ourselves
+func subscriptionChanges(before *models.Subscription, after *models.Subscription) []string {
+	if before.Id == "" {
+		return []string{"created"}
+	}
+
+	changes := diffSubscriptions(before, after)
+	diffTime := func(field string, before time.Time, after time.Time) {
+		if !before.Equal(after) {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", field, before.Format(time.RFC3339), after.Format(time.RFC3339)))
+		}
+	}
+	diffTime("suspendedAt", before.SuspendedAt, after.SuspendedAt)
+	diffTime("graceEndsAt", before.GraceEndsAt, after.GraceEndsAt)
+	diffTime("accessRevokedAt", before.AccessRevokedAt, after.AccessRevokedAt)
+	diffTime("unsubscribedAt", before.UnsubscribedAt, after.UnsubscribedAt)
+	diffTime("overAllocatedAt", before.OverAllocatedAt, after.OverAllocatedAt)
+	diffTime("overAllocationUnassignAt", before.OverAllocationUnassignAt, after.OverAllocationUnassignAt)
+	diffTime("termEndingNotifiedAt", before.TermEndingNotifiedAt, after.TermEndingNotifiedAt)
+	diffTime("termExpiredAt", before.TermExpiredAt, after.TermExpiredAt)
+	diffTime("renewedUntil", before.RenewedUntil, after.RenewedUntil)
+	return changes
+}
+
+// the ledger entry for a change to a subscription; false if nothing changed
+func subscriptionLedgerEntry(source ledgerSource, before *models.Subscription, after *models.Subscription) (models.SubscriptionLedgerEntry, bool) {
+	changes := subscriptionChanges(before, after)
+	if len(changes) == 0 {
+		return models.SubscriptionLedgerEntry{}, false
+	}
+	snapshot, _ := json.Marshal(after)
+	return models.SubscriptionLedgerEntry{
+		SubscriptionId: after.Id,
+		Event:          models.LedgerEventEnumSubscriptionChanged,
+		Operation:      source.Operation,
+		OperationId:    source.OperationId,
+		Actor:          source.Actor,
+		Changes:        strings.Join(changes, "\n"),
+		Snapshot:       string(snapshot),
+	}, true
+}
+
+// the ledger entry for a renewal, with the subscription's new term
+func renewalLedgerEntry(source ledgerSource, subscription *models.Subscription) models.SubscriptionLedgerEntry {
+	snapshot, _ := json.Marshal(subscription)
+	return models.SubscriptionLedgerEntry{
+		SubscriptionId: subscription.Id,
+		Event:          models.LedgerEventEnumRenewed,
+		Operation:      source.Operation,
+		OperationId:    source.OperationId,
+		Actor:          source.Actor,
+		Changes: strings.Join([]string{
+			"subscriptionTermStartDate: " + subscription.SubscriptionTermStartDate.Format(time.RFC3339),
+			"subscriptionTermEndDate: " + subscription.SubscriptionTermEndDate.Format(time.RFC3339),
+		}, "\n"),
+		Snapshot: string(snapshot),
+	}
+}
+
+// one ledger entry per user assigned to or unassigned from a subscription, or
+// granted or revoked admin rights on it
+func seatLedgerEntries(source ledgerSource, subscriptionId string, event models.LedgerEventEnum, users []models.TenantUser) []models.SubscriptionLedgerEntry {
+	entries := make([]models.SubscriptionLedgerEntry, len(users))
+	for i, user := range users {
+		entries[i] = models.SubscriptionLedgerEntry{
+			SubscriptionId: subscriptionId,
+			Event:          event,
+			Operation:      source.Operation,
+			OperationId:    source.OperationId,
+			Actor:          source.Actor,
+			UserOid:        user.Oid,
+			UserEmail:      user.Email,
+		}
+	}
+	return entries
+}
+
+// record the change from before to the stored subscription, if there was one
+func recordSubscriptionChange(ctx context.Context, repo *repository.Repository, source ledgerSource, before *models.Subscription, subscriptionId string) error {
+	after, err := repo.GetSubscription(ctx, subscriptionId)
+	if err != nil {
+		return err
+	}
+	entry, changed := subscriptionLedgerEntry(source, before, after)
+	if !changed {
+		return nil
+	}
+	return repo.CreateLedgerEntries(ctx, []models.SubscriptionLedgerEntry{entry})
+}
+
+// SaveSubscription, and record what changed in the ledger
+func saveSubscriptionToLedger(ctx context.Context, repo *repository.Repository, subscription *models.Subscription, source ledgerSource) error {
+	return repo.Transaction(ctx, func(tx *repository.Repository) error {
+		before, err := tx.GetSubscription(ctx, subscription.Id)
+		if errors.Is(err, repository.ErrNotFound) {
+			before = &models.Subscription{}
+		} else if err != nil {
+			return err
+		}
+		err = tx.SaveSubscription(ctx, subscription)
+		if err != nil {
+			return err
+		}
+		return recordSubscriptionChange(ctx, tx, source, before, subscription.Id)
+	})
+}
+
+// UpdateSubscription, and record what changed in the ledger
+func updateSubscriptionToLedger(ctx context.Context, repo *repository.Repository, subscriptionId string, updates map[string]interface{}, source ledgerSource) error {
+	return repo.Transaction(ctx, func(tx *repository.Repository) error {
+		before, err := tx.GetSubscription(ctx, subscriptionId)
+		if err != nil {
+			return err
+		}
+		err = tx.UpdateSubscription(ctx, subscriptionId, updates)
+		if err != nil {
+			return err
+		}
+		return recordSubscriptionChange(ctx, tx, source, before, subscriptionId)
+	})
+}
+
+// Lock the subscription and, if due says the change is still to be made,
+// UpdateSubscription and record it in the ledger. Returns false if another run
+// made it first: jobs run on every instance, so they claim a change this way
+// before acting on it (emails, removing users from rooms).
+func claimSubscriptionUpdate(ctx context.Context, repo *repository.Repository, subscriptionId string, due func(subscription *models.Subscription) bool, updates map[string]interface{}, source ledgerSource) (bool, error) {
+	claimed := false
+	err := repo.Transaction(ctx, func(tx *repository.Repository) error {
+		before, err := tx.LockSubscription(ctx, subscriptionId)
+		if err != nil {
+			return err
+		}
+		if !due(before) {
+			return nil
+		}
+		err = tx.UpdateSubscription(ctx, subscriptionId, updates)
+		if err != nil {
+			return err
+		}
+		claimed = true
+		return recordSubscriptionChange(ctx, tx, source, before, subscriptionId)
+	})
+	if err != nil {
+		return false, err
+	}
+	return claimed, nil
+}
+
+// record users assigned to or unassigned from a subscription, or granted or
+// revoked admin rights on it
+func recordSeatChanges(ctx context.Context, repo *repository.Repository, source ledgerSource, subscriptionId string, event models.LedgerEventEnum, users []models.TenantUser) error {
+	return repo.CreateLedgerEntries(ctx, seatLedgerEntries(source, subscriptionId, event, users))
+}
+
+// --------------------------------------------------------------------------------
+// Get Subscription Ledger Request
+// --------------------------------------------------------------------------------
+type GetSubscriptionLedgerResponse struct {
+	Success bool                             `json:"success"`
+	Entries []models.SubscriptionLedgerEntry `json:"entries"`
+}
+
+func GetSubscriptionLedger(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid limit")
+	}
+	before, err := strconv.ParseUint(c.Query("before", "0"), 10, 0)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid before")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getAdminSubscription(c.Context(), repo, claims.Oid, c.Params("subscriptionId"))
+	if err != nil {
+		return err
+	}
+
+	// get entries
+	entries, err := repo.ListLedgerEntries(c.Context(), subscription.Id, uint(before), limit)
+	if err != nil {
+		fmt.Println("db error getting ledger entries:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get ledger")
+	}
+
+	// return response
+	response := &GetSubscriptionLedgerResponse{
+		Success: true,
+		Entries: entries,
+	}
+	return c.JSON(response)
+}
@@ -0,0 +1,78 @@
+package routes
+
+import (
+	"peachone/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionLedgerEntry(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	source := ledgerSource{Actor: "admin", Operation: "ChangeQuantity", OperationId: "op"}
+	before := &models.Subscription{Id: "sub", Quantity: 5, SaaSSubscriptionStatus: models.SubscriptionStatusEnumSubscribed}
+
+	if _, changed := subscriptionLedgerEntry(source, before, before); changed {
+		t.Error("entry for an unchanged subscription")
+	}
+
+	after := *before
+	after.Quantity = 3
+	after.OverAllocatedAt = now
+	entry, changed := subscriptionLedgerEntry(source, before, &after)
+	if !changed {
+		t.Fatal("no entry for a changed subscription")
+	}
+	if entry.SubscriptionId != "sub" || entry.Event != models.LedgerEventEnumSubscriptionChanged ||
+		entry.Actor != "admin" || entry.Operation != "ChangeQuantity" || entry.OperationId != "op" {
+		t.Errorf("entry = %+v", entry)
+	}
+	changes := strings.Split(entry.Changes, "\n")
+	if len(changes) != 2 || changes[0] != "quantity: 5 -> 3" || !strings.HasPrefix(changes[1], "overAllocatedAt: ") {
+		t.Errorf("changes = %q", changes)
+	}
+	if !strings.Contains(entry.Snapshot, `"quantity":3`) {
+		t.Errorf("snapshot = %s", entry.Snapshot)
+	}
+
+	// a subscription we didn't have yet
+	entry, _ = subscriptionLedgerEntry(ledgerSource{Actor: "purchaser", Operation: "Activate"}, &models.Subscription{}, &after)
+	if entry.Changes != "created" || entry.SubscriptionId != "sub" {
+		t.Errorf("created entry = %+v", entry)
+	}
+}
+
+func TestRenewalLedgerEntry(t *testing.T) {
+	subscription := &models.Subscription{
+		Id:                        "sub",
+		SubscriptionTermStartDate: time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC),
+		SubscriptionTermEndDate:   time.Date(2026, 4, 9, 0, 0, 0, 0, time.UTC),
+	}
+	entry := renewalLedgerEntry(ledgerSource{Actor: ledgerActorMarketplace, Operation: "Renew", OperationId: "op"}, subscription)
+	if entry.SubscriptionId != "sub" || entry.Event != models.LedgerEventEnumRenewed || entry.OperationId != "op" {
+		t.Errorf("entry = %+v", entry)
+	}
+	if entry.Changes != "subscriptionTermStartDate: 2026-03-10T00:00:00Z\nsubscriptionTermEndDate: 2026-04-09T00:00:00Z" {
+		t.Errorf("changes = %q", entry.Changes)
+	}
+}
+
+func TestSeatLedgerEntries(t *testing.T) {
+	source := ledgerSource{Actor: ledgerActorSystem, Operation: "SeatOverage"}
+	users := []models.TenantUser{{Oid: "a", Email: "a@example.com"}, {Oid: "b", Email: "b@example.com"}}
+
+	entries := seatLedgerEntries(source, "sub", models.LedgerEventEnumSeatUnassigned, users)
+	if len(entries) != 2 {
+		t.Fatalf("entries = %+v", entries)
+	}
+	for i, entry := range entries {
+		if entry.SubscriptionId != "sub" || entry.Event != models.LedgerEventEnumSeatUnassigned ||
+			entry.Actor != ledgerActorSystem || entry.Operation != "SeatOverage" ||
+			entry.UserOid != users[i].Oid || entry.UserEmail != users[i].Email {
+			t.Errorf("entry %d = %+v", i, entry)
+		}
+	}
+	if entries := seatLedgerEntries(source, "sub", models.LedgerEventEnumSeatAssigned, nil); len(entries) != 0 {
+		t.Errorf("entries for no users = %+v", entries)
+	}
+}
@@ -0,0 +1,412 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"peachone/database"
+	"peachone/models"
+	"peachone/repository"
+	"strconv"
+	"time"
+
+	livekit "github.com/livekit/protocol/livekit"
+)
+
+const defaultSuspendGraceDays = 7
+
+// how long users keep access after the Marketplace suspends a subscription
+func suspendGracePeriod() time.Duration {
+	SUSPEND_GRACE_DAYS := os.Getenv("SUSPEND_GRACE_DAYS")
+	days, err := strconv.Atoi(SUSPEND_GRACE_DAYS)
+	if err != nil || days < 0 {
+		days = defaultSuspendGraceDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+const defaultTermEndNoticeDays = 14
+
+// how long before a subscription that won't renew ends its admins are warned
+func termEndNoticePeriod() time.Duration {
+	TERM_END_NOTICE_DAYS := os.Getenv("TERM_END_NOTICE_DAYS")
+	days, err := strconv.Atoi(TERM_END_NOTICE_DAYS)
+	if err != nil || days < 0 {
+		days = defaultTermEndNoticeDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// when the subscription's current term ends; the Marketplace's end date is
+// the term's last day
+func subscriptionTermEndsAt(subscription *models.Subscription) time.Time {
+	return subscription.SubscriptionTermEndDate.Add(24 * time.Hour)
+}
+
+// whether the subscription has run past the end of a term it won't renew for
+func subscriptionTermEnded(subscription *models.Subscription, now time.Time) bool {
+	return !subscription.AutoRenew &&
+		!subscription.SubscriptionTermEndDate.IsZero() &&
+		!now.Before(subscriptionTermEndsAt(subscription))
+}
+
+// whether users assigned to the subscription may use rooms
+func subscriptionGrantsAccess(subscription *models.Subscription, now time.Time) bool {
+	if subscriptionTermEnded(subscription, now) {
+		return false // no Renew arrived
+	}
+	switch subscription.SaaSSubscriptionStatus {
+	case models.SubscriptionStatusEnumSubscribed:
+		return true
+	case models.SubscriptionStatusEnumSuspended:
+		return !subscription.GraceEndsAt.IsZero() && now.Before(subscription.GraceEndsAt)
+	default:
+		return false
+	}
+}
+
+// whether the user is on a trial, their own or their tenant's (tenantTrial may be nil)
+func trialActive(user *models.TenantUser, tenantTrial *models.TenantTrial, now time.Time) bool {
+	if user.TrialActivated && now.Before(user.TrialExpiresAt) {
+		return true
+	}
+	return tenantTrialActive(tenantTrial, now)
+}
+
+// whether the user may join rooms, through their subscription or a trial
+func userHasRoomAccess(user *models.TenantUser, subscription *models.Subscription, tenantTrial *models.TenantTrial, now time.Time) bool {
+	if trialActive(user, tenantTrial, now) {
+		return true
+	}
+	return user.SubscriptionId != "" && subscriptionGrantsAccess(subscription, now)
+}
+
+// load the user, their subscription and tenant trial, and check their room access
+func getUserRoomAccess(ctx context.Context, repo *repository.Repository, oid string) (bool, error) {
+	user, err := repo.GetUser(ctx, oid)
+	if err != nil {
+		return false, err
+	}
+	subscription := &models.Subscription{}
+	if user.SubscriptionId != "" {
+		subscription, err = repo.GetSubscription(ctx, user.SubscriptionId)
+		if err != nil {
+			return false, err
+		}
+	}
+	tenantTrial, err := getTenantTrial(ctx, repo, user.Tid)
+	if err != nil {
+		return false, err
+	}
+	return userHasRoomAccess(user, subscription, tenantTrial, time.Now()), nil
+}
+
+// Apply a Marketplace lifecycle or quantity change (source.Operation) to our
+// users, after the subscription itself has been synced. Safe to repeat when an
+// operation is retried.
+func applySubscriptionLifecycle(ctx context.Context, repo *repository.Repository, source ledgerSource, subscriptionId string) error {
+	subscription, err := repo.GetSubscription(ctx, subscriptionId)
+	if err != nil {
+		return err
+	}
+
+	switch source.Operation {
+	case "Suspend":
+		return suspendSubscription(ctx, repo, subscription, source)
+	case "Reinstate":
+		return reinstateSubscription(ctx, repo, subscription, source)
+	case "Unsubscribe":
+		err = unsubscribeSubscription(ctx, repo, subscription, source)
+		if err != nil {
+			return err
+		}
+		return recordSubscriptionCancelled(ctx, repo, subscription.Id)
+	case "ChangeQuantity":
+		return applySeatOverage(ctx, repo, subscription, source)
+	case "Renew":
+		return renewSubscription(ctx, repo, subscription, source)
+	default:
+		return nil
+	}
+}
+
+// Users keep their seats, and keep access until the grace period ends
+// (see EnforceSuspendGracePeriods).
+func suspendSubscription(ctx context.Context, repo *repository.Repository, subscription *models.Subscription, source ledgerSource) error {
+	if !subscription.SuspendedAt.IsZero() {
+		return nil // already suspended
+	}
+
+	now := time.Now()
+	graceEndsAt := now.Add(suspendGracePeriod())
+	err := updateSubscriptionToLedger(ctx, repo, subscription.Id, map[string]interface{}{
+		"suspended_at":      now,
+		"grace_ends_at":     graceEndsAt,
+		"access_revoked_at": time.Time{},
+	}, source)
+	if err != nil {
+		return err
+	}
+
+	notifyPurchaser(ctx, subscription, fmt.Sprintf("Your subscription %s has been suspended", subscription.Name), []string{
+		fmt.Sprintf("Microsoft has suspended your Teraphone subscription %s, usually because a payment failed.", subscription.Name),
+		fmt.Sprintf("Assigned users keep access until %s. Please update your payment details in the Microsoft 365 admin center before then; your seat assignments will be restored as soon as the subscription is reinstated.", graceEndsAt.UTC().Format("January 2, 2006 15:04 MST")),
+	})
+	return nil
+}
+
+// Seats were kept while suspended, so clearing the suspension restores access.
+func reinstateSubscription(ctx context.Context, repo *repository.Repository, subscription *models.Subscription, source ledgerSource) error {
+	if subscription.SuspendedAt.IsZero() {
+		return nil // not suspended
+	}
+
+	err := updateSubscriptionToLedger(ctx, repo, subscription.Id, map[string]interface{}{
+		"suspended_at":      time.Time{},
+		"grace_ends_at":     time.Time{},
+		"access_revoked_at": time.Time{},
+	}, source)
+	if err != nil {
+		return err
+	}
+
+	notifyPurchaser(ctx, subscription, fmt.Sprintf("Your subscription %s has been reinstated", subscription.Name), []string{
+		fmt.Sprintf("Your Teraphone subscription %s has been reinstated. All seat assignments have been restored.", subscription.Name),
+	})
+	return nil
+}
+
+// Unsubscribe is final: clear the seats and remove the users from their rooms.
+func unsubscribeSubscription(ctx context.Context, repo *repository.Repository, subscription *models.Subscription, source ledgerSource) error {
+	if !subscription.UnsubscribedAt.IsZero() {
+		return nil // already cleared
+	}
+
+	users := []models.TenantUser{}
+	var cleared int64
+	err := repo.Transaction(ctx, func(tx *repository.Repository) error {
+		var err error
+		users, err = tx.ListSubscriptionUsers(ctx, subscription.Id)
+		if err != nil {
+			return err
+		}
+		cleared, err = tx.UnassignSubscriptionUsers(ctx, subscription.Id)
+		if err != nil {
+			return err
+		}
+		err = recordSeatChanges(ctx, tx, source, subscription.Id, models.LedgerEventEnumSeatUnassigned, users)
+		if err != nil {
+			return err
+		}
+		return updateSubscriptionToLedger(ctx, tx, subscription.Id, map[string]interface{}{
+			"unsubscribed_at": time.Now(),
+		}, source)
+	})
+	if err != nil {
+		return err
+	}
+
+	revokeRoomAccess(ctx, repo, users)
+
+	notifyPurchaser(ctx, subscription, fmt.Sprintf("Your subscription %s has been cancelled", subscription.Name), []string{
+		fmt.Sprintf("Your Teraphone subscription %s has been cancelled.", subscription.Name),
+		fmt.Sprintf("%d assigned users have been unassigned and no longer have access to their rooms.", cleared),
+	})
+	return nil
+}
+
+// Record the term the Marketplace renewed the subscription for (once per term),
+// and clear the warning and expiry of the previous term. Seats were kept, so
+// access comes back if the term had ended.
+func renewSubscription(ctx context.Context, repo *repository.Repository, subscription *models.Subscription, source ledgerSource) error {
+	if subscription.RenewedUntil.Equal(subscription.SubscriptionTermEndDate) {
+		return nil // this term's renewal was recorded already
+	}
+
+	err := repo.Transaction(ctx, func(tx *repository.Repository) error {
+		err := updateSubscriptionToLedger(ctx, tx, subscription.Id, map[string]interface{}{
+			"renewed_until":           subscription.SubscriptionTermEndDate,
+			"term_ending_notified_at": time.Time{},
+			"term_expired_at":         time.Time{},
+		}, source)
+		if err != nil {
+			return err
+		}
+		return tx.CreateLedgerEntries(ctx, []models.SubscriptionLedgerEntry{renewalLedgerEntry(source, subscription)})
+	})
+	if err != nil {
+		return err
+	}
+
+	// the admins were told it would end
+	if !subscription.TermEndingNotifiedAt.IsZero() || !subscription.TermExpiredAt.IsZero() {
+		notifySubscriptionAdmins(ctx, repo, subscription, fmt.Sprintf("Your subscription %s has been renewed", subscription.Name), []string{
+			fmt.Sprintf("Your Teraphone subscription %s has been renewed until %s.", subscription.Name, subscription.SubscriptionTermEndDate.UTC().Format("January 2, 2006")),
+			"Assigned users keep their seats and can join rooms.",
+		})
+	}
+	return nil
+}
+
+// Job: warn the admins of subscriptions that won't auto-renew before their term
+// ends, and revoke room access once it has ended without a Renew. Seats stay
+// assigned, so access comes back if the subscription is renewed after all.
+func EnforceSubscriptionTerms(ctx context.Context) error {
+	repo := repository.New(database.DB.DB)
+
+	now := time.Now()
+	subscriptions, err := repo.ListNonRenewingSubscriptions(ctx, now.Add(termEndNoticePeriod()))
+	if err != nil {
+		return err
+	}
+
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		endsAt := subscriptionTermEndsAt(subscription)
+		lastDay := subscription.SubscriptionTermEndDate.UTC().Format("January 2, 2006")
+
+		if subscriptionTermEnded(subscription, now) {
+			claimed, err := claimSubscriptionUpdate(ctx, repo, subscription.Id, func(locked *models.Subscription) bool {
+				return locked.TermExpiredAt.IsZero() && subscriptionTermEnded(locked, now)
+			}, map[string]interface{}{
+				"term_expired_at": now,
+			}, ledgerSource{Actor: ledgerActorSystem, Operation: "TermEnded"})
+			if err != nil {
+				return err
+			}
+			if !claimed {
+				continue // renewed meanwhile, or done by another instance
+			}
+
+			users, err := repo.ListSubscriptionUsers(ctx, subscription.Id)
+			if err != nil {
+				return err
+			}
+			revokeRoomAccess(ctx, repo, users)
+
+			notifySubscriptionAdmins(ctx, repo, subscription, fmt.Sprintf("Your subscription %s has ended", subscription.Name), []string{
+				fmt.Sprintf("Your Teraphone subscription %s was not renewed and ended after %s, so assigned users can no longer join rooms.", subscription.Name, lastDay),
+				"Seat assignments have been kept and will be restored if the subscription is renewed.",
+			})
+			continue
+		}
+
+		if !subscription.TermEndingNotifiedAt.IsZero() || !now.Add(termEndNoticePeriod()).After(endsAt) {
+			continue // warned already, or not yet due
+		}
+		claimed, err := claimSubscriptionUpdate(ctx, repo, subscription.Id, func(locked *models.Subscription) bool {
+			return locked.TermEndingNotifiedAt.IsZero() && !locked.AutoRenew && locked.SubscriptionTermEndDate.Equal(subscription.SubscriptionTermEndDate)
+		}, map[string]interface{}{
+			"term_ending_notified_at": now,
+		}, ledgerSource{Actor: ledgerActorSystem, Operation: "TermEnding"})
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue // renewed meanwhile, or warned by another instance
+		}
+
+		notifySubscriptionAdmins(ctx, repo, subscription, fmt.Sprintf("Your subscription %s ends after %s", subscription.Name, lastDay), []string{
+			fmt.Sprintf("Your Teraphone subscription %s is set not to renew, so it ends after %s and assigned users will then no longer be able to join rooms.", subscription.Name, lastDay),
+			"To keep it, turn on recurring billing for the subscription in the Microsoft 365 admin center.",
+		})
+	}
+
+	return nil
+}
+
+// Job: revoke room access for suspended subscriptions whose grace period is over.
+// Seats stay assigned, so access comes back on Reinstate.
+func EnforceSuspendGracePeriods(ctx context.Context) error {
+	repo := repository.New(database.DB.DB)
+
+	now := time.Now()
+	subscriptions, err := repo.ListSubscriptionsPastGrace(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		claimed, err := claimSubscriptionUpdate(ctx, repo, subscription.Id, func(locked *models.Subscription) bool {
+			return !locked.SuspendedAt.IsZero() && locked.AccessRevokedAt.IsZero() && !locked.GraceEndsAt.After(now)
+		}, map[string]interface{}{
+			"access_revoked_at": now,
+		}, ledgerSource{Actor: ledgerActorSystem, Operation: "GracePeriodEnded"})
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue // reinstated meanwhile, or done by another instance
+		}
+
+		users, err := repo.ListSubscriptionUsers(ctx, subscription.Id)
+		if err != nil {
+			return err
+		}
+		revokeRoomAccess(ctx, repo, users)
+
+		notifyPurchaser(ctx, subscription, fmt.Sprintf("Your subscription %s is no longer active", subscription.Name), []string{
+			fmt.Sprintf("The grace period for your suspended Teraphone subscription %s has ended, so assigned users can no longer join rooms.", subscription.Name),
+			"Seat assignments have been kept and will be restored as soon as Microsoft reinstates the subscription.",
+		})
+	}
+
+	return nil
+}
+
+// remove users from any room they are in right now; handleParticipantJoined
+// keeps them from coming back with a join token they already have. Users whose
+// own or tenant trial is running keep their access and are left alone.
+func revokeRoomAccess(ctx context.Context, repo *repository.Repository, users []models.TenantUser) {
+	client := CreateRoomServiceClient()
+	now := time.Now()
+
+	tenantTrials := make(map[string]*models.TenantTrial)
+	for _, user := range users {
+		tenantTrial, loaded := tenantTrials[user.Tid]
+		if !loaded {
+			var err error
+			tenantTrial, err = getTenantTrial(ctx, repo, user.Tid)
+			if err != nil {
+				fmt.Println("error getting tenant trial for user:", user.Oid, err)
+				continue
+			}
+			tenantTrials[user.Tid] = tenantTrial
+		}
+		if trialActive(&user, tenantTrial, now) {
+			continue
+		}
+
+		teams, err := repo.ListTeamsForUser(ctx, user.Oid)
+		if err != nil {
+			fmt.Println("error getting teams for user:", user.Oid, err)
+			continue
+		}
+		for _, team := range teams {
+			rooms, err := repo.ListRoomsForTeam(ctx, team.Id)
+			if err != nil {
+				fmt.Println("error getting rooms for team:", team.Id, err)
+				continue
+			}
+			for _, room := range rooms {
+				// fails with not found unless the user is in the room
+				client.RemoveParticipant(ctx, &livekit.RoomParticipantIdentity{
+					Room:     EncodeRoomName(team.Id, room.Id.String()),
+					Identity: user.Oid,
+				})
+			}
+		}
+	}
+}
+
+func notifyPurchaser(ctx context.Context, subscription *models.Subscription, subject string, paragraphs []string) {
+	_, _, err := SendNotificationEmail(ctx, &NotificationVars{
+		RecipientEmails: []string{subscription.PurchaserEmail},
+		Subject:         subject,
+		Paragraphs:      paragraphs,
+	})
+	if err != nil {
+		fmt.Println("error notifying purchaser for subscriptionId:", subscription.Id, err)
+	}
+}
@@ -0,0 +1,88 @@
+package routes
+
+import (
+	"peachone/models"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionGrantsAccess(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		name         string
+		subscription models.Subscription
+		want         bool
+	}{
+		{"subscribed", models.Subscription{SaaSSubscriptionStatus: models.SubscriptionStatusEnumSubscribed}, true},
+		{"pending", models.Subscription{SaaSSubscriptionStatus: models.SubscriptionStatusEnumPendingFulfillmentStart}, false},
+		{"unsubscribed", models.Subscription{SaaSSubscriptionStatus: models.SubscriptionStatusEnumUnsubscribed}, false},
+		{"suspended in grace", models.Subscription{SaaSSubscriptionStatus: models.SubscriptionStatusEnumSuspended, GraceEndsAt: now.Add(time.Hour)}, true},
+		{"suspended past grace", models.Subscription{SaaSSubscriptionStatus: models.SubscriptionStatusEnumSuspended, GraceEndsAt: now.Add(-time.Hour)}, false},
+		{"suspended before sync", models.Subscription{SaaSSubscriptionStatus: models.SubscriptionStatusEnumSuspended}, false},
+		{"last day of a term not renewed", models.Subscription{SaaSSubscriptionStatus: models.SubscriptionStatusEnumSubscribed, SubscriptionTermEndDate: now.Add(-time.Hour)}, true},
+		{"term not renewed", models.Subscription{SaaSSubscriptionStatus: models.SubscriptionStatusEnumSubscribed, SubscriptionTermEndDate: now.Add(-25 * time.Hour)}, false},
+		{"term auto-renewing", models.Subscription{SaaSSubscriptionStatus: models.SubscriptionStatusEnumSubscribed, AutoRenew: true, SubscriptionTermEndDate: now.Add(-25 * time.Hour)}, true},
+	}
+	for _, c := range cases {
+		if got := subscriptionGrantsAccess(&c.subscription, now); got != c.want {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestUserHasRoomAccess(t *testing.T) {
+	now := time.Now()
+	subscribed := &models.Subscription{SaaSSubscriptionStatus: models.SubscriptionStatusEnumSubscribed}
+	unsubscribed := &models.Subscription{SaaSSubscriptionStatus: models.SubscriptionStatusEnumUnsubscribed}
+
+	if !userHasRoomAccess(&models.TenantUser{SubscriptionId: "sub"}, subscribed, nil, now) {
+		t.Error("expected access through an active subscription")
+	}
+	if userHasRoomAccess(&models.TenantUser{}, subscribed, nil, now) {
+		t.Error("expected no access without an assigned subscription")
+	}
+	if userHasRoomAccess(&models.TenantUser{SubscriptionId: "sub"}, unsubscribed, nil, now) {
+		t.Error("expected no access through an unsubscribed subscription")
+	}
+	if !userHasRoomAccess(&models.TenantUser{TrialActivated: true, TrialExpiresAt: now.Add(time.Hour)}, unsubscribed, nil, now) {
+		t.Error("expected access through an active trial")
+	}
+	if userHasRoomAccess(&models.TenantUser{TrialActivated: true, TrialExpiresAt: now.Add(-time.Hour)}, &models.Subscription{}, nil, now) {
+		t.Error("expected no access after the trial expired")
+	}
+	tenantTrial := &models.TenantTrial{Tid: "tid", ExpiresAt: now.Add(time.Hour)}
+	if !userHasRoomAccess(&models.TenantUser{}, &models.Subscription{}, tenantTrial, now) {
+		t.Error("expected access through the tenant's trial")
+	}
+	tenantTrial.ExpiresAt = now.Add(-time.Hour)
+	if userHasRoomAccess(&models.TenantUser{}, &models.Subscription{}, tenantTrial, now) {
+		t.Error("expected no access after the tenant's trial expired")
+	}
+}
+
+func TestSuspendGracePeriod(t *testing.T) {
+	t.Setenv("SUSPEND_GRACE_DAYS", "")
+	if got := suspendGracePeriod(); got != defaultSuspendGraceDays*24*time.Hour {
+		t.Errorf("expected default grace period, got %s", got)
+	}
+	t.Setenv("SUSPEND_GRACE_DAYS", "3")
+	if got := suspendGracePeriod(); got != 3*24*time.Hour {
+		t.Errorf("expected 3 days, got %s", got)
+	}
+	t.Setenv("SUSPEND_GRACE_DAYS", "-1")
+	if got := suspendGracePeriod(); got != defaultSuspendGraceDays*24*time.Hour {
+		t.Errorf("expected default for a negative value, got %s", got)
+	}
+}
+
+func TestTermEndNoticePeriod(t *testing.T) {
+	t.Setenv("TERM_END_NOTICE_DAYS", "")
+	if got := termEndNoticePeriod(); got != defaultTermEndNoticeDays*24*time.Hour {
+		t.Errorf("expected default notice period, got %s", got)
+	}
+	t.Setenv("TERM_END_NOTICE_DAYS", "30")
+	if got := termEndNoticePeriod(); got != 30*24*time.Hour {
+		t.Errorf("expected 30 days, got %s", got)
+	}
+}
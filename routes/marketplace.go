@@ -0,0 +1,207 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"peachone/database"
+	"peachone/jobs"
+	"peachone/models"
+	"peachone/repository"
+	"peachone/saasapi"
+	"time"
+)
+
+// retry failed marketplace operations with exponential backoff, then give up
+const marketplaceOperationMaxAttempts = 10
+const marketplaceOperationRetryBase = 30 * time.Second
+const marketplaceOperationRetryMax = time.Hour
+
+// operations processed per worker run, so one run can't hold the worker forever
+const marketplaceOperationBatchSize = 20
+
+// how long a claimed operation is left to its worker before another may retry it
+const marketplaceOperationLease = 5 * time.Minute
+
+// Worker for operations recorded by SubscriptionsWebhook. Each operation is
+// claimed by leasing it (pushing its next attempt past the work) under its row
+// lock, so concurrent workers (and instances) never process the same operation
+// at the same time, and no lock is held during the Marketplace calls and emails.
+func ProcessMarketplaceOperations(ctx context.Context) error {
+	repo := repository.New(database.DB.DB)
+
+	for i := 0; i < marketplaceOperationBatchSize; i++ {
+		operation, err := claimNextDueMarketplaceOperation(ctx, repo, time.Now())
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = processMarketplaceOperation(ctx, repo, operation)
+		recordMarketplaceOperationResult(operation, err, time.Now())
+		err = repo.SaveMarketplaceOperation(ctx, operation)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lease the next due operation to this worker and count the attempt
+func claimNextDueMarketplaceOperation(ctx context.Context, repo *repository.Repository, now time.Time) (*models.MarketplaceOperation, error) {
+	var operation *models.MarketplaceOperation
+	err := repo.Transaction(ctx, func(tx *repository.Repository) error {
+		var err error
+		operation, err = tx.LockNextDueMarketplaceOperation(ctx, now)
+		if err != nil {
+			return err
+		}
+		operation.Attempts++
+		operation.NextAttemptAt = now.Add(marketplaceOperationLease)
+		return tx.SaveMarketplaceOperation(ctx, operation)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+// update status after an attempt: done, retry later, or give up
+func recordMarketplaceOperationResult(operation *models.MarketplaceOperation, err error, now time.Time) {
+	if err == nil {
+		operation.Status = models.MarketplaceOperationStatusEnumSucceeded
+		operation.LastError = ""
+		operation.CompletedAt = now
+		return
+	}
+
+	fmt.Println("error processing marketplace operation:", operation.Id, "attempt", operation.Attempts, err)
+	operation.LastError = err.Error()
+	if operation.Attempts >= marketplaceOperationMaxAttempts {
+		operation.Status = models.MarketplaceOperationStatusEnumFailed
+		operation.CompletedAt = now
+		return
+	}
+	operation.NextAttemptAt = now.Add(jobs.Backoff(operation.Attempts, marketplaceOperationRetryBase, marketplaceOperationRetryMax))
+}
+
+// Do the work for one operation. Steps that must not be repeated are recorded
+// on the operation, so a retry after a partial failure picks up where it left off.
+func processMarketplaceOperation(ctx context.Context, repo *repository.Repository, operation *models.MarketplaceOperation) error {
+	// create subscription operations client
+	operationsClient, err := saasapi.NewDefaultSubscriptionOperationsClient()
+	if err != nil {
+		return fmt.Errorf("could not create subscription operations client: %w", err)
+	}
+
+	// get operation
+	operationStatusResponse, err := operationsClient.GetOperationStatus(
+		ctx,
+		operation.SubscriptionId,
+		operation.Id,
+		&saasapi.SubscriptionOperationsClientGetOperationStatusOptions{},
+	)
+	if err != nil {
+		return fmt.Errorf("could not retrieve operation: %w", err)
+	}
+	operationJSON, err := operationStatusResponse.MarshalJSON()
+	if err == nil {
+		fmt.Println("operation:", string(operationJSON))
+	}
+
+	// operations we started ourselves are tracked by ProcessPublisherOperations
+	// and must not be acknowledged
+	_, err = repo.GetPublisherOperation(ctx, operation.Id)
+	startedByUs := err == nil
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		return fmt.Errorf("db could not get publisher operation: %w", err)
+	}
+
+	// update operation status if action is "Reinstate", "ChangePlan", or "ChangeQuantity"
+	action := *operationStatusResponse.Action
+	if operation.AckedAt.IsZero() && !startedByUs &&
+		(action == saasapi.OperationActionEnumReinstate ||
+			action == saasapi.OperationActionEnumChangePlan ||
+			action == saasapi.OperationActionEnumChangeQuantity) {
+		quantity := int64(*operationStatusResponse.Quantity)
+		status := saasapi.UpdateOperationStatusEnumSuccess
+
+		// a lower quantity than the assigned seats may be rejected, per subscription
+		if action == saasapi.OperationActionEnumChangeQuantity {
+			status, err = checkChangeQuantity(ctx, repo, operation.SubscriptionId, int(quantity))
+			if err != nil {
+				return fmt.Errorf("could not check seats for quantity change: %w", err)
+			}
+		}
+
+		updateOperation := &saasapi.UpdateOperation{
+			PlanID:   operationStatusResponse.PlanID,
+			Quantity: &quantity,
+			Status:   &status,
+		}
+		_, err = operationsClient.UpdateOperationStatus(
+			ctx,
+			*operationStatusResponse.SubscriptionID,
+			*operationStatusResponse.ID,
+			*updateOperation,
+			&saasapi.SubscriptionOperationsClientUpdateOperationStatusOptions{},
+		)
+		if err != nil {
+			return fmt.Errorf("could not update operation: %w", err)
+		}
+		operation.AckedAt = time.Now()
+
+		if status == saasapi.UpdateOperationStatusEnumFailure {
+			notifyQuantityChangeRejected(ctx, repo, operation.SubscriptionId, quantity)
+		}
+	}
+
+	// create fulfillment api client
+	fulfillmentClient, err := saasapi.NewDefaultFulfillmentOperationsClient()
+	if err != nil {
+		return fmt.Errorf("could not create fulfillment api client: %w", err)
+	}
+
+	// get subscription
+	subscriptionResponse, err := fulfillmentClient.GetSubscription(
+		ctx,
+		*operationStatusResponse.SubscriptionID,
+		&saasapi.FulfillmentOperationsClientGetSubscriptionOptions{},
+	)
+	if err != nil {
+		return fmt.Errorf("could not retrieve subscription: %w", err)
+	}
+
+	// populate new subscription
+	newSubscription := makeSubscription(&subscriptionResponse.Subscription)
+
+	// check if subscription in db... if no, create it; if so, update it
+	currentSubscription, err := repo.GetSubscription(ctx, newSubscription.Id)
+	if errors.Is(err, repository.ErrNotFound) {
+		currentSubscription = &models.Subscription{}
+	} else if err != nil {
+		return fmt.Errorf("db could not get subscription: %w", err)
+	}
+	source := ledgerSource{Actor: ledgerActorMarketplace, Operation: string(action), OperationId: operation.Id}
+	err = saveSubscriptionToLedger(ctx, repo, newSubscription, source)
+	if err != nil {
+		return fmt.Errorf("db could not save subscription: %w", err)
+	}
+
+	// suspend, reinstate, clear seats or flag over-allocation
+	err = applySubscriptionLifecycle(ctx, repo, source, newSubscription.Id)
+	if err != nil {
+		return fmt.Errorf("could not apply %s to subscription: %w", action, err)
+	}
+
+	// send email (not retried: the subscription is already up to date)
+	_, _, err = SendSubscriptionActionAlert(ctx, string(action), newSubscription, currentSubscription)
+	if err != nil {
+		fmt.Println("error sending subscription action alert for subscriptionId:", newSubscription.Id, err)
+	}
+
+	return nil
+}
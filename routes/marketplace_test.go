@@ -0,0 +1,33 @@
+package routes
+
+import (
+	"errors"
+	"peachone/models"
+	"testing"
+	"time"
+)
+
+func TestRecordMarketplaceOperationResult(t *testing.T) {
+	now := time.Now()
+
+	succeeded := &models.MarketplaceOperation{Attempts: 2, LastError: "earlier failure", Status: models.MarketplaceOperationStatusEnumPending}
+	recordMarketplaceOperationResult(succeeded, nil, now)
+	if succeeded.Status != models.MarketplaceOperationStatusEnumSucceeded || succeeded.LastError != "" || !succeeded.CompletedAt.Equal(now) {
+		t.Fatalf("unexpected result after success: %+v", succeeded)
+	}
+
+	retry := &models.MarketplaceOperation{Attempts: 1, Status: models.MarketplaceOperationStatusEnumPending}
+	recordMarketplaceOperationResult(retry, errors.New("mailgun down"), now)
+	if retry.Status != models.MarketplaceOperationStatusEnumPending || retry.LastError != "mailgun down" {
+		t.Fatalf("unexpected result after first failure: %+v", retry)
+	}
+	if !retry.NextAttemptAt.Equal(now.Add(marketplaceOperationRetryBase)) {
+		t.Fatalf("expected retry after %s, got %s", marketplaceOperationRetryBase, retry.NextAttemptAt.Sub(now))
+	}
+
+	failed := &models.MarketplaceOperation{Attempts: marketplaceOperationMaxAttempts, Status: models.MarketplaceOperationStatusEnumPending}
+	recordMarketplaceOperationResult(failed, errors.New("still down"), now)
+	if failed.Status != models.MarketplaceOperationStatusEnumFailed || failed.LastError != "still down" || failed.CompletedAt.IsZero() {
+		t.Fatalf("unexpected result after last attempt: %+v", failed)
+	}
+}
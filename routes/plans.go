@@ -0,0 +1,628 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"peachone/database"
+	"peachone/entitlements"
+	"peachone/jobs"
+	"peachone/models"
+	"peachone/repository"
+	"peachone/saasapi"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/gofiber/fiber/v2"
+)
+
+// how often to poll an operation we started, and how long to wait for the
+// Marketplace to complete it before giving up
+const publisherOperationPollInterval = 10 * time.Second
+const publisherOperationMaxWait = 2 * time.Hour
+
+// retry failed polls with exponential backoff, then give up
+const publisherOperationMaxAttempts = 10
+const publisherOperationRetryBase = 30 * time.Second
+const publisherOperationRetryMax = 30 * time.Minute
+
+// operations polled per worker run
+const publisherOperationBatchSize = 20
+
+// --------------------------------------------------------------------------------
+// Get Subscription Plans
+// --------------------------------------------------------------------------------
+type PlanPrice struct {
+	TermUnit        string  `json:"termUnit"` // P1M, P1Y, ...
+	TermDescription string  `json:"termDescription"`
+	Price           float32 `json:"price"` // per seat if the plan is priced per seat
+	Currency        string  `json:"currency"`
+}
+
+type PlanMeteringDimension struct {
+	Id            string  `json:"id"`
+	DisplayName   string  `json:"displayName"`
+	UnitOfMeasure string  `json:"unitOfMeasure"`
+	PricePerUnit  float32 `json:"pricePerUnit"`
+	Currency      string  `json:"currency"`
+}
+
+type SubscriptionPlan struct {
+	PlanId             string                    `json:"planId"`
+	DisplayName        string                    `json:"displayName"`
+	Description        string                    `json:"description"`
+	IsCurrent          bool                      `json:"isCurrent"`
+	IsPricePerSeat     bool                      `json:"isPricePerSeat"`
+	IsPrivate          bool                      `json:"isPrivate"`
+	HasFreeTrials      bool                      `json:"hasFreeTrials"`
+	Prices             []PlanPrice               `json:"prices"`
+	MeteringDimensions []PlanMeteringDimension   `json:"meteringDimensions"`
+	Entitlements       entitlements.Entitlements `json:"entitlements"` // what the plan includes, from the plan catalog
+}
+
+type GetSubscriptionPlansResponse struct {
+	Success bool               `json:"success"`
+	Plans   []SubscriptionPlan `json:"plans"`
+}
+
+// the plans the subscription can change to (and its current plan), with pricing
+func GetSubscriptionPlans(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getAdminSubscription(c.Context(), repo, claims.Oid, c.Params("subscriptionId"))
+	if err != nil {
+		return err
+	}
+
+	// get plans
+	plans, err := listAvailablePlans(c.Context(), subscription.Id)
+	if err != nil {
+		fmt.Println("error listing available plans:", subscription.Id, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get plans")
+	}
+
+	// return response
+	response := &GetSubscriptionPlansResponse{
+		Success: true,
+		Plans:   makeSubscriptionPlans(plans, subscription.PlanId),
+	}
+	return c.JSON(response)
+}
+
+func listAvailablePlans(ctx context.Context, subscriptionId string) ([]*saasapi.Plan, error) {
+	// create fulfillment api client
+	client, err := saasapi.NewDefaultFulfillmentOperationsClient()
+	if err != nil {
+		return nil, fmt.Errorf("could not create fulfillment api client: %w", err)
+	}
+
+	plansResponse, err := client.ListAvailablePlans(ctx, subscriptionId, &saasapi.FulfillmentOperationsClientListAvailablePlansOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return plansResponse.Plans, nil
+}
+
+// plans no longer sold are left out, unless the subscription is on one
+func makeSubscriptionPlans(plans []*saasapi.Plan, currentPlanId string) []SubscriptionPlan {
+	subscriptionPlans := []SubscriptionPlan{}
+	for _, plan := range plans {
+		if plan == nil || plan.PlanID == nil {
+			continue
+		}
+		isCurrent := *plan.PlanID == currentPlanId
+		if ReadBool(plan.IsStopSell) && !isCurrent {
+			continue
+		}
+
+		subscriptionPlan := SubscriptionPlan{
+			PlanId:             *plan.PlanID,
+			DisplayName:        ReadString(plan.DisplayName),
+			Description:        ReadString(plan.Description),
+			IsCurrent:          isCurrent,
+			IsPricePerSeat:     ReadBool(plan.IsPricePerSeat),
+			IsPrivate:          ReadBool(plan.IsPrivate),
+			HasFreeTrials:      ReadBool(plan.HasFreeTrials),
+			Prices:             []PlanPrice{},
+			MeteringDimensions: []PlanMeteringDimension{},
+			Entitlements:       planCatalog.ForPlan(*plan.PlanID),
+		}
+		if plan.PlanComponents != nil {
+			for _, term := range plan.PlanComponents.RecurrentBillingTerms {
+				if term == nil {
+					continue
+				}
+				price := PlanPrice{
+					TermDescription: ReadString(term.TermDescription),
+					Currency:        ReadString(term.Currency),
+				}
+				if term.TermUnit != nil {
+					price.TermUnit = string(*term.TermUnit)
+				}
+				if term.Price != nil {
+					price.Price = *term.Price
+				}
+				subscriptionPlan.Prices = append(subscriptionPlan.Prices, price)
+			}
+			for _, dimension := range plan.PlanComponents.MeteringDimensions {
+				if dimension == nil {
+					continue
+				}
+				meteringDimension := PlanMeteringDimension{
+					Id:            ReadString(dimension.ID),
+					DisplayName:   ReadString(dimension.DisplayName),
+					UnitOfMeasure: ReadString(dimension.UnitOfMeasure),
+					Currency:      ReadString(dimension.Currency),
+				}
+				if dimension.PricePerUnit != nil {
+					meteringDimension.PricePerUnit = *dimension.PricePerUnit
+				}
+				subscriptionPlan.MeteringDimensions = append(subscriptionPlan.MeteringDimensions, meteringDimension)
+			}
+		}
+		subscriptionPlans = append(subscriptionPlans, subscriptionPlan)
+	}
+	return subscriptionPlans
+}
+
+// --------------------------------------------------------------------------------
+// Change Subscription Plan
+// --------------------------------------------------------------------------------
+type ChangeSubscriptionPlanRequest struct {
+	PlanId string `json:"planId"`
+}
+
+type ChangeSubscriptionResponse struct {
+	Success   bool                       `json:"success"`
+	Operation *models.PublisherOperation `json:"operation"`
+}
+
+// Start a plan change with the Marketplace and return right away; the client
+// polls /:subscriptionId/operations until the operation completes.
+func ChangeSubscriptionPlan(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get request body
+	req := &ChangeSubscriptionPlanRequest{}
+	if err := c.BodyParser(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if req.PlanId == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid planId")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getOwnedSubscription(c, repo, claims.Oid)
+	if err != nil {
+		return err
+	}
+	if err := checkSubscriptionChangeable(subscription); err != nil {
+		return err
+	}
+	if req.PlanId == subscription.PlanId {
+		return fiber.NewError(fiber.StatusBadRequest, "subscription is already on this plan")
+	}
+
+	// the plan must be one the subscription can change to
+	plans, err := listAvailablePlans(c.Context(), subscription.Id)
+	if err != nil {
+		fmt.Println("error listing available plans:", subscription.Id, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get plans")
+	}
+	available := false
+	for _, plan := range makeSubscriptionPlans(plans, subscription.PlanId) {
+		if plan.PlanId == req.PlanId {
+			available = true
+			break
+		}
+	}
+	if !available {
+		return fiber.NewError(fiber.StatusBadRequest, "plan is not available for this subscription")
+	}
+
+	// start the change
+	operation, err := startPublisherOperation(c.Context(), repo, subscription, claims.Oid, &models.PublisherOperation{
+		Action: string(saasapi.OperationActionEnumChangePlan),
+		PlanId: req.PlanId,
+	})
+	if err != nil {
+		return err
+	}
+
+	// return response
+	response := &ChangeSubscriptionResponse{
+		Success:   true,
+		Operation: operation,
+	}
+	return c.Status(fiber.StatusAccepted).JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Change Subscription Quantity
+// --------------------------------------------------------------------------------
+type ChangeSubscriptionQuantityRequest struct {
+	Quantity int `json:"quantity"`
+}
+
+// Start a quantity change with the Marketplace and return right away. Lowering
+// the quantity below the assigned seats follows the over-allocation policy:
+// refused with "reject", or the extra users are unassigned after the notice
+// period with "unassign".
+func ChangeSubscriptionQuantity(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get request body
+	req := &ChangeSubscriptionQuantityRequest{}
+	if err := c.BodyParser(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if req.Quantity < 1 {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid quantity")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getOwnedSubscription(c, repo, claims.Oid)
+	if err != nil {
+		return err
+	}
+	if err := checkSubscriptionChangeable(subscription); err != nil {
+		return err
+	}
+	if req.Quantity == subscription.Quantity {
+		return fiber.NewError(fiber.StatusBadRequest, "subscription already has this quantity")
+	}
+
+	// check the assigned seats against the policy
+	status, err := checkChangeQuantity(c.Context(), repo, subscription.Id, req.Quantity)
+	if err != nil {
+		fmt.Println("db error checking seats:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not check seats")
+	}
+	if status == saasapi.UpdateOperationStatusEnumFailure {
+		return fiber.NewError(fiber.StatusConflict, "more users are assigned than the new quantity; unassign users first")
+	}
+
+	// start the change
+	operation, err := startPublisherOperation(c.Context(), repo, subscription, claims.Oid, &models.PublisherOperation{
+		Action:   string(saasapi.OperationActionEnumChangeQuantity),
+		Quantity: req.Quantity,
+	})
+	if err != nil {
+		return err
+	}
+
+	// return response
+	response := &ChangeSubscriptionResponse{
+		Success:   true,
+		Operation: operation,
+	}
+	return c.Status(fiber.StatusAccepted).JSON(response)
+}
+
+// only active subscriptions can be changed by the publisher
+func checkSubscriptionChangeable(subscription *models.Subscription) error {
+	if subscription.SaaSSubscriptionStatus != models.SubscriptionStatusEnumSubscribed {
+		return fiber.NewError(fiber.StatusConflict, fmt.Sprintf("subscription is %s", subscription.SaaSSubscriptionStatus))
+	}
+	return nil
+}
+
+// Call UpdateSubscription for the change described by operation (a plan or a
+// quantity), or DeleteSubscription to cancel, then record the operation it
+// started for the worker to track. Returns a fiber error for the handler to return.
+func startPublisherOperation(ctx context.Context, repo *repository.Repository, subscription *models.Subscription, oid string, operation *models.PublisherOperation) (*models.PublisherOperation, error) {
+	// create fulfillment api client
+	client, err := saasapi.NewDefaultFulfillmentOperationsClient()
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "could not create fulfillment api client")
+	}
+
+	var location *string
+	switch operation.Action {
+	case string(saasapi.OperationActionEnumUnsubscribe):
+		deleteResponse, err := client.DeleteSubscription(ctx, subscription.Id, &saasapi.FulfillmentOperationsClientDeleteSubscriptionOptions{})
+		if err != nil {
+			return nil, marketplaceChangeError(subscription.Id, err)
+		}
+		location = deleteResponse.OperationLocationURI
+	default:
+		// the Marketplace changes either the plan or the quantity, not both
+		body := saasapi.SubscriberPlan{}
+		if operation.Action == string(saasapi.OperationActionEnumChangePlan) {
+			body.PlanID = &operation.PlanId
+		} else {
+			quantity := int64(operation.Quantity)
+			body.Quantity = &quantity
+		}
+		updateResponse, err := client.UpdateSubscription(ctx, subscription.Id, body, &saasapi.FulfillmentOperationsClientUpdateSubscriptionOptions{})
+		if err != nil {
+			return nil, marketplaceChangeError(subscription.Id, err)
+		}
+		location = updateResponse.OperationLocationURI
+	}
+
+	// record the operation
+	operationId, err := operationIdFromLocation(ReadString(location))
+	if err != nil {
+		fmt.Println("error reading operation location:", subscription.Id, err)
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "could not track the change")
+	}
+	now := time.Now()
+	operation.Id = operationId
+	operation.SubscriptionId = subscription.Id
+	operation.RequestedBy = oid
+	operation.OperationLocation = ReadString(location)
+	operation.Status = models.PublisherOperationStatusEnumInProgress
+	operation.MarketplaceStatus = string(saasapi.OperationStatusEnumInProgress)
+	operation.NextAttemptAt = now.Add(publisherOperationPollInterval)
+	err = repo.CreatePublisherOperation(ctx, operation)
+	if err != nil {
+		fmt.Println("db error saving publisher operation:", operationId, err)
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "could not track the change")
+	}
+	return operation, nil
+}
+
+// a fiber error for a Marketplace call that changes the subscription
+func marketplaceChangeError(subscriptionId string, err error) error {
+	fmt.Println("error changing subscription with the Marketplace:", subscriptionId, err)
+	var responseError *azcore.ResponseError
+	if errors.As(err, &responseError) {
+		switch responseError.StatusCode {
+		case http.StatusConflict:
+			return fiber.NewError(fiber.StatusConflict, "another change to the subscription is in progress")
+		case http.StatusBadRequest:
+			return fiber.NewError(fiber.StatusBadRequest, "the Marketplace rejected the change")
+		}
+	}
+	return fiber.NewError(fiber.StatusBadGateway, "could not change the subscription with the Marketplace")
+}
+
+// the operation id is the last segment of the Operation-Location URL
+func operationIdFromLocation(location string) (string, error) {
+	operationURL, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	id := path.Base(operationURL.Path)
+	if path.Base(path.Dir(operationURL.Path)) != "operations" || id == "" {
+		return "", fmt.Errorf("not an operation location: %q", location)
+	}
+	return id, nil
+}
+
+// --------------------------------------------------------------------------------
+// Get Subscription Operations
+// --------------------------------------------------------------------------------
+type GetSubscriptionOperationsResponse struct {
+	Success    bool                        `json:"success"`
+	Operations []models.PublisherOperation `json:"operations"`
+}
+
+// the plan and quantity changes and cancellations started by admins, newest
+// first, with their progress
+func GetSubscriptionOperations(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getAdminSubscription(c.Context(), repo, claims.Oid, c.Params("subscriptionId"))
+	if err != nil {
+		return err
+	}
+
+	// get operations
+	operations, err := repo.ListPublisherOperations(c.Context(), subscription.Id)
+	if err != nil {
+		fmt.Println("db error getting publisher operations:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get operations")
+	}
+
+	// return response
+	response := &GetSubscriptionOperationsResponse{
+		Success:    true,
+		Operations: operations,
+	}
+	return c.JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Publisher operation worker
+// --------------------------------------------------------------------------------
+
+// Worker for operations started by admins. The Marketplace doesn't call our
+// webhook for plan and quantity changes we start, so each one is polled until it completes; the
+// subscription is then synced. Each operation is processed in a transaction
+// holding its row lock, so no two workers poll it at once.
+func ProcessPublisherOperations(ctx context.Context) error {
+	repo := repository.New(database.DB.DB)
+
+	for i := 0; i < publisherOperationBatchSize; i++ {
+		processed := false
+		err := repo.Transaction(ctx, func(tx *repository.Repository) error {
+			operation, err := tx.LockNextDuePublisherOperation(ctx, time.Now())
+			if errors.Is(err, repository.ErrNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			processed = true
+
+			status, err := processPublisherOperation(ctx, tx, operation)
+			recordPublisherOperationResult(operation, status, err, time.Now())
+			err = tx.SavePublisherOperation(ctx, operation)
+			if err != nil {
+				return err
+			}
+			if operation.Status == models.PublisherOperationStatusEnumInProgress {
+				return nil
+			}
+			if operation.Action == string(saasapi.OperationActionEnumUnsubscribe) {
+				// a successful cancellation was recorded with the subscription's lifecycle
+				if operation.Status == models.PublisherOperationStatusEnumFailed {
+					return failSubscriptionCancellation(ctx, tx, operation)
+				}
+				return nil
+			}
+			notifyPublisherOperationResult(ctx, tx, operation)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !processed {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// update status after a poll: done, poll again, retry later, or give up
+func recordPublisherOperationResult(operation *models.PublisherOperation, status saasapi.OperationStatusEnum, err error, now time.Time) {
+	if err != nil {
+		operation.Attempts++
+		fmt.Println("error tracking publisher operation:", operation.Id, "attempt", operation.Attempts, err)
+		operation.LastError = err.Error()
+		if operation.Attempts >= publisherOperationMaxAttempts {
+			operation.Status = models.PublisherOperationStatusEnumFailed
+			operation.CompletedAt = now
+			return
+		}
+		operation.NextAttemptAt = now.Add(jobs.Backoff(operation.Attempts, publisherOperationRetryBase, publisherOperationRetryMax))
+		return
+	}
+
+	operation.MarketplaceStatus = string(status)
+	switch status {
+	case saasapi.OperationStatusEnumSucceeded:
+		operation.Status = models.PublisherOperationStatusEnumSucceeded
+		operation.LastError = ""
+		operation.CompletedAt = now
+	case saasapi.OperationStatusEnumFailed, saasapi.OperationStatusEnumConflict:
+		operation.Status = models.PublisherOperationStatusEnumFailed
+		operation.LastError = fmt.Sprintf("the Marketplace reported the operation as %s", status)
+		operation.CompletedAt = now
+	default:
+		// NotStarted or InProgress
+		if now.Sub(operation.CreatedAt) > publisherOperationMaxWait {
+			operation.Status = models.PublisherOperationStatusEnumFailed
+			operation.LastError = "the Marketplace did not complete the operation in time"
+			operation.CompletedAt = now
+			return
+		}
+		operation.NextAttemptAt = now.Add(publisherOperationPollInterval)
+	}
+}
+
+// Poll the operation; once it succeeded, sync the subscription and apply the
+// side effects of the change (e.g. over-allocation after a lower quantity).
+func processPublisherOperation(ctx context.Context, repo *repository.Repository, operation *models.PublisherOperation) (saasapi.OperationStatusEnum, error) {
+	// create subscription operations client
+	operationsClient, err := saasapi.NewDefaultSubscriptionOperationsClient()
+	if err != nil {
+		return "", fmt.Errorf("could not create subscription operations client: %w", err)
+	}
+
+	// get operation
+	operationStatusResponse, err := operationsClient.GetOperationStatus(
+		ctx,
+		operation.SubscriptionId,
+		operation.Id,
+		&saasapi.SubscriptionOperationsClientGetOperationStatusOptions{},
+	)
+	if err != nil {
+		return "", fmt.Errorf("could not retrieve operation: %w", err)
+	}
+	if operationStatusResponse.Status == nil {
+		return "", errors.New("operation has no status")
+	}
+	status := *operationStatusResponse.Status
+	if status != saasapi.OperationStatusEnumSucceeded {
+		return status, nil
+	}
+
+	// create fulfillment api client
+	fulfillmentClient, err := saasapi.NewDefaultFulfillmentOperationsClient()
+	if err != nil {
+		return "", fmt.Errorf("could not create fulfillment api client: %w", err)
+	}
+
+	// get subscription
+	subscriptionResponse, err := fulfillmentClient.GetSubscription(
+		ctx,
+		operation.SubscriptionId,
+		&saasapi.FulfillmentOperationsClientGetSubscriptionOptions{},
+	)
+	if err != nil {
+		return "", fmt.Errorf("could not retrieve subscription: %w", err)
+	}
+
+	// update subscription
+	source := ledgerSource{Actor: operation.RequestedBy, Operation: operation.Action, OperationId: operation.Id}
+	err = saveSubscriptionToLedger(ctx, repo, makeSubscription(&subscriptionResponse.Subscription), source)
+	if err != nil {
+		return "", fmt.Errorf("db could not save subscription: %w", err)
+	}
+	err = applySubscriptionLifecycle(ctx, repo, source, operation.SubscriptionId)
+	if err != nil {
+		return "", fmt.Errorf("could not apply %s to subscription: %w", operation.Action, err)
+	}
+
+	return status, nil
+}
+
+func notifyPublisherOperationResult(ctx context.Context, repo *repository.Repository, operation *models.PublisherOperation) {
+	subscription, err := repo.GetSubscription(ctx, operation.SubscriptionId)
+	if err != nil {
+		fmt.Println("error getting subscription:", operation.SubscriptionId, err)
+		return
+	}
+
+	change := fmt.Sprintf("%d seats", operation.Quantity)
+	if operation.Action == string(saasapi.OperationActionEnumChangePlan) {
+		change = fmt.Sprintf("the %s plan", operation.PlanId)
+	}
+	if operation.Status == models.PublisherOperationStatusEnumSucceeded {
+		notifySubscriptionAdmins(ctx, repo, subscription, fmt.Sprintf("Your subscription %s was changed", subscription.Name), []string{
+			fmt.Sprintf("Your Teraphone subscription %s was changed to %s.", subscription.Name, change),
+		})
+		return
+	}
+	notifySubscriptionAdmins(ctx, repo, subscription, fmt.Sprintf("The change to your subscription %s failed", subscription.Name), []string{
+		fmt.Sprintf("The change of your Teraphone subscription %s to %s did not go through: %s.", subscription.Name, change, operation.LastError),
+		"The subscription is unchanged. Please try again, or contact us if the problem persists.",
+	})
+}
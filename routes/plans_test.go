@@ -0,0 +1,103 @@
+package routes
+
+import (
+	"errors"
+	"peachone/models"
+	"peachone/saasapi"
+	"testing"
+	"time"
+)
+
+func TestMakeSubscriptionPlans(t *testing.T) {
+	month := saasapi.TermUnitEnumP1M
+	plans := []*saasapi.Plan{
+		{
+			PlanID:         to("basic"),
+			DisplayName:    to("Basic"),
+			IsPricePerSeat: to(true),
+			PlanComponents: &saasapi.PlanComponents{
+				RecurrentBillingTerms: []*saasapi.RecurrentBillingTerm{{Currency: to("USD"), Price: to(float32(4)), TermUnit: &month}},
+				MeteringDimensions:    []*saasapi.MeteringDimension{{ID: to("participant_minutes"), PricePerUnit: to(float32(0.01))}},
+			},
+		},
+		{PlanID: to("legacy"), IsStopSell: to(true)},
+		{PlanID: to("old"), IsStopSell: to(true)},
+		nil,
+	}
+
+	subscriptionPlans := makeSubscriptionPlans(plans, "old")
+	if len(subscriptionPlans) != 2 {
+		t.Fatalf("got %d plans, want basic and the current plan", len(subscriptionPlans))
+	}
+	basic := subscriptionPlans[0]
+	if basic.PlanId != "basic" || basic.IsCurrent || !basic.IsPricePerSeat {
+		t.Errorf("basic = %+v", basic)
+	}
+	if len(basic.Prices) != 1 || basic.Prices[0].Price != 4 || basic.Prices[0].TermUnit != "P1M" || basic.Prices[0].Currency != "USD" {
+		t.Errorf("basic prices = %+v", basic.Prices)
+	}
+	if len(basic.MeteringDimensions) != 1 || basic.MeteringDimensions[0].Id != "participant_minutes" {
+		t.Errorf("basic metering dimensions = %+v", basic.MeteringDimensions)
+	}
+	if current := subscriptionPlans[1]; current.PlanId != "old" || !current.IsCurrent || current.Prices == nil {
+		t.Errorf("current plan = %+v", current)
+	}
+}
+
+func TestOperationIdFromLocation(t *testing.T) {
+	id, err := operationIdFromLocation("https://marketplaceapi.microsoft.com/api/saas/subscriptions/sub/operations/op-1?api-version=2018-08-31")
+	if err != nil || id != "op-1" {
+		t.Errorf("got %q, %v; want op-1", id, err)
+	}
+	for _, location := range []string{"", "https://marketplaceapi.microsoft.com/api/saas/subscriptions/sub"} {
+		if id, err := operationIdFromLocation(location); err == nil {
+			t.Errorf("%q: got %q, want an error", location, id)
+		}
+	}
+}
+
+func TestRecordPublisherOperationResult(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	newOperation := func() *models.PublisherOperation {
+		return &models.PublisherOperation{Status: models.PublisherOperationStatusEnumInProgress, CreatedAt: now.Add(-time.Minute)}
+	}
+
+	operation := newOperation()
+	recordPublisherOperationResult(operation, saasapi.OperationStatusEnumInProgress, nil, now)
+	if operation.Status != models.PublisherOperationStatusEnumInProgress || !operation.NextAttemptAt.Equal(now.Add(publisherOperationPollInterval)) {
+		t.Errorf("in progress: %s, next attempt %s", operation.Status, operation.NextAttemptAt)
+	}
+
+	operation = newOperation()
+	recordPublisherOperationResult(operation, saasapi.OperationStatusEnumSucceeded, nil, now)
+	if operation.Status != models.PublisherOperationStatusEnumSucceeded || !operation.CompletedAt.Equal(now) {
+		t.Errorf("succeeded: %s, completed %s", operation.Status, operation.CompletedAt)
+	}
+
+	operation = newOperation()
+	recordPublisherOperationResult(operation, saasapi.OperationStatusEnumConflict, nil, now)
+	if operation.Status != models.PublisherOperationStatusEnumFailed || operation.MarketplaceStatus != "Conflict" {
+		t.Errorf("conflict: %s (%s)", operation.Status, operation.MarketplaceStatus)
+	}
+
+	// still in progress long after it started: give up
+	operation = newOperation()
+	operation.CreatedAt = now.Add(-publisherOperationMaxWait - time.Minute)
+	recordPublisherOperationResult(operation, saasapi.OperationStatusEnumNotStarted, nil, now)
+	if operation.Status != models.PublisherOperationStatusEnumFailed {
+		t.Errorf("timed out: %s", operation.Status)
+	}
+
+	// poll errors are retried with backoff, then given up on
+	operation = newOperation()
+	for i := 1; i < publisherOperationMaxAttempts; i++ {
+		recordPublisherOperationResult(operation, "", errors.New("unavailable"), now)
+		if operation.Status != models.PublisherOperationStatusEnumInProgress || !operation.NextAttemptAt.After(now) {
+			t.Fatalf("attempt %d: %s, next attempt %s", i, operation.Status, operation.NextAttemptAt)
+		}
+	}
+	recordPublisherOperationResult(operation, "", errors.New("unavailable"), now)
+	if operation.Status != models.PublisherOperationStatusEnumFailed || operation.LastError != "unavailable" {
+		t.Errorf("last attempt: %s, %q", operation.Status, operation.LastError)
+	}
+}
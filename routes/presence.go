@@ -0,0 +1,204 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"peachone/auth"
+	"peachone/database"
+	"peachone/models"
+	"peachone/repository"
+	"time"
+
+	graphmodels "github.com/microsoftgraph/msgraph-sdk-go/models"
+)
+
+// graph presence subscriptions expire after at most one hour
+const presenceSubscriptionLifetime = 55 * time.Minute
+const presenceSubscriptionRenewBefore = 15 * time.Minute
+
+// map Microsoft Graph availability values onto our smaller set
+func mapGraphAvailability(availability string) models.AvailabilityEnum {
+	switch availability {
+	case "Available", "AvailableIdle":
+		return models.AvailabilityEnumAvailable
+	case "Busy", "BusyIdle":
+		return models.AvailabilityEnumBusy
+	case "Away", "BeRightBack":
+		return models.AvailabilityEnumAway
+	case "DoNotDisturb":
+		return models.AvailabilityEnumDoNotDisturb
+	default:
+		return models.AvailabilityEnumOffline
+	}
+}
+
+func isManualStatusActive(status *models.UserStatus, now time.Time) bool {
+	return status.Source == models.StatusSourceEnumManual &&
+		(status.ExpiresAt.IsZero() || now.Before(status.ExpiresAt))
+}
+
+// returns the status to show other users, or nil if there is nothing to show
+func effectiveStatus(status *models.UserStatus, now time.Time) *models.UserStatus {
+	if status.Source == models.StatusSourceEnumManual && !isManualStatusActive(status, now) {
+		return nil
+	}
+	return status
+}
+
+// store presence reported by Teams, unless the user has set a manual status
+func setTeamsPresence(ctx context.Context, repo *repository.Repository, oid string, presence graphmodels.Presenceable) error {
+	current, err := repo.GetUserStatus(ctx, oid)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		return err
+	}
+	if err == nil && isManualStatusActive(current, time.Now()) {
+		return nil
+	}
+
+	status := &models.UserStatus{
+		Oid:          oid,
+		Availability: mapGraphAvailability(ReadString(presence.GetAvailability())),
+		Activity:     ReadString(presence.GetActivity()),
+		Source:       models.StatusSourceEnumTeams,
+	}
+	return repo.SaveUserStatus(ctx, status)
+}
+
+// fetch a user's presence with app-only credentials after a change notification
+func refreshTeamsPresence(ctx context.Context, repo *repository.Repository, subscription *models.PresenceSubscription) error {
+	client, err := auth.NewAppMSGraphClient(subscription.Tid)
+	if err != nil {
+		return err
+	}
+
+	presence, err := client.Communications().PresencesById(subscription.Oid).Get()
+	if err != nil {
+		return err
+	}
+
+	return setTeamsPresence(ctx, repo, subscription.Oid, presence)
+}
+
+// fetch the signed in user's Teams presence (needs the Presence.Read scope)
+func syncTeamsPresence(ctx context.Context, repo *repository.Repository, msAccessToken string, user *models.TenantUser) error {
+	_, client, err := auth.NewMSGraphClientWithScopes(msAccessToken, []string{"Presence.Read"})
+	if err != nil {
+		return err
+	}
+
+	presence, err := client.Me().Presence().Get()
+	if err != nil {
+		return err
+	}
+
+	return setTeamsPresence(ctx, repo, user.Oid, presence)
+}
+
+// keep renewing a user's feed while their client has requested it this recently
+const presenceSubscriptionIdleAfter = time.Hour
+
+// Job: create or renew the graph subscriptions that feed PresenceWebhook, for
+// users whose client requested their feed recently (GetWorld, sign in). Runs
+// on one instance at a time, so no feed is created twice.
+func RenewPresenceSubscriptions(ctx context.Context) error {
+	GRAPH_NOTIFICATION_URL := os.Getenv("GRAPH_NOTIFICATION_URL")
+	GRAPH_CLIENT_STATE := os.Getenv("GRAPH_CLIENT_STATE")
+	if GRAPH_NOTIFICATION_URL == "" || GRAPH_CLIENT_STATE == "" {
+		return nil
+	}
+
+	repo := repository.New(database.DB.DB)
+	release, locked, err := repo.TryAdvisoryLock(ctx, "presence-subscriptions")
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return nil // running on another instance
+	}
+	defer release()
+
+	now := time.Now()
+	subscriptions, err := repo.ListPresenceSubscriptionsToRenew(ctx, now.Add(-presenceSubscriptionIdleAfter), now.Add(presenceSubscriptionRenewBefore))
+	if err != nil {
+		return err
+	}
+	for i := range subscriptions {
+		err := ensurePresenceSubscription(ctx, repo, &subscriptions[i], GRAPH_NOTIFICATION_URL, GRAPH_CLIENT_STATE)
+		if err != nil {
+			fmt.Println("error renewing presence subscription for user:", subscriptions[i].Oid, err)
+		}
+	}
+
+	return nil
+}
+
+// renew the user's graph subscription, or create one if it was never created,
+// has expired or can't be renewed
+func ensurePresenceSubscription(ctx context.Context, repo *repository.Repository, current *models.PresenceSubscription, notificationUrl string, clientState string) error {
+	client, err := auth.NewAppMSGraphClient(current.Tid)
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(presenceSubscriptionLifetime).UTC()
+
+	// try to renew the existing subscription first
+	if current.Id != "" && time.Now().Before(current.ExpiresAt) {
+		renewal := graphmodels.NewSubscription()
+		renewal.SetExpirationDateTime(&expiresAt)
+		err = client.SubscriptionsById(current.Id).Patch(renewal)
+		if err == nil {
+			return repo.RenewPresenceSubscription(ctx, current.Oid, expiresAt)
+		}
+		fmt.Println("error renewing presence subscription, creating a new one:", err)
+	}
+
+	resource := fmt.Sprintf("/communications/presences/%s", current.Oid)
+	changeType := "updated"
+	subscription := graphmodels.NewSubscription()
+	subscription.SetResource(&resource)
+	subscription.SetChangeType(&changeType)
+	subscription.SetNotificationUrl(&notificationUrl)
+	subscription.SetClientState(&clientState)
+	subscription.SetExpirationDateTime(&expiresAt)
+	created, err := client.Subscriptions().Post(subscription)
+	if err != nil {
+		return err
+	}
+
+	current.Id = ReadString(created.GetId())
+	current.ExpiresAt = expiresAt
+	return repo.SavePresenceSubscription(ctx, current)
+}
+
+// The webhook acknowledges change notifications right away (Graph expects a
+// response within a few seconds) and fetches the new presences afterwards.
+const presenceRefreshTimeout = time.Minute
+
+// fetch the presence of the users the notified subscriptions belong to
+func refreshNotifiedPresences(subscriptionIds []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), presenceRefreshTimeout)
+	defer cancel()
+	repo := repository.New(database.DB.DB)
+
+	for _, subscriptionId := range subscriptionIds {
+		// find the user this subscription belongs to
+		subscription, err := repo.GetPresenceSubscriptionById(ctx, subscriptionId)
+		if errors.Is(err, repository.ErrNotFound) {
+			log.Println("Ignoring notification for unknown subscription:", subscriptionId)
+			continue
+		}
+		if err != nil {
+			log.Println("Error getting presence subscription:", subscriptionId, err)
+			continue
+		}
+
+		// notifications don't carry resource data, so fetch the new presence
+		err = refreshTeamsPresence(ctx, repo, subscription)
+		if err != nil {
+			log.Println("Error refreshing presence for user:", subscription.Oid, err)
+		}
+	}
+}
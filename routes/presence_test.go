@@ -0,0 +1,54 @@
+package routes
+
+import (
+	"peachone/models"
+	"testing"
+	"time"
+)
+
+func TestMapGraphAvailability(t *testing.T) {
+	cases := map[string]models.AvailabilityEnum{
+		"Available":       models.AvailabilityEnumAvailable,
+		"AvailableIdle":   models.AvailabilityEnumAvailable,
+		"Busy":            models.AvailabilityEnumBusy,
+		"BusyIdle":        models.AvailabilityEnumBusy,
+		"Away":            models.AvailabilityEnumAway,
+		"BeRightBack":     models.AvailabilityEnumAway,
+		"DoNotDisturb":    models.AvailabilityEnumDoNotDisturb,
+		"Offline":         models.AvailabilityEnumOffline,
+		"PresenceUnknown": models.AvailabilityEnumOffline,
+		"":                models.AvailabilityEnumOffline,
+	}
+	for graphAvailability, expected := range cases {
+		if actual := mapGraphAvailability(graphAvailability); actual != expected {
+			t.Errorf("mapGraphAvailability(%q) = %s, expected %s", graphAvailability, actual, expected)
+		}
+	}
+}
+
+func TestEffectiveStatus(t *testing.T) {
+	now := time.Now()
+
+	teams := &models.UserStatus{Source: models.StatusSourceEnumTeams}
+	if effectiveStatus(teams, now) != teams {
+		t.Error("teams status should always be shown")
+	}
+
+	forever := &models.UserStatus{Source: models.StatusSourceEnumManual}
+	if effectiveStatus(forever, now) != forever {
+		t.Error("manual status without expiry should be shown")
+	}
+
+	active := &models.UserStatus{Source: models.StatusSourceEnumManual, ExpiresAt: now.Add(time.Hour)}
+	if effectiveStatus(active, now) != active {
+		t.Error("unexpired manual status should be shown")
+	}
+
+	expired := &models.UserStatus{Source: models.StatusSourceEnumManual, ExpiresAt: now.Add(-time.Hour)}
+	if effectiveStatus(expired, now) != nil {
+		t.Error("expired manual status should be hidden")
+	}
+	if isManualStatusActive(expired, now) {
+		t.Error("expired manual status should not block Teams presence")
+	}
+}
@@ -1,10 +1,15 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"peachone/avatars"
 	"peachone/database"
+	"peachone/entitlements"
 	"peachone/models"
-	"peachone/queries"
+	"peachone/repository"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -18,9 +23,14 @@ func PrivateWelcome(c *fiber.Ctx) error {
 // --------------------------------------------------------------------------------
 // Update Trial request handler
 // --------------------------------------------------------------------------------
+type UpdateTrialRequest struct {
+	Tenant bool `json:"tenant"` // start (or join) the trial for the user's whole tenant instead
+}
+
 type UpdateTrialResponse struct {
 	Success bool              `json:"success"`
 	User    models.TenantUser `json:"user"`
+	Trial   TrialState        `json:"trial"`
 }
 
 func UpdateTrial(c *fiber.Ctx) error {
@@ -31,34 +41,68 @@ func UpdateTrial(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusUnauthorized, "Expired JWT.")
 	}
 
-	// get database connection
-	db := database.DB.DB
+	// parse request; the body is optional
+	req := &UpdateTrialRequest{}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body.")
+		}
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
 
 	// get user
-	user := &models.TenantUser{}
-	query := db.Where("oid = ?", claims.Oid).Find(user)
-	if query.RowsAffected == 0 {
-		fmt.Println("user not found:", claims.Oid)
+	user, err := repo.GetUser(c.Context(), claims.Oid)
+	if err != nil {
+		fmt.Println("error getting user:", claims.Oid, err)
 		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
 	}
 	fmt.Println("found user:", user)
 
+	// start or join the tenant trial; the first user to ask starts it for everyone
+	if req.Tenant {
+		tenantTrial, err := startTenantTrial(c.Context(), repo, user, time.Now())
+		if err != nil {
+			fmt.Println("error starting tenant trial:", user.Tid, err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
+		}
+		response := &UpdateTrialResponse{
+			Success: true,
+			User:    *user,
+			Trial:   trialState(user, tenantTrial, time.Now()),
+		}
+		return c.JSON(response)
+	}
+
 	// update trial
 	if !user.TrialActivated {
-		tx := db.Model(user).Updates(models.TenantUser{
-			TrialActivated: true,
-			TrialExpiresAt: time.Now().Add(time.Hour * 24 * 30),
+		user.TrialActivated = true
+		user.TrialStartedAt = time.Now()
+		user.TrialExpiresAt = user.TrialStartedAt.Add(trialLength())
+		err = repo.UpdateUser(c.Context(), user.Oid, map[string]interface{}{
+			"trial_activated":  user.TrialActivated,
+			"trial_started_at": user.TrialStartedAt,
+			"trial_expires_at": user.TrialExpiresAt,
 		})
-		if tx.Error != nil {
-			fmt.Println("error updating trial:", tx.Error)
+		if err != nil {
+			fmt.Println("error updating trial:", err)
 			return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
 		}
 	}
 
+	// get tenant trial
+	tenantTrial, err := getTenantTrial(c.Context(), repo, user.Tid)
+	if err != nil {
+		fmt.Println("error getting tenant trial:", user.Tid, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
+	}
+
 	// return response
 	response := &UpdateTrialResponse{
 		Success: true,
 		User:    *user,
+		Trial:   trialState(user, tenantTrial, time.Now()),
 	}
 	return c.JSON(response)
 
@@ -68,7 +112,9 @@ func UpdateTrial(c *fiber.Ctx) error {
 // Get World request handler
 // --------------------------------------------------------------------------------
 type GetWorldResponse struct {
-	Teams []models.TeamInfo `json:"teams"`
+	Teams        []models.TeamInfo         `json:"teams"`
+	Entitlements entitlements.Entitlements `json:"entitlements"` // what the user's subscription or trial includes
+	Trial        TrialState                `json:"trial"`
 }
 
 func GetWorld(c *fiber.Ctx) error {
@@ -79,14 +125,14 @@ func GetWorld(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusUnauthorized, "Expired JWT.")
 	}
 
-	// get database connection
-	db := database.DB.DB
+	// get repository
+	repo := repository.New(database.DB.DB)
+	ctx := c.Context()
 
 	// get user
-	user := &models.TenantUser{}
-	query := db.Where("oid = ?", claims.Oid).Find(user)
-	if query.RowsAffected == 0 {
-		fmt.Println("user not found for user:", claims.Oid)
+	user, err := repo.GetUser(ctx, claims.Oid)
+	if err != nil {
+		fmt.Println("error getting user:", claims.Oid, err)
 		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
 	}
 	fmt.Println("found user:", user)
@@ -94,51 +140,49 @@ func GetWorld(c *fiber.Ctx) error {
 	// get subscription
 	subscription := &models.Subscription{}
 	if user.SubscriptionId != "" {
-		query = db.Where("id = ?", user.SubscriptionId).Find(subscription)
-		if query.RowsAffected == 0 {
-			fmt.Println("subscription not found:", user.SubscriptionId)
+		subscription, err = repo.GetSubscription(ctx, user.SubscriptionId)
+		if err != nil {
+			fmt.Println("error getting subscription:", user.SubscriptionId, err)
 			return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
 		}
 	}
 
+	// get tenant trial
+	tenantTrial, err := getTenantTrial(ctx, repo, user.Tid)
+	if err != nil {
+		fmt.Println("error getting tenant trial:", user.Tid, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
+	}
+
+	// features of the user's plan; none without access
+	features := userEntitlements(user, subscription, tenantTrial, time.Now())
+
 	teamInfos := []models.TeamInfo{}
 
-	// get the user's teams
-	usersTeams := []models.TeamUser{}
-	query = db.Where("oid = ?", user.Oid).Find(&usersTeams)
-	if query.RowsAffected == 0 {
-		fmt.Println("no teams found for user:", user.Oid)
+	// get the user's teams (users who signed in with basic consent have none)
+	teams, err := repo.ListTeamsForUser(ctx, user.Oid)
+	if err != nil {
+		fmt.Println("error getting teams for user:", user.Oid, err)
 		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
 	}
 
 	// get TeamInfo for each team
-	for _, userTeam := range usersTeams {
+	for _, team := range teams {
 		roomInfos := []models.RoomInfo{}
 
-		// get TenantTeam
-		team := &models.TenantTeam{}
-		query := db.Where("id = ?", userTeam.Id).Find(team)
-		if query.RowsAffected == 0 {
-			fmt.Println("team not found:", userTeam.Id)
-			return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
-		}
-
 		// get TeamRooms for team
-		rooms := []models.TeamRoom{}
-		query = db.Where("team_id = ?", team.Id).Find(&rooms)
-		if query.RowsAffected == 0 {
-			fmt.Println("rooms not found for team:", team.Id)
+		rooms, err := repo.ListRoomsForTeam(ctx, team.Id)
+		if err != nil {
+			fmt.Println("error getting rooms for team:", team.Id, err)
 			return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
 		}
 
-		// check if subscription is active or trial is active
-		subscriptionActive := subscription.SaaSSubscriptionStatus == models.SubscriptionStatusEnumSubscribed
-		trialActive := user.TrialActivated && (time.Now().Unix() < user.TrialExpiresAt.Unix())
-		canJoin := subscriptionActive || trialActive
+		// check if subscription is active (or in its suspend grace period) or a trial is active
+		canJoin := userHasRoomAccess(user, subscription, tenantTrial, time.Now())
 
 		// for each room, get LivekitJoinToken
 		for _, room := range rooms {
-			token, err := createLiveKitJoinToken(room.TeamId, room.Id.String(), userTeam.Oid)
+			token, err := createLiveKitJoinToken(room.TeamId, room.Id.String(), user.Oid, features.Recording)
 			if err != nil {
 				fmt.Println("error creating LiveKitJoinToken:", err)
 				return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
@@ -153,15 +197,18 @@ func GetWorld(c *fiber.Ctx) error {
 		}
 
 		// get users for team
-		users, err := queries.GetUsersForTeam(db, team.Id)
+		users, err := repo.ListTeamMembers(ctx, team.Id)
 		if err != nil {
 			fmt.Println("error getting users for team:", err)
 			return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
 		}
+		for i := range users {
+			setAvatarUrl(&users[i])
+		}
 
 		// create TeamInfo
 		teamInfo := &models.TeamInfo{
-			Team:  *team,
+			Team:  team,
 			Rooms: roomInfos,
 			Users: users,
 		}
@@ -169,9 +216,148 @@ func GetWorld(c *fiber.Ctx) error {
 		teamInfos = append(teamInfos, *teamInfo)
 	}
 
+	// attach user statuses
+	oids := []string{}
+	for _, teamInfo := range teamInfos {
+		for _, teamUser := range teamInfo.Users {
+			oids = append(oids, teamUser.Oid)
+		}
+	}
+	statuses, err := repo.ListUserStatuses(ctx, oids)
+	if err != nil {
+		fmt.Println("db error getting user statuses:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
+	}
+	now := time.Now()
+	statusByOid := make(map[string]*models.UserStatus)
+	for i := range statuses {
+		if status := effectiveStatus(&statuses[i], now); status != nil {
+			statusByOid[status.Oid] = status
+		}
+	}
+	for _, teamInfo := range teamInfos {
+		for i := range teamInfo.Users {
+			teamInfo.Users[i].Status = statusByOid[teamInfo.Users[i].Oid]
+		}
+	}
+
+	// keep the Teams presence feed alive while the user is active (renewed by
+	// the RenewPresenceSubscriptions job)
+	err = repo.RequestPresenceSubscription(ctx, user.Oid, user.Tid, now)
+	if err != nil {
+		fmt.Println("db error requesting presence subscription:", err)
+	}
+
 	// return response
 	response := &GetWorldResponse{
-		Teams: teamInfos,
+		Teams:        teamInfos,
+		Entitlements: features,
+		Trial:        trialState(user, tenantTrial, now),
+	}
+	return c.JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Set Status request handler
+// --------------------------------------------------------------------------------
+type SetStatusRequest struct {
+	Availability models.AvailabilityEnum `json:"availability"`
+	Message      string                  `json:"message"`
+	ExpiresAt    time.Time               `json:"expiresAt"`
+}
+
+type SetStatusResponse struct {
+	Success bool              `json:"success"`
+	Status  models.UserStatus `json:"status"`
+}
+
+const maxStatusMessageLength = 280
+
+func SetStatus(c *fiber.Ctx) error {
+	// extract claims from JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		fmt.Println("error extracting claims from JWT:", err)
+		return fiber.NewError(fiber.StatusUnauthorized, "Expired JWT.")
+	}
+
+	// get request body
+	req := &SetStatusRequest{}
+	if err := c.BodyParser(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body.")
+	}
+
+	// validate request body
+	validAvailability := false
+	for _, availability := range models.PossibleAvailabilityEnumValues() {
+		if req.Availability == availability {
+			validAvailability = true
+			break
+		}
+	}
+	if !validAvailability {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid availability.")
+	}
+	if len(req.Message) > maxStatusMessageLength {
+		return fiber.NewError(fiber.StatusBadRequest, "Status message is too long.")
+	}
+	if !req.ExpiresAt.IsZero() && req.ExpiresAt.Before(time.Now()) {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid expiresAt.")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// set status
+	status := &models.UserStatus{
+		Oid:          claims.Oid,
+		Availability: req.Availability,
+		Message:      req.Message,
+		Source:       models.StatusSourceEnumManual,
+		ExpiresAt:    req.ExpiresAt,
+	}
+	err = repo.SaveUserStatus(c.Context(), status)
+	if err != nil {
+		fmt.Println("db error setting status:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
+	}
+
+	// return response
+	response := &SetStatusResponse{
+		Success: true,
+		Status:  *status,
+	}
+	return c.JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Clear Status request handler
+// --------------------------------------------------------------------------------
+type ClearStatusResponse struct {
+	Success bool `json:"success"`
+}
+
+func ClearStatus(c *fiber.Ctx) error {
+	// extract claims from JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		fmt.Println("error extracting claims from JWT:", err)
+		return fiber.NewError(fiber.StatusUnauthorized, "Expired JWT.")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// clear status (Teams presence takes over again on its next update)
+	err = repo.DeleteUserStatus(c.Context(), claims.Oid)
+	if err != nil {
+		fmt.Println("db error clearing status:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
+	}
+
+	// return response
+	response := &ClearStatusResponse{
+		Success: true,
 	}
 	return c.JSON(response)
 }
@@ -229,3 +415,65 @@ func GetRefreshedAccessToken(c *fiber.Ctx) error {
 	}
 	return c.JSON(response)
 }
+
+// --------------------------------------------------------------------------------
+// Get Avatar request handler
+// --------------------------------------------------------------------------------
+func GetAvatar(c *fiber.Ctx) error {
+	// extract claims from JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		fmt.Println("error extracting claims from JWT:", err)
+		return fiber.NewError(fiber.StatusUnauthorized, "Expired JWT.")
+	}
+
+	// get userId from request
+	oid := c.Params("oid")
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get user
+	user, err := repo.GetUser(c.Context(), oid)
+	if errors.Is(err, repository.ErrNotFound) {
+		return fiber.NewError(fiber.StatusNotFound, "Avatar not found.")
+	}
+	if err != nil {
+		fmt.Println("error getting user:", oid, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
+	}
+	if user.PhotoHash == "" {
+		return fiber.NewError(fiber.StatusNotFound, "Avatar not found.")
+	}
+
+	// requester must be in the same tenant or share a team with the user
+	if user.Tid != claims.Tid {
+		shared, err := repo.ShareTeam(c.Context(), claims.Oid, user.Oid)
+		if err != nil {
+			fmt.Println("db error checking shared teams:", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
+		}
+		if !shared {
+			return fiber.NewError(fiber.StatusNotFound, "Avatar not found.")
+		}
+	}
+
+	// photos are content addressed, so a matching etag means nothing changed
+	etag := "\"" + user.PhotoHash + "\""
+	c.Set(fiber.HeaderCacheControl, "private, max-age=86400")
+	c.Set(fiber.HeaderETag, etag)
+	if strings.Contains(c.Get(fiber.HeaderIfNoneMatch), etag) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	// read photo from avatar store
+	data, err := avatars.Read(user.PhotoHash)
+	if err != nil {
+		fmt.Println("error reading avatar:", user.PhotoHash, err)
+		return fiber.NewError(fiber.StatusNotFound, "Avatar not found.")
+	}
+
+	// return photo
+	c.Set(fiber.HeaderContentType, http.DetectContentType(data))
+	return c.Send(data)
+}
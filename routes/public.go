@@ -1,16 +1,21 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"peachone/auth"
 	"peachone/database"
 	"peachone/models"
 	"peachone/queries"
+	"peachone/repository"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofrs/uuid"
-	"github.com/microsoftgraph/msgraph-sdk-go/me"
+	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+	"gorm.io/gorm"
 )
 
 // Public Welcome handler
@@ -19,26 +24,75 @@ func PublicWelcome(c *fiber.Ctx) error {
 }
 
 // --------------------------------------------------------------------------------
-// Login request handler
+// Sign in request handler
 // --------------------------------------------------------------------------------
-type LoginRequest struct {
-	MSAccessToken string `json:"msAccessToken"`
+type SignInRequest struct {
+	MSAccessToken string                  `json:"msAccessToken"`
+	Consent       models.ConsentLevelEnum `json:"consent"`     // requested consent level
+	Incremental   bool                    `json:"incremental"` // fall back to a lower consent level instead of failing
 }
 
-type LoginResponse struct {
-	Success                bool                `json:"success"`
-	AccessToken            string              `json:"accessToken"`
-	AccessTokenExpiration  int64               `json:"accessTokenExpiration"`
-	RefreshToken           string              `json:"refreshToken"`
-	RefreshTokenExpiration int64               `json:"refreshTokenExpiration"`
-	FirebaseAuthToken      string              `json:"firebaseAuthToken"`
-	User                   models.TenantUser   `json:"user"`
-	Subscription           models.Subscription `json:"subscription"`
+type AuthUserInfo struct {
+	Oid         string `json:"oid"`
+	Tid         string `json:"tid"`
+	Email       string `json:"email"`
+	Name        string `json:"name"`
+	CompanyName string `json:"companyName"`
+}
+
+type SignInResponse struct {
+	Success                bool                    `json:"success"`
+	AccessToken            string                  `json:"accessToken"`
+	AccessTokenExpiration  int64                   `json:"accessTokenExpiration"`
+	RefreshToken           string                  `json:"refreshToken"`
+	RefreshTokenExpiration int64                   `json:"refreshTokenExpiration"`
+	FirebaseAuthToken      string                  `json:"firebaseAuthToken"`
+	User                   models.TenantUser       `json:"user"`
+	UserInfo               AuthUserInfo            `json:"userInfo"`
+	Tenant                 *models.Tenant          `json:"tenant"`
+	Subscription           models.Subscription     `json:"subscription"`
+	Trial                  TrialState              `json:"trial"`           // the user's own trial and their tenant's
+	ConsentLevel           models.ConsentLevelEnum `json:"consentLevel"`    // consent level granted for this sign in
+	ConsentRequired        []string                `json:"consentRequired"` // scopes to request to reach the requested consent level
+}
+
+var consentScopes = map[models.ConsentLevelEnum][]string{
+	models.ConsentLevelEnumBasic: auth.BasicScopes,
+	models.ConsentLevelEnumTeams: auth.TeamsScopes,
+}
+
+// Sign in with a microsoft access token. Always provisions the user and tenant;
+// joined teams and rooms are only synced once the user has granted teams consent.
+func SignIn(c *fiber.Ctx) error {
+	return signIn(c, models.ConsentLevelEnumTeams)
 }
 
+// Deprecated: use SignIn. Requests teams consent by default.
 func Login(c *fiber.Ctx) error {
+	return signIn(c, models.ConsentLevelEnumTeams)
+}
+
+// Deprecated: use SignIn. Requests basic consent by default.
+func Auth(c *fiber.Ctx) error {
+	return signIn(c, models.ConsentLevelEnumBasic)
+}
+
+// authenticate with on-behalf-of flow for the scopes of a consent level
+func newSignInClient(ctx context.Context, msAccessToken string, consent models.ConsentLevelEnum) (*auth.TokenCredentialHelper, *msgraphsdk.GraphServiceClient, error) {
+	cred, client, err := auth.NewMSGraphClientWithScopes(msAccessToken, consentScopes[consent])
+	if err != nil {
+		return nil, nil, err
+	}
+	err = cred.Authenticate(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cred, client, nil
+}
+
+func signIn(c *fiber.Ctx, defaultConsent models.ConsentLevelEnum) error {
 	// get request body
-	req := new(LoginRequest)
+	req := new(SignInRequest)
 	if err := c.BodyParser(req); err != nil {
 		return err
 	}
@@ -47,35 +101,30 @@ func Login(c *fiber.Ctx) error {
 	if req.MSAccessToken == "" {
 		return fiber.NewError(fiber.StatusBadRequest, "Invalid login credentials.")
 	}
-
-	// authenticate with on-behalf-of flow
-	cred, client, err := auth.NewMSGraphClient(req.MSAccessToken)
-	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Could not authenticate.")
+	if req.Consent == "" {
+		req.Consent = defaultConsent
 	}
-
-	// get joined teams
-	me := client.Me()
-	joinedTeamsReq := me.JoinedTeams()
-	result, errObj := joinedTeamsReq.Get()
-	if errObj != nil {
-		errJSON, _ := json.MarshalIndent(errObj, "", "  ")
-		fmt.Println("Error making request:", errJSON)
-		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
+	if _, ok := consentScopes[req.Consent]; !ok {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid consent level.")
 	}
 
-	// process result
-	teamables := result.GetValue()
-	teams := make([]models.TenantTeam, len(teamables))
-	for i, teamable := range teamables {
-		teams[i] = models.TenantTeam{
-			Id:          ReadString(teamable.GetId()),
-			Tid:         ReadString(teamable.GetTenantId()), // <-- why is this empty?
-			DisplayName: ReadString(teamable.GetDisplayName()),
-			Description: ReadString(teamable.GetDescription()),
+	// authenticate, falling back to basic consent in incremental mode
+	consent := req.Consent
+	consentRequired := []string{}
+	cred, client, err := newSignInClient(c.Context(), req.MSAccessToken, consent)
+	if auth.IsConsentRequired(err) && req.Incremental && consent != models.ConsentLevelEnumBasic {
+		fmt.Println("consent required, falling back to basic consent:", err)
+		consentRequired = consentScopes[consent]
+		consent = models.ConsentLevelEnumBasic
+		cred, client, err = newSignInClient(c.Context(), req.MSAccessToken, consent)
+	}
+	if err != nil {
+		fmt.Println("error authenticating with on-behalf-of flow:", err)
+		if auth.IsConsentRequired(err) {
+			return fiber.NewError(fiber.StatusForbidden, "Consent required.")
 		}
+		return fiber.NewError(fiber.StatusInternalServerError, "Could not authenticate.")
 	}
-	fmt.Println("teams:", teams)
 
 	// get user from IDToken
 	user := &models.TenantUser{
@@ -86,13 +135,40 @@ func Login(c *fiber.Ctx) error {
 	}
 	fmt.Println("user from cred.UserAuth:", user)
 
+	// get profile info and photo (not fatal: the client falls back to initials)
+	profile, err := fetchUserProfile(client)
+	if err != nil {
+		fmt.Println("error fetching user profile:", err)
+	}
+	profileOk := err == nil
+
 	// get database connection
 	db := database.DB.DB
+	repo := repository.New(db)
+	ctx := c.Context()
+
+	// get tenant, created from organization data on first login (not fatal)
+	tenant, err := getOrCreateTenant(db, client, user.Tid)
+	if err != nil {
+		fmt.Println("error getting tenant:", err)
+	}
 
 	// check if user exists
-	query := db.Where("oid = ?", user.Oid).Find(user)
-	if query.RowsAffected == 0 {
-		err := queries.SetUpNewUser(db, user)
+	now := time.Now()
+	existingUser, err := repo.GetUser(ctx, user.Oid)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		fmt.Println("error getting user:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
+	}
+	if existingUser == nil {
+		if profileOk {
+			applyUserProfile(user, profile)
+		}
+		user.ConsentLevel = consent
+		user.LastActiveAt = now
+		err := referenceAvatar(ctx, repo, profile, func() error {
+			return queries.SetUpNewUser(db, user)
+		})
 		if err != nil {
 			fmt.Println("error setting up new user:", err)
 			return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
@@ -103,46 +179,89 @@ func Login(c *fiber.Ctx) error {
 			fmt.Println("error sending new sign up alert email for user:", user, err)
 		}
 
+	} else {
+		user = existingUser
+		updates := map[string]interface{}{"last_active_at": now}
+
+		// refresh profile info for existing user
+		if profileOk {
+			updates["job_title"] = profile.JobTitle
+			updates["department"] = profile.Department
+			if profile.PhotoKnown {
+				updates["photo_hash"] = profile.PhotoHash
+			}
+		}
+
+		// upgrade consent level (never downgrade: an incremental sign in may
+		// have fallen back to basic consent for a user who granted more before)
+		if !user.ConsentLevel.Includes(consent) {
+			updates["consent_level"] = consent
+		}
+
+		err := referenceAvatar(ctx, repo, profile, func() error {
+			return repo.UpdateUser(ctx, user.Oid, updates)
+		})
+		if err != nil {
+			fmt.Println("error updating user:", err)
+		} else {
+			user.LastActiveAt = now
+			if _, ok := updates["consent_level"]; ok {
+				user.ConsentLevel = consent
+			}
+			if profileOk {
+				oldPhotoHash := user.PhotoHash
+				applyUserProfile(user, profile)
+				if oldPhotoHash != "" && oldPhotoHash != user.PhotoHash {
+					removeUnusedAvatar(ctx, repo, oldPhotoHash)
+				}
+			}
+		}
 	}
+	setAvatarUrl(user)
 	fmt.Println("found user:", user)
 
-	// get subscription
-	subscription := &models.Subscription{}
-	if user.SubscriptionId != "" {
-		query = db.Where("id = ?", user.SubscriptionId).Find(subscription)
-		if query.RowsAffected == 0 {
-			fmt.Println("subscription not found for id:", user.SubscriptionId)
+	// sync joined teams and rooms
+	if consent == models.ConsentLevelEnumTeams {
+		err = syncJoinedTeams(ctx, db, client, user)
+		if err != nil {
+			fmt.Println("error syncing joined teams:", err)
 			return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
 		}
 	}
 
-	// for each team
-	for _, team := range teams {
-		// fix empty team.Tid
-		team.Tid = user.Tid
+	// give the user a seat if an auto-assign policy covers them (not fatal)
+	_, err = autoAssignUser(ctx, repo, user)
+	if err != nil {
+		fmt.Println("error auto-assigning seat:", user.Oid, err)
+	}
 
-		// check if team exists
-		query := db.Where("id = ?", team.Id).Find(&team)
-		if query.RowsAffected == 0 {
-			err := queries.SetUpNewTeamAndRooms(db, &team)
-			if err != nil {
-				fmt.Println("error setting up new team and rooms:", err, team)
-				return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
-			}
-		}
+	// mirror Teams presence (best effort: needs Presence.Read consent)
+	err = syncTeamsPresence(ctx, repo, req.MSAccessToken, user)
+	if err != nil {
+		fmt.Println("error syncing teams presence:", err)
+	}
+	err = repo.RequestPresenceSubscription(ctx, user.Oid, user.Tid, time.Now())
+	if err != nil {
+		fmt.Println("db error requesting presence subscription:", err)
+	}
 
-		// check if user exists in team
-		teamUser := &models.TeamUser{
-			Id:  team.Id,
-			Oid: user.Oid,
-		}
-		query = db.Where("id = ? AND oid = ?", team.Id, user.Oid).Find(teamUser)
-		if query.RowsAffected == 0 {
-			db.Create(teamUser)
-			fmt.Println("create team user:", teamUser)
+	// get subscription
+	subscription := &models.Subscription{}
+	if user.SubscriptionId != "" {
+		subscription, err = repo.GetSubscription(ctx, user.SubscriptionId)
+		if err != nil {
+			fmt.Println("error getting subscription:", user.SubscriptionId, err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
 		}
 	}
 
+	// get tenant trial
+	tenantTrial, err := getTenantTrial(ctx, repo, user.Tid)
+	if err != nil {
+		fmt.Println("error getting tenant trial:", user.Tid, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
+	}
+
 	// create access token
 	accessToken, accessTokenExp, err := createAccessToken(user)
 	if err != nil {
@@ -164,8 +283,22 @@ func Login(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
 	}
 
+	// populate auth user info (companyName is often unset on the user, so
+	// prefer the organization name)
+	userInfo := &AuthUserInfo{
+		Oid:   user.Oid,
+		Tid:   user.Tid,
+		Email: user.Email,
+		Name:  user.Name,
+	}
+	if tenant != nil && tenant.DisplayName != "" {
+		userInfo.CompanyName = tenant.DisplayName
+	} else if profileOk {
+		userInfo.CompanyName = profile.CompanyName
+	}
+
 	// return response
-	response := &LoginResponse{
+	response := &SignInResponse{
 		Success:                true,
 		AccessToken:            accessToken,
 		AccessTokenExpiration:  accessTokenExp,
@@ -173,12 +306,67 @@ func Login(c *fiber.Ctx) error {
 		RefreshTokenExpiration: refreshTokenExpiration,
 		FirebaseAuthToken:      firebaseAuthToken,
 		User:                   *user,
+		UserInfo:               *userInfo,
+		Tenant:                 tenant,
 		Subscription:           *subscription,
+		Trial:                  trialState(user, tenantTrial, time.Now()),
+		ConsentLevel:           consent,
+		ConsentRequired:        consentRequired,
 	}
 	return c.JSON(response)
 
 }
 
+// create the user's joined teams (and their default rooms) and team memberships
+func syncJoinedTeams(ctx context.Context, db *gorm.DB, client *msgraphsdk.GraphServiceClient, user *models.TenantUser) error {
+	repo := repository.New(db)
+
+	// get joined teams
+	result, err := client.Me().JoinedTeams().Get()
+	if err != nil {
+		errJSON, _ := json.MarshalIndent(err, "", "  ")
+		fmt.Println("Error making request:", string(errJSON))
+		return err
+	}
+
+	// process result
+	teamables := result.GetValue()
+	teams := make([]models.TenantTeam, len(teamables))
+	for i, teamable := range teamables {
+		teams[i] = models.TenantTeam{
+			Id:          ReadString(teamable.GetId()),
+			Tid:         user.Tid, // teamable.GetTenantId() is empty for joinedTeams
+			DisplayName: ReadString(teamable.GetDisplayName()),
+			Description: ReadString(teamable.GetDescription()),
+		}
+	}
+	fmt.Println("teams:", teams)
+
+	// for each team
+	for _, team := range teams {
+		// check if team exists
+		_, err := repo.GetTeam(ctx, team.Id)
+		if errors.Is(err, repository.ErrNotFound) {
+			err = queries.SetUpNewTeamAndRooms(db, &team)
+			if err != nil {
+				fmt.Println("error setting up new team and rooms:", err, team)
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		// add user to team (if not a member yet)
+		err = repo.AddTeamMember(ctx, team.Id, user.Oid)
+		if err != nil {
+			fmt.Println("error adding team user:", err, team.Id, user.Oid)
+			return err
+		}
+	}
+
+	return nil
+}
+
 // --------------------------------------------------------------------------------
 // EmailSignup
 // --------------------------------------------------------------------------------
@@ -228,104 +416,6 @@ func EmailSignup(c *fiber.Ctx) error {
 
 }
 
-// --------------------------------------------------------------------------------
-// Auth
-// --------------------------------------------------------------------------------
-type AuthRequest struct {
-	MSAccessToken string `json:"msAccessToken"`
-}
-
-type AuthUserInfo struct {
-	Oid         string `json:"oid"`
-	Tid         string `json:"tid"`
-	Email       string `json:"email"`
-	Name        string `json:"name"`
-	CompanyName string `json:"companyName"`
-}
-
-type AuthResponse struct {
-	Success                bool         `json:"success"`
-	AccessToken            string       `json:"accessToken"`
-	AccessTokenExpiration  int64        `json:"accessTokenExpiration"`
-	RefreshToken           string       `json:"refreshToken"`
-	RefreshTokenExpiration int64        `json:"refreshTokenExpiration"`
-	UserInfo               AuthUserInfo `json:"userInfo"`
-}
-
-func Auth(c *fiber.Ctx) error {
-	// get request body
-	req := new(AuthRequest)
-	if err := c.BodyParser(req); err != nil {
-		return err
-	}
-
-	// validate request body
-	if req.MSAccessToken == "" {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid access token")
-	}
-
-	// authenticate with on-behalf-of flow
-	cred, client, err := auth.NewMSGraphClientWithScopes(req.MSAccessToken, []string{"User.Read"})
-	if err != nil {
-		fmt.Println("error authenticating with on-behalf-of flow:", err)
-		return fiber.NewError(fiber.StatusInternalServerError, "could not authenticate")
-	}
-
-	// get user info
-	userable, err := client.Me().GetWithRequestConfigurationAndResponseHandler(
-		&me.MeRequestBuilderGetRequestConfiguration{
-			QueryParameters: &me.MeRequestBuilderGetQueryParameters{
-				Select: []string{"companyName"},
-			},
-		}, nil,
-	)
-	if err != nil {
-		fmt.Println("error getting user:", err)
-		return fiber.NewError(fiber.StatusInternalServerError, "error fetching user info")
-	}
-
-	// populate auth user info
-	userInfo := &AuthUserInfo{
-		Oid:         cred.UserAuth.IDToken.Oid,
-		Tid:         cred.UserAuth.IDToken.TenantID,
-		Email:       cred.UserAuth.IDToken.Email,
-		Name:        cred.UserAuth.IDToken.Name,
-		CompanyName: ReadString(userable.GetCompanyName()), // <-- why is this empty?
-	}
-
-	// create access token
-	accessToken, accessTokenExp, err := createAccessToken(&models.TenantUser{
-		Oid: userInfo.Oid,
-		Tid: userInfo.Tid,
-	})
-	if err != nil {
-		fmt.Println("error creating access token:", err)
-		return fiber.NewError(fiber.StatusInternalServerError, "error creating access token")
-	}
-
-	// create refresh token
-	refreshToken, refreshTokenExpiration, err := createRefreshToken(&models.TenantUser{
-		Oid: userInfo.Oid,
-		Tid: userInfo.Tid,
-	})
-	if err != nil {
-		fmt.Println("error creating firebase auth token:", err)
-		return fiber.NewError(fiber.StatusInternalServerError, "error creating access token")
-	}
-
-	// return response
-	response := &AuthResponse{
-		Success:                true,
-		AccessToken:            accessToken,
-		AccessTokenExpiration:  accessTokenExp,
-		RefreshToken:           refreshToken,
-		RefreshTokenExpiration: refreshTokenExpiration,
-		UserInfo:               *userInfo,
-	}
-	return c.JSON(response)
-
-}
-
 // --------------------------------------------------------------------------------
 // GetConnectionTestToken
 // --------------------------------------------------------------------------------
@@ -339,7 +429,7 @@ func GetConnectionTestToken(c *fiber.Ctx) error {
 	teamId := "public-connection-test"
 	roomId := "common"
 	userId := uuid.Must(uuid.NewV4()).String()
-	token, err := createLiveKitJoinToken(teamId, roomId, userId)
+	token, err := createLiveKitJoinToken(teamId, roomId, userId, false)
 	if err != nil {
 		fmt.Println("error creating livekit token:", err)
 		return fiber.NewError(fiber.StatusInternalServerError, "error creating token")
@@ -0,0 +1,309 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"peachone/database"
+	"peachone/models"
+	"peachone/repository"
+	"peachone/saasapi"
+	"time"
+)
+
+type SubscriptionDiscrepancy struct {
+	SubscriptionId string   `json:"subscriptionId"`
+	Name           string   `json:"name"`
+	Differences    []string `json:"differences"` // "field: ours -> marketplace"
+}
+
+type ReconciliationReport struct {
+	Checked          int                       `json:"checked"`
+	Updated          int                       `json:"updated"`
+	OperationsQueued int                       `json:"operationsQueued"`
+	Discrepancies    []SubscriptionDiscrepancy `json:"discrepancies"`
+	Errors           []string                  `json:"errors"`
+	NotInMarketplace []string                  `json:"notInMarketplace"` // ids we have that the Marketplace didn't list
+	StartedAt        time.Time                 `json:"startedAt"`
+	CompletedAt      time.Time                 `json:"completedAt"`
+}
+
+func (report *ReconciliationReport) hasFindings() bool {
+	return len(report.Discrepancies) > 0 || len(report.Errors) > 0 || len(report.NotInMarketplace) > 0 || report.OperationsQueued > 0
+}
+
+// Job: bring our subscriptions in line with the Marketplace, in case webhooks
+// were missed. Differences are applied (with the same side effects a webhook
+// would have had), outstanding operations are queued for the operations
+// worker to acknowledge, and anything found is emailed to us. Subscriptions we
+// don't have are only reported. Runs on one
+// instance at a time; the others skip the run.
+func ReconcileSubscriptions(ctx context.Context) error {
+	repo := repository.New(database.DB.DB)
+
+	release, locked, err := repo.TryAdvisoryLock(ctx, "subscription-reconciliation")
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return nil // running on another instance
+	}
+	defer release()
+
+	report := &ReconciliationReport{StartedAt: time.Now()}
+
+	// create api clients
+	fulfillmentClient, err := saasapi.NewDefaultFulfillmentOperationsClient()
+	if err != nil {
+		return fmt.Errorf("could not create fulfillment api client: %w", err)
+	}
+	operationsClient, err := saasapi.NewDefaultSubscriptionOperationsClient()
+	if err != nil {
+		return fmt.Errorf("could not create subscription operations client: %w", err)
+	}
+
+	// our subscriptions, to find the ones the Marketplace no longer lists
+	stored, err := repo.ListSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+	unseen := make(map[string]bool)
+	for _, subscription := range stored {
+		unseen[subscription.Id] = true
+	}
+
+	pager := fulfillmentClient.NewListSubscriptionsPager(&saasapi.FulfillmentOperationsClientListSubscriptionsOptions{})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("could not list subscriptions: %w", err)
+		}
+		for _, marketplaceSubscription := range page.Subscriptions {
+			if marketplaceSubscription == nil || marketplaceSubscription.ID == nil {
+				continue
+			}
+			report.Checked++
+			delete(unseen, *marketplaceSubscription.ID)
+
+			err := reconcileSubscription(ctx, repo, operationsClient, marketplaceSubscription, report)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", *marketplaceSubscription.ID, err))
+			}
+		}
+	}
+
+	for _, subscription := range stored {
+		if unseen[subscription.Id] {
+			report.NotInMarketplace = append(report.NotInMarketplace, subscription.Id)
+		}
+	}
+
+	report.CompletedAt = time.Now()
+	log.Printf("Reconciled subscriptions: %d checked, %d updated, %d operations queued, %d discrepancies, %d errors",
+		report.Checked, report.Updated, report.OperationsQueued, len(report.Discrepancies), len(report.Errors))
+	if report.hasFindings() {
+		_, _, err = SendReconciliationReport(ctx, report)
+		if err != nil {
+			fmt.Println("error sending reconciliation report:", err)
+		}
+	}
+
+	return nil
+}
+
+func reconcileSubscription(ctx context.Context, repo *repository.Repository, operationsClient *saasapi.SubscriptionOperationsClient, marketplaceSubscription *saasapi.Subscription, report *ReconciliationReport) error {
+	current := makeSubscription(marketplaceSubscription)
+
+	// queue outstanding operations; already recorded ones are skipped, and the
+	// worker acknowledges them and applies their side effects
+	operationsResponse, err := operationsClient.ListOperations(ctx, current.Id, &saasapi.SubscriptionOperationsClientListOperationsOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list operations: %w", err)
+	}
+	queued := false
+	for _, operation := range operationsResponse.Operations {
+		if operation == nil || operation.ID == nil || operation.Action == nil {
+			continue
+		}
+		// operations we started are tracked by ProcessPublisherOperations
+		_, err := repo.GetPublisherOperation(ctx, *operation.ID)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, repository.ErrNotFound) {
+			return fmt.Errorf("could not get publisher operation %s: %w", *operation.ID, err)
+		}
+		payload, _ := json.Marshal(operation)
+		created, err := repo.CreateMarketplaceOperation(ctx, &models.MarketplaceOperation{
+			Id:             *operation.ID,
+			ActivityId:     ReadString(operation.ActivityID),
+			SubscriptionId: current.Id,
+			Action:         string(*operation.Action),
+			Payload:        string(payload),
+			Status:         models.MarketplaceOperationStatusEnumPending,
+			NextAttemptAt:  time.Now(),
+		})
+		if err != nil {
+			return fmt.Errorf("could not record operation %s: %w", *operation.ID, err)
+		}
+		if created {
+			report.OperationsQueued++
+			queued = true
+		}
+	}
+	if queued {
+		return nil // the worker syncs the subscription after acknowledging
+	}
+
+	// compare with our copy
+	stored, err := repo.GetSubscription(ctx, current.Id)
+	if errors.Is(err, repository.ErrNotFound) {
+		stored = &models.Subscription{}
+	} else if err != nil {
+		return err
+	}
+	differences := diffSubscriptions(stored, current)
+	if len(differences) == 0 {
+		return nil
+	}
+	report.Discrepancies = append(report.Discrepancies, SubscriptionDiscrepancy{
+		SubscriptionId: current.Id,
+		Name:           current.Name,
+		Differences:    differences,
+	})
+
+	// one we don't have was never activated through us (or is still
+	// activating); it is reported, and only an activation may create it
+	if stored.Id == "" {
+		return nil
+	}
+
+	// apply, with the side effects the missed webhooks would have had
+	err = saveSubscriptionToLedger(ctx, repo, current, ledgerSource{Actor: ledgerActorMarketplace, Operation: "Reconcile"})
+	if err != nil {
+		return fmt.Errorf("could not save subscription: %w", err)
+	}
+	report.Updated++
+	for _, action := range missedActions(stored, current) {
+		err = applySubscriptionLifecycle(ctx, repo, ledgerSource{Actor: ledgerActorMarketplace, Operation: action}, current.Id)
+		if err != nil {
+			return fmt.Errorf("could not apply %s: %w", action, err)
+		}
+	}
+
+	return nil
+}
+
+// fields where our copy differs from the Marketplace; empty if in sync
+func diffSubscriptions(stored *models.Subscription, current *models.Subscription) []string {
+	if stored.Id == "" {
+		return []string{"missing: not in our database"}
+	}
+
+	differences := []string{}
+	diff := func(field string, ours interface{}, theirs interface{}) {
+		if ours != theirs {
+			differences = append(differences, fmt.Sprintf("%s: %v -> %v", field, ours, theirs))
+		}
+	}
+	diffTime := func(field string, ours time.Time, theirs time.Time) {
+		if !ours.Equal(theirs) {
+			differences = append(differences, fmt.Sprintf("%s: %s -> %s", field, ours.Format(time.RFC3339), theirs.Format(time.RFC3339)))
+		}
+	}
+	diff("saasSubscriptionStatus", stored.SaaSSubscriptionStatus, current.SaaSSubscriptionStatus)
+	diff("planId", stored.PlanId, current.PlanId)
+	diff("quantity", stored.Quantity, current.Quantity)
+	diff("autoRenew", stored.AutoRenew, current.AutoRenew)
+	diff("name", stored.Name, current.Name)
+	diff("beneficiaryTid", stored.BeneficiaryTid, current.BeneficiaryTid)
+	diff("purchaserOid", stored.PurchaserOid, current.PurchaserOid)
+	diffTime("subscriptionTermStartDate", stored.SubscriptionTermStartDate, current.SubscriptionTermStartDate)
+	diffTime("subscriptionTermEndDate", stored.SubscriptionTermEndDate, current.SubscriptionTermEndDate)
+	return differences
+}
+
+// the webhook actions implied by a change we didn't hear about
+func missedActions(stored *models.Subscription, current *models.Subscription) []string {
+	if stored.Id == "" {
+		return nil // never activated through us; nothing to undo or restore
+	}
+
+	actions := []string{}
+	if stored.SaaSSubscriptionStatus != current.SaaSSubscriptionStatus {
+		switch current.SaaSSubscriptionStatus {
+		case models.SubscriptionStatusEnumSuspended:
+			actions = append(actions, "Suspend")
+		case models.SubscriptionStatusEnumUnsubscribed:
+			actions = append(actions, "Unsubscribe")
+		case models.SubscriptionStatusEnumSubscribed:
+			if stored.SaaSSubscriptionStatus == models.SubscriptionStatusEnumSuspended {
+				actions = append(actions, "Reinstate")
+			}
+		}
+	}
+	if stored.Quantity != current.Quantity {
+		actions = append(actions, "ChangeQuantity")
+	}
+	if !stored.SubscriptionTermEndDate.IsZero() && current.SubscriptionTermEndDate.After(stored.SubscriptionTermEndDate) {
+		actions = append(actions, "Renew")
+	}
+	return actions
+}
+
+func SendReconciliationReport(ctx context.Context, report *ReconciliationReport) (mes string, id string, err error) {
+	// email template
+	htmlReconciliationReportTemplate := `
+<html>
+	<body>
+		<p>Subscription Reconciliation Report</p>
+		<p><pre>{{.ReportJSON}}</pre></p>
+	</body>
+</html>
+`
+	type TemplateVars struct {
+		ReportJSON string
+	}
+
+	reportJSON, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", "", err
+	}
+
+	templateVars := &TemplateVars{
+		ReportJSON: string(reportJSON),
+	}
+
+	// create email message
+	mg := CreateMailgunClient()
+	subject := fmt.Sprintf("Subscription Reconciliation: %d discrepancies, %d errors", len(report.Discrepancies), len(report.Errors))
+	message := mg.NewMessage("alerts@teraphone.app", subject, "", "help@teraphone.app")
+	parsedHtmlTemplate, err := template.New("body").Parse(htmlReconciliationReportTemplate)
+	if err != nil {
+		fmt.Println(err.Error())
+		return "", "", err
+	}
+	var htmlBuffer bytes.Buffer
+	if err := parsedHtmlTemplate.Execute(&htmlBuffer, templateVars); err != nil {
+		fmt.Println(err.Error())
+		return "", "", err
+	}
+	message.SetHtml(htmlBuffer.String())
+
+	// send message with 10 second timeout
+	log.Printf("Sending alert to help@teraphone.app")
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	resp, id, err := mg.Send(ctxWithTimeout, message)
+	if err != nil {
+		fmt.Println(err.Error())
+		return resp, id, err
+	}
+	log.Printf("ID: %s Resp: %s", id, resp)
+
+	return resp, id, nil
+}
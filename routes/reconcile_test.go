@@ -0,0 +1,73 @@
+package routes
+
+import (
+	"peachone/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffSubscriptions(t *testing.T) {
+	termStart := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	stored := &models.Subscription{
+		Id:                        "sub",
+		Quantity:                  5,
+		SaaSSubscriptionStatus:    models.SubscriptionStatusEnumSubscribed,
+		SubscriptionTermStartDate: termStart,
+		SuspendedAt:               time.Now(), // ours, not compared
+	}
+	current := &models.Subscription{
+		Id:                        "sub",
+		Quantity:                  5,
+		SaaSSubscriptionStatus:    models.SubscriptionStatusEnumSubscribed,
+		SubscriptionTermStartDate: termStart.In(time.FixedZone("EST", -5*60*60)), // same instant
+	}
+	if differences := diffSubscriptions(stored, current); len(differences) != 0 {
+		t.Fatalf("expected no differences, got %v", differences)
+	}
+
+	current.Quantity = 3
+	current.SaaSSubscriptionStatus = models.SubscriptionStatusEnumSuspended
+	expected := []string{"saasSubscriptionStatus: Subscribed -> Suspended", "quantity: 5 -> 3"}
+	if differences := diffSubscriptions(stored, current); !reflect.DeepEqual(differences, expected) {
+		t.Fatalf("expected %v, got %v", expected, differences)
+	}
+
+	if differences := diffSubscriptions(&models.Subscription{}, current); len(differences) != 1 {
+		t.Fatalf("expected a missing subscription to be reported, got %v", differences)
+	}
+}
+
+func TestMissedActions(t *testing.T) {
+	subscription := func(status models.SubscriptionStatusEnum, quantity int) *models.Subscription {
+		return &models.Subscription{Id: "sub", SaaSSubscriptionStatus: status, Quantity: quantity}
+	}
+	renewed := func(subscription *models.Subscription, terms int) *models.Subscription {
+		subscription.SubscriptionTermEndDate = time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC).AddDate(terms, 0, 0)
+		return subscription
+	}
+	subscribed := models.SubscriptionStatusEnumSubscribed
+	suspended := models.SubscriptionStatusEnumSuspended
+	unsubscribed := models.SubscriptionStatusEnumUnsubscribed
+
+	cases := []struct {
+		name     string
+		stored   *models.Subscription
+		current  *models.Subscription
+		expected []string
+	}{
+		{"unchanged", subscription(subscribed, 5), subscription(subscribed, 5), []string{}},
+		{"suspended", subscription(subscribed, 5), subscription(suspended, 5), []string{"Suspend"}},
+		{"reinstated", subscription(suspended, 5), subscription(subscribed, 5), []string{"Reinstate"}},
+		{"unsubscribed", subscription(suspended, 5), subscription(unsubscribed, 5), []string{"Unsubscribe"}},
+		{"quantity", subscription(subscribed, 5), subscription(subscribed, 3), []string{"ChangeQuantity"}},
+		{"new", &models.Subscription{}, subscription(subscribed, 5), nil},
+		{"renewed", renewed(subscription(subscribed, 5), 0), renewed(subscription(subscribed, 5), 1), []string{"Renew"}},
+		{"term dates set", subscription(subscribed, 5), renewed(subscription(subscribed, 5), 0), []string{}},
+	}
+	for _, c := range cases {
+		if actions := missedActions(c.stored, c.current); !reflect.DeepEqual(actions, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, actions)
+		}
+	}
+}
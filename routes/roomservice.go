@@ -2,7 +2,7 @@ package routes
 
 import (
 	"peachone/database"
-	"peachone/models"
+	"peachone/repository"
 
 	"github.com/gofiber/fiber/v2"
 
@@ -29,18 +29,35 @@ func JoinLiveKitRoom(c *fiber.Ctx) error {
 	teamId := c.Params("teamId")
 	roomId := c.Params("room_id")
 
-	// get database connection
-	db := database.DB.DB
+	// get repository
+	repo := repository.New(database.DB.DB)
 
 	// verify user is in team
-	teamUser := &models.TeamUser{}
-	query := db.Where("id = ? AND oid = ?", teamId, userId).Find(teamUser)
-	if query.RowsAffected == 0 {
+	isMember, err := repo.IsTeamMember(c.Context(), teamId, userId)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
+	}
+	if !isMember {
 		return fiber.NewError(fiber.StatusUnauthorized, "You do not have access to this team.")
 	}
 
+	// verify user has an active subscription or trial
+	hasAccess, err := getUserRoomAccess(c.Context(), repo, userId)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
+	}
+	if !hasAccess {
+		return fiber.NewError(fiber.StatusForbidden, "No active subscription or trial.")
+	}
+
+	// features of the user's plan
+	features, err := getUserEntitlements(c.Context(), repo, userId)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
+	}
+
 	// construct access token
-	token, err := createLiveKitJoinToken(teamId, roomId, userId)
+	token, err := createLiveKitJoinToken(teamId, roomId, userId, features.Recording)
 	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "Error generating access token.")
 	}
@@ -58,7 +75,7 @@ func JoinLiveKitRoom(c *fiber.Ctx) error {
 // Get livekit room participants
 // -----------------------------------------------------------------------------
 type GetLiveKitRoomParticipantsResponse struct {
-	livekit.ListParticipantsResponse
+	*livekit.ListParticipantsResponse
 	Success bool `json:"success"`
 }
 
@@ -74,13 +91,15 @@ func GetLiveKitRoomParticipants(c *fiber.Ctx) error {
 	teamId := c.Params("teamId")
 	roomId := c.Params("room_id")
 
-	// get database connection
-	db := database.DB.DB
+	// get repository
+	repo := repository.New(database.DB.DB)
 
 	// verify user is in team
-	teamUser := &models.TeamUser{}
-	query := db.Where("id = ? AND oid = ?", teamId, userId).Find(teamUser)
-	if query.RowsAffected == 0 {
+	isMember, err := repo.IsTeamMember(c.Context(), teamId, userId)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Error processing request.")
+	}
+	if !isMember {
 		return fiber.NewError(fiber.StatusUnauthorized, "You do not have access to this team.")
 	}
 
@@ -97,7 +116,7 @@ func GetLiveKitRoomParticipants(c *fiber.Ctx) error {
 
 	// return response
 	response := &GetLiveKitRoomParticipantsResponse{
-		ListParticipantsResponse: *participants,
+		ListParticipantsResponse: participants,
 		Success:                  true,
 	}
 	return c.JSON(response)
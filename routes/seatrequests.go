@@ -0,0 +1,378 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"peachone/database"
+	"peachone/models"
+	"peachone/repository"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const maxSeatRequestTextLength = 1000
+
+// everyone who can decide a seat request in the tenant: the admins of its
+// active subscriptions, each once
+func seatRequestAdminEmails(subscriptions []models.Subscription, admins []models.SubscriptionAdmin) []string {
+	emails := []string{}
+	seen := make(map[string]bool)
+	for i := range subscriptions {
+		if subscriptions[i].SaaSSubscriptionStatus != models.SubscriptionStatusEnumSubscribed {
+			continue
+		}
+		for _, email := range subscriptionAdminEmails(&subscriptions[i], admins) {
+			if !seen[email] {
+				seen[email] = true
+				emails = append(emails, email)
+			}
+		}
+	}
+	return emails
+}
+
+func notifySeatRequester(ctx context.Context, request *models.SeatRequest, subject string, paragraphs []string) {
+	_, _, err := SendNotificationEmail(ctx, &NotificationVars{
+		RecipientEmails: []string{request.Email},
+		Subject:         subject,
+		Paragraphs:      paragraphs,
+	})
+	if err != nil {
+		fmt.Println("error notifying user of seat request:", request.Id, err)
+	}
+}
+
+// lock a pending request of the subscription's tenant, in a transaction
+func lockPendingSeatRequest(ctx context.Context, tx *repository.Repository, subscription *models.Subscription, requestId string) (*models.SeatRequest, error) {
+	id, err := strconv.ParseUint(requestId, 10, 0)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "invalid request id")
+	}
+	request, err := tx.LockSeatRequest(ctx, uint(id))
+	if errors.Is(err, repository.ErrNotFound) || (err == nil && request.Tid != subscription.BeneficiaryTid) {
+		return nil, fiber.NewError(fiber.StatusNotFound, "seat request not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if request.Status != models.SeatRequestStatusEnumPending {
+		return nil, fiber.NewError(fiber.StatusConflict, "seat request was already "+string(request.Status))
+	}
+	return request, nil
+}
+
+// --------------------------------------------------------------------------------
+// Request Seat Request
+// --------------------------------------------------------------------------------
+type RequestSeatRequest struct {
+	Message string `json:"message"`
+}
+
+type SeatRequestResponse struct {
+	Success bool               `json:"success"`
+	Request models.SeatRequest `json:"request"`
+}
+
+func RequestSeat(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// parse request
+	req := &RequestSeatRequest{}
+	if err := c.BodyParser(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if len(req.Message) > maxSeatRequestTextLength {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("message must be at most %d characters", maxSeatRequestTextLength))
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get user
+	user, err := repo.GetUser(c.Context(), claims.Oid)
+	if err != nil {
+		fmt.Println("db error getting user:", claims.Oid, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get user")
+	}
+	if user.SubscriptionId != "" {
+		return fiber.NewError(fiber.StatusConflict, "user already has a seat")
+	}
+
+	// a pending request stands; asking again doesn't notify the admins again
+	latest, err := repo.GetLatestSeatRequest(c.Context(), user.Oid)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		fmt.Println("db error getting seat request:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get seat request")
+	}
+	if err == nil && latest.Status == models.SeatRequestStatusEnumPending {
+		return c.JSON(&SeatRequestResponse{Success: true, Request: *latest})
+	}
+
+	// find who to ask
+	subscriptions, err := repo.ListTenantSubscriptions(c.Context(), user.Tid)
+	if err != nil {
+		fmt.Println("db error getting subscriptions:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get subscriptions")
+	}
+	subscriptionIds := make([]string, len(subscriptions))
+	for i, subscription := range subscriptions {
+		subscriptionIds[i] = subscription.Id
+	}
+	delegated, err := repo.ListSubscriptionAdmins(c.Context(), subscriptionIds)
+	if err != nil {
+		fmt.Println("db error getting subscription admins:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get subscriptions")
+	}
+	admins := seatRequestAdminEmails(subscriptions, delegated)
+	if len(admins) == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "your organization has no subscription to request a seat from")
+	}
+
+	// create request
+	request := &models.SeatRequest{
+		Oid:     user.Oid,
+		Tid:     user.Tid,
+		Name:    user.Name,
+		Email:   user.Email,
+		Message: req.Message,
+		Status:  models.SeatRequestStatusEnumPending,
+	}
+	err = repo.CreateSeatRequest(c.Context(), request)
+	if err != nil {
+		fmt.Println("db error creating seat request:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not create seat request")
+	}
+
+	// notify admins
+	paragraphs := []string{
+		fmt.Sprintf("%s (%s) has asked for a Teraphone seat.", user.Name, user.Email),
+	}
+	if request.Message != "" {
+		paragraphs = append(paragraphs, "Their message: "+request.Message)
+	}
+	paragraphs = append(paragraphs, "You can approve or deny the request from your subscription's seat requests.")
+	_, _, err = SendNotificationEmail(c.Context(), &NotificationVars{
+		RecipientEmails: admins,
+		Subject:         fmt.Sprintf("%s has requested a Teraphone seat", user.Name),
+		Paragraphs:      paragraphs,
+	})
+	if err != nil {
+		fmt.Println("error notifying admins of seat request:", request.Id, err)
+	}
+
+	// return response
+	response := &SeatRequestResponse{
+		Success: true,
+		Request: *request,
+	}
+	return c.JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Get Seat Request Request
+// --------------------------------------------------------------------------------
+func GetSeatRequest(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get the user's latest request
+	request, err := repo.GetLatestSeatRequest(c.Context(), claims.Oid)
+	if errors.Is(err, repository.ErrNotFound) {
+		return fiber.NewError(fiber.StatusNotFound, "no seat request")
+	}
+	if err != nil {
+		fmt.Println("db error getting seat request:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get seat request")
+	}
+
+	// return response
+	response := &SeatRequestResponse{
+		Success: true,
+		Request: *request,
+	}
+	return c.JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Get Subscription Seat Requests Request
+// --------------------------------------------------------------------------------
+type GetSubscriptionSeatRequestsResponse struct {
+	Success  bool                 `json:"success"`
+	Requests []models.SeatRequest `json:"requests"`
+}
+
+func GetSubscriptionSeatRequests(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getAdminSubscription(c.Context(), repo, claims.Oid, c.Params("subscriptionId"))
+	if err != nil {
+		return err
+	}
+
+	// get the tenant's pending requests
+	requests, err := repo.ListSeatRequests(c.Context(), subscription.BeneficiaryTid, models.SeatRequestStatusEnumPending)
+	if err != nil {
+		fmt.Println("db error getting seat requests:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get seat requests")
+	}
+
+	// return response
+	response := &GetSubscriptionSeatRequestsResponse{
+		Success:  true,
+		Requests: requests,
+	}
+	return c.JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Approve Seat Request Request
+// --------------------------------------------------------------------------------
+func ApproveSeatRequest(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getAdminSubscription(c.Context(), repo, claims.Oid, c.Params("subscriptionId"))
+	if err != nil {
+		return err
+	}
+
+	// assign the seat like any other, and decide the request with it
+	request := &models.SeatRequest{}
+	err = repo.Transaction(c.Context(), func(tx *repository.Repository) error {
+		request, err = lockPendingSeatRequest(c.Context(), tx, subscription, c.Params("requestId"))
+		if err != nil {
+			return err
+		}
+		assignment, err := assignSeats(c.Context(), tx, subscription.Id, []string{request.Oid}, nil, ledgerSource{Actor: claims.Oid, Operation: "ApproveSeatRequest"})
+		if err != nil {
+			return err
+		}
+		if assignment.Results[0].Status == models.SeatAssignmentStatusEnumNotFound {
+			return fiber.NewError(fiber.StatusNotFound, "user not found")
+		}
+
+		request.Status = models.SeatRequestStatusEnumApproved
+		request.SubscriptionId = subscription.Id
+		request.DecidedBy = claims.Oid
+		request.DecidedAt = time.Now()
+		return tx.SaveSeatRequest(c.Context(), request)
+	})
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return fiberErr
+	}
+	if errors.Is(err, errNotEnoughSeats) || errors.Is(err, errSubscriptionCancelled) {
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	}
+	if err != nil {
+		fmt.Println("db error approving seat request:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not approve seat request")
+	}
+
+	notifySeatRequester(c.Context(), request, "Your Teraphone seat request was approved", []string{
+		fmt.Sprintf("You have been assigned a seat on the Teraphone subscription %s. Sign in again to start using your rooms.", subscription.Name),
+	})
+
+	// return response
+	response := &SeatRequestResponse{
+		Success: true,
+		Request: *request,
+	}
+	return c.JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Deny Seat Request Request
+// --------------------------------------------------------------------------------
+type DenySeatRequestRequest struct {
+	Reason string `json:"reason"`
+}
+
+func DenySeatRequest(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// parse request
+	req := &DenySeatRequestRequest{}
+	if err := c.BodyParser(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if len(req.Reason) > maxSeatRequestTextLength {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("reason must be at most %d characters", maxSeatRequestTextLength))
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getAdminSubscription(c.Context(), repo, claims.Oid, c.Params("subscriptionId"))
+	if err != nil {
+		return err
+	}
+
+	// deny request
+	request := &models.SeatRequest{}
+	err = repo.Transaction(c.Context(), func(tx *repository.Repository) error {
+		request, err = lockPendingSeatRequest(c.Context(), tx, subscription, c.Params("requestId"))
+		if err != nil {
+			return err
+		}
+		request.Status = models.SeatRequestStatusEnumDenied
+		request.DecidedBy = claims.Oid
+		request.DecidedAt = time.Now()
+		request.Reason = req.Reason
+		return tx.SaveSeatRequest(c.Context(), request)
+	})
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return fiberErr
+	}
+	if err != nil {
+		fmt.Println("db error denying seat request:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not deny seat request")
+	}
+
+	paragraphs := []string{"Your request for a Teraphone seat was declined by your organization's admin."}
+	if request.Reason != "" {
+		paragraphs = append(paragraphs, "Reason: "+request.Reason)
+	}
+	notifySeatRequester(c.Context(), request, "Your Teraphone seat request was declined", paragraphs)
+
+	// return response
+	response := &SeatRequestResponse{
+		Success: true,
+		Request: *request,
+	}
+	return c.JSON(response)
+}
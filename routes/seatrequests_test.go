@@ -0,0 +1,26 @@
+package routes
+
+import (
+	"fmt"
+	"peachone/models"
+	"testing"
+)
+
+func TestSeatRequestAdminEmails(t *testing.T) {
+	subscriptions := []models.Subscription{
+		{Id: "a", SaaSSubscriptionStatus: models.SubscriptionStatusEnumSubscribed, PurchaserEmail: "buyer@example.com", BeneficiaryEmail: "it@example.com"},
+		{Id: "b", SaaSSubscriptionStatus: models.SubscriptionStatusEnumSubscribed, PurchaserEmail: "buyer@example.com", BeneficiaryEmail: "buyer@example.com"},
+		{Id: "c", SaaSSubscriptionStatus: models.SubscriptionStatusEnumUnsubscribed, PurchaserEmail: "former@example.com"},
+	}
+	admins := []models.SubscriptionAdmin{
+		{SubscriptionId: "b", Email: "delegate@example.com"},
+		{SubscriptionId: "c", Email: "former-delegate@example.com"},
+	}
+	got := fmt.Sprint(seatRequestAdminEmails(subscriptions, admins))
+	if want := "[buyer@example.com it@example.com delegate@example.com]"; got != want {
+		t.Fatalf("admins = %s, want %s", got, want)
+	}
+	if got := seatRequestAdminEmails(subscriptions[2:], admins); len(got) != 0 {
+		t.Fatalf("admins of cancelled subscriptions = %v", got)
+	}
+}
@@ -0,0 +1,443 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"peachone/database"
+	"peachone/models"
+	"peachone/repository"
+	"peachone/saasapi"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// get a subscription the user administers, or a fiber error for the handler to return
+func getAdminSubscription(ctx context.Context, repo *repository.Repository, oid string, subscriptionId string) (*models.Subscription, error) {
+	subscription, err := repo.GetSubscription(ctx, subscriptionId)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, fiber.NewError(fiber.StatusNotFound, "subscription not found")
+	}
+	if err != nil {
+		fmt.Println("db error getting subscription:", subscriptionId, err)
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "could not get subscription")
+	}
+	if isSubscriptionOwner(subscription, oid) {
+		return subscription, nil
+	}
+	delegated, err := repo.IsSubscriptionAdmin(ctx, subscription.Id, oid)
+	if err != nil {
+		fmt.Println("db error getting subscription admin:", subscriptionId, err)
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "could not get subscription")
+	}
+	if !delegated {
+		return nil, fiber.NewError(fiber.StatusForbidden, "user is not admin of this subscription")
+	}
+	return subscription, nil
+}
+
+// the purchaser and beneficiary of a subscription are its admins from the
+// Marketplace; only they can grant admin rights to others
+func isSubscriptionOwner(subscription *models.Subscription, oid string) bool {
+	return subscription.PurchaserOid == oid || subscription.BeneficiaryOid == oid
+}
+
+// number of users assigned beyond the subscription's quantity
+func seatOverage(assigned int64, quantity int) int64 {
+	overage := assigned - int64(quantity)
+	if overage < 0 {
+		return 0
+	}
+	return overage
+}
+
+// status to report for a ChangeQuantity operation, given the subscription's policy
+func changeQuantityStatus(settings *models.SubscriptionSettings, assigned int64, quantity int) saasapi.UpdateOperationStatusEnum {
+	if settings.OverAllocationPolicy == models.OverAllocationPolicyEnumReject && seatOverage(assigned, quantity) > 0 {
+		return saasapi.UpdateOperationStatusEnumFailure
+	}
+	return saasapi.UpdateOperationStatusEnumSuccess
+}
+
+// Decide whether to accept a ChangeQuantity operation. With the reject policy,
+// lowering the quantity below the assigned seats fails the operation.
+func checkChangeQuantity(ctx context.Context, repo *repository.Repository, subscriptionId string, quantity int) (saasapi.UpdateOperationStatusEnum, error) {
+	settings, err := repo.GetSubscriptionSettings(ctx, subscriptionId)
+	if err != nil {
+		return "", err
+	}
+	assigned, err := repo.CountSubscriptionUsers(ctx, subscriptionId)
+	if err != nil {
+		return "", err
+	}
+	return changeQuantityStatus(settings, assigned, quantity), nil
+}
+
+func notifyQuantityChangeRejected(ctx context.Context, repo *repository.Repository, subscriptionId string, quantity int64) {
+	subscription, err := repo.GetSubscription(ctx, subscriptionId)
+	if err != nil {
+		fmt.Println("error getting subscription:", subscriptionId, err)
+		return
+	}
+	notifySubscriptionAdmins(ctx, repo, subscription, fmt.Sprintf("The seat change for your subscription %s was rejected", subscription.Name), []string{
+		fmt.Sprintf("A change of your Teraphone subscription %s to %d seats was rejected, because more users are assigned to it than that.", subscription.Name, quantity),
+		"Please unassign users before lowering the number of seats, or change the over-allocation policy of the subscription to unassign users automatically.",
+	})
+}
+
+// After the quantity changed: start the notice period if the subscription is
+// now over-allocated, or clear it if it no longer is.
+func applySeatOverage(ctx context.Context, repo *repository.Repository, subscription *models.Subscription, source ledgerSource) error {
+	assigned, err := repo.CountSubscriptionUsers(ctx, subscription.Id)
+	if err != nil {
+		return err
+	}
+	overage := seatOverage(assigned, subscription.Quantity)
+
+	if overage == 0 {
+		if subscription.OverAllocatedAt.IsZero() {
+			return nil
+		}
+		return updateSubscriptionToLedger(ctx, repo, subscription.Id, map[string]interface{}{
+			"over_allocated_at":           time.Time{},
+			"over_allocation_unassign_at": time.Time{},
+		}, source)
+	}
+	if !subscription.OverAllocatedAt.IsZero() {
+		return nil // notice already sent
+	}
+
+	settings, err := repo.GetSubscriptionSettings(ctx, subscription.Id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	updates := map[string]interface{}{"over_allocated_at": now}
+	paragraphs := []string{
+		fmt.Sprintf("Your Teraphone subscription %s now has %d seats, but %d users are assigned to it.", subscription.Name, subscription.Quantity, assigned),
+	}
+	if settings.OverAllocationPolicy == models.OverAllocationPolicyEnumUnassign {
+		unassignAt := now.AddDate(0, 0, settings.OverAllocationNoticeDays)
+		updates["over_allocation_unassign_at"] = unassignAt
+		paragraphs = append(paragraphs, fmt.Sprintf("Please unassign %d users by %s. After that, the %d least recently active users will be unassigned automatically.", overage, unassignAt.UTC().Format("January 2, 2006 15:04 MST"), overage))
+	} else {
+		paragraphs = append(paragraphs, fmt.Sprintf("Please unassign %d users; no new users can be assigned until then.", overage))
+	}
+	err = updateSubscriptionToLedger(ctx, repo, subscription.Id, updates, source)
+	if err != nil {
+		return err
+	}
+
+	notifySubscriptionAdmins(ctx, repo, subscription, fmt.Sprintf("Your subscription %s has more users than seats", subscription.Name), paragraphs)
+	return nil
+}
+
+// Job: unassign the least recently active users of over-allocated
+// subscriptions once their notice period is over.
+func EnforceSeatOverages(ctx context.Context) error {
+	repo := repository.New(database.DB.DB)
+
+	subscriptions, err := repo.ListSubscriptionsDueForUnassign(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		unassigned, err := unassignSeatOverage(ctx, repo, subscription)
+		if err != nil {
+			return err
+		}
+		if len(unassigned) == 0 {
+			continue
+		}
+
+		revokeRoomAccess(ctx, repo, unassigned)
+
+		names := make([]string, len(unassigned))
+		for j, user := range unassigned {
+			names[j] = fmt.Sprintf("%s (%s)", user.Name, user.Email)
+		}
+		notifySubscriptionAdmins(ctx, repo, subscription, fmt.Sprintf("Users were unassigned from your subscription %s", subscription.Name), append([]string{
+			fmt.Sprintf("Your Teraphone subscription %s had more users than its %d seats, so the %d least recently active users have been unassigned:", subscription.Name, subscription.Quantity, len(unassigned)),
+		}, names...))
+	}
+
+	return nil
+}
+
+// Unassign users until the subscription fits its quantity, and clear the
+// overage. The subscription is locked and the overage claimed first, so when
+// the job runs on several instances only one unassigns and notifies; the
+// others get no users back.
+func unassignSeatOverage(ctx context.Context, repo *repository.Repository, subscription *models.Subscription) ([]models.TenantUser, error) {
+	unassigned := []models.TenantUser{}
+	err := repo.Transaction(ctx, func(tx *repository.Repository) error {
+		locked, err := tx.LockSubscription(ctx, subscription.Id)
+		if err != nil {
+			return err
+		}
+		if locked.OverAllocationUnassignAt.IsZero() || locked.OverAllocationUnassignAt.After(time.Now()) {
+			return nil // cleared, or done by another instance
+		}
+		assigned, err := tx.CountSubscriptionUsers(ctx, subscription.Id)
+		if err != nil {
+			return err
+		}
+		overage := seatOverage(assigned, locked.Quantity)
+		if overage > 0 {
+			users, err := tx.ListLeastRecentlyActiveSubscriptionUsers(ctx, subscription.Id, int(overage))
+			if err != nil {
+				return err
+			}
+			oids := make([]string, len(users))
+			for i, user := range users {
+				oids[i] = user.Oid
+			}
+			_, err = tx.UnassignUsers(ctx, subscription.Id, oids)
+			if err != nil {
+				return err
+			}
+			unassigned = users
+		}
+		source := ledgerSource{Actor: ledgerActorSystem, Operation: "SeatOverage"}
+		err = recordSeatChanges(ctx, tx, source, subscription.Id, models.LedgerEventEnumSeatUnassigned, unassigned)
+		if err != nil {
+			return err
+		}
+		return updateSubscriptionToLedger(ctx, tx, subscription.Id, map[string]interface{}{
+			"over_allocated_at":           time.Time{},
+			"over_allocation_unassign_at": time.Time{},
+		}, source)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return unassigned, nil
+}
+
+// the emails of everyone who administers the subscription, each once
+func subscriptionAdminEmails(subscription *models.Subscription, admins []models.SubscriptionAdmin) []string {
+	emails := []string{}
+	seen := make(map[string]bool)
+	add := func(email string) {
+		if email != "" && !seen[email] {
+			seen[email] = true
+			emails = append(emails, email)
+		}
+	}
+	add(subscription.PurchaserEmail)
+	add(subscription.BeneficiaryEmail)
+	for _, admin := range admins {
+		if admin.SubscriptionId == subscription.Id {
+			add(admin.Email)
+		}
+	}
+	return emails
+}
+
+func notifySubscriptionAdmins(ctx context.Context, repo *repository.Repository, subscription *models.Subscription, subject string, paragraphs []string) {
+	admins, err := repo.ListSubscriptionAdmins(ctx, []string{subscription.Id})
+	if err != nil {
+		fmt.Println("error getting admins for subscriptionId:", subscription.Id, err)
+	}
+	_, _, err = SendNotificationEmail(ctx, &NotificationVars{
+		RecipientEmails: subscriptionAdminEmails(subscription, admins),
+		Subject:         subject,
+		Paragraphs:      paragraphs,
+	})
+	if err != nil {
+		fmt.Println("error notifying admins for subscriptionId:", subscription.Id, err)
+	}
+}
+
+// --------------------------------------------------------------------------------
+// Get Subscription Overage
+// --------------------------------------------------------------------------------
+type GetSubscriptionOverageResponse struct {
+	Success         bool                         `json:"success"`
+	Subscription    models.Subscription          `json:"subscription"`
+	Settings        *models.SubscriptionSettings `json:"settings"`
+	Assigned        int64                        `json:"assigned"`
+	Overage         int64                        `json:"overage"`
+	UsersToUnassign []models.TenantUser          `json:"usersToUnassign"` // who will lose their seat if nothing changes
+}
+
+func GetSubscriptionOverage(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getAdminSubscription(c.Context(), repo, claims.Oid, c.Params("subscriptionId"))
+	if err != nil {
+		return err
+	}
+
+	// get settings and assigned seats
+	settings, err := repo.GetSubscriptionSettings(c.Context(), subscription.Id)
+	if err != nil {
+		fmt.Println("db error getting subscription settings:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get subscription settings")
+	}
+	assigned, err := repo.CountSubscriptionUsers(c.Context(), subscription.Id)
+	if err != nil {
+		fmt.Println("db error counting users:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not count users")
+	}
+	overage := seatOverage(assigned, subscription.Quantity)
+
+	usersToUnassign := []models.TenantUser{}
+	if overage > 0 && settings.OverAllocationPolicy == models.OverAllocationPolicyEnumUnassign {
+		usersToUnassign, err = repo.ListLeastRecentlyActiveSubscriptionUsers(c.Context(), subscription.Id, int(overage))
+		if err != nil {
+			fmt.Println("db error getting users:", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "could not get users")
+		}
+	}
+
+	// create response
+	response := &GetSubscriptionOverageResponse{
+		Success:         true,
+		Subscription:    *subscription,
+		Settings:        settings,
+		Assigned:        assigned,
+		Overage:         overage,
+		UsersToUnassign: usersToUnassign,
+	}
+	return c.JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Update Subscription Settings
+// --------------------------------------------------------------------------------
+type UpdateSubscriptionSettingsRequest struct {
+	OverAllocationPolicy     *models.OverAllocationPolicyEnum `json:"overAllocationPolicy"`
+	OverAllocationNoticeDays *int                             `json:"overAllocationNoticeDays"`
+	AutoAssignNewUsers       *bool                            `json:"autoAssignNewUsers"`
+	AutoAssignTeamIds        *[]string                        `json:"autoAssignTeamIds"` // replaces the teams
+}
+
+// teams an auto-assign policy may name
+const maxAutoAssignTeams = 50
+
+type UpdateSubscriptionSettingsResponse struct {
+	Success  bool                         `json:"success"`
+	Settings *models.SubscriptionSettings `json:"settings"`
+}
+
+func UpdateSubscriptionSettings(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// get request body
+	req := &UpdateSubscriptionSettingsRequest{}
+	if err := c.BodyParser(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getAdminSubscription(c.Context(), repo, claims.Oid, c.Params("subscriptionId"))
+	if err != nil {
+		return err
+	}
+
+	// apply changes to current settings
+	settings, err := repo.GetSubscriptionSettings(c.Context(), subscription.Id)
+	if err != nil {
+		fmt.Println("db error getting subscription settings:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get subscription settings")
+	}
+	if req.OverAllocationPolicy != nil {
+		validPolicy := false
+		for _, policy := range models.PossibleOverAllocationPolicyEnumValues() {
+			if *req.OverAllocationPolicy == policy {
+				validPolicy = true
+				break
+			}
+		}
+		if !validPolicy {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid overAllocationPolicy")
+		}
+		settings.OverAllocationPolicy = *req.OverAllocationPolicy
+	}
+	if req.OverAllocationNoticeDays != nil {
+		if *req.OverAllocationNoticeDays < 0 || *req.OverAllocationNoticeDays > 90 {
+			return fiber.NewError(fiber.StatusBadRequest, "overAllocationNoticeDays must be between 0 and 90")
+		}
+		settings.OverAllocationNoticeDays = *req.OverAllocationNoticeDays
+	}
+	if req.AutoAssignNewUsers != nil {
+		// users who signed up before the policy was turned on aren't "new"
+		if *req.AutoAssignNewUsers && !settings.AutoAssignNewUsers {
+			settings.AutoAssignNewUsersAt = time.Now()
+		}
+		if !*req.AutoAssignNewUsers {
+			settings.AutoAssignNewUsersAt = time.Time{}
+		}
+		settings.AutoAssignNewUsers = *req.AutoAssignNewUsers
+	}
+	if req.AutoAssignTeamIds != nil {
+		if len(*req.AutoAssignTeamIds) > maxAutoAssignTeams {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("at most %d autoAssignTeamIds", maxAutoAssignTeams))
+		}
+		teamIds := []string{}
+		seen := make(map[string]bool)
+		for _, teamId := range *req.AutoAssignTeamIds {
+			if seen[teamId] {
+				continue
+			}
+			seen[teamId] = true
+			team, err := repo.GetTeam(c.Context(), teamId)
+			if errors.Is(err, repository.ErrNotFound) || (err == nil && team.Tid != subscription.BeneficiaryTid) {
+				return fiber.NewError(fiber.StatusBadRequest, "unknown team in autoAssignTeamIds: "+teamId)
+			}
+			if err != nil {
+				fmt.Println("db error getting team:", err)
+				return fiber.NewError(fiber.StatusInternalServerError, "could not get team")
+			}
+			teamIds = append(teamIds, teamId)
+		}
+		settings.AutoAssignTeamIds = teamIds
+	}
+
+	err = repo.SaveSubscriptionSettings(c.Context(), settings)
+	if err != nil {
+		fmt.Println("db error saving subscription settings:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not save subscription settings")
+	}
+
+	// reschedule a pending unassign under the new settings
+	if !subscription.OverAllocatedAt.IsZero() {
+		unassignAt := time.Time{}
+		if settings.OverAllocationPolicy == models.OverAllocationPolicyEnumUnassign {
+			unassignAt = subscription.OverAllocatedAt.AddDate(0, 0, settings.OverAllocationNoticeDays)
+		}
+		err = repo.UpdateSubscription(c.Context(), subscription.Id, map[string]interface{}{
+			"over_allocation_unassign_at": unassignAt,
+		})
+		if err != nil {
+			fmt.Println("db error rescheduling unassign:", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "could not save subscription settings")
+		}
+	}
+
+	// create response
+	response := &UpdateSubscriptionSettingsResponse{
+		Success:  true,
+		Settings: settings,
+	}
+	return c.JSON(response)
+}
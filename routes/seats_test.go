@@ -0,0 +1,53 @@
+package routes
+
+import (
+	"peachone/models"
+	"peachone/saasapi"
+	"testing"
+)
+
+func TestSeatOverage(t *testing.T) {
+	cases := []struct {
+		assigned int64
+		quantity int
+		want     int64
+	}{
+		{0, 5, 0},
+		{5, 5, 0},
+		{7, 5, 2},
+		{3, 0, 3},
+	}
+	for _, c := range cases {
+		if got := seatOverage(c.assigned, c.quantity); got != c.want {
+			t.Errorf("seatOverage(%d, %d): expected %d, got %d", c.assigned, c.quantity, c.want, got)
+		}
+	}
+}
+
+func TestChangeQuantityStatus(t *testing.T) {
+	reject := &models.SubscriptionSettings{OverAllocationPolicy: models.OverAllocationPolicyEnumReject}
+	unassign := models.DefaultSubscriptionSettings("sub")
+
+	if got := changeQuantityStatus(reject, 7, 5); got != saasapi.UpdateOperationStatusEnumFailure {
+		t.Errorf("reject policy, over-allocated: expected Failure, got %s", got)
+	}
+	if got := changeQuantityStatus(reject, 5, 5); got != saasapi.UpdateOperationStatusEnumSuccess {
+		t.Errorf("reject policy, enough seats: expected Success, got %s", got)
+	}
+	if got := changeQuantityStatus(unassign, 7, 5); got != saasapi.UpdateOperationStatusEnumSuccess {
+		t.Errorf("unassign policy, over-allocated: expected Success, got %s", got)
+	}
+}
+
+func TestSubscriptionAdminEmails(t *testing.T) {
+	subscription := &models.Subscription{Id: "sub", PurchaserEmail: "buyer@example.com", BeneficiaryEmail: "buyer@example.com"}
+	admins := []models.SubscriptionAdmin{
+		{SubscriptionId: "sub", Email: "delegate@example.com"},
+		{SubscriptionId: "other", Email: "elsewhere@example.com"},
+		{SubscriptionId: "sub", Email: "buyer@example.com"},
+	}
+	got := subscriptionAdminEmails(subscription, admins)
+	if len(got) != 2 || got[0] != "buyer@example.com" || got[1] != "delegate@example.com" {
+		t.Fatalf("admins = %v", got)
+	}
+}
@@ -1,41 +1,46 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"peachone/auth"
 	"peachone/database"
 	"peachone/models"
+	"peachone/repository"
 	"peachone/saasapi"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-func makeSubscription(resp saasapi.FulfillmentOperationsClientGetSubscriptionResponse) *models.Subscription {
+// our copy of a Marketplace subscription
+func makeSubscription(subscription *saasapi.Subscription) *models.Subscription {
 	return &models.Subscription{
-		AutoRenew:                 *resp.Subscription.AutoRenew,
-		BeneficiaryEmail:          *resp.Subscription.Beneficiary.EmailID,
-		BeneficiaryOid:            *resp.Subscription.Beneficiary.ObjectID,
-		BeneficiaryTid:            *resp.Subscription.Beneficiary.TenantID,
-		BeneficiaryPuid:           *resp.Subscription.Beneficiary.Puid,
-		Created:                   *resp.Subscription.Created,
-		Id:                        *resp.Subscription.ID,
-		IsTest:                    *resp.Subscription.IsTest,
-		Name:                      *resp.Subscription.Name,
-		OfferId:                   *resp.Subscription.OfferID,
-		PlanId:                    *resp.Subscription.PlanID,
-		PublisherId:               *resp.Subscription.PublisherID,
-		PurchaserEmail:            *resp.Subscription.Purchaser.EmailID,
-		PurchaserOid:              *resp.Subscription.Purchaser.ObjectID,
-		PurchaserTid:              *resp.Subscription.Purchaser.TenantID,
-		PurchaserPuid:             *resp.Subscription.Purchaser.Puid,
-		Quantity:                  int(*resp.Quantity),
-		SaaSSubscriptionStatus:    models.SubscriptionStatusEnum(*resp.SaasSubscriptionStatus),
-		SandboxType:               models.SandboxTypeEnum(*resp.Subscription.SandboxType),
-		SessionId:                 ReadString(resp.Subscription.SessionID),
-		SessionMode:               models.SessionModeEnum(*resp.Subscription.SessionMode),
-		StoreFront:                ReadString(resp.Subscription.StoreFront),
-		SubscriptionTermStartDate: ReadDate(resp.Subscription.Term.StartDate),
-		SubscriptionTermEndDate:   ReadDate(resp.Subscription.Term.EndDate),
+		AutoRenew:                 *subscription.AutoRenew,
+		BeneficiaryEmail:          *subscription.Beneficiary.EmailID,
+		BeneficiaryOid:            *subscription.Beneficiary.ObjectID,
+		BeneficiaryTid:            *subscription.Beneficiary.TenantID,
+		BeneficiaryPuid:           *subscription.Beneficiary.Puid,
+		Created:                   *subscription.Created,
+		Id:                        *subscription.ID,
+		IsTest:                    *subscription.IsTest,
+		Name:                      *subscription.Name,
+		OfferId:                   *subscription.OfferID,
+		PlanId:                    *subscription.PlanID,
+		PublisherId:               *subscription.PublisherID,
+		PurchaserEmail:            *subscription.Purchaser.EmailID,
+		PurchaserOid:              *subscription.Purchaser.ObjectID,
+		PurchaserTid:              *subscription.Purchaser.TenantID,
+		PurchaserPuid:             *subscription.Purchaser.Puid,
+		Quantity:                  int(*subscription.Quantity),
+		SaaSSubscriptionStatus:    models.SubscriptionStatusEnum(*subscription.SaasSubscriptionStatus),
+		SandboxType:               models.SandboxTypeEnum(*subscription.SandboxType),
+		SessionId:                 ReadString(subscription.SessionID),
+		SessionMode:               models.SessionModeEnum(*subscription.SessionMode),
+		StoreFront:                ReadString(subscription.StoreFront),
+		SubscriptionTermStartDate: ReadDate(subscription.Term.StartDate),
+		SubscriptionTermEndDate:   ReadDate(subscription.Term.EndDate),
 	}
 }
 
@@ -89,169 +94,50 @@ func Resolve(c *fiber.Ctx) error {
 }
 
 // --------------------------------------------------------------------------------
-// Activate handler
+// Subscriptions Webhook Authentication
 // --------------------------------------------------------------------------------
-type ActivateRequest struct {
-	SubscriptionId string `json:"subscriptionId"`
-}
+var marketplaceTokenValidator = newMarketplaceTokenValidator()
 
-type ActivateResponse struct {
-	Success      bool                `json:"success"`
-	Subscription models.Subscription `json:"subscription"`
-}
+func newMarketplaceTokenValidator() *auth.MarketplaceTokenValidator {
+	validator := auth.NewMarketplaceTokenValidator(saasapi.TenantId, saasapi.AppId)
 
-func Activate(c *fiber.Ctx) error {
-	// check JWT
-	_, err := getClaimsFromJWT(c)
-	if err != nil {
-		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
-	}
-
-	// get request body
-	req := new(ActivateRequest)
-	if err := c.BodyParser(req); err != nil {
-		return err
-	}
-
-	// validate request body
-	if req.SubscriptionId == "" {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid subscriptionId")
-	}
-
-	// create fulfillment api client
-	client, err := saasapi.NewDefaultFulfillmentOperationsClient()
-	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "could not create fulfillment api client")
-	}
-
-	// get subscription
-	subscriptionResponse, err := client.GetSubscription(
-		c.Context(),
-		req.SubscriptionId,
-		&saasapi.FulfillmentOperationsClientGetSubscriptionOptions{},
-	)
-	if err != nil {
-		fmt.Println("error getting subscription:", err)
-		return fiber.NewError(fiber.StatusInternalServerError, "could not retrieve subscription")
-	}
-
-	// activate subscription
-	quantity := int64(*subscriptionResponse.Subscription.Quantity)
-	_, err = client.ActivateSubscription(c.Context(), req.SubscriptionId, saasapi.SubscriberPlan{
-		PlanID:   subscriptionResponse.Subscription.PlanID,
-		Quantity: &quantity,
-	}, &saasapi.FulfillmentOperationsClientActivateSubscriptionOptions{})
-	if err != nil {
-		fmt.Println("error activating subscription:", err)
-		return fiber.NewError(fiber.StatusInternalServerError, "could not activate subscription")
+	// e.g. the Marketplace emulator's, which signs its own webhook tokens
+	MARKETPLACE_OPENID_CONFIG_URL := os.Getenv("MARKETPLACE_OPENID_CONFIG_URL")
+	if MARKETPLACE_OPENID_CONFIG_URL != "" {
+		validator.OpenIDConfigUrl = MARKETPLACE_OPENID_CONFIG_URL
 	}
+	return validator
+}
 
-	// get activated subscription
-	activatedSubscriptionResponse, err := client.GetSubscription(
-		c.Context(),
-		req.SubscriptionId,
-		&saasapi.FulfillmentOperationsClientGetSubscriptionOptions{},
-	)
+// rejects webhook calls that don't carry a valid Azure AD token from the Marketplace
+func AuthenticateMarketplaceWebhook(c *fiber.Ctx) error {
+	_, err := marketplaceTokenValidator.ValidateAuthorizationHeader(c.Context(), c.Get(fiber.HeaderAuthorization))
 	if err != nil {
-		fmt.Println("error getting activated subscription:", err)
-		return fiber.NewError(fiber.StatusInternalServerError, "could not retrieve activated subscription")
-	}
-
-	// populate new subscription
-	newSubscription := makeSubscription(activatedSubscriptionResponse)
-
-	// make sure subscription has valid start dates
-	maxTries := 24
-	for i := 0; i < maxTries; i++ {
-		if newSubscription.SubscriptionTermEndDate.IsZero() ||
-			newSubscription.SubscriptionTermStartDate.IsZero() {
-			time.Sleep(5 * time.Second)
-			activatedSubscriptionResponse, err = client.GetSubscription(
-				c.Context(),
-				req.SubscriptionId,
-				&saasapi.FulfillmentOperationsClientGetSubscriptionOptions{},
-			)
-			if err != nil {
-				fmt.Println("error getting activated subscription:", err)
-				return fiber.NewError(fiber.StatusInternalServerError, "could not retrieve activated subscription")
-			}
-			newSubscription = makeSubscription(activatedSubscriptionResponse)
-		} else {
-			break
-		}
-	}
-
-	// get database connection
-	db := database.DB.DB
-
-	// check if subscription in db... if no, create it; if so, update it
-	query := db.Where("id = ?", req.SubscriptionId).Find(&models.Subscription{})
-	if query.RowsAffected == 0 {
-		tx := db.Create(newSubscription)
-		if tx.Error != nil {
-			fmt.Println("db error creating subscription:", tx.Error)
-			return fiber.NewError(fiber.StatusInternalServerError, "db could not create subscription")
-		}
-		// if new subscription, send email
-		_, _, err := SendNewSubscriptionAlert(c.Context(), newSubscription)
-		if err != nil {
-			fmt.Println("error sending new subscription alert for subscriptionId:", newSubscription.Id, err)
-		}
-	} else {
-		tx := db.Model(&models.Subscription{}).Where("id = ?", req.SubscriptionId).Updates(newSubscription)
-		if tx.Error != nil {
-			fmt.Println("db error updating subscription:", tx.Error)
-			return fiber.NewError(fiber.StatusInternalServerError, "db could not update subscription")
-		}
+		fmt.Println("rejected subscriptions webhook:", err)
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid token")
 	}
-
-	// return response
-	response := &ActivateResponse{
-		Success:      true,
-		Subscription: *newSubscription,
-	}
-	return c.JSON(response)
+	return c.Next()
 }
 
 // --------------------------------------------------------------------------------
-// Subscriptions Webhook Dispatch
+// Subscriptions Webhook handler
 // --------------------------------------------------------------------------------
 type SubscriptionsWebhookRequest struct {
-	Action saasapi.OperationActionEnum `json:"action"`
-}
-
-func SubscriptionsWebhook(c *fiber.Ctx) error {
-	// get request body
-	req := new(SubscriptionsWebhookRequest)
-	if err := c.BodyParser(req); err != nil {
-		return err
-	}
-
-	// validate request body
-	if req.Action == "" {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
-	}
-
-	return GenericAction(c)
-
-}
-
-// --------------------------------------------------------------------------------
-// Webhook Generic Action handler
-// --------------------------------------------------------------------------------
-type GenericActionRequest struct {
 	Id             string                      `json:"id"`
+	ActivityId     string                      `json:"activityId"`
 	SubscriptionId string                      `json:"subscriptionId"`
 	Action         saasapi.OperationActionEnum `json:"action"`
 }
 
-type GenericActionResponse struct {
+type SubscriptionsWebhookResponse struct {
 	Success bool `json:"success"`
 }
 
-func GenericAction(c *fiber.Ctx) error {
+// Records the operation and returns; the work is done by ProcessMarketplaceOperations.
+// Retries of an operation we already recorded are acknowledged without doing it again.
+func SubscriptionsWebhook(c *fiber.Ctx) error {
 	// get request body
-	req := new(GenericActionRequest)
+	req := new(SubscriptionsWebhookRequest)
 	if err := c.BodyParser(req); err != nil {
 		return err
 	}
@@ -261,103 +147,30 @@ func GenericAction(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
 	}
 
-	// create subscription operations client
-	operationsClient, err := saasapi.NewDefaultSubscriptionOperationsClient()
-	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "could not create subscription operations client")
-	}
+	// get repository
+	repo := repository.New(database.DB.DB)
 
-	// get operation
-	operationStatusResponse, err := operationsClient.GetOperationStatus(
-		c.Context(),
-		req.SubscriptionId,
-		req.Id,
-		&saasapi.SubscriptionOperationsClientGetOperationStatusOptions{},
-	)
-	if err != nil {
-		fmt.Println("error getting operation:", err)
-		return fiber.NewError(fiber.StatusInternalServerError, "could not retrieve operation")
+	// record operation
+	operation := &models.MarketplaceOperation{
+		Id:             req.Id,
+		ActivityId:     req.ActivityId,
+		SubscriptionId: req.SubscriptionId,
+		Action:         string(req.Action),
+		Payload:        string(c.Body()),
+		Status:         models.MarketplaceOperationStatusEnumPending,
+		NextAttemptAt:  time.Now(),
 	}
-	operationJSON, err := operationStatusResponse.MarshalJSON()
+	created, err := repo.CreateMarketplaceOperation(c.Context(), operation)
 	if err != nil {
-		fmt.Println("error marshalling operation:", err)
-		return fiber.NewError(fiber.StatusInternalServerError, "could not marshal operation")
-	}
-	fmt.Println("operation:", string(operationJSON))
-
-	// update operation status if action is "Reinstate", "ChangePlan", or "ChangeQuantity"
-	action := *operationStatusResponse.Action
-	if action == saasapi.OperationActionEnumReinstate ||
-		action == saasapi.OperationActionEnumChangePlan ||
-		action == saasapi.OperationActionEnumChangeQuantity {
-		quantity := int64(*operationStatusResponse.Quantity)
-		status := saasapi.UpdateOperationStatusEnumSuccess
-		updateOperation := &saasapi.UpdateOperation{
-			PlanID:   operationStatusResponse.PlanID,
-			Quantity: &quantity,
-			Status:   &status,
-		}
-		_, err = operationsClient.UpdateOperationStatus(
-			c.Context(),
-			*operationStatusResponse.SubscriptionID,
-			*operationStatusResponse.ID,
-			*updateOperation,
-			&saasapi.SubscriptionOperationsClientUpdateOperationStatusOptions{},
-		)
-		if err != nil {
-			fmt.Println("error updating operation:", err)
-			return fiber.NewError(fiber.StatusInternalServerError, "could not update operation")
-		}
+		fmt.Println("db error recording operation:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not record operation")
 	}
-
-	// create fulfillment api client
-	fulfillmentClient, err := saasapi.NewDefaultFulfillmentOperationsClient()
-	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "could not create fulfillment api client")
-	}
-
-	// get subscription
-	subscriptionResponse, err := fulfillmentClient.GetSubscription(
-		c.Context(),
-		*operationStatusResponse.SubscriptionID,
-		&saasapi.FulfillmentOperationsClientGetSubscriptionOptions{},
-	)
-	if err != nil {
-		fmt.Println("error getting subscription:", err)
-		return fiber.NewError(fiber.StatusInternalServerError, "could not retrieve subscription")
-	}
-
-	// get database connection
-	db := database.DB.DB
-
-	// populate new subscription
-	newSubscription := makeSubscription(subscriptionResponse)
-
-	// check if subscription in db... if no, create it; if so, update it
-	currentSubscription := &models.Subscription{}
-	query := db.Where("id = ?", newSubscription.Id).Find(currentSubscription)
-	if query.RowsAffected == 0 {
-		tx := db.Create(newSubscription)
-		if tx.Error != nil {
-			fmt.Println("db error creating subscription:", tx.Error)
-			return fiber.NewError(fiber.StatusInternalServerError, "db could not create subscription")
-		}
-	} else {
-		tx := db.Model(&models.Subscription{}).Where("id = ?", newSubscription.Id).Updates(newSubscription)
-		if tx.Error != nil {
-			fmt.Println("db error updating subscription:", tx.Error)
-			return fiber.NewError(fiber.StatusInternalServerError, "db could not update subscription")
-		}
-	}
-
-	// send email
-	_, _, err = SendSubscriptionActionAlert(c.Context(), string(action), newSubscription, currentSubscription)
-	if err != nil {
-		fmt.Println("error sending subscription action alert for subscriptionId:", newSubscription.Id, err)
+	if !created {
+		fmt.Println("ignoring retry of operation:", req.Id)
 	}
 
 	// return response
-	response := &GenericActionResponse{
+	response := &SubscriptionsWebhookResponse{
 		Success: true,
 	}
 	return c.JSON(response)
@@ -369,8 +182,9 @@ func GenericAction(c *fiber.Ctx) error {
 type TenantSubscriptions map[string]map[string]models.Subscription
 
 type GetSubscriptionsResponse struct {
-	Success       bool                `json:"success"`
-	Subscriptions TenantSubscriptions `json:"subscriptions"`
+	Success       bool                     `json:"success"`
+	Subscriptions TenantSubscriptions      `json:"subscriptions"`
+	Tenants       map[string]models.Tenant `json:"tenants"`
 }
 
 func GetSubscriptions(c *fiber.Ctx) error {
@@ -380,28 +194,27 @@ func GetSubscriptions(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
 	}
 
-	// get database connection
-	db := database.DB.DB
+	// get repository
+	repo := repository.New(database.DB.DB)
 
 	// get user, user subscription (if exists)
-	user := &models.TenantUser{}
 	hasUserSubscription := false
 	userSubscription := &models.Subscription{}
-	query := db.Where("oid = ?", claims.Oid).Find(user)
-	if query.RowsAffected != 0 {
-		query = db.Where("id = ?", user.SubscriptionId).Find(userSubscription)
-		if query.RowsAffected != 0 {
+	user, err := repo.GetUser(c.Context(), claims.Oid)
+	if err == nil && user.SubscriptionId != "" {
+		userSubscription, err = repo.GetSubscription(c.Context(), user.SubscriptionId)
+		if err == nil {
 			hasUserSubscription = true
 		}
 	}
 
 	// get admin (purchaser/beneficiary) subscriptions?
-	hasAdminSubscriptions := false
-	adminSubscriptions := []models.Subscription{}
-	query = db.Where("beneficiary_oid = ? OR purchaser_oid = ?", claims.Oid, claims.Oid).Find(&adminSubscriptions)
-	if query.RowsAffected != 0 {
-		hasAdminSubscriptions = true
+	adminSubscriptions, err := repo.ListAdminSubscriptions(c.Context(), claims.Oid)
+	if err != nil {
+		fmt.Println("db error getting admin subscriptions:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get subscriptions")
 	}
+	hasAdminSubscriptions := len(adminSubscriptions) > 0
 
 	// populate TenantSubscriptions
 	tenantSubscriptions := make(TenantSubscriptions)
@@ -424,10 +237,22 @@ func GetSubscriptions(c *fiber.Ctx) error {
 		}
 	}
 
+	// get tenant details for each tenant with subscriptions
+	tenants := make(map[string]models.Tenant)
+	for tid := range tenantSubscriptions {
+		tenant, err := repo.GetTenant(c.Context(), tid)
+		if err != nil {
+			fmt.Println("error getting tenant:", tid, err)
+			continue
+		}
+		tenants[tid] = *tenant
+	}
+
 	// create response
 	response := &GetSubscriptionsResponse{
 		Success:       true,
 		Subscriptions: tenantSubscriptions,
+		Tenants:       tenants,
 	}
 
 	return c.JSON(response)
@@ -462,20 +287,26 @@ func AssignUserSubscription(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
 	}
 
-	// get database connection
-	db := database.DB.DB
+	// get repository
+	repo := repository.New(database.DB.DB)
 
 	// get user
-	user := &models.TenantUser{}
-	query := db.Where("oid = ? AND tid = ?", oid, tid).Find(user)
-	if query.RowsAffected == 0 {
+	user, err := repo.GetTenantUser(c.Context(), tid, oid)
+	if errors.Is(err, repository.ErrNotFound) {
 		return fiber.NewError(fiber.StatusNotFound, "user not found")
 	}
+	if err != nil {
+		fmt.Println("db error getting user:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get user")
+	}
 
 	// get subscriptions
-	subscriptions := []models.Subscription{}
-	query = db.Where("beneficiary_oid = ? OR purchaser_oid = ?", claims.Oid, claims.Oid).Find(&subscriptions)
-	if query.RowsAffected == 0 {
+	subscriptions, err := repo.ListAdminSubscriptions(c.Context(), claims.Oid)
+	if err != nil {
+		fmt.Println("db error getting admin subscriptions:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get subscriptions")
+	}
+	if len(subscriptions) == 0 {
 		return fiber.NewError(fiber.StatusNotFound, "user is not admin of any subscriptions")
 	}
 
@@ -490,70 +321,62 @@ func AssignUserSubscription(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusNotFound, "user is not admin of any subscriptions for this tenant")
 	}
 
-	// are we assigning or removing a subscription?
-	var assigning = false
-	if req.SubscriptionId != "" {
-		assigning = true
+	isTenantSubscription := func(subscriptionId string) bool {
+		for _, id := range tenantSubscriptionIds {
+			if id == subscriptionId {
+				return true
+			}
+		}
+		return false
 	}
 
-	if !assigning {
-		// remove subscription
-		tx := db.Model(user).Update("subscription_id", "")
-		if tx.Error != nil {
-			fmt.Println("db error removing subscription:", tx.Error)
-			return fiber.NewError(fiber.StatusInternalServerError, "could not unassign subscription")
+	if req.SubscriptionId == "" {
+		// remove subscription, if it is one the caller administers
+		previousSubscriptionId := user.SubscriptionId
+		if previousSubscriptionId != "" {
+			if !isTenantSubscription(previousSubscriptionId) {
+				return fiber.NewError(fiber.StatusForbidden, "user is not admin of the user's subscription")
+			}
+			source := ledgerSource{Actor: claims.Oid, Operation: "UnassignSeat"}
+			err = unassignSeat(c.Context(), repo, user, source)
+			if errors.Is(err, errSeatChanged) {
+				return fiber.NewError(fiber.StatusConflict, err.Error())
+			}
+			if err != nil {
+				fmt.Println("db error removing subscription:", err)
+				return fiber.NewError(fiber.StatusInternalServerError, "could not unassign subscription")
+			}
+			user.SubscriptionId = ""
+
+			// the seat freed may resolve an over-allocation
+			previousSubscription, err := repo.GetSubscription(c.Context(), previousSubscriptionId)
+			if err == nil && !previousSubscription.OverAllocatedAt.IsZero() {
+				err = applySeatOverage(c.Context(), repo, previousSubscription, source)
+			}
+			if err != nil {
+				fmt.Println("error updating seat overage:", previousSubscriptionId, err)
+			}
 		}
 	} else {
 		// check if req.SubscriptionId is in tenantSubscriptionIds
-		var subscriptionIdFound = false
-		for _, subscriptionId := range tenantSubscriptionIds {
-			if subscriptionId == req.SubscriptionId {
-				subscriptionIdFound = true
-				break
-			}
-		}
-		if !subscriptionIdFound {
+		if !isTenantSubscription(req.SubscriptionId) {
 			return fiber.NewError(fiber.StatusNotFound, "subscription not found")
 		}
-	}
-
-	// find target subscription
-	targetSubscription := &models.Subscription{}
-	for _, subscription := range subscriptions {
-		if subscription.Id == req.SubscriptionId {
-			targetSubscription = &subscription
-			break
-		}
-	}
-
-	// check if subscription is already assigned to user
-	isNewSubscription := false
-	if targetSubscription.Id != user.SubscriptionId {
-		isNewSubscription = true
-	}
-
-	// assign subscription
-	if isNewSubscription {
 
-		// check if there are seats available
-		var count int64 = 0
-		tx := db.Model(&models.TenantUser{}).Where("subscription_id = ?", targetSubscription.Id).Count(&count)
-		if tx.Error != nil {
-			fmt.Println("db error counting users:", tx.Error)
-			return fiber.NewError(fiber.StatusInternalServerError, "could not assign subscription")
-		}
-		if count >= int64(targetSubscription.Quantity) && assigning {
+		// assign subscription; seats are counted with the subscription locked,
+		// so concurrent assignments can't exceed its quantity
+		_, err = assignSeats(c.Context(), repo, req.SubscriptionId, []string{user.Oid}, nil, ledgerSource{Actor: claims.Oid, Operation: "AssignSeat"})
+		if errors.Is(err, errNotEnoughSeats) {
 			return fiber.NewError(fiber.StatusForbidden, "not enough seats available")
 		}
-
-		// update user
-		user.SubscriptionId = req.SubscriptionId
-		tx = db.Model(user).Update("subscription_id", req.SubscriptionId)
-		if tx.Error != nil {
-			fmt.Println("db error updating subscription:", tx.Error)
+		if errors.Is(err, errSubscriptionCancelled) {
+			return fiber.NewError(fiber.StatusConflict, err.Error())
+		}
+		if err != nil {
+			fmt.Println("db error updating subscription:", err)
 			return fiber.NewError(fiber.StatusInternalServerError, "could not assign subscription")
 		}
-
+		user.SubscriptionId = req.SubscriptionId
 	}
 
 	// create response
@@ -570,6 +393,7 @@ func AssignUserSubscription(c *fiber.Ctx) error {
 // --------------------------------------------------------------------------------
 type GetUsersByTenantResponse struct {
 	Success bool                `json:"success"`
+	Tenant  *models.Tenant      `json:"tenant"`
 	Users   []models.TenantUser `json:"users"`
 }
 
@@ -583,8 +407,8 @@ func GetUsersByTenant(c *fiber.Ctx) error {
 	// get tenantId from request
 	tid := c.Params("tid")
 
-	// get database connection
-	db := database.DB.DB
+	// get repository
+	repo := repository.New(database.DB.DB)
 
 	// check if user has admin access to this tenant or is a user of this tenant
 	var hasAccess = false
@@ -592,16 +416,12 @@ func GetUsersByTenant(c *fiber.Ctx) error {
 		hasAccess = true
 	} else {
 		// check if user is admin of any subscriptions for this tenant
-		subscriptions := []models.Subscription{}
-		query := db.Where("beneficiary_oid = ? OR purchaser_oid = ?", claims.Oid, claims.Oid).Find(&subscriptions)
-		if query.RowsAffected > 0 {
-			for _, subscription := range subscriptions {
-				if subscription.BeneficiaryTid == tid {
-					hasAccess = true
-					break
-				}
-			}
+		subscriptions, err := repo.ListAdminSubscriptionsForTenant(c.Context(), claims.Oid, tid)
+		if err != nil {
+			fmt.Println("db error getting admin subscriptions:", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "could not get subscriptions")
 		}
+		hasAccess = len(subscriptions) > 0
 	}
 
 	if !hasAccess {
@@ -609,16 +429,23 @@ func GetUsersByTenant(c *fiber.Ctx) error {
 	}
 
 	// get users
-	users := []models.TenantUser{}
-	query := db.Where("tid = ?", tid).Find(&users)
-	if query.Error != nil {
-		fmt.Println("db error getting users:", query.Error)
+	users, err := repo.ListUsersByTenant(c.Context(), tid)
+	if err != nil {
+		fmt.Println("db error getting users:", err)
 		return fiber.NewError(fiber.StatusInternalServerError, "could not get users")
 	}
 
+	// get tenant (may not exist yet if no user has signed in since it was added)
+	tenant, err := repo.GetTenant(c.Context(), tid)
+	if err != nil {
+		fmt.Println("error getting tenant:", tid, err)
+		tenant = nil
+	}
+
 	// create response
 	response := &GetUsersByTenantResponse{
 		Success: true,
+		Tenant:  tenant,
 		Users:   users,
 	}
 	return c.JSON(response)
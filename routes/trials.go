@@ -0,0 +1,497 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"peachone/database"
+	"peachone/models"
+	"peachone/repository"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const defaultTrialDays = 30
+
+// trials started before TrialStartedAt was recorded were all this long
+const legacyTrialLength = 30 * 24 * time.Hour
+
+// how long a trial lasts once the user starts it
+func trialLength() time.Duration {
+	TRIAL_DAYS := os.Getenv("TRIAL_DAYS")
+	days, err := strconv.Atoi(TRIAL_DAYS)
+	if err != nil || days < 1 {
+		days = defaultTrialDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// when the user's trial started, estimated for trials from before it was recorded
+func trialStartedAt(user *models.TenantUser) time.Time {
+	if !user.TrialStartedAt.IsZero() {
+		return user.TrialStartedAt
+	}
+	return user.TrialExpiresAt.Add(-legacyTrialLength)
+}
+
+// the tenant's trial, or nil if it has none
+func getTenantTrial(ctx context.Context, repo *repository.Repository, tid string) (*models.TenantTrial, error) {
+	trial, err := repo.GetTenantTrial(ctx, tid)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, nil
+	}
+	return trial, err
+}
+
+func tenantTrialActive(trial *models.TenantTrial, now time.Time) bool {
+	return trial != nil && now.Before(trial.ExpiresAt)
+}
+
+// The trials covering a user, as shown to clients: their own, and their
+// tenant's if one was started.
+type TrialState struct {
+	Active        bool                `json:"active"` // either trial is running
+	UserActivated bool                `json:"userActivated"`
+	UserExpiresAt time.Time           `json:"userExpiresAt"`
+	UserActive    bool                `json:"userActive"`
+	TenantTrial   *models.TenantTrial `json:"tenantTrial"`
+	TenantActive  bool                `json:"tenantActive"`
+}
+
+func trialState(user *models.TenantUser, tenantTrial *models.TenantTrial, now time.Time) TrialState {
+	return TrialState{
+		Active:        trialActive(user, tenantTrial, now),
+		UserActivated: user.TrialActivated,
+		UserExpiresAt: user.TrialExpiresAt,
+		UserActive:    trialActive(user, nil, now),
+		TenantTrial:   tenantTrial,
+		TenantActive:  tenantTrialActive(tenantTrial, now),
+	}
+}
+
+// Start the user's tenant trial, unless the tenant has one already; returns
+// the tenant's trial either way.
+func startTenantTrial(ctx context.Context, repo *repository.Repository, user *models.TenantUser, now time.Time) (*models.TenantTrial, error) {
+	_, err := repo.CreateTenantTrial(ctx, &models.TenantTrial{
+		Tid:            user.Tid,
+		StartedBy:      user.Oid,
+		StartedByEmail: user.Email,
+		StartedAt:      now,
+		ExpiresAt:      now.Add(trialLength()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repo.GetTenantTrial(ctx, user.Tid)
+}
+
+// the reminders emailed as a trial ends, in order, and how long before the end
+var trialReminders = []struct {
+	reminder models.TrialReminderEnum
+	before   time.Duration
+}{
+	{models.TrialReminderEnumSevenDays, 7 * 24 * time.Hour},
+	{models.TrialReminderEnumOneDay, 24 * time.Hour},
+	{models.TrialReminderEnumExpired, 0},
+}
+
+func trialReminderOrder(reminder models.TrialReminderEnum) int {
+	for i, r := range trialReminders {
+		if r.reminder == reminder {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// The reminder to email now: the latest one due, unless it (or a later one)
+// was sent already. Reminders skipped over, e.g. on a trial shorter than a
+// week, are not sent.
+func trialReminderDue(expiresAt time.Time, sent models.TrialReminderEnum, now time.Time) models.TrialReminderEnum {
+	due := models.TrialReminderEnumNone
+	for _, r := range trialReminders {
+		if !now.Before(expiresAt.Add(-r.before)) {
+			due = r.reminder
+		}
+	}
+	if trialReminderOrder(due) <= trialReminderOrder(sent) {
+		return models.TrialReminderEnumNone
+	}
+	return due
+}
+
+// the reminder email for a user's trial, or their tenant's trial if tenant is set
+func trialReminderEmail(reminder models.TrialReminderEnum, tenant bool, expiresAt time.Time, now time.Time) (string, []string) {
+	ends := expiresAt.UTC().Format("January 2, 2006 15:04 MST")
+	trial, who := "Your Teraphone trial", "you"
+	if tenant {
+		trial, who = "Your organization's Teraphone trial", "your organization's users"
+	}
+	upgrade := "To keep using your rooms, ask your organization's admin for a seat, or buy a subscription in Microsoft AppSource."
+	switch reminder {
+	case models.TrialReminderEnumExpired:
+		return trial + " has ended", []string{
+			fmt.Sprintf("%s ended on %s, so %s can no longer join rooms.", trial, ends, who),
+			upgrade,
+		}
+	case models.TrialReminderEnumOneDay:
+		return trial + " ends tomorrow", []string{
+			fmt.Sprintf("%s ends on %s.", trial, ends),
+			upgrade,
+		}
+	default:
+		days := int(expiresAt.Sub(now).Hours()/24 + 0.5)
+		return fmt.Sprintf("%s ends in %d days", trial, days), []string{
+			fmt.Sprintf("%s ends on %s.", trial, ends),
+			upgrade,
+		}
+	}
+}
+
+// Job: email users whose trial is about to end or just ended, and the users
+// who started a tenant trial. Users who got a seat in the meantime aren't
+// reminded; trials that ended over a week ago are left alone. Each reminder is
+// claimed before it is sent, so only one instance sends it.
+func SendTrialReminders(ctx context.Context) error {
+	repo := repository.New(database.DB.DB)
+
+	now := time.Now()
+	week := 7 * 24 * time.Hour
+	users, err := repo.ListTrialsEndingBetween(ctx, now.Add(-week), now.Add(week))
+	if err != nil {
+		return err
+	}
+
+	for i := range users {
+		user := &users[i]
+		reminder := trialReminderDue(user.TrialExpiresAt, user.TrialReminder, now)
+		if reminder == models.TrialReminderEnumNone {
+			continue
+		}
+		claimed, err := repo.AdvanceTrialReminder(ctx, user.Oid, user.TrialReminder, reminder)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue // sent by another instance
+		}
+		subject, paragraphs := trialReminderEmail(reminder, false, user.TrialExpiresAt, now)
+		_, _, err = SendNotificationEmail(ctx, &NotificationVars{
+			RecipientEmails: []string{user.Email},
+			Subject:         subject,
+			Paragraphs:      paragraphs,
+		})
+		if err != nil {
+			fmt.Println("error sending trial reminder:", user.Oid, err)
+			// put it back to retry next run
+			_, err = repo.AdvanceTrialReminder(ctx, user.Oid, reminder, user.TrialReminder)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	tenantTrials, err := repo.ListTenantTrialsEndingBetween(ctx, now.Add(-week), now.Add(week))
+	if err != nil {
+		return err
+	}
+
+	for i := range tenantTrials {
+		trial := &tenantTrials[i]
+		reminder := trialReminderDue(trial.ExpiresAt, trial.Reminder, now)
+		if reminder == models.TrialReminderEnumNone {
+			continue
+		}
+		claimed, err := repo.AdvanceTenantTrialReminder(ctx, trial.Tid, trial.Reminder, reminder)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue // sent by another instance
+		}
+		subject, paragraphs := trialReminderEmail(reminder, true, trial.ExpiresAt, now)
+		_, _, err = SendNotificationEmail(ctx, &NotificationVars{
+			RecipientEmails: []string{trial.StartedByEmail},
+			Subject:         subject,
+			Paragraphs:      paragraphs,
+		})
+		if err != nil {
+			fmt.Println("error sending tenant trial reminder:", trial.Tid, err)
+			// put it back to retry next run
+			_, err = repo.AdvanceTenantTrialReminder(ctx, trial.Tid, reminder, trial.Reminder)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// whether the user is Teraphone staff (STAFF_OIDS, comma separated)
+func isStaff(oid string) bool {
+	STAFF_OIDS := os.Getenv("STAFF_OIDS")
+	for _, staffOid := range strings.Split(STAFF_OIDS, ",") {
+		if oid != "" && strings.TrimSpace(staffOid) == oid {
+			return true
+		}
+	}
+	return false
+}
+
+// middleware for /v1/staff, after the JWT check
+func RequireStaff(c *fiber.Ctx) error {
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+	if !isStaff(claims.Oid) {
+		return fiber.NewError(fiber.StatusForbidden, "staff only")
+	}
+	return c.Next()
+}
+
+// --------------------------------------------------------------------------------
+// Extend Trial Request
+// --------------------------------------------------------------------------------
+type ExtendTrialRequest struct {
+	Days   int    `json:"days"`
+	Reason string `json:"reason"`
+}
+
+type ExtendTrialResponse struct {
+	Success   bool                  `json:"success"`
+	User      models.TenantUser     `json:"user"`
+	Extension models.TrialExtension `json:"extension"`
+}
+
+func ExtendTrial(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+
+	// parse request
+	req := &ExtendTrialRequest{}
+	if err := c.BodyParser(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if req.Days < 1 || req.Days > 365 {
+		return fiber.NewError(fiber.StatusBadRequest, "days must be between 1 and 365")
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "a reason is required")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get user
+	user, err := repo.GetUser(c.Context(), c.Params("oid"))
+	if errors.Is(err, repository.ErrNotFound) {
+		return fiber.NewError(fiber.StatusNotFound, "user not found")
+	}
+	if err != nil {
+		fmt.Println("db error getting user:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get user")
+	}
+	if !user.TrialActivated {
+		return fiber.NewError(fiber.StatusConflict, "user has not started a trial")
+	}
+
+	// extend from the end of the trial, or from now if it ended already
+	now := time.Now()
+	base := user.TrialExpiresAt
+	if base.Before(now) {
+		base = now
+	}
+	extension := &models.TrialExtension{
+		Oid:               user.Oid,
+		Days:              req.Days,
+		Reason:            req.Reason,
+		GrantedBy:         claims.Oid,
+		PreviousExpiresAt: user.TrialExpiresAt,
+		ExpiresAt:         base.Add(time.Duration(req.Days) * 24 * time.Hour),
+	}
+	user.TrialStartedAt = trialStartedAt(user)
+	user.TrialExpiresAt = extension.ExpiresAt
+	user.TrialReminder = models.TrialReminderEnumNone // remind again before the new end
+	err = repo.Transaction(c.Context(), func(tx *repository.Repository) error {
+		err := tx.UpdateUser(c.Context(), user.Oid, map[string]interface{}{
+			"trial_started_at": user.TrialStartedAt,
+			"trial_expires_at": user.TrialExpiresAt,
+			"trial_reminder":   user.TrialReminder,
+		})
+		if err != nil {
+			return err
+		}
+		return tx.CreateTrialExtension(c.Context(), extension)
+	})
+	if err != nil {
+		fmt.Println("db error extending trial:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not extend trial")
+	}
+
+	_, _, err = SendNotificationEmail(c.Context(), &NotificationVars{
+		RecipientEmails: []string{user.Email},
+		Subject:         "Your Teraphone trial was extended",
+		Paragraphs: []string{
+			fmt.Sprintf("Your Teraphone trial now ends on %s.", user.TrialExpiresAt.UTC().Format("January 2, 2006 15:04 MST")),
+		},
+	})
+	if err != nil {
+		fmt.Println("error notifying user of trial extension:", user.Oid, err)
+	}
+
+	// return response
+	response := &ExtendTrialResponse{
+		Success:   true,
+		User:      *user,
+		Extension: *extension,
+	}
+	return c.JSON(response)
+}
+
+// --------------------------------------------------------------------------------
+// Get Trial Conversions Request
+// --------------------------------------------------------------------------------
+
+// a trial user, and the subscriptions that followed their trial
+type TrialConversion struct {
+	Oid                  string    `json:"oid"`
+	Email                string    `json:"email"`
+	Tid                  string    `json:"tid"`
+	TrialStartedAt       time.Time `json:"trialStartedAt"`
+	TrialExpiresAt       time.Time `json:"trialExpiresAt"`
+	ExtendedDays         int       `json:"extendedDays"`
+	Converted            bool      `json:"converted"`          // assigned a seat after the trial started
+	SeatSubscriptionId   string    `json:"seatSubscriptionId"` // the subscription of their first seat since
+	SeatAssignedAt       time.Time `json:"seatAssignedAt"`
+	TenantSubscriptionId string    `json:"tenantSubscriptionId"` // the first subscription their tenant got since
+	TenantSubscribedAt   time.Time `json:"tenantSubscribedAt"`
+}
+
+type TrialConversionSummary struct {
+	Trials         int     `json:"trials"`
+	Converted      int     `json:"converted"`
+	ConversionRate float64 `json:"conversionRate"` // converted / trials
+}
+
+// link trials started since the given time to the seats and subscriptions that followed
+func trialConversions(users []models.TenantUser, since time.Time, extensions []models.TrialExtension, seats []models.SubscriptionLedgerEntry, subscriptions []models.Subscription) ([]TrialConversion, TrialConversionSummary) {
+	conversions := []TrialConversion{}
+	summary := TrialConversionSummary{}
+	for i := range users {
+		user := &users[i]
+		startedAt := trialStartedAt(user)
+		if startedAt.Before(since) {
+			continue
+		}
+		conversion := TrialConversion{
+			Oid:            user.Oid,
+			Email:          user.Email,
+			Tid:            user.Tid,
+			TrialStartedAt: startedAt,
+			TrialExpiresAt: user.TrialExpiresAt,
+		}
+		for _, extension := range extensions {
+			if extension.Oid == user.Oid {
+				conversion.ExtendedDays += extension.Days
+			}
+		}
+		for _, seat := range seats {
+			if seat.UserOid == user.Oid && !seat.CreatedAt.Before(startedAt) {
+				conversion.Converted = true
+				conversion.SeatSubscriptionId = seat.SubscriptionId
+				conversion.SeatAssignedAt = seat.CreatedAt
+				break
+			}
+		}
+		for _, subscription := range subscriptions {
+			if subscription.BeneficiaryTid == user.Tid && !subscription.Created.Before(startedAt) {
+				conversion.TenantSubscriptionId = subscription.Id
+				conversion.TenantSubscribedAt = subscription.Created
+				break
+			}
+		}
+
+		conversions = append(conversions, conversion)
+		summary.Trials++
+		if conversion.Converted {
+			summary.Converted++
+		}
+	}
+	if summary.Trials > 0 {
+		summary.ConversionRate = float64(summary.Converted) / float64(summary.Trials)
+	}
+	return conversions, summary
+}
+
+type GetTrialConversionsResponse struct {
+	Success     bool                   `json:"success"`
+	Since       time.Time              `json:"since"`
+	Summary     TrialConversionSummary `json:"summary"`
+	Conversions []TrialConversion      `json:"conversions"`
+}
+
+func GetTrialConversions(c *fiber.Ctx) error {
+	// trials started since (default: the last 90 days)
+	since := time.Now().AddDate(0, 0, -90)
+	if c.Query("since") != "" {
+		var err error
+		since, err = time.Parse("2006-01-02", c.Query("since"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid since, expected YYYY-MM-DD")
+		}
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get trial users, and what followed
+	users, err := repo.ListTrialUsersSince(c.Context(), since)
+	if err != nil {
+		fmt.Println("db error getting trial users:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get trials")
+	}
+	oids := []string{}
+	tids := []string{}
+	seenTids := make(map[string]bool)
+	for _, user := range users {
+		oids = append(oids, user.Oid)
+		if !seenTids[user.Tid] {
+			seenTids[user.Tid] = true
+			tids = append(tids, user.Tid)
+		}
+	}
+	extensions, err := repo.ListTrialExtensions(c.Context(), oids)
+	if err != nil {
+		fmt.Println("db error getting trial extensions:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get trials")
+	}
+	seats, err := repo.ListSeatAssignments(c.Context(), oids)
+	if err != nil {
+		fmt.Println("db error getting seat assignments:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get trials")
+	}
+	subscriptions, err := repo.ListSubscriptionsForTenants(c.Context(), tids)
+	if err != nil {
+		fmt.Println("db error getting subscriptions:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get trials")
+	}
+	conversions, summary := trialConversions(users, since, extensions, seats, subscriptions)
+
+	// return response
+	response := &GetTrialConversionsResponse{
+		Success:     true,
+		Since:       since,
+		Summary:     summary,
+		Conversions: conversions,
+	}
+	return c.JSON(response)
+}
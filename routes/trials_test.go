@@ -0,0 +1,124 @@
+package routes
+
+import (
+	"peachone/models"
+	"testing"
+	"time"
+)
+
+func TestTrialLength(t *testing.T) {
+	t.Setenv("TRIAL_DAYS", "")
+	if got := trialLength(); got != 30*24*time.Hour {
+		t.Errorf("default trial length = %v", got)
+	}
+	t.Setenv("TRIAL_DAYS", "14")
+	if got := trialLength(); got != 14*24*time.Hour {
+		t.Errorf("trial length = %v, want 14 days", got)
+	}
+	t.Setenv("TRIAL_DAYS", "0")
+	if got := trialLength(); got != 30*24*time.Hour {
+		t.Errorf("invalid TRIAL_DAYS: trial length = %v, want the default", got)
+	}
+}
+
+func TestTrialReminderDue(t *testing.T) {
+	expiresAt := time.Date(2026, 5, 20, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	cases := []struct {
+		now  time.Time
+		sent models.TrialReminderEnum
+		want models.TrialReminderEnum
+	}{
+		{expiresAt.Add(-8 * day), models.TrialReminderEnumNone, models.TrialReminderEnumNone},
+		{expiresAt.Add(-7 * day), models.TrialReminderEnumNone, models.TrialReminderEnumSevenDays},
+		{expiresAt.Add(-3 * day), models.TrialReminderEnumSevenDays, models.TrialReminderEnumNone},
+		{expiresAt.Add(-day + time.Minute), models.TrialReminderEnumSevenDays, models.TrialReminderEnumOneDay},
+		{expiresAt.Add(-time.Hour), models.TrialReminderEnumNone, models.TrialReminderEnumOneDay}, // short trial: only the latest
+		{expiresAt, models.TrialReminderEnumOneDay, models.TrialReminderEnumExpired},
+		{expiresAt.Add(2 * day), models.TrialReminderEnumExpired, models.TrialReminderEnumNone},
+	}
+	for _, c := range cases {
+		if got := trialReminderDue(expiresAt, c.sent, c.now); got != c.want {
+			t.Errorf("trialReminderDue at %v after %q: got %q, want %q", c.now, c.sent, got, c.want)
+		}
+	}
+}
+
+func TestTrialReminderEmail(t *testing.T) {
+	expiresAt := time.Date(2026, 5, 20, 12, 0, 0, 0, time.UTC)
+	subject, _ := trialReminderEmail(models.TrialReminderEnumSevenDays, false, expiresAt, expiresAt.Add(-7*24*time.Hour+time.Minute))
+	if subject != "Your Teraphone trial ends in 7 days" {
+		t.Errorf("subject = %q", subject)
+	}
+	subject, _ = trialReminderEmail(models.TrialReminderEnumExpired, false, expiresAt, expiresAt)
+	if subject != "Your Teraphone trial has ended" {
+		t.Errorf("subject = %q", subject)
+	}
+	subject, _ = trialReminderEmail(models.TrialReminderEnumOneDay, true, expiresAt, expiresAt.Add(-time.Hour))
+	if subject != "Your organization's Teraphone trial ends tomorrow" {
+		t.Errorf("subject = %q", subject)
+	}
+}
+
+func TestTrialState(t *testing.T) {
+	now := time.Date(2026, 5, 20, 12, 0, 0, 0, time.UTC)
+	expired := &models.TenantUser{TrialActivated: true, TrialExpiresAt: now.Add(-time.Hour)}
+	if got := trialState(expired, nil, now); got.Active || got.UserActive || !got.UserActivated || got.TenantTrial != nil {
+		t.Errorf("expired user trial = %+v", got)
+	}
+	tenantTrial := &models.TenantTrial{Tid: "tid", ExpiresAt: now.Add(time.Hour)}
+	if got := trialState(expired, tenantTrial, now); !got.Active || got.UserActive || !got.TenantActive {
+		t.Errorf("tenant trial = %+v", got)
+	}
+	tenantTrial.ExpiresAt = now
+	if got := trialState(&models.TenantUser{}, tenantTrial, now); got.Active || got.TenantActive || got.TenantTrial == nil {
+		t.Errorf("expired tenant trial = %+v", got)
+	}
+}
+
+func TestIsStaff(t *testing.T) {
+	t.Setenv("STAFF_OIDS", "alice, bob")
+	if !isStaff("alice") || !isStaff("bob") {
+		t.Error("staff not recognized")
+	}
+	if isStaff("carol") || isStaff("") {
+		t.Error("non-staff recognized")
+	}
+	t.Setenv("STAFF_OIDS", "")
+	if isStaff("") {
+		t.Error("empty oid is staff with no STAFF_OIDS")
+	}
+}
+
+func TestTrialConversions(t *testing.T) {
+	since := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	started := since.Add(24 * time.Hour)
+	users := []models.TenantUser{
+		{Oid: "converted", Tid: "acme", TrialActivated: true, TrialStartedAt: started, TrialExpiresAt: started.Add(30 * 24 * time.Hour)},
+		{Oid: "lapsed", Tid: "globex", TrialActivated: true, TrialStartedAt: started, TrialExpiresAt: started.Add(30 * 24 * time.Hour)},
+		{Oid: "legacy", Tid: "acme", TrialActivated: true, TrialExpiresAt: started.Add(30 * 24 * time.Hour)}, // started before it was recorded
+		{Oid: "earlier", Tid: "acme", TrialActivated: true, TrialStartedAt: since.Add(-time.Hour), TrialExpiresAt: since.Add(29 * 24 * time.Hour)},
+	}
+	extensions := []models.TrialExtension{{Oid: "lapsed", Days: 7}, {Oid: "lapsed", Days: 3}}
+	seats := []models.SubscriptionLedgerEntry{
+		{SubscriptionId: "old", UserOid: "converted", CreatedAt: started.Add(-time.Hour)}, // before the trial
+		{SubscriptionId: "sub", UserOid: "converted", CreatedAt: started.Add(10 * 24 * time.Hour)},
+	}
+	subscriptions := []models.Subscription{{Id: "sub", BeneficiaryTid: "acme", Created: started.Add(9 * 24 * time.Hour)}}
+
+	conversions, summary := trialConversions(users, since, extensions, seats, subscriptions)
+	if summary.Trials != 3 || summary.Converted != 1 || summary.ConversionRate != 1.0/3 {
+		t.Fatalf("summary = %+v", summary)
+	}
+	converted := conversions[0]
+	if !converted.Converted || converted.SeatSubscriptionId != "sub" || converted.TenantSubscriptionId != "sub" {
+		t.Errorf("converted = %+v", converted)
+	}
+	lapsed := conversions[1]
+	if lapsed.Converted || lapsed.ExtendedDays != 10 || lapsed.TenantSubscriptionId != "" {
+		t.Errorf("lapsed = %+v", lapsed)
+	}
+	if legacy := conversions[2]; !legacy.TrialStartedAt.Equal(started) || legacy.TenantSubscriptionId != "sub" {
+		t.Errorf("legacy = %+v", legacy)
+	}
+}
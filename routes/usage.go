@@ -0,0 +1,302 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"peachone/database"
+	"peachone/models"
+	"peachone/repository"
+	"peachone/saasapi"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// metering dimension for the minutes subscribed users spend in rooms; must
+// match the dimension id of the plans in Partner Center
+const participantMinutesDimension = "participant_minutes"
+
+// an hour is aggregated once it is this far in the past, so leave events
+// that arrive a little late are counted
+const usageReportDelay = 10 * time.Minute
+
+// how far back hours are aggregated; the Marketplace rejects usage more than
+// 24 hours old, so this leaves a few hours to retry failed reports
+const usageAggregationWindow = 20 * time.Hour
+const usageEventMaxAge = 24 * time.Hour
+
+// batches of usage events submitted per job run
+const usageReportBatches = 10
+
+// --------------------------------------------------------------------------------
+// Usage reporting job
+// --------------------------------------------------------------------------------
+
+// Job: aggregate the participant-minutes of each subscription into hourly
+// usage reports, then submit the pending ones to the Marketplace metering API.
+// Each subscription, dimension and hour has one report row, so usage is never
+// reported twice; a resubmission after a crash comes back as Duplicate.
+func ReportUsage(ctx context.Context) error {
+	repo := repository.New(database.DB.DB)
+
+	err := aggregateUsage(ctx, repo, time.Now())
+	if err != nil {
+		return fmt.Errorf("could not aggregate usage: %w", err)
+	}
+
+	// create metering api client
+	client, err := saasapi.NewDefaultMeteringClient()
+	if err != nil {
+		return fmt.Errorf("could not create metering api client: %w", err)
+	}
+
+	for i := 0; i < usageReportBatches; i++ {
+		submitted := 0
+		err := repo.Transaction(ctx, func(tx *repository.Repository) error {
+			reports, err := tx.LockPendingUsageReports(ctx, saasapi.MaxBatchUsageEvents)
+			if err != nil {
+				return err
+			}
+			submitted = len(reports)
+			if submitted == 0 {
+				return nil
+			}
+
+			submitUsageReports(ctx, client, reports, time.Now())
+			for i := range reports {
+				err = tx.SaveUsageReport(ctx, &reports[i])
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if submitted < saasapi.MaxBatchUsageEvents {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// record a report for every subscription with usage in each complete hour of
+// the window; hours already recorded are skipped
+func aggregateUsage(ctx context.Context, repo *repository.Repository, now time.Time) error {
+	subscriptions := make(map[string]*models.Subscription)
+	last := now.Add(-usageReportDelay).UTC().Truncate(time.Hour)
+
+	for start := last.Add(-usageAggregationWindow); start.Before(last); start = start.Add(time.Hour) {
+		end := start.Add(time.Hour)
+		sessions, err := repo.ListSubscriptionParticipantSessions(ctx, start, end)
+		if err != nil {
+			return err
+		}
+
+		reports := []models.UsageReport{}
+		for subscriptionId, quantity := range participantMinutes(sessions, start, end, now) {
+			subscription, ok := subscriptions[subscriptionId]
+			if !ok {
+				subscription, err = repo.GetSubscription(ctx, subscriptionId)
+				if errors.Is(err, repository.ErrNotFound) {
+					log.Println("Skipping usage of unknown subscription:", subscriptionId)
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				subscriptions[subscriptionId] = subscription
+			}
+			reports = append(reports, models.UsageReport{
+				SubscriptionId:     subscriptionId,
+				Dimension:          participantMinutesDimension,
+				EffectiveStartTime: start,
+				PlanId:             subscription.PlanId,
+				Quantity:           quantity,
+				Status:             models.UsageReportStatusEnumPending,
+			})
+		}
+		sort.Slice(reports, func(i, j int) bool { return reports[i].SubscriptionId < reports[j].SubscriptionId })
+
+		created, err := repo.CreateUsageReports(ctx, reports)
+		if err != nil {
+			return err
+		}
+		if created > 0 {
+			log.Printf("Recorded usage for %d subscriptions for the hour starting %s", created, start.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
+
+// minutes each subscription's users spent in rooms during [start, end),
+// rounded to 1/100 minute; sessions still open count until now
+func participantMinutes(sessions []models.ParticipantSession, start time.Time, end time.Time, now time.Time) map[string]float64 {
+	minutes := make(map[string]float64)
+	for _, session := range sessions {
+		from := session.JoinedAt
+		if from.Before(start) {
+			from = start
+		}
+		to := session.LeftAt
+		if to.IsZero() {
+			to = now
+		}
+		if to.After(end) {
+			to = end
+		}
+		if to.After(from) {
+			minutes[session.SubscriptionId] += to.Sub(from).Minutes()
+		}
+	}
+	for subscriptionId, quantity := range minutes {
+		quantity = math.Round(quantity*100) / 100
+		if quantity <= 0 {
+			delete(minutes, subscriptionId)
+			continue
+		}
+		minutes[subscriptionId] = quantity
+	}
+	return minutes
+}
+
+// submit a batch of reports and record the results on them
+func submitUsageReports(ctx context.Context, client *saasapi.MeteringClient, reports []models.UsageReport, now time.Time) {
+	events := []saasapi.UsageEvent{}
+	for i := range reports {
+		report := &reports[i]
+		if now.Sub(report.EffectiveStartTime) > usageEventMaxAge {
+			recordUsageReportResult(report, saasapi.UsageEventResult{
+				Status: saasapi.UsageEventStatusEnumExpired,
+				Error:  &saasapi.UsageEventError{Message: "not reported within 24 hours"},
+			}, now)
+			continue
+		}
+		events = append(events, usageEvent(report))
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	response, err := client.BatchUsageEvent(ctx, events)
+	if err != nil {
+		fmt.Println("error reporting usage:", err)
+		for i := range reports {
+			if reports[i].Status == models.UsageReportStatusEnumPending {
+				reports[i].Attempts++
+				reports[i].LastError = err.Error()
+			}
+		}
+		return
+	}
+
+	results := make(map[string]saasapi.UsageEventResult)
+	for _, result := range response.Result {
+		results[usageEventKey(result.ResourceID, result.Dimension, result.EffectiveStartTime)] = result
+	}
+	for i := range reports {
+		report := &reports[i]
+		if report.Status != models.UsageReportStatusEnumPending {
+			continue
+		}
+		result, ok := results[usageEventKey(report.SubscriptionId, report.Dimension, report.EffectiveStartTime)]
+		if !ok {
+			report.Attempts++
+			report.LastError = "no result for usage event"
+			continue
+		}
+		recordUsageReportResult(report, result, now)
+	}
+}
+
+// update a report with the Marketplace's result; Duplicate means it was
+// already accepted
+func recordUsageReportResult(report *models.UsageReport, result saasapi.UsageEventResult, now time.Time) {
+	report.Attempts++
+	report.MarketplaceStatus = string(result.Status)
+	report.ReportedAt = now
+
+	switch result.Status {
+	case saasapi.UsageEventStatusEnumAccepted, saasapi.UsageEventStatusEnumDuplicate:
+		report.Status = models.UsageReportStatusEnumAccepted
+		report.LastError = ""
+		if result.UsageEventID != "" {
+			report.UsageEventId = result.UsageEventID
+		}
+	default:
+		report.Status = models.UsageReportStatusEnumRejected
+		report.LastError = string(result.Status)
+		if result.Error != nil && result.Error.Message != "" {
+			report.LastError = result.Error.Message
+		}
+		fmt.Println("usage report rejected:", report.SubscriptionId, report.Dimension, report.EffectiveStartTime, report.LastError)
+	}
+}
+
+func usageEvent(report *models.UsageReport) saasapi.UsageEvent {
+	return saasapi.UsageEvent{
+		ResourceID:         report.SubscriptionId,
+		Quantity:           report.Quantity,
+		Dimension:          report.Dimension,
+		EffectiveStartTime: report.EffectiveStartTime.UTC(),
+		PlanID:             report.PlanId,
+	}
+}
+
+func usageEventKey(resourceId string, dimension string, effectiveStartTime time.Time) string {
+	return resourceId + "/" + dimension + "/" + strconv.FormatInt(effectiveStartTime.Unix(), 10)
+}
+
+// --------------------------------------------------------------------------------
+// Get Subscription Usage
+// --------------------------------------------------------------------------------
+type GetSubscriptionUsageResponse struct {
+	Success bool                 `json:"success"`
+	Reports []models.UsageReport `json:"reports"`
+}
+
+// the usage reported for a subscription over the last ?days= (default 7, max 90)
+func GetSubscriptionUsage(c *fiber.Ctx) error {
+	// check JWT
+	claims, err := getClaimsFromJWT(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "expired jwt")
+	}
+	days := c.Query("days", "7")
+	numDays, err := strconv.Atoi(days)
+	if err != nil || numDays < 1 || numDays > 90 {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid days")
+	}
+
+	// get repository
+	repo := repository.New(database.DB.DB)
+
+	// get subscription
+	subscription, err := getAdminSubscription(c.Context(), repo, claims.Oid, c.Params("subscriptionId"))
+	if err != nil {
+		return err
+	}
+
+	// get reports
+	since := time.Now().AddDate(0, 0, -numDays)
+	reports, err := repo.ListUsageReports(c.Context(), subscription.Id, since)
+	if err != nil {
+		fmt.Println("db error getting usage reports:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "could not get usage")
+	}
+
+	// return response
+	response := &GetSubscriptionUsageResponse{
+		Success: true,
+		Reports: reports,
+	}
+	return c.JSON(response)
+}
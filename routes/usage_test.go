@@ -0,0 +1,66 @@
+package routes
+
+import (
+	"peachone/models"
+	"peachone/saasapi"
+	"testing"
+	"time"
+)
+
+func TestParticipantMinutes(t *testing.T) {
+	start := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	now := end.Add(30 * time.Minute)
+	sessions := []models.ParticipantSession{
+		// inside the hour
+		{SubscriptionId: "a", JoinedAt: start.Add(10 * time.Minute), LeftAt: start.Add(20 * time.Minute)},
+		// joined the hour before
+		{SubscriptionId: "a", JoinedAt: start.Add(-time.Hour), LeftAt: start.Add(5*time.Minute + 30*time.Second)},
+		// still open: counts until the end of the hour
+		{SubscriptionId: "b", JoinedAt: start.Add(45 * time.Minute)},
+		// left before the hour
+		{SubscriptionId: "c", JoinedAt: start.Add(-time.Hour), LeftAt: start},
+	}
+
+	minutes := participantMinutes(sessions, start, end, now)
+	want := map[string]float64{"a": 15.5, "b": 15}
+	if len(minutes) != len(want) {
+		t.Fatalf("minutes = %v, want %v", minutes, want)
+	}
+	for subscriptionId, quantity := range want {
+		if minutes[subscriptionId] != quantity {
+			t.Errorf("minutes[%s] = %v, want %v", subscriptionId, minutes[subscriptionId], quantity)
+		}
+	}
+
+	// an open session in the current hour counts until now
+	minutes = participantMinutes(sessions[2:3], start, end, start.Add(50*time.Minute))
+	if minutes["b"] != 5 {
+		t.Errorf("open session = %v minutes, want 5", minutes["b"])
+	}
+}
+
+func TestRecordUsageReportResult(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		result saasapi.UsageEventResult
+		status models.UsageReportStatusEnum
+	}{
+		{saasapi.UsageEventResult{Status: saasapi.UsageEventStatusEnumAccepted, UsageEventID: "event"}, models.UsageReportStatusEnumAccepted},
+		{saasapi.UsageEventResult{Status: saasapi.UsageEventStatusEnumDuplicate, UsageEventID: "event"}, models.UsageReportStatusEnumAccepted},
+		{saasapi.UsageEventResult{Status: saasapi.UsageEventStatusEnumInvalidDimension, Error: &saasapi.UsageEventError{Message: "no such dimension"}}, models.UsageReportStatusEnumRejected},
+	}
+	for _, test := range tests {
+		report := models.UsageReport{Status: models.UsageReportStatusEnumPending, LastError: "timeout"}
+		recordUsageReportResult(&report, test.result, now)
+		if report.Status != test.status || report.Attempts != 1 || !report.ReportedAt.Equal(now) {
+			t.Errorf("%s: status %s, attempts %d, reported at %s", test.result.Status, report.Status, report.Attempts, report.ReportedAt)
+		}
+		if test.status == models.UsageReportStatusEnumAccepted && (report.UsageEventId != "event" || report.LastError != "") {
+			t.Errorf("%s: usage event id %q, last error %q", test.result.Status, report.UsageEventId, report.LastError)
+		}
+		if test.status == models.UsageReportStatusEnumRejected && report.LastError != "no such dimension" {
+			t.Errorf("%s: last error %q", test.result.Status, report.LastError)
+		}
+	}
+}
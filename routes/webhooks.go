@@ -6,6 +6,10 @@ import (
 	"encoding/base64"
 	"log"
 	"os"
+	"peachone/database"
+	"peachone/models"
+	"peachone/repository"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/livekit/protocol/auth"
@@ -107,16 +111,150 @@ func handleRoomStarted(ctx context.Context, event *livekit.WebhookEvent) {
 func handleRoomFinished(ctx context.Context, event *livekit.WebhookEvent) {
 	log.Println("Handling event:", event.Event)
 	log.Println("Room name:", event.Room.Name)
+
+	// close sessions whose leave event never arrived
+	repo := repository.New(database.DB.DB)
+	_, err := repo.EndRoomParticipantSessions(ctx, event.Room.Name, webhookEventTime(event))
+	if err != nil {
+		log.Println("Error ending participant sessions for room:", event.Room.Name, err)
+	}
 }
 
 func handleParticipantJoined(ctx context.Context, event *livekit.WebhookEvent) {
 	log.Println("Handling event:", event.Event)
 	log.Println("Room name:", event.Room.Name)
 	log.Println("Participant identity:", event.Participant.Identity)
+
+	// join tokens are long-lived, so remove participants who lost access since
+	// their token was issued (suspended past grace, unsubscribed, trial expired)
+	repo := repository.New(database.DB.DB)
+	hasAccess, err := getUserRoomAccess(ctx, repo, event.Participant.Identity)
+	if err != nil {
+		log.Println("Error checking room access for participant:", event.Participant.Identity, err)
+		return
+	}
+	if !hasAccess {
+		log.Println("Removing participant without access:", event.Participant.Identity)
+		removeParticipant(ctx, event)
+		return
+	}
+
+	// rooms hold as many participants as the joining user's plan allows
+	features, err := getUserEntitlements(ctx, repo, event.Participant.Identity)
+	if err != nil {
+		log.Println("Error getting entitlements for participant:", event.Participant.Identity, err)
+	} else if int(event.Room.NumParticipants) > features.MaxRoomCapacity {
+		log.Println("Removing participant over their plan's room capacity:", event.Participant.Identity, features.MaxRoomCapacity)
+		removeParticipant(ctx, event)
+		return
+	}
+
+	// used to pick who loses a seat when a subscription is over-allocated
+	err = repo.UpdateUser(ctx, event.Participant.Identity, map[string]interface{}{"last_active_at": time.Now()})
+	if err != nil {
+		log.Println("Error updating last active time for participant:", event.Participant.Identity, err)
+	}
+	recordParticipantSession(ctx, repo, event)
+}
+
+func removeParticipant(ctx context.Context, event *livekit.WebhookEvent) {
+	_, err := CreateRoomServiceClient().RemoveParticipant(ctx, &livekit.RoomParticipantIdentity{
+		Room:     event.Room.Name,
+		Identity: event.Participant.Identity,
+	})
+	if err != nil {
+		log.Println("Error removing participant:", event.Participant.Identity, err)
+	}
 }
 
 func handleParticipantLeft(ctx context.Context, event *livekit.WebhookEvent) {
 	log.Println("Handling event:", event.Event)
 	log.Println("Room name:", event.Room.Name)
 	log.Println("Participant identity:", event.Participant.Identity)
+
+	repo := repository.New(database.DB.DB)
+	err := repo.EndParticipantSession(ctx, event.Participant.Sid, webhookEventTime(event))
+	if err != nil {
+		log.Println("Error ending participant session:", event.Participant.Sid, err)
+	}
+}
+
+// record the session of a subscribed participant, to be metered as participant-minutes
+func recordParticipantSession(ctx context.Context, repo *repository.Repository, event *livekit.WebhookEvent) {
+	user, err := repo.GetUser(ctx, event.Participant.Identity)
+	if err != nil {
+		log.Println("Error getting user for participant session:", event.Participant.Identity, err)
+		return
+	}
+	if user.SubscriptionId == "" {
+		return
+	}
+
+	err = repo.CreateParticipantSession(ctx, &models.ParticipantSession{
+		Sid:            event.Participant.Sid,
+		Oid:            user.Oid,
+		SubscriptionId: user.SubscriptionId,
+		RoomName:       event.Room.Name,
+		JoinedAt:       webhookEventTime(event),
+	})
+	if err != nil {
+		log.Println("Error recording participant session:", event.Participant.Sid, err)
+	}
+}
+
+// when LiveKit sent the event; webhooks can be retried, so this is more
+// accurate than the time it was received
+func webhookEventTime(event *livekit.WebhookEvent) time.Time {
+	if event.CreatedAt > 0 {
+		return time.Unix(event.CreatedAt, 0)
+	}
+	return time.Now()
+}
+
+// --------------------------------------------------------------------------------
+// Microsoft Graph presence change notification handler
+// --------------------------------------------------------------------------------
+type GraphChangeNotification struct {
+	SubscriptionId string `json:"subscriptionId"`
+	ClientState    string `json:"clientState"`
+	ChangeType     string `json:"changeType"`
+	Resource       string `json:"resource"`
+	TenantId       string `json:"tenantId"`
+}
+
+type GraphChangeNotifications struct {
+	Value []GraphChangeNotification `json:"value"`
+}
+
+func PresenceWebhook(c *fiber.Ctx) error {
+	// respond to the subscription validation handshake
+	validationToken := c.Query("validationToken")
+	if validationToken != "" {
+		c.Set(fiber.HeaderContentType, fiber.MIMETextPlain)
+		return c.SendString(validationToken)
+	}
+
+	// get request body
+	req := &GraphChangeNotifications{}
+	if err := c.BodyParser(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+
+	GRAPH_CLIENT_STATE := os.Getenv("GRAPH_CLIENT_STATE")
+	subscriptionIds := []string{}
+	for _, notification := range req.Value {
+		// only trust notifications carrying our secret
+		if GRAPH_CLIENT_STATE == "" || notification.ClientState != GRAPH_CLIENT_STATE {
+			log.Println("Ignoring notification with invalid client state for subscription:", notification.SubscriptionId)
+			continue
+		}
+		subscriptionIds = append(subscriptionIds, notification.SubscriptionId)
+	}
+
+	// acknowledge now; fetching the presences takes longer than Graph waits
+	if len(subscriptionIds) > 0 {
+		go refreshNotifiedPresences(subscriptionIds)
+	}
+
+	return c.SendStatus(fiber.StatusAccepted)
 }
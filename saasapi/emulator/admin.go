@@ -0,0 +1,162 @@
+package emulator
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"peachone/saasapi"
+	"strings"
+	"time"
+)
+
+// --------------------------------------------------------------------------------
+// Scripting API, for driving the emulator from outside Go (e.g. with curl while
+// developing against cmd/marketplace-emulator)
+//
+//	POST /emulator/subscriptions                  add a subscription (body: Subscription); returns its purchase token
+//	GET  /emulator/subscriptions/:id              get a subscription
+//	POST /emulator/subscriptions/:id/operations   start an operation (body: StartOperationRequest); sends the webhook if webhookUrl is set
+//	POST /emulator/operations/:id/complete        complete a held operation (body: {"status": "Succeeded"})
+//	PUT  /emulator/plans                          set the available plans (body: [Plan])
+//	POST /emulator/failures                       fail the next requests (body: FailNextRequest)
+//	PATCH /emulator/settings                      hold operations, term delay, page size (body: SettingsRequest)
+//	GET  /emulator/requests                       the requests received so far
+// --------------------------------------------------------------------------------
+
+type AddSubscriptionResponse struct {
+	SubscriptionId string `json:"subscriptionId"`
+	Token          string `json:"token"`
+}
+
+type StartOperationRequest struct {
+	Action     saasapi.OperationActionEnum `json:"action"`
+	PlanId     string                      `json:"planId"`
+	Quantity   int32                       `json:"quantity"`
+	WebhookUrl string                      `json:"webhookUrl"`
+}
+
+type StartOperationResponse struct {
+	Operation     saasapi.Operation `json:"operation"`
+	WebhookStatus int               `json:"webhookStatus,omitempty"`
+	WebhookError  string            `json:"webhookError,omitempty"`
+}
+
+type CompleteOperationRequest struct {
+	Status saasapi.OperationStatusEnum `json:"status"`
+}
+
+type FailNextRequest struct {
+	Match  string `json:"match"`
+	Count  int    `json:"count"`
+	Status int    `json:"status"`
+}
+
+type SettingsRequest struct {
+	HoldOperations   *bool `json:"holdOperations"`
+	TermDelaySeconds *int  `json:"termDelaySeconds"`
+	PageSize         *int  `json:"pageSize"`
+}
+
+func (e *Emulator) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/emulator/"), "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "subscriptions" && r.Method == http.MethodPost:
+		subscription := saasapi.Subscription{}
+		if !readJSON(w, r, &subscription) {
+			return
+		}
+		id, token := e.AddSubscription(subscription)
+		writeJSON(w, http.StatusCreated, AddSubscriptionResponse{SubscriptionId: id, Token: token})
+
+	case len(parts) == 2 && parts[0] == "subscriptions" && r.Method == http.MethodGet:
+		subscription, err := e.Subscription(parts[1])
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, subscription)
+
+	case len(parts) == 3 && parts[0] == "subscriptions" && parts[2] == "operations" && r.Method == http.MethodPost:
+		req := StartOperationRequest{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		op, err := e.StartOperation(parts[1], req.Action, req.PlanId, req.Quantity)
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		response := StartOperationResponse{Operation: op}
+		if req.WebhookUrl != "" {
+			response.WebhookStatus, err = e.SendWebhook(r.Context(), req.WebhookUrl, *op.ID)
+			if err != nil {
+				response.WebhookError = err.Error()
+			}
+		}
+		writeJSON(w, http.StatusCreated, response)
+
+	case len(parts) == 3 && parts[0] == "operations" && parts[2] == "complete" && r.Method == http.MethodPost:
+		req := CompleteOperationRequest{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		err := e.CompleteOperation(parts[1], req.Status)
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		op, _ := e.Operation(parts[1])
+		writeJSON(w, http.StatusOK, op)
+
+	case len(parts) == 1 && parts[0] == "plans" && r.Method == http.MethodPut:
+		plans := []*saasapi.Plan{}
+		if !readJSON(w, r, &plans) {
+			return
+		}
+		e.SetPlans(plans...)
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 1 && parts[0] == "failures" && r.Method == http.MethodPost:
+		req := FailNextRequest{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		e.FailNext(req.Match, req.Count, req.Status)
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 1 && parts[0] == "settings" && r.Method == http.MethodPatch:
+		req := SettingsRequest{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.HoldOperations != nil {
+			e.HoldOperations(*req.HoldOperations)
+		}
+		if req.TermDelaySeconds != nil {
+			e.SetTermDelay(time.Duration(*req.TermDelaySeconds) * time.Second)
+		}
+		if req.PageSize != nil && *req.PageSize > 0 {
+			e.SetPageSize(*req.PageSize)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 1 && parts[0] == "requests" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, e.Requests())
+
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, out interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(out); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,411 @@
+// Package emulator is a local stand-in for the Marketplace SaaS fulfillment
+// API, for tests and development. Point the saasapi clients at it with
+// MARKETPLACE_API_URL and MARKETPLACE_EMULATOR=true (or a client made with its
+// URL and saasapi.NewEmulatorPipeline), then script its
+// state: add subscriptions and plans, start operations the way a customer
+// would in the Azure portal, hold or fail requests, and send the webhook
+// calls the Marketplace would make.
+package emulator
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"peachone/saasapi"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// how long the emulator takes to set the term dates after activation, unless
+// changed with SetTermDelay (the real API takes a few seconds)
+const defaultTermDelay = 0
+
+// subscriptions per page of ListSubscriptions, unless changed with SetPageSize
+const defaultPageSize = 10
+
+type Emulator struct {
+	TenantId  string // publisher tenant, for webhook tokens
+	Audience  string // publisher app id, for webhook tokens
+	Now       func() time.Time
+	mu        sync.Mutex
+	subs      map[string]*subscriptionState
+	subIds    []string // in the order added, for paging
+	tokens    map[string]string
+	plans     []*saasapi.Plan
+	ops       map[string]*saasapi.Operation
+	opIds     []string // in the order started
+	hold      bool
+	termDelay time.Duration
+	pageSize  int
+	failures  []*failure
+	requests  []string
+	usage     map[usageKey]*saasapi.UsageEventResult
+	usageKeys []usageKey // in the order accepted
+	key       *rsa.PrivateKey
+	keyId     string
+}
+
+type subscriptionState struct {
+	subscription saasapi.Subscription
+	activatedAt  time.Time
+	termPending  bool // activated, term dates not set yet
+}
+
+type failure struct {
+	match  string // substring of "METHOD /path"
+	status int
+	count  int
+}
+
+func New() *Emulator {
+	return &Emulator{
+		TenantId:  saasapi.TenantId,
+		Audience:  saasapi.AppId,
+		Now:       time.Now,
+		subs:      make(map[string]*subscriptionState),
+		tokens:    make(map[string]string),
+		ops:       make(map[string]*saasapi.Operation),
+		usage:     make(map[usageKey]*saasapi.UsageEventResult),
+		termDelay: defaultTermDelay,
+		pageSize:  defaultPageSize,
+	}
+}
+
+// --------------------------------------------------------------------------------
+// Subscriptions
+// --------------------------------------------------------------------------------
+
+// Add a subscription, as if bought in the Azure portal, and return its id and
+// the purchase token the landing page would get. Unset fields get test values; a
+// subscription without a status is PendingFulfillmentStart.
+func (e *Emulator) AddSubscription(subscription saasapi.Subscription) (string, string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	fillSubscriptionDefaults(&subscription, e.Now())
+	id := *subscription.ID
+	if _, ok := e.subs[id]; !ok {
+		e.subIds = append(e.subIds, id)
+	}
+	e.subs[id] = &subscriptionState{subscription: subscription}
+
+	token := "token-" + newId()
+	e.tokens[token] = id
+	return id, token
+}
+
+// the subscription as the API would return it now
+func (e *Emulator) Subscription(id string) (saasapi.Subscription, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	state, ok := e.subs[id]
+	if !ok {
+		return saasapi.Subscription{}, ErrNotFound
+	}
+	e.refreshLocked(state)
+	return copySubscription(state.subscription), nil
+}
+
+// change a subscription directly, without an operation (e.g. to simulate a
+// missed webhook)
+func (e *Emulator) UpdateSubscription(id string, update func(subscription *saasapi.Subscription)) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	state, ok := e.subs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	update(&state.subscription)
+	return nil
+}
+
+// the plans every subscription may switch to
+func (e *Emulator) SetPlans(plans ...*saasapi.Plan) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.plans = plans
+}
+
+// how long after activation the term dates appear
+func (e *Emulator) SetTermDelay(delay time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.termDelay = delay
+}
+
+func (e *Emulator) SetPageSize(size int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pageSize = size
+}
+
+// --------------------------------------------------------------------------------
+// Operations
+// --------------------------------------------------------------------------------
+
+// Start an operation the way the customer would in the Azure portal. Suspend,
+// Unsubscribe and Renew take effect right away. ChangePlan, ChangeQuantity and
+// Reinstate wait for the publisher to PATCH the operation with Success (or
+// Failure), as the real API does. Send the webhook with SendWebhook.
+func (e *Emulator) StartOperation(subscriptionId string, action saasapi.OperationActionEnum, planId string, quantity int32) (saasapi.Operation, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	state, ok := e.subs[subscriptionId]
+	if !ok {
+		return saasapi.Operation{}, ErrNotFound
+	}
+	op := e.newOperationLocked(state, action, planId, quantity)
+	switch action {
+	case saasapi.OperationActionEnumSuspend,
+		saasapi.OperationActionEnumUnsubscribe,
+		saasapi.OperationActionEnumRenew:
+		e.completeOperationLocked(op, saasapi.OperationStatusEnumSucceeded)
+	}
+	return *op, nil
+}
+
+// the operation as the API would return it now
+func (e *Emulator) Operation(id string) (saasapi.Operation, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	op, ok := e.ops[id]
+	if !ok {
+		return saasapi.Operation{}, ErrNotFound
+	}
+	return *op, nil
+}
+
+// Keep operations started by the publisher (update and delete) InProgress
+// until CompleteOperation, instead of completing them right away.
+func (e *Emulator) HoldOperations(hold bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.hold = hold
+}
+
+// finish an InProgress operation; Succeeded applies its change
+func (e *Emulator) CompleteOperation(id string, status saasapi.OperationStatusEnum) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	op, ok := e.ops[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if *op.Status != saasapi.OperationStatusEnumInProgress {
+		return fmt.Errorf("operation is %s", *op.Status)
+	}
+	e.completeOperationLocked(op, status)
+	return nil
+}
+
+func (e *Emulator) newOperationLocked(state *subscriptionState, action saasapi.OperationActionEnum, planId string, quantity int32) *saasapi.Operation {
+	subscription := state.subscription
+	if planId == "" {
+		planId = *subscription.PlanID
+	}
+	if quantity == 0 {
+		quantity = *subscription.Quantity
+	}
+	now := e.Now()
+	op := &saasapi.Operation{
+		Action:         &action,
+		ActivityID:     to(newId()),
+		ID:             to(newId()),
+		OfferID:        subscription.OfferID,
+		PlanID:         &planId,
+		PublisherID:    subscription.PublisherID,
+		Quantity:       &quantity,
+		Status:         to(saasapi.OperationStatusEnumInProgress),
+		SubscriptionID: subscription.ID,
+		TimeStamp:      &now,
+	}
+	e.ops[*op.ID] = op
+	e.opIds = append(e.opIds, *op.ID)
+	return op
+}
+
+func (e *Emulator) completeOperationLocked(op *saasapi.Operation, status saasapi.OperationStatusEnum) {
+	op.Status = &status
+	now := e.Now()
+	op.TimeStamp = &now
+	if status != saasapi.OperationStatusEnumSucceeded {
+		return
+	}
+
+	state := e.subs[*op.SubscriptionID]
+	subscription := &state.subscription
+	switch *op.Action {
+	case saasapi.OperationActionEnumChangePlan:
+		subscription.PlanID = to(*op.PlanID)
+	case saasapi.OperationActionEnumChangeQuantity:
+		subscription.Quantity = to(*op.Quantity)
+	case saasapi.OperationActionEnumSuspend:
+		subscription.SaasSubscriptionStatus = to(saasapi.SubscriptionStatusEnumSuspended)
+	case saasapi.OperationActionEnumReinstate:
+		subscription.SaasSubscriptionStatus = to(saasapi.SubscriptionStatusEnumSubscribed)
+	case saasapi.OperationActionEnumUnsubscribe:
+		subscription.SaasSubscriptionStatus = to(saasapi.SubscriptionStatusEnumUnsubscribed)
+	case saasapi.OperationActionEnumRenew:
+		start := now
+		if subscription.Term != nil && subscription.Term.EndDate != nil {
+			start = *subscription.Term.EndDate
+		}
+		end := start.AddDate(0, 1, 0)
+		subscription.Term = &saasapi.SubscriptionTerm{StartDate: &start, EndDate: &end}
+	}
+}
+
+// operations on a subscription that are still InProgress, oldest first
+func (e *Emulator) pendingOperationsLocked(subscriptionId string) []*saasapi.Operation {
+	pending := []*saasapi.Operation{}
+	for _, id := range e.opIds {
+		op := e.ops[id]
+		if *op.SubscriptionID == subscriptionId && *op.Status == saasapi.OperationStatusEnumInProgress {
+			pending = append(pending, op)
+		}
+	}
+	return pending
+}
+
+// --------------------------------------------------------------------------------
+// Failures and request log
+// --------------------------------------------------------------------------------
+
+// Fail the next count requests whose "METHOD /path" contains match (e.g.
+// "POST /saas/subscriptions/" or "/activate") with status.
+func (e *Emulator) FailNext(match string, count int, status int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures = append(e.failures, &failure{match: match, status: status, count: count})
+}
+
+// "METHOD /path" of every request received, in order
+func (e *Emulator) Requests() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string{}, e.requests...)
+}
+
+// record a request and return the status to fail it with, if any
+func (e *Emulator) recordRequestLocked(request string) int {
+	e.requests = append(e.requests, request)
+	for i, f := range e.failures {
+		if strings.Contains(request, f.match) {
+			f.count--
+			if f.count <= 0 {
+				e.failures = append(e.failures[:i], e.failures[i+1:]...)
+			}
+			return f.status
+		}
+	}
+	return 0
+}
+
+// --------------------------------------------------------------------------------
+// Helpers
+// --------------------------------------------------------------------------------
+
+// set the term dates once the delay after activation has passed
+func (e *Emulator) refreshLocked(state *subscriptionState) {
+	if !state.termPending || e.Now().Sub(state.activatedAt) < e.termDelay {
+		return
+	}
+	state.termPending = false
+	start := state.activatedAt.UTC().Truncate(24 * time.Hour)
+	end := start.AddDate(0, 1, -1)
+	state.subscription.Term = &saasapi.SubscriptionTerm{StartDate: &start, EndDate: &end}
+}
+
+func fillSubscriptionDefaults(subscription *saasapi.Subscription, now time.Time) {
+	if subscription.ID == nil {
+		subscription.ID = to(newId())
+	}
+	if subscription.Name == nil {
+		subscription.Name = to("Test Subscription")
+	}
+	if subscription.OfferID == nil {
+		subscription.OfferID = to("teraphone")
+	}
+	if subscription.PlanID == nil {
+		subscription.PlanID = to("basic")
+	}
+	if subscription.PublisherID == nil {
+		subscription.PublisherID = to("teraphone")
+	}
+	if subscription.Quantity == nil {
+		subscription.Quantity = to(int32(5))
+	}
+	if subscription.AutoRenew == nil {
+		subscription.AutoRenew = to(true)
+	}
+	if subscription.IsTest == nil {
+		subscription.IsTest = to(true)
+	}
+	if subscription.Created == nil {
+		subscription.Created = &now
+	}
+	if subscription.SaasSubscriptionStatus == nil {
+		subscription.SaasSubscriptionStatus = to(saasapi.SubscriptionStatusEnumPendingFulfillmentStart)
+	}
+	if subscription.SandboxType == nil {
+		subscription.SandboxType = to(saasapi.SandboxTypeEnumNone)
+	}
+	if subscription.SessionMode == nil {
+		subscription.SessionMode = to(saasapi.SessionModeEnumNone)
+	}
+	if subscription.Term == nil {
+		subscription.Term = &saasapi.SubscriptionTerm{}
+	}
+	subscription.Purchaser = fillIdentityDefaults(subscription.Purchaser, "purchaser")
+	subscription.Beneficiary = fillIdentityDefaults(subscription.Beneficiary, "beneficiary")
+}
+
+func fillIdentityDefaults(identity *saasapi.AADIdentifier, name string) *saasapi.AADIdentifier {
+	if identity == nil {
+		identity = &saasapi.AADIdentifier{}
+	}
+	if identity.ObjectID == nil {
+		identity.ObjectID = to(newId())
+	}
+	if identity.TenantID == nil {
+		identity.TenantID = to(newId())
+	}
+	if identity.EmailID == nil {
+		identity.EmailID = to(name + "@example.com")
+	}
+	if identity.Puid == nil {
+		identity.Puid = to("10030000" + strings.ToUpper(newId()[:8]))
+	}
+	return identity
+}
+
+// a copy that doesn't share the pointers the emulator changes
+func copySubscription(subscription saasapi.Subscription) saasapi.Subscription {
+	if subscription.Term != nil {
+		term := *subscription.Term
+		subscription.Term = &term
+	}
+	return subscription
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func to[T any](v T) *T {
+	return &v
+}
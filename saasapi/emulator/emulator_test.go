@@ -0,0 +1,373 @@
+package emulator
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"peachone/auth"
+	"peachone/saasapi"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the emulator, and saasapi clients pointed at it
+type testAPI struct {
+	emulator    *Emulator
+	server      *httptest.Server
+	fulfillment *saasapi.FulfillmentOperationsClient
+	operations  *saasapi.SubscriptionOperationsClient
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	emulator := New()
+	server := httptest.NewServer(emulator)
+	t.Cleanup(server.Close)
+
+	pl := saasapi.NewEmulatorPipeline()
+	return &testAPI{
+		emulator:    emulator,
+		server:      server,
+		fulfillment: saasapi.NewFulfillmentOperationsClient(server.URL, *pl),
+		operations:  saasapi.NewSubscriptionOperationsClient(server.URL, *pl),
+	}
+}
+
+func TestResolveAndActivate(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	id, token := api.emulator.AddSubscription(saasapi.Subscription{Quantity: to(int32(3))})
+
+	resolved, err := api.fulfillment.Resolve(ctx, token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *resolved.ID != id || *resolved.Quantity != 3 {
+		t.Fatalf("resolved %s (quantity %d), want %s (quantity 3)", *resolved.ID, *resolved.Quantity, id)
+	}
+	if *resolved.Subscription.SaasSubscriptionStatus != saasapi.SubscriptionStatusEnumPendingFulfillmentStart {
+		t.Fatalf("status = %s before activation", *resolved.Subscription.SaasSubscriptionStatus)
+	}
+
+	_, err = api.fulfillment.Resolve(ctx, "not-a-token", nil)
+	if err == nil {
+		t.Fatal("resolved an unknown token")
+	}
+
+	// the term dates show up a while after activation
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	api.emulator.Now = func() time.Time { return now }
+	api.emulator.SetTermDelay(10 * time.Second)
+	_, err = api.fulfillment.ActivateSubscription(ctx, id, saasapi.SubscriberPlan{PlanID: to("other"), Quantity: to(int64(3))}, nil)
+	if err == nil {
+		t.Fatal("activated with a plan the subscription doesn't have")
+	}
+	_, err = api.fulfillment.ActivateSubscription(ctx, id, saasapi.SubscriberPlan{PlanID: to("basic"), Quantity: to(int64(3))}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription, err := api.fulfillment.GetSubscription(ctx, id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *subscription.SaasSubscriptionStatus != saasapi.SubscriptionStatusEnumSubscribed || subscription.Term.StartDate != nil {
+		t.Fatalf("right after activation: status %s, term %v", *subscription.SaasSubscriptionStatus, subscription.Term)
+	}
+
+	now = now.Add(10 * time.Second)
+	subscription, err = api.fulfillment.GetSubscription(ctx, id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subscription.Term.StartDate == nil || subscription.Term.EndDate == nil || !subscription.Term.EndDate.After(*subscription.Term.StartDate) {
+		t.Fatalf("term = %v after the delay", subscription.Term)
+	}
+}
+
+func TestListSubscriptionsPages(t *testing.T) {
+	api := newTestAPI(t)
+	api.emulator.SetPageSize(2)
+	want := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		id, _ := api.emulator.AddSubscription(saasapi.Subscription{})
+		want[id] = true
+	}
+
+	pages := 0
+	pager := api.fulfillment.NewListSubscriptionsPager(&saasapi.FulfillmentOperationsClientListSubscriptionsOptions{})
+	for pager.More() {
+		page, err := pager.NextPage(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, subscription := range page.Subscriptions {
+			if !want[*subscription.ID] {
+				t.Fatalf("unexpected or repeated subscription %s", *subscription.ID)
+			}
+			delete(want, *subscription.ID)
+		}
+	}
+	if pages != 3 || len(want) != 0 {
+		t.Fatalf("%d pages, %d subscriptions missing; want 3 pages, none missing", pages, len(want))
+	}
+}
+
+func TestPublisherOperations(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	api.emulator.SetPlans(&saasapi.Plan{PlanID: to("basic")}, &saasapi.Plan{PlanID: to("pro")})
+	id, _ := api.emulator.AddSubscription(saasapi.Subscription{
+		SaasSubscriptionStatus: to(saasapi.SubscriptionStatusEnumSubscribed),
+	})
+
+	plans, err := api.fulfillment.ListAvailablePlans(ctx, id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans.Plans) != 2 {
+		t.Fatalf("%d plans, want 2", len(plans.Plans))
+	}
+
+	// completed right away
+	updated, err := api.fulfillment.UpdateSubscription(ctx, id, saasapi.SubscriberPlan{Quantity: to(int64(8))}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.OperationLocationURI == nil || !strings.HasPrefix(*updated.OperationLocationURI, api.server.URL) {
+		t.Fatalf("operation location = %v", updated.OperationLocationURI)
+	}
+	subscription, _ := api.emulator.Subscription(id)
+	if *subscription.Quantity != 8 {
+		t.Fatalf("quantity = %d, want 8", *subscription.Quantity)
+	}
+
+	_, err = api.fulfillment.UpdateSubscription(ctx, id, saasapi.SubscriberPlan{PlanID: to("enterprise")}, nil)
+	if err == nil {
+		t.Fatal("changed to a plan that isn't available")
+	}
+
+	// held until completed, and nothing else may start meanwhile
+	api.emulator.HoldOperations(true)
+	updated, err = api.fulfillment.UpdateSubscription(ctx, id, saasapi.SubscriberPlan{PlanID: to("pro")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opId := (*updated.OperationLocationURI)[strings.LastIndex(*updated.OperationLocationURI, "/")+1:]
+	opId = opId[:strings.Index(opId, "?")]
+	op, err := api.operations.GetOperationStatus(ctx, id, opId, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *op.Status != saasapi.OperationStatusEnumInProgress || *op.Action != saasapi.OperationActionEnumChangePlan {
+		t.Fatalf("operation %s %s, want ChangePlan InProgress", *op.Action, *op.Status)
+	}
+	_, err = api.fulfillment.DeleteSubscription(ctx, id, nil)
+	if err == nil {
+		t.Fatal("deleted while an operation was in progress")
+	}
+
+	err = api.emulator.CompleteOperation(opId, saasapi.OperationStatusEnumSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription, _ = api.emulator.Subscription(id)
+	if *subscription.PlanID != "pro" {
+		t.Fatalf("plan = %s, want pro", *subscription.PlanID)
+	}
+
+	// delete
+	api.emulator.HoldOperations(false)
+	deleted, err := api.fulfillment.DeleteSubscription(ctx, id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.OperationLocationURI == nil {
+		t.Fatal("no operation location for delete")
+	}
+	subscription, _ = api.emulator.Subscription(id)
+	if *subscription.SaasSubscriptionStatus != saasapi.SubscriptionStatusEnumUnsubscribed {
+		t.Fatalf("status = %s after delete", *subscription.SaasSubscriptionStatus)
+	}
+}
+
+func TestCustomerOperations(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	id, _ := api.emulator.AddSubscription(saasapi.Subscription{
+		SaasSubscriptionStatus: to(saasapi.SubscriptionStatusEnumSubscribed),
+		Quantity:               to(int32(5)),
+	})
+
+	// waits for the publisher
+	op, err := api.emulator.StartOperation(id, saasapi.OperationActionEnumChangeQuantity, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := api.operations.ListOperations(ctx, id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Operations) != 1 || *list.Operations[0].ID != *op.ID {
+		t.Fatalf("outstanding operations = %d, want the ChangeQuantity", len(list.Operations))
+	}
+
+	// rejected: nothing changes
+	_, err = api.operations.UpdateOperationStatus(ctx, id, *op.ID, saasapi.UpdateOperation{Status: to(saasapi.UpdateOperationStatusEnumFailure)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _ := api.operations.GetOperationStatus(ctx, id, *op.ID, nil)
+	subscription, _ := api.emulator.Subscription(id)
+	if *status.Status != saasapi.OperationStatusEnumFailed || *subscription.Quantity != 5 {
+		t.Fatalf("after Failure: operation %s, quantity %d", *status.Status, *subscription.Quantity)
+	}
+	_, err = api.operations.UpdateOperationStatus(ctx, id, *op.ID, saasapi.UpdateOperation{Status: to(saasapi.UpdateOperationStatusEnumSuccess)}, nil)
+	if err == nil {
+		t.Fatal("updated a completed operation")
+	}
+
+	// accepted
+	op, _ = api.emulator.StartOperation(id, saasapi.OperationActionEnumChangeQuantity, "", 7)
+	_, err = api.operations.UpdateOperationStatus(ctx, id, *op.ID, saasapi.UpdateOperation{Status: to(saasapi.UpdateOperationStatusEnumSuccess)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription, _ = api.emulator.Subscription(id)
+	if *subscription.Quantity != 7 {
+		t.Fatalf("quantity = %d, want 7", *subscription.Quantity)
+	}
+
+	// immediate
+	api.emulator.StartOperation(id, saasapi.OperationActionEnumSuspend, "", 0)
+	subscription, _ = api.emulator.Subscription(id)
+	if *subscription.SaasSubscriptionStatus != saasapi.SubscriptionStatusEnumSuspended {
+		t.Fatalf("status = %s after Suspend", *subscription.SaasSubscriptionStatus)
+	}
+}
+
+func TestRenewAdvancesTerm(t *testing.T) {
+	api := newTestAPI(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC)
+	id, _ := api.emulator.AddSubscription(saasapi.Subscription{
+		SaasSubscriptionStatus: to(saasapi.SubscriptionStatusEnumSubscribed),
+		Term:                   &saasapi.SubscriptionTerm{StartDate: &start, EndDate: &end},
+	})
+
+	api.emulator.StartOperation(id, saasapi.OperationActionEnumRenew, "", 0)
+	subscription, _ := api.emulator.Subscription(id)
+	if !subscription.Term.StartDate.Equal(end) || !subscription.Term.EndDate.Equal(end.AddDate(0, 1, 0)) {
+		t.Fatalf("term after renew = %s - %s", subscription.Term.StartDate, subscription.Term.EndDate)
+	}
+}
+
+func TestFailNext(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	id, _ := api.emulator.AddSubscription(saasapi.Subscription{})
+
+	api.emulator.FailNext("/activate", 1, http.StatusInternalServerError)
+	plan := saasapi.SubscriberPlan{PlanID: to("basic"), Quantity: to(int64(5))}
+	_, err := api.fulfillment.ActivateSubscription(ctx, id, plan, nil)
+	if err == nil {
+		t.Fatal("injected failure not returned")
+	}
+	_, err = api.fulfillment.ActivateSubscription(ctx, id, plan, nil)
+	if err != nil {
+		t.Fatalf("second attempt: %v", err)
+	}
+
+	requests := api.emulator.Requests()
+	if len(requests) != 2 || requests[0] != "POST /saas/subscriptions/"+id+"/activate" {
+		t.Fatalf("requests = %v", requests)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	api := newTestAPI(t)
+	id, _ := api.emulator.AddSubscription(saasapi.Subscription{
+		SaasSubscriptionStatus: to(saasapi.SubscriptionStatusEnumSubscribed),
+	})
+	op, _ := api.emulator.StartOperation(id, saasapi.OperationActionEnumSuspend, "", 0)
+
+	// the token passes the webhook's validation, using the emulator's keys
+	validator := auth.NewMarketplaceTokenValidator(saasapi.TenantId, saasapi.AppId)
+	validator.OpenIDConfigUrl = api.server.URL + "/.well-known/openid-configuration"
+	var received map[string]interface{}
+	var validationErr error
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, validationErr = validator.ValidateAuthorizationHeader(r.Context(), r.Header.Get("Authorization"))
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &received)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer webhook.Close()
+
+	status, err := api.emulator.SendWebhook(context.Background(), webhook.URL, *op.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatalf("webhook status = %d", status)
+	}
+	if validationErr != nil {
+		t.Fatalf("webhook token rejected: %v", validationErr)
+	}
+	if received["id"] != *op.ID || received["subscriptionId"] != id || received["action"] != "Suspend" {
+		t.Fatalf("payload = %v", received)
+	}
+}
+
+func TestUsageEvents(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	metering := saasapi.NewMeteringClient(api.server.URL, *saasapi.NewEmulatorPipeline())
+
+	now := time.Date(2026, 3, 10, 12, 30, 0, 0, time.UTC)
+	api.emulator.Now = func() time.Time { return now }
+	id, _ := api.emulator.AddSubscription(saasapi.Subscription{SaasSubscriptionStatus: to(saasapi.SubscriptionStatusEnumSubscribed)})
+	hour := now.Add(-time.Hour).Truncate(time.Hour)
+	event := saasapi.UsageEvent{ResourceID: id, Quantity: 42.5, Dimension: "participant_minutes", EffectiveStartTime: hour, PlanID: "basic"}
+
+	accepted, err := metering.PostUsageEvent(ctx, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted.Status != saasapi.UsageEventStatusEnumAccepted || accepted.UsageEventID == "" {
+		t.Fatalf("first event: status %s, id %q", accepted.Status, accepted.UsageEventID)
+	}
+
+	// the same resource, dimension and hour again is a duplicate, not an error
+	duplicate, err := metering.PostUsageEvent(ctx, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duplicate.Status != saasapi.UsageEventStatusEnumDuplicate || duplicate.UsageEventID != accepted.UsageEventID {
+		t.Fatalf("second event: status %s, id %q, want Duplicate of %q", duplicate.Status, duplicate.UsageEventID, accepted.UsageEventID)
+	}
+
+	expired := event
+	expired.EffectiveStartTime = now.Add(-25 * time.Hour).Truncate(time.Hour)
+	next := event
+	next.EffectiveStartTime = hour.Add(-time.Hour)
+	batch, err := metering.BatchUsageEvent(ctx, []saasapi.UsageEvent{event, expired, next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []saasapi.UsageEventStatusEnum{saasapi.UsageEventStatusEnumDuplicate, saasapi.UsageEventStatusEnumExpired, saasapi.UsageEventStatusEnumAccepted}
+	if batch.Count != len(want) {
+		t.Fatalf("batch count = %d, want %d", batch.Count, len(want))
+	}
+	for i, result := range batch.Result {
+		if result.Status != want[i] {
+			t.Errorf("batch result %d: status %s, want %s", i, result.Status, want[i])
+		}
+	}
+	if got := len(api.emulator.UsageEvents()); got != 2 {
+		t.Fatalf("%d usage events recorded, want 2", got)
+	}
+}
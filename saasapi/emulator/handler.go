@@ -0,0 +1,342 @@
+package emulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"peachone/saasapi"
+	"strconv"
+	"strings"
+)
+
+const apiVersion = "2018-08-31"
+
+// Serves the SaaS fulfillment API at /saas/..., the metering API at
+// /usageEvent and /batchUsageEvent, the signing keys for webhook
+// tokens at /.well-known/openid-configuration, and the scripting API at
+// /emulator/... (see admin.go).
+func (e *Emulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/saas/"):
+		e.serveAPI(w, r)
+	case r.URL.Path == "/usageEvent" || r.URL.Path == "/batchUsageEvent":
+		e.serveMetering(w, r)
+	case strings.HasPrefix(r.URL.Path, "/emulator/"):
+		e.serveAdmin(w, r)
+	case r.URL.Path == openIDConfigPath:
+		e.serveOpenIDConfiguration(w, r)
+	case r.URL.Path == keysPath:
+		e.serveKeys(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (e *Emulator) serveAPI(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if status := e.recordRequestLocked(r.Method + " " + r.URL.Path); status != 0 {
+		writeError(w, status, "injected failure")
+		return
+	}
+	if r.URL.Query().Get("api-version") != apiVersion {
+		writeError(w, http.StatusBadRequest, "unsupported api-version")
+		return
+	}
+
+	// /saas/subscriptions/{id}/{action}/{operationId}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/saas/subscriptions"), "/")
+	if len(parts) > 0 && parts[0] == "" {
+		parts = parts[1:]
+	}
+	if len(parts) > 0 && parts[len(parts)-1] == "" {
+		parts = parts[:len(parts)-1]
+	}
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		e.listSubscriptions(w, r)
+	case len(parts) == 1 && parts[0] == "resolve" && r.Method == http.MethodPost:
+		e.resolve(w, r)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		e.getSubscription(w, parts[0])
+	case len(parts) == 1 && r.Method == http.MethodPatch:
+		e.updateSubscription(w, r, parts[0])
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		e.deleteSubscription(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "activate" && r.Method == http.MethodPost:
+		e.activate(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "listAvailablePlans" && r.Method == http.MethodGet:
+		e.listAvailablePlans(w, parts[0])
+	case len(parts) == 2 && parts[1] == "operations" && r.Method == http.MethodGet:
+		e.listOperations(w, parts[0])
+	case len(parts) == 3 && parts[1] == "operations" && r.Method == http.MethodGet:
+		e.getOperation(w, parts[0], parts[2])
+	case len(parts) == 3 && parts[1] == "operations" && r.Method == http.MethodPatch:
+		e.updateOperation(w, r, parts[0], parts[2])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (e *Emulator) resolve(w http.ResponseWriter, r *http.Request) {
+	id, ok := e.tokens[r.Header.Get("x-ms-marketplace-token")]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid marketplace token")
+		return
+	}
+	state := e.subs[id]
+	e.refreshLocked(state)
+	subscription := copySubscription(state.subscription)
+	writeJSON(w, http.StatusOK, saasapi.ResolvedSubscription{
+		ID:               subscription.ID,
+		OfferID:          subscription.OfferID,
+		PlanID:           subscription.PlanID,
+		Quantity:         to(int64(*subscription.Quantity)),
+		Subscription:     &subscription,
+		SubscriptionName: subscription.Name,
+	})
+}
+
+func (e *Emulator) listSubscriptions(w http.ResponseWriter, r *http.Request) {
+	start := 0
+	if token := r.URL.Query().Get("continuationToken"); token != "" {
+		var err error
+		start, err = strconv.Atoi(token)
+		if err != nil || start < 0 || start > len(e.subIds) {
+			writeError(w, http.StatusBadRequest, "invalid continuationToken")
+			return
+		}
+	}
+	end := start + e.pageSize
+	if end > len(e.subIds) {
+		end = len(e.subIds)
+	}
+
+	response := saasapi.SubscriptionsResponse{Subscriptions: []*saasapi.Subscription{}}
+	for _, id := range e.subIds[start:end] {
+		state := e.subs[id]
+		e.refreshLocked(state)
+		subscription := copySubscription(state.subscription)
+		response.Subscriptions = append(response.Subscriptions, &subscription)
+	}
+	if end < len(e.subIds) {
+		response.NextLink = to(fmt.Sprintf("%s/saas/subscriptions/?continuationToken=%d&api-version=%s", baseURL(r), end, apiVersion))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (e *Emulator) getSubscription(w http.ResponseWriter, id string) {
+	state, ok := e.subs[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "subscription not found")
+		return
+	}
+	e.refreshLocked(state)
+	writeJSON(w, http.StatusOK, copySubscription(state.subscription))
+}
+
+func (e *Emulator) activate(w http.ResponseWriter, r *http.Request, id string) {
+	state, ok := e.subs[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "subscription not found")
+		return
+	}
+	body := saasapi.SubscriberPlan{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	subscription := &state.subscription
+	if body.PlanID == nil || *body.PlanID != *subscription.PlanID {
+		writeError(w, http.StatusBadRequest, "plan does not match the subscription")
+		return
+	}
+
+	switch *subscription.SaasSubscriptionStatus {
+	case saasapi.SubscriptionStatusEnumPendingFulfillmentStart:
+		subscription.SaasSubscriptionStatus = to(saasapi.SubscriptionStatusEnumSubscribed)
+		state.activatedAt = e.Now()
+		state.termPending = true
+		e.refreshLocked(state)
+	case saasapi.SubscriptionStatusEnumSubscribed:
+		// activating again is fine
+	default:
+		writeError(w, http.StatusBadRequest, "subscription cannot be activated")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (e *Emulator) updateSubscription(w http.ResponseWriter, r *http.Request, id string) {
+	state, ok := e.subs[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "subscription not found")
+		return
+	}
+	body := saasapi.SubscriberPlan{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	if (body.PlanID == nil) == (body.Quantity == nil) {
+		writeError(w, http.StatusBadRequest, "change either the plan or the quantity")
+		return
+	}
+	if !e.checkChangeAllowedLocked(w, state) {
+		return
+	}
+
+	var op *saasapi.Operation
+	if body.PlanID != nil {
+		if !e.hasPlanLocked(*body.PlanID) {
+			writeError(w, http.StatusBadRequest, "plan not available")
+			return
+		}
+		op = e.newOperationLocked(state, saasapi.OperationActionEnumChangePlan, *body.PlanID, 0)
+	} else {
+		if *body.Quantity < 1 {
+			writeError(w, http.StatusBadRequest, "invalid quantity")
+			return
+		}
+		op = e.newOperationLocked(state, saasapi.OperationActionEnumChangeQuantity, "", int32(*body.Quantity))
+	}
+	e.acceptOperationLocked(w, r, op)
+}
+
+func (e *Emulator) deleteSubscription(w http.ResponseWriter, r *http.Request, id string) {
+	state, ok := e.subs[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "subscription not found")
+		return
+	}
+	if !e.checkChangeAllowedLocked(w, state) {
+		return
+	}
+	op := e.newOperationLocked(state, saasapi.OperationActionEnumUnsubscribe, "", 0)
+	e.acceptOperationLocked(w, r, op)
+}
+
+// a subscription can be changed by the publisher while it is active and has
+// no operation in progress
+func (e *Emulator) checkChangeAllowedLocked(w http.ResponseWriter, state *subscriptionState) bool {
+	status := *state.subscription.SaasSubscriptionStatus
+	if status != saasapi.SubscriptionStatusEnumSubscribed && status != saasapi.SubscriptionStatusEnumSuspended {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("subscription is %s", status))
+		return false
+	}
+	if len(e.pendingOperationsLocked(*state.subscription.ID)) > 0 {
+		writeError(w, http.StatusConflict, "another operation is in progress")
+		return false
+	}
+	return true
+}
+
+// respond 202 with the operation's location, completing it unless held
+func (e *Emulator) acceptOperationLocked(w http.ResponseWriter, r *http.Request, op *saasapi.Operation) {
+	if !e.hold {
+		e.completeOperationLocked(op, saasapi.OperationStatusEnumSucceeded)
+	}
+	location := fmt.Sprintf("%s/saas/subscriptions/%s/operations/%s?api-version=%s", baseURL(r), *op.SubscriptionID, *op.ID, apiVersion)
+	w.Header().Set("Operation-Location", location)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (e *Emulator) listAvailablePlans(w http.ResponseWriter, id string) {
+	if _, ok := e.subs[id]; !ok {
+		writeError(w, http.StatusNotFound, "subscription not found")
+		return
+	}
+	plans := e.plans
+	if plans == nil {
+		plans = []*saasapi.Plan{}
+	}
+	writeJSON(w, http.StatusOK, saasapi.SubscriptionPlans{Plans: plans})
+}
+
+func (e *Emulator) hasPlanLocked(planId string) bool {
+	for _, plan := range e.plans {
+		if plan.PlanID != nil && *plan.PlanID == planId {
+			return true
+		}
+	}
+	return false
+}
+
+// the API lists only the operations still waiting on the publisher
+func (e *Emulator) listOperations(w http.ResponseWriter, id string) {
+	if _, ok := e.subs[id]; !ok {
+		writeError(w, http.StatusNotFound, "subscription not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, saasapi.OperationList{Operations: e.pendingOperationsLocked(id)})
+}
+
+func (e *Emulator) getOperation(w http.ResponseWriter, subscriptionId string, id string) {
+	op, ok := e.ops[id]
+	if !ok || *op.SubscriptionID != subscriptionId {
+		writeError(w, http.StatusNotFound, "operation not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, op)
+}
+
+func (e *Emulator) updateOperation(w http.ResponseWriter, r *http.Request, subscriptionId string, id string) {
+	op, ok := e.ops[id]
+	if !ok || *op.SubscriptionID != subscriptionId {
+		writeError(w, http.StatusNotFound, "operation not found")
+		return
+	}
+	body := saasapi.UpdateOperation{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Status == nil {
+		writeError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	if *op.Status != saasapi.OperationStatusEnumInProgress {
+		writeError(w, http.StatusConflict, fmt.Sprintf("operation is %s", *op.Status))
+		return
+	}
+
+	switch *body.Status {
+	case saasapi.UpdateOperationStatusEnumSuccess:
+		e.completeOperationLocked(op, saasapi.OperationStatusEnumSucceeded)
+	case saasapi.UpdateOperationStatusEnumFailure:
+		e.completeOperationLocked(op, saasapi.OperationStatusEnumFailed)
+	default:
+		writeError(w, http.StatusBadRequest, "invalid status")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// --------------------------------------------------------------------------------
+// Helpers
+// --------------------------------------------------------------------------------
+
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{Error: errorDetail{Code: http.StatusText(status), Message: message}})
+}
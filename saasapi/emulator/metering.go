@@ -0,0 +1,169 @@
+package emulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"peachone/saasapi"
+	"time"
+)
+
+// the metering service only accepts usage from the last 24 hours
+const usageEventMaxAge = 24 * time.Hour
+
+type usageKey struct {
+	resourceId string
+	dimension  string
+	hour       time.Time
+}
+
+// the usage events accepted so far, in order
+func (e *Emulator) UsageEvents() []saasapi.UsageEventResult {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	events := []saasapi.UsageEventResult{}
+	for _, key := range e.usageKeys {
+		events = append(events, *e.usage[key])
+	}
+	return events
+}
+
+// POST /usageEvent and /batchUsageEvent
+func (e *Emulator) serveMetering(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if status := e.recordRequestLocked(r.Method + " " + r.URL.Path); status != 0 {
+		writeError(w, status, "injected failure")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.URL.Query().Get("api-version") != apiVersion {
+		writeError(w, http.StatusBadRequest, "unsupported api-version")
+		return
+	}
+
+	if r.URL.Path == "/batchUsageEvent" {
+		batch := saasapi.BatchUsageEvent{}
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body")
+			return
+		}
+		if len(batch.Request) == 0 || len(batch.Request) > saasapi.MaxBatchUsageEvents {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("a batch has 1 to %d events", saasapi.MaxBatchUsageEvents))
+			return
+		}
+		response := saasapi.BatchUsageEventResult{Result: []saasapi.UsageEventResult{}}
+		for _, event := range batch.Request {
+			response.Result = append(response.Result, e.recordUsageLocked(event))
+		}
+		response.Count = len(response.Result)
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	event := saasapi.UsageEvent{}
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	result := e.recordUsageLocked(event)
+	switch result.Status {
+	case saasapi.UsageEventStatusEnumAccepted:
+		writeJSON(w, http.StatusOK, result)
+	case saasapi.UsageEventStatusEnumDuplicate:
+		accepted := e.usage[usageKeyOf(event)]
+		writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"code":           "Conflict",
+			"message":        "This usage event already exist.",
+			"additionalInfo": map[string]interface{}{"acceptedMessage": accepted},
+		})
+	default:
+		writeError(w, http.StatusBadRequest, string(result.Status))
+	}
+}
+
+// validate a usage event and record it if accepted
+func (e *Emulator) recordUsageLocked(event saasapi.UsageEvent) saasapi.UsageEventResult {
+	now := e.Now()
+	result := saasapi.UsageEventResult{
+		ResourceID:         event.ResourceID,
+		Quantity:           event.Quantity,
+		Dimension:          event.Dimension,
+		EffectiveStartTime: event.EffectiveStartTime,
+		PlanID:             event.PlanID,
+		MessageTime:        &now,
+	}
+	reject := func(status saasapi.UsageEventStatusEnum, message string) saasapi.UsageEventResult {
+		result.Status = status
+		result.Error = &saasapi.UsageEventError{Code: string(status), Message: message}
+		return result
+	}
+
+	state, ok := e.subs[event.ResourceID]
+	if !ok {
+		return reject(saasapi.UsageEventStatusEnumResourceNotFound, "subscription not found")
+	}
+	subscription := state.subscription
+	if *subscription.SaasSubscriptionStatus != saasapi.SubscriptionStatusEnumSubscribed {
+		return reject(saasapi.UsageEventStatusEnumResourceNotActive, "subscription is not active")
+	}
+	if event.PlanID != *subscription.PlanID {
+		return reject(saasapi.UsageEventStatusEnumBadArgument, "plan does not match the subscription")
+	}
+	if event.Quantity <= 0 {
+		return reject(saasapi.UsageEventStatusEnumInvalidQuantity, "quantity must be positive")
+	}
+	if now.Sub(event.EffectiveStartTime) > usageEventMaxAge {
+		return reject(saasapi.UsageEventStatusEnumExpired, "usage is more than 24 hours old")
+	}
+	if event.EffectiveStartTime.After(now) {
+		return reject(saasapi.UsageEventStatusEnumBadArgument, "usage is in the future")
+	}
+	if !e.hasDimensionLocked(event.PlanID, event.Dimension) {
+		return reject(saasapi.UsageEventStatusEnumInvalidDimension, "plan has no such dimension")
+	}
+
+	key := usageKeyOf(event)
+	if _, ok := e.usage[key]; ok {
+		result.Status = saasapi.UsageEventStatusEnumDuplicate
+		return result
+	}
+	result.Status = saasapi.UsageEventStatusEnumAccepted
+	result.UsageEventID = newId()
+	e.usage[key] = &result
+	e.usageKeys = append(e.usageKeys, key)
+	return result
+}
+
+// dimensions are only checked for plans set with SetPlans
+func (e *Emulator) hasDimensionLocked(planId string, dimension string) bool {
+	for _, plan := range e.plans {
+		if plan.PlanID == nil || *plan.PlanID != planId {
+			continue
+		}
+		if plan.PlanComponents == nil {
+			return false
+		}
+		for _, meteringDimension := range plan.PlanComponents.MeteringDimensions {
+			if meteringDimension.ID != nil && *meteringDimension.ID == dimension {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// one event per resource, dimension and hour
+func usageKeyOf(event saasapi.UsageEvent) usageKey {
+	return usageKey{
+		resourceId: event.ResourceID,
+		dimension:  event.Dimension,
+		hour:       event.EffectiveStartTime.UTC().Truncate(time.Hour),
+	}
+}
@@ -0,0 +1,142 @@
+package emulator
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"peachone/auth"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const openIDConfigPath = "/.well-known/openid-configuration"
+const keysPath = "/discovery/keys"
+
+// how long webhook tokens are valid
+const webhookTokenLifetime = time.Hour
+
+// The emulator signs webhook tokens with its own key, published the way Azure
+// AD publishes its keys. Point the webhook's token validator at
+// <emulator url>/.well-known/openid-configuration to accept them.
+func (e *Emulator) signingKeyLocked() (*rsa.PrivateKey, string, error) {
+	if e.key == nil {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, "", err
+		}
+		e.key = key
+		e.keyId = "emulator-" + newId()[:8]
+	}
+	return e.key, e.keyId, nil
+}
+
+// a bearer token like the one the Marketplace sends on webhook calls
+func (e *Emulator) WebhookToken() (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key, kid, err := e.signingKeyLocked()
+	if err != nil {
+		return "", err
+	}
+	now := e.Now()
+	claims := &auth.MarketplaceClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    fmt.Sprintf("https://sts.windows.net/%s/", e.TenantId),
+			Audience:  jwt.ClaimStrings{e.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(webhookTokenLifetime)),
+		},
+		TenantId: e.TenantId,
+		AppId:    auth.MarketplaceAppId,
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	return token.SignedString(key)
+}
+
+// Call the webhook at url for an operation, as the Marketplace would, and
+// return the response status.
+func (e *Emulator) SendWebhook(ctx context.Context, url string, operationId string) (int, error) {
+	payload, err := e.webhookPayload(operationId)
+	if err != nil {
+		return 0, err
+	}
+	token, err := e.WebhookToken()
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// the operation, with the subscription it applies to
+func (e *Emulator) webhookPayload(operationId string) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	op, ok := e.ops[operationId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	state := e.subs[*op.SubscriptionID]
+	e.refreshLocked(state)
+
+	opJSON, err := json.Marshal(op)
+	if err != nil {
+		return nil, err
+	}
+	payload := map[string]interface{}{}
+	if err := json.Unmarshal(opJSON, &payload); err != nil {
+		return nil, err
+	}
+	payload["operationRequestSource"] = "Azure"
+	payload["subscription"] = copySubscription(state.subscription)
+	return json.Marshal(payload)
+}
+
+func (e *Emulator) serveOpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":   fmt.Sprintf("https://sts.windows.net/%s/", e.TenantId),
+		"jwks_uri": baseURL(r) + keysPath,
+	})
+}
+
+func (e *Emulator) serveKeys(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	key, kid, err := e.signingKeyLocked()
+	e.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
@@ -17,13 +17,19 @@ import (
 )
 
 type FulfillmentOperationsClient struct {
+	host string
 	pl runtime.Pipeline
 }
 
 // NewFulfillmentOperationsClient creates a new instance of FulfillmentOperationsClient with the specified values.
+// host - the API's base URL; empty for the Marketplace API.
 // pl - the pipeline used for sending requests and handling responses.
-func NewFulfillmentOperationsClient(pl runtime.Pipeline) *FulfillmentOperationsClient {
+func NewFulfillmentOperationsClient(host string, pl runtime.Pipeline) *FulfillmentOperationsClient {
+	if host == "" {
+		host = DefaultHost
+	}
 	client := &FulfillmentOperationsClient{
+		host: host,
 		pl: pl,
 	}
 	return client
@@ -53,7 +59,7 @@ func (client *FulfillmentOperationsClient) ActivateSubscription(ctx context.Cont
 func (client *FulfillmentOperationsClient) activateSubscriptionCreateRequest(ctx context.Context, subscriptionID string, body SubscriberPlan, options *FulfillmentOperationsClientActivateSubscriptionOptions) (*policy.Request, error) {
 	urlPath := "/saas/subscriptions/{subscriptionId}/activate"
 	urlPath = strings.ReplaceAll(urlPath, "{subscriptionId}", url.PathEscape(subscriptionID))
-	req, err := runtime.NewRequest(ctx, http.MethodPost, runtime.JoinPaths(	host, urlPath))
+	req, err := runtime.NewRequest(ctx, http.MethodPost, runtime.JoinPaths(	client.host, urlPath))
 	if err != nil {
 		return nil, err
 	}
@@ -93,7 +99,7 @@ func (client *FulfillmentOperationsClient) DeleteSubscription(ctx context.Contex
 func (client *FulfillmentOperationsClient) deleteSubscriptionCreateRequest(ctx context.Context, subscriptionID string, options *FulfillmentOperationsClientDeleteSubscriptionOptions) (*policy.Request, error) {
 	urlPath := "/saas/subscriptions/{subscriptionId}"
 	urlPath = strings.ReplaceAll(urlPath, "{subscriptionId}", url.PathEscape(subscriptionID))
-	req, err := runtime.NewRequest(ctx, http.MethodDelete, runtime.JoinPaths(	host, urlPath))
+	req, err := runtime.NewRequest(ctx, http.MethodDelete, runtime.JoinPaths(	client.host, urlPath))
 	if err != nil {
 		return nil, err
 	}
@@ -142,7 +148,7 @@ func (client *FulfillmentOperationsClient) GetSubscription(ctx context.Context,
 func (client *FulfillmentOperationsClient) getSubscriptionCreateRequest(ctx context.Context, subscriptionID string, options *FulfillmentOperationsClientGetSubscriptionOptions) (*policy.Request, error) {
 	urlPath := "/saas/subscriptions/{subscriptionId}"
 	urlPath = strings.ReplaceAll(urlPath, "{subscriptionId}", url.PathEscape(subscriptionID))
-	req, err := runtime.NewRequest(ctx, http.MethodGet, runtime.JoinPaths(	host, urlPath))
+	req, err := runtime.NewRequest(ctx, http.MethodGet, runtime.JoinPaths(	client.host, urlPath))
 	if err != nil {
 		return nil, err
 	}
@@ -192,7 +198,7 @@ func (client *FulfillmentOperationsClient) ListAvailablePlans(ctx context.Contex
 func (client *FulfillmentOperationsClient) listAvailablePlansCreateRequest(ctx context.Context, subscriptionID string, options *FulfillmentOperationsClientListAvailablePlansOptions) (*policy.Request, error) {
 	urlPath := "/saas/subscriptions/{subscriptionId}/listAvailablePlans"
 	urlPath = strings.ReplaceAll(urlPath, "{subscriptionId}", url.PathEscape(subscriptionID))
-	req, err := runtime.NewRequest(ctx, http.MethodGet, runtime.JoinPaths(	host, urlPath))
+	req, err := runtime.NewRequest(ctx, http.MethodGet, runtime.JoinPaths(	client.host, urlPath))
 	if err != nil {
 		return nil, err
 	}
@@ -254,7 +260,7 @@ func (client *FulfillmentOperationsClient) NewListSubscriptionsPager(options *Fu
 // listSubscriptionsCreateRequest creates the ListSubscriptions request.
 func (client *FulfillmentOperationsClient) listSubscriptionsCreateRequest(ctx context.Context, options *FulfillmentOperationsClientListSubscriptionsOptions) (*policy.Request, error) {
 	urlPath := "/saas/subscriptions/"
-	req, err := runtime.NewRequest(ctx, http.MethodGet, runtime.JoinPaths(	host, urlPath))
+	req, err := runtime.NewRequest(ctx, http.MethodGet, runtime.JoinPaths(	client.host, urlPath))
 	if err != nil {
 		return nil, err
 	}
@@ -313,7 +319,7 @@ func (client *FulfillmentOperationsClient) Resolve(ctx context.Context, xmsMarke
 // resolveCreateRequest creates the Resolve request.
 func (client *FulfillmentOperationsClient) resolveCreateRequest(ctx context.Context, xmsMarketplaceToken string, options *FulfillmentOperationsClientResolveOptions) (*policy.Request, error) {
 	urlPath := "/saas/subscriptions/resolve"
-	req, err := runtime.NewRequest(ctx, http.MethodPost, runtime.JoinPaths(	host, urlPath))
+	req, err := runtime.NewRequest(ctx, http.MethodPost, runtime.JoinPaths(	client.host, urlPath))
 	if err != nil {
 		return nil, err
 	}
@@ -364,7 +370,7 @@ func (client *FulfillmentOperationsClient) UpdateSubscription(ctx context.Contex
 func (client *FulfillmentOperationsClient) updateSubscriptionCreateRequest(ctx context.Context, subscriptionID string, body SubscriberPlan, options *FulfillmentOperationsClientUpdateSubscriptionOptions) (*policy.Request, error) {
 	urlPath := "/saas/subscriptions/{subscriptionId}"
 	urlPath = strings.ReplaceAll(urlPath, "{subscriptionId}", url.PathEscape(subscriptionID))
-	req, err := runtime.NewRequest(ctx, http.MethodPatch, runtime.JoinPaths(	host, urlPath))
+	req, err := runtime.NewRequest(ctx, http.MethodPatch, runtime.JoinPaths(	client.host, urlPath))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,167 @@
+package saasapi
+
+// Client for the Marketplace metering service API, which isn't part of the
+// SaaS fulfillment API the rest of this package is generated from. It follows
+// the generated clients: same pipeline, host and api version.
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+)
+
+// most usage events the batch endpoint accepts per call
+const MaxBatchUsageEvents = 25
+
+// UsageEventStatusEnum - the result of a usage event
+type UsageEventStatusEnum string
+
+const (
+	UsageEventStatusEnumAccepted              UsageEventStatusEnum = "Accepted"
+	UsageEventStatusEnumDuplicate             UsageEventStatusEnum = "Duplicate" // already reported for this resource, dimension and hour
+	UsageEventStatusEnumExpired               UsageEventStatusEnum = "Expired"   // more than 24 hours old
+	UsageEventStatusEnumError                 UsageEventStatusEnum = "Error"
+	UsageEventStatusEnumResourceNotFound      UsageEventStatusEnum = "ResourceNotFound"
+	UsageEventStatusEnumResourceNotAuthorized UsageEventStatusEnum = "ResourceNotAuthorized"
+	UsageEventStatusEnumResourceNotActive     UsageEventStatusEnum = "ResourceNotActive"
+	UsageEventStatusEnumInvalidDimension      UsageEventStatusEnum = "InvalidDimension"
+	UsageEventStatusEnumInvalidQuantity       UsageEventStatusEnum = "InvalidQuantity"
+	UsageEventStatusEnumBadArgument           UsageEventStatusEnum = "BadArgument"
+)
+
+// UsageEvent - usage of one dimension by one subscription in one hour
+type UsageEvent struct {
+	ResourceID         string    `json:"resourceId"` // the SaaS subscription id
+	Quantity           float64   `json:"quantity"`
+	Dimension          string    `json:"dimension"`          // the MeteringDimension id
+	EffectiveStartTime time.Time `json:"effectiveStartTime"` // start of the hour, UTC
+	PlanID             string    `json:"planId"`
+}
+
+type UsageEventError struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// UsageEventResult - what the metering service did with a usage event
+type UsageEventResult struct {
+	UsageEventID       string               `json:"usageEventId,omitempty"`
+	Status             UsageEventStatusEnum `json:"status"`
+	MessageTime        *time.Time           `json:"messageTime,omitempty"`
+	ResourceID         string               `json:"resourceId"`
+	Quantity           float64              `json:"quantity"`
+	Dimension          string               `json:"dimension"`
+	EffectiveStartTime time.Time            `json:"effectiveStartTime"`
+	PlanID             string               `json:"planId"`
+	Error              *UsageEventError     `json:"error,omitempty"`
+}
+
+type BatchUsageEvent struct {
+	Request []UsageEvent `json:"request"`
+}
+
+type BatchUsageEventResult struct {
+	Result []UsageEventResult `json:"result"`
+	Count  int                `json:"count"`
+}
+
+// body of the 409 returned for a usage event that was already accepted
+type usageEventConflict struct {
+	AdditionalInfo struct {
+		AcceptedMessage UsageEventResult `json:"acceptedMessage"`
+	} `json:"additionalInfo"`
+}
+
+type MeteringClient struct {
+	host string
+	pl   runtime.Pipeline
+}
+
+// host is the API's base URL; empty for the Marketplace API
+func NewMeteringClient(host string, pl runtime.Pipeline) *MeteringClient {
+	if host == "" {
+		host = DefaultHost
+	}
+	return &MeteringClient{
+		host: host,
+		pl:   pl,
+	}
+}
+
+func NewDefaultMeteringClient() (*MeteringClient, error) {
+	pl, err := NewDefaultPipeline()
+	if err != nil {
+		return nil, err
+	}
+	return NewMeteringClient(Host(), *pl), nil
+}
+
+// PostUsageEvent - report one usage event. An event that was already reported
+// is not an error: its result has status Duplicate and the accepted event's id.
+// If the operation fails it returns an *azcore.ResponseError type.
+func (client *MeteringClient) PostUsageEvent(ctx context.Context, event UsageEvent) (UsageEventResult, error) {
+	req, err := client.createRequest(ctx, "/usageEvent", event)
+	if err != nil {
+		return UsageEventResult{}, err
+	}
+	resp, err := client.pl.Do(req)
+	if err != nil {
+		return UsageEventResult{}, err
+	}
+
+	switch {
+	case runtime.HasStatusCode(resp, http.StatusOK):
+		result := UsageEventResult{}
+		if err := runtime.UnmarshalAsJSON(resp, &result); err != nil {
+			return UsageEventResult{}, err
+		}
+		return result, nil
+	case runtime.HasStatusCode(resp, http.StatusConflict):
+		conflict := usageEventConflict{}
+		if err := runtime.UnmarshalAsJSON(resp, &conflict); err != nil {
+			return UsageEventResult{}, err
+		}
+		result := conflict.AdditionalInfo.AcceptedMessage
+		result.Status = UsageEventStatusEnumDuplicate
+		return result, nil
+	default:
+		return UsageEventResult{}, runtime.NewResponseError(resp)
+	}
+}
+
+// BatchUsageEvent - report up to MaxBatchUsageEvents usage events; each has
+// its own result.
+// If the operation fails it returns an *azcore.ResponseError type.
+func (client *MeteringClient) BatchUsageEvent(ctx context.Context, events []UsageEvent) (BatchUsageEventResult, error) {
+	req, err := client.createRequest(ctx, "/batchUsageEvent", BatchUsageEvent{Request: events})
+	if err != nil {
+		return BatchUsageEventResult{}, err
+	}
+	resp, err := client.pl.Do(req)
+	if err != nil {
+		return BatchUsageEventResult{}, err
+	}
+	if !runtime.HasStatusCode(resp, http.StatusOK) {
+		return BatchUsageEventResult{}, runtime.NewResponseError(resp)
+	}
+	result := BatchUsageEventResult{}
+	if err := runtime.UnmarshalAsJSON(resp, &result); err != nil {
+		return BatchUsageEventResult{}, err
+	}
+	return result, nil
+}
+
+func (client *MeteringClient) createRequest(ctx context.Context, urlPath string, body interface{}) (*policy.Request, error) {
+	req, err := runtime.NewRequest(ctx, http.MethodPost, runtime.JoinPaths(client.host, urlPath))
+	if err != nil {
+		return nil, err
+	}
+	reqQP := req.Raw().URL.Query()
+	reqQP.Set("api-version", "2018-08-31")
+	req.Raw().URL.RawQuery = reqQP.Encode()
+	req.Raw().Header["Accept"] = []string{"application/json"}
+	return req, runtime.MarshalAsJSON(req, body)
+}
@@ -3,6 +3,7 @@ package saasapi
 import (
 	"os"
 	"peachone/meta"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
@@ -14,7 +15,30 @@ const (
 	TenantId = "a6db0c33-ff9b-49f7-be5a-a5c50ee313cd"
 )
 
+// The base URL the default clients send requests to: the Marketplace API, or
+// MARKETPLACE_API_URL if set (e.g. the emulator in saasapi/emulator).
+func Host() string {
+	MARKETPLACE_API_URL := os.Getenv("MARKETPLACE_API_URL")
+	if MARKETPLACE_API_URL != "" {
+		return strings.TrimSuffix(MARKETPLACE_API_URL, "/")
+	}
+	return DefaultHost
+}
+
+// Whether MARKETPLACE_EMULATOR is set to "true", which makes the default
+// pipeline talk to the emulator: no Azure AD token, no retries. Never set it
+// in production.
+func EmulatorMode() bool {
+	return os.Getenv("MARKETPLACE_EMULATOR") == "true"
+}
+
+// Authenticates with Azure AD and retries failed requests, unless in emulator
+// mode (see EmulatorMode).
 func NewDefaultPipeline() (*runtime.Pipeline, error) {
+	if EmulatorMode() {
+		return NewEmulatorPipeline(), nil
+	}
+
 	co := policy.ClientOptions{
 		Telemetry: policy.TelemetryOptions{
 			ApplicationID: AppId,
@@ -41,12 +65,28 @@ func NewDefaultPipeline() (*runtime.Pipeline, error) {
 	return &pl, nil
 }
 
+// A pipeline for the emulator. No Azure AD token is sent, and failed requests
+// are not retried, so tests see errors right away.
+func NewEmulatorPipeline() *runtime.Pipeline {
+	co := policy.ClientOptions{
+		Telemetry: policy.TelemetryOptions{
+			ApplicationID: AppId,
+		},
+		Retry: policy.RetryOptions{
+			MaxRetries: -1,
+		},
+	}
+	pl := runtime.NewPipeline("saasapi", meta.Version, runtime.PipelineOptions{}, &co)
+
+	return &pl
+}
+
 func NewDefaultFulfillmentOperationsClient() (*FulfillmentOperationsClient, error) {
 	pl, err := NewDefaultPipeline()
 	if err != nil {
 		return nil, err
 	}
-	return NewFulfillmentOperationsClient(*pl), nil
+	return NewFulfillmentOperationsClient(Host(), *pl), nil
 }
 
 func NewDefaultSubscriptionOperationsClient() (*SubscriptionOperationsClient, error) {
@@ -54,5 +94,5 @@ func NewDefaultSubscriptionOperationsClient() (*SubscriptionOperationsClient, er
 	if err != nil {
 		return nil, err
 	}
-	return NewSubscriptionOperationsClient(*pl), nil
+	return NewSubscriptionOperationsClient(Host(), *pl), nil
 }
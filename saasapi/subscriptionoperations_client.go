@@ -17,13 +17,19 @@ import (
 )
 
 type SubscriptionOperationsClient struct {
+	host string
 	pl runtime.Pipeline
 }
 
 // NewSubscriptionOperationsClient creates a new instance of SubscriptionOperationsClient with the specified values.
+// host - the API's base URL; empty for the Marketplace API.
 // pl - the pipeline used for sending requests and handling responses.
-func NewSubscriptionOperationsClient(pl runtime.Pipeline) *SubscriptionOperationsClient {
+func NewSubscriptionOperationsClient(host string, pl runtime.Pipeline) *SubscriptionOperationsClient {
+	if host == "" {
+		host = DefaultHost
+	}
 	client := &SubscriptionOperationsClient{
+		host: host,
 		pl: pl,
 	}
 	return client
@@ -55,7 +61,7 @@ func (client *SubscriptionOperationsClient) getOperationStatusCreateRequest(ctx
 	urlPath := "/saas/subscriptions/{subscriptionId}/operations/{operationId}"
 	urlPath = strings.ReplaceAll(urlPath, "{subscriptionId}", url.PathEscape(subscriptionID))
 	urlPath = strings.ReplaceAll(urlPath, "{operationId}", url.PathEscape(operationID))
-	req, err := runtime.NewRequest(ctx, http.MethodGet, runtime.JoinPaths(	host, urlPath))
+	req, err := runtime.NewRequest(ctx, http.MethodGet, runtime.JoinPaths(	client.host, urlPath))
 	if err != nil {
 		return nil, err
 	}
@@ -105,7 +111,7 @@ func (client *SubscriptionOperationsClient) ListOperations(ctx context.Context,
 func (client *SubscriptionOperationsClient) listOperationsCreateRequest(ctx context.Context, subscriptionID string, options *SubscriptionOperationsClientListOperationsOptions) (*policy.Request, error) {
 	urlPath := "/saas/subscriptions/{subscriptionId}/operations"
 	urlPath = strings.ReplaceAll(urlPath, "{subscriptionId}", url.PathEscape(subscriptionID))
-	req, err := runtime.NewRequest(ctx, http.MethodGet, runtime.JoinPaths(	host, urlPath))
+	req, err := runtime.NewRequest(ctx, http.MethodGet, runtime.JoinPaths(	client.host, urlPath))
 	if err != nil {
 		return nil, err
 	}
@@ -156,7 +162,7 @@ func (client *SubscriptionOperationsClient) updateOperationStatusCreateRequest(c
 	urlPath := "/saas/subscriptions/{subscriptionId}/operations/{operationId}"
 	urlPath = strings.ReplaceAll(urlPath, "{subscriptionId}", url.PathEscape(subscriptionID))
 	urlPath = strings.ReplaceAll(urlPath, "{operationId}", url.PathEscape(operationID))
-	req, err := runtime.NewRequest(ctx, http.MethodPatch, runtime.JoinPaths(	host, urlPath))
+	req, err := runtime.NewRequest(ctx, http.MethodPatch, runtime.JoinPaths(	client.host, urlPath))
 	if err != nil {
 		return nil, err
 	}